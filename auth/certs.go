@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+)
+
+// ReadX509Certificate reads and parses a PEM encoded certificate file.
+func ReadX509Certificate(filename string) (*x509.Certificate, error) {
+	pemBlock, err := ReadCertificate(filename, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(pemBlock.Bytes)
+}
+
+// ReadCertificateChain reads and parses all certificates in a PEM encoded file. The leaf
+// certificate comes first and is followed by its issuers.
+func ReadCertificateChain(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file")
+	}
+
+	var chain []*x509.Certificate
+	for {
+		var pemBlock *pem.Block
+		pemBlock, data = pem.Decode(data)
+		if pemBlock == nil {
+			break
+		} else if pemBlock.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("error decoding PEM format")
+	}
+	return chain, nil
+}
+
+// LoadCertPool reads a PEM encoded file containing one or more CA certificates. Self-signed
+// certificates are added to the root pool and all others to the intermediate pool.
+func LoadCertPool(filename string) (roots, intermediates *x509.CertPool, err error) {
+	chain, err := ReadCertificateChain(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roots = x509.NewCertPool()
+	intermediates = x509.NewCertPool()
+	for _, cert := range chain {
+		if isSelfSigned(cert) {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	return roots, intermediates, nil
+}
+
+// CertificateChain appends the intermediate CA certificates from the CA certificate file to a
+// newly issued certificate, so that the saved file contains the full chain up to the root.
+func CertificateChain(caCertFile string, cert []byte) ([][]byte, error) {
+	chain, err := ReadCertificateChain(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := [][]byte{cert}
+	for _, ca := range chain {
+		if !isSelfSigned(ca) {
+			certs = append(certs, ca.Raw)
+		}
+	}
+	return certs, nil
+}
+
+// isSelfSigned determines if a certificate is a root certificate.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// CertificateHosts returns the comma delimited list of IPs and domains in the certificate.
+// The result is in the same format as the host list given to CreateCertificate.
+func CertificateHosts(cert *x509.Certificate) string {
+	var hosts []string
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	hosts = append(hosts, cert.DNSNames...)
+	return strings.Join(hosts, ",")
+}
+
+// VerifyCertificate verifies that the first certificate in the chain was issued by one of the
+// given roots. The remaining certificates in the chain are used as intermediates, in addition
+// to any in the intermediates pool.
+func VerifyCertificate(chain []*x509.Certificate, roots, intermediates *x509.CertPool) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("empty certificate chain")
+	}
+
+	pool := x509.NewCertPool()
+	if intermediates != nil {
+		pool = intermediates.Clone()
+	}
+	for _, cert := range chain[1:] {
+		pool.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: pool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// ExpiresWithin determines if a certificate expires before the given duration has elapsed.
+func ExpiresWithin(cert *x509.Certificate, d time.Duration) bool {
+	return time.Now().Add(d).After(cert.NotAfter)
+}
+
+// RenewCertificate issues a new certificate with the same subject and hosts as an existing certificate.
+// The key may be the original private key or a new one if the certificate is being rotated.
+func RenewCertificate(logger log.Logger, caCertFile, caKeyFile string, caPassphrase PassphraseFunc, cert *x509.Certificate, key crypto.Signer, years int) ([]byte, error) {
+	req := &x509.CertificateRequest{Subject: cert.Subject}
+	return CreateCertificate(logger, caCertFile, caKeyFile, caPassphrase, req, key, years, CertificateHosts(cert))
+}
+
+// ReadCertificateRequest reads and parses a PEM encoded certificate request and verifies its signature.
+func ReadCertificateRequest(filename string) (*x509.CertificateRequest, error) {
+	pemBlock, err := ReadCertificate(filename, "CERTIFICATE REQUEST")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := x509.ParseCertificateRequest(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	} else if err := req.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %s", err)
+	}
+	return req, nil
+}
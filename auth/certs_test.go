@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCertificate issues a certificate for the given hosts signed by the CA in the files.
+func newTestCertificate(t *testing.T, caFile, caKeyFile, hosts string) *x509.Certificate {
+	key, err := GenerateKey(KeyTypeECDSAP256, 0)
+	requireNil(t, err)
+	req := &x509.CertificateRequest{Subject: pkix.Name{OrganizationalUnit: []string{"node-1"}}}
+	der, err := CreateCertificate(log.NullLog, caFile, caKeyFile, nil, req, key, 1, hosts)
+	requireNil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	requireNil(t, err)
+	return cert
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	root, _, caFile, caKeyFile := newTestAuthority(t, dir, 1)
+	cert := newTestCertificate(t, caFile, caKeyFile, "127.0.0.1")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	assert.Nil(t, VerifyCertificate([]*x509.Certificate{cert}, roots, nil))
+	assert.NotNil(t, VerifyCertificate(nil, roots, nil))
+
+	// Certificates of another CA are rejected
+	otherDir := filepath.Join(dir, "other")
+	requireNil(t, os.Mkdir(otherDir, 0700))
+	other, _, _, _ := newTestAuthority(t, otherDir, 1)
+	others := x509.NewCertPool()
+	others.AddCert(other)
+	assert.NotNil(t, VerifyCertificate([]*x509.Certificate{cert}, others, nil))
+}
+
+func TestExpiresWithin(t *testing.T) {
+	cert := &x509.Certificate{NotAfter: time.Now().Add(10 * 24 * time.Hour)}
+	assert.True(t, ExpiresWithin(cert, 30*24*time.Hour))
+	assert.False(t, ExpiresWithin(cert, 24*time.Hour))
+
+	// Expired certificates expire within any duration
+	cert.NotAfter = time.Now().Add(-time.Hour)
+	assert.True(t, ExpiresWithin(cert, 0))
+}
+
+func TestRenewCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	root, _, caFile, caKeyFile := newTestAuthority(t, dir, 10)
+	cert := newTestCertificate(t, caFile, caKeyFile, "127.0.0.1,node-1")
+
+	// The certificate is renewed for a new key with the same subject and hosts
+	key, err := GenerateKey(KeyTypeEd25519, 0)
+	requireNil(t, err)
+	der, err := RenewCertificate(log.NullLog, caFile, caKeyFile, nil, cert, key, 2)
+	requireNil(t, err)
+	renewed, err := x509.ParseCertificate(der)
+	requireNil(t, err)
+
+	assert.Equal(t, cert.Subject.String(), renewed.Subject.String())
+	assert.Equal(t, CertificateHosts(cert), CertificateHosts(renewed))
+	assert.Equal(t, key.Public(), renewed.PublicKey)
+	assert.NotEqual(t, cert.SerialNumber, renewed.SerialNumber)
+	assert.True(t, renewed.NotAfter.After(cert.NotAfter))
+	assert.False(t, ExpiresWithin(renewed, 365*24*time.Hour))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	assert.Nil(t, VerifyCertificate([]*x509.Certificate{renewed}, roots, nil))
+}
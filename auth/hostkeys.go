@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyMismatchError is returned when the host key presented by a server does not match
+// the key stored in the known_hosts file.
+type HostKeyMismatchError struct {
+	Host        string
+	Fingerprint string
+	Known       []string
+	File        string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key for %s does not match the known key in %s", e.Host, e.File)
+}
+
+// KnownHosts is a list of trusted SSH host keys stored in the OpenSSH known_hosts format.
+type KnownHosts struct {
+	filename string
+	mutex    sync.Mutex
+	keys     map[string][]ssh.PublicKey
+}
+
+// LoadKnownHosts reads a known_hosts file. A missing file is treated as an empty list.
+func LoadKnownHosts(filename string) (*KnownHosts, error) {
+	known := &KnownHosts{filename: filename, keys: make(map[string][]ssh.PublicKey)}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for len(data) > 0 {
+		var hosts []string
+		var key ssh.PublicKey
+		_, hosts, key, _, data, err = ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", filename, err)
+		}
+
+		for _, host := range hosts {
+			known.keys[host] = append(known.keys[host], key)
+		}
+	}
+	return known, nil
+}
+
+// Lookup returns the known keys for a host address.
+func (k *KnownHosts) Lookup(addr string) []ssh.PublicKey {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.keys[normalizeHost(addr)]
+}
+
+// Add trusts a host key and appends it to the known_hosts file.
+func (k *KnownHosts) Add(addr string, key ssh.PublicKey) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(k.filename), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(k.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	host := normalizeHost(addr)
+	w := bufio.NewWriter(file)
+	w.WriteString(host + " ")
+	w.Write(ssh.MarshalAuthorizedKey(key))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	k.keys[host] = append(k.keys[host], key)
+	return nil
+}
+
+// normalizeHost converts a host address to the form used in known_hosts files. The port is
+// omitted for the default SSH port, otherwise the host is written as [host]:port.
+func normalizeHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	} else if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// HostKeyChecker verifies the host key presented by a kappa server. Host certificates signed
+// by one of the authorities are always accepted. Other keys are trusted on first use and
+// saved in the known_hosts file. A host whose key has changed is rejected.
+type HostKeyChecker struct {
+
+	// Authorities are the CA keys trusted to sign host certificates.
+	Authorities []ssh.PublicKey
+
+	// KnownHosts holds the keys of previously seen hosts.
+	KnownHosts *KnownHosts
+
+	// Output receives notices about new and changed host keys.
+	Output io.Writer
+}
+
+// NewHostKeyChecker creates a HostKeyChecker from a CA certificate bundle and known_hosts
+// file. The CA file is optional and may be empty.
+func NewHostKeyChecker(caFile, knownHostsFile string, output io.Writer) (*HostKeyChecker, error) {
+	checker := &HostKeyChecker{Output: output}
+
+	if caFile != "" {
+		authorities, err := ReadCertificateAuthorities(caFile)
+		if err != nil {
+			return nil, err
+		}
+		checker.Authorities = authorities
+	}
+
+	known, err := LoadKnownHosts(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	checker.KnownHosts = known
+	return checker, nil
+}
+
+// Check implements ssh.HostKeyCallback.
+func (h *HostKeyChecker) Check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+
+	// Verify host certificates against the CA
+	if cert, ok := key.(*ssh.Certificate); ok && len(h.Authorities) > 0 {
+		checker := &ssh.CertChecker{IsHostAuthority: h.isAuthority}
+		if err := checker.CheckHostKey(hostname, remote, key); err != nil {
+			return fmt.Errorf("host certificate for %s was rejected: %s", hostname, err)
+		}
+		return nil
+	} else if ok {
+		key = cert.Key
+	}
+
+	// Trust on first use
+	fingerprint := CreateFingerprint(key.Marshal())
+	known := h.KnownHosts.Lookup(hostname)
+	if len(known) == 0 {
+		if err := h.KnownHosts.Add(hostname, key); err != nil {
+			return err
+		}
+		h.printf("Permanently added '%s' (%s %s) to the list of known hosts.\r\n", hostname, key.Type(), fingerprint)
+		return nil
+	}
+
+	// Check for a changed key
+	var fingerprints []string
+	for _, k := range known {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return nil
+		}
+		fingerprints = append(fingerprints, CreateFingerprint(k.Marshal()))
+	}
+
+	err := &HostKeyMismatchError{hostname, fingerprint, fingerprints, h.KnownHosts.filename}
+	h.printf("WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!\r\n")
+	h.printf("Someone could be eavesdropping on you right now (man-in-the-middle attack).\r\n")
+	h.printf("The %s key sent by %s has fingerprint %s,\r\n", key.Type(), hostname, fingerprint)
+	h.printf("but %s lists %s.\r\n", err.File, strings.Join(fingerprints, ", "))
+	h.printf("Remove the old key from %s if the host key was intentionally changed.\r\n", err.File)
+	return err
+}
+
+// isAuthority determines if a key belongs to one of the trusted CAs.
+func (h *HostKeyChecker) isAuthority(auth ssh.PublicKey, address string) bool {
+	return isAuthority(h.Authorities, auth)
+}
+
+// isAuthority determines if a key is one of the authorities.
+func isAuthority(authorities []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, ca := range authorities {
+		if bytes.Equal(ca.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadCertificateAuthorities reads the public keys of the certificates in a CA bundle as
+// SSH keys, which verify the host certificates signed by the CA.
+func ReadCertificateAuthorities(caFile string) ([]ssh.PublicKey, error) {
+	chain, err := ReadCertificateChain(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var authorities []ssh.PublicKey
+	for _, ca := range chain {
+		key, err := ssh.NewPublicKey(ca.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		authorities = append(authorities, key)
+	}
+	return authorities, nil
+}
+
+// VerifyHostCertificate verifies that a key is a valid host certificate signed by one of the
+// authorities, and returns the name of the host in its key ID. The name must also be one of
+// the certificate's principals.
+func VerifyHostCertificate(authorities []ssh.PublicKey, key ssh.PublicKey) (string, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return "", fmt.Errorf("key is not a host certificate")
+	} else if cert.CertType != ssh.HostCert {
+		return "", fmt.Errorf("certificate is not a host certificate")
+	} else if !isAuthority(authorities, cert.SignatureKey) {
+		return "", fmt.Errorf("host certificate %s was not signed by the CA", cert.KeyId)
+	} else if cert.KeyId == "" {
+		return "", fmt.Errorf("host certificate does not name a host")
+	}
+
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert(cert.KeyId, cert); err != nil {
+		return "", err
+	}
+	return cert.KeyId, nil
+}
+
+func (h *HostKeyChecker) printf(format string, args ...interface{}) {
+	if h.Output != nil {
+		fmt.Fprintf(h.Output, format, args...)
+	}
+}
+
+// CreateHostCertificate issues an SSH host certificate for the key in an X.509 certificate.
+// The SSH certificate has the same hosts and validity period and is signed by the CA private
+// key, so clients which trust the CA can verify the server's host key. The name is the key ID
+// and a principal of the certificate, which identifies the server to the other servers of the
+// cluster. The passphrase function is only called if the CA private key is encrypted.
+func CreateHostCertificate(logger log.Logger, caKeyFile string, caPassphrase PassphraseFunc, cert *x509.Certificate, name string) (*ssh.Certificate, error) {
+
+	// Read CA private key
+	logger.Info("Reading Certificate Authority Private Key")
+	priv, err := LoadEncryptedPrivateKey(caKeyFile, caPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get host key
+	key, err := ssh.NewPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The name is a principal so that the other servers accept the certificate
+	principals := strings.Split(CertificateHosts(cert), ",")
+	found := false
+	for _, principal := range principals {
+		found = found || principal == name
+	}
+	if !found {
+		principals = append(principals, name)
+	}
+
+	// Create host certificate
+	logger.Info("Generating Host Certificate")
+	hostCert := &ssh.Certificate{
+		Key:             key,
+		Serial:          cert.SerialNumber.Uint64(),
+		CertType:        ssh.HostCert,
+		KeyId:           name,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(cert.NotBefore.Unix()),
+		ValidBefore:     uint64(cert.NotAfter.Unix()),
+	}
+	if err := hostCert.SignCert(rand.Reader, signer); err != nil {
+		return nil, err
+	}
+	return hostCert, nil
+}
+
+// SaveHostCertificate saves an SSH certificate in the OpenSSH format.
+func SaveHostCertificate(logger log.Logger, cert *ssh.Certificate, filename string) error {
+	logger.Info("Saving Host Certificate")
+	return ioutil.WriteFile(filename, ssh.MarshalAuthorizedKey(cert), 0644)
+}
+
+// ReadHostCertificate reads an SSH certificate in the OpenSSH format.
+func ReadHostCertificate(filename string) (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file")
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", filename)
+	}
+	return cert, nil
+}
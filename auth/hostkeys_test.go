@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestHostKey generates a host key for the SSH tests.
+func newTestHostKey(t *testing.T) ssh.Signer {
+	key, err := GenerateKey(KeyTypeEd25519, 0)
+	requireNil(t, err)
+	signer, err := ssh.NewSignerFromSigner(key)
+	requireNil(t, err)
+	return signer
+}
+
+// newTestHostCertificate signs a host certificate for the given principals, which is valid
+// until the given time.
+func newTestHostCertificate(t *testing.T, ca ssh.Signer, key ssh.PublicKey, validBefore time.Time, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1,
+		CertType:        ssh.HostCert,
+		KeyId:           "node-1",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	requireNil(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+// newTestHostKeyChecker returns a checker trusting the given authorities with an empty
+// known_hosts file in a temporary directory.
+func newTestHostKeyChecker(t *testing.T, authorities ...ssh.PublicKey) (*HostKeyChecker, *bytes.Buffer, func()) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	known, err := LoadKnownHosts(filepath.Join(dir, "known_hosts"))
+	requireNil(t, err)
+
+	var output bytes.Buffer
+	checker := &HostKeyChecker{Authorities: authorities, KnownHosts: known, Output: &output}
+	return checker, &output, func() { os.RemoveAll(dir) }
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"db1.example.com:22":   "db1.example.com",
+		"db1.example.com:9022": "[db1.example.com]:9022",
+		"127.0.0.1:9022":       "[127.0.0.1]:9022",
+		"[::1]:9022":           "[::1]:9022",
+		"[::1]:22":             "::1",
+		"db1.example.com":      "db1.example.com",
+	} {
+		assert.Equal(t, expected, normalizeHost(addr), addr)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "kappa", "known_hosts")
+
+	// A missing file has no keys
+	known, err := LoadKnownHosts(filename)
+	requireNil(t, err)
+	assert.Empty(t, known.Lookup("127.0.0.1:9022"))
+
+	key := newTestHostKey(t).PublicKey()
+	requireNil(t, known.Add("127.0.0.1:9022", key))
+	assert.Equal(t, []ssh.PublicKey{key}, known.Lookup("127.0.0.1:9022"))
+	assert.Empty(t, known.Lookup("127.0.0.1:9023"))
+
+	// Keys are saved in the OpenSSH format
+	data, err := ioutil.ReadFile(filename)
+	requireNil(t, err)
+	assert.Equal(t, "[127.0.0.1]:9022 "+string(ssh.MarshalAuthorizedKey(key)), string(data))
+
+	known, err = LoadKnownHosts(filename)
+	requireNil(t, err)
+	if keys := known.Lookup("127.0.0.1:9022"); assert.Len(t, keys, 1) {
+		assert.Equal(t, key.Marshal(), keys[0].Marshal())
+	}
+
+	// Invalid files are rejected
+	requireNil(t, ioutil.WriteFile(filename, []byte("127.0.0.1 ssh-ed25519 invalid\n"), 0600))
+	_, err = LoadKnownHosts(filename)
+	assert.NotNil(t, err)
+}
+
+func TestHostKeyChecker_TrustOnFirstUse(t *testing.T) {
+	checker, output, cleanup := newTestHostKeyChecker(t)
+	defer cleanup()
+	key := newTestHostKey(t).PublicKey()
+
+	// The key is added the first time the host is seen
+	requireNil(t, checker.Check("127.0.0.1:9022", nil, key))
+	assert.Contains(t, output.String(), "Permanently added '127.0.0.1:9022'")
+	assert.Len(t, checker.KnownHosts.Lookup("127.0.0.1:9022"), 1)
+
+	output.Reset()
+	assert.Nil(t, checker.Check("127.0.0.1:9022", nil, key))
+	assert.Empty(t, output.String())
+	assert.Len(t, checker.KnownHosts.Lookup("127.0.0.1:9022"), 1)
+
+	// Other hosts are trusted separately
+	assert.Nil(t, checker.Check("127.0.0.1:9023", nil, newTestHostKey(t).PublicKey()))
+	assert.Len(t, checker.KnownHosts.Lookup("127.0.0.1:9023"), 1)
+}
+
+func TestHostKeyChecker_Mismatch(t *testing.T) {
+	checker, output, cleanup := newTestHostKeyChecker(t)
+	defer cleanup()
+	key := newTestHostKey(t).PublicKey()
+	requireNil(t, checker.Check("127.0.0.1:9022", nil, key))
+
+	// A changed key is rejected and not saved
+	output.Reset()
+	other := newTestHostKey(t).PublicKey()
+	err := checker.Check("127.0.0.1:9022", nil, other)
+	if assert.IsType(t, &HostKeyMismatchError{}, err) {
+		mismatch := err.(*HostKeyMismatchError)
+		assert.Equal(t, "127.0.0.1:9022", mismatch.Host)
+		assert.Equal(t, CreateFingerprint(other.Marshal()), mismatch.Fingerprint)
+		assert.Equal(t, []string{CreateFingerprint(key.Marshal())}, mismatch.Known)
+	}
+	assert.Contains(t, output.String(), "REMOTE HOST IDENTIFICATION HAS CHANGED")
+	assert.Len(t, checker.KnownHosts.Lookup("127.0.0.1:9022"), 1)
+
+	// Certificates for a changed key are rejected without a trusted CA
+	ca := newTestHostKey(t)
+	cert := newTestHostCertificate(t, ca, other, time.Now().Add(time.Hour), "127.0.0.1")
+	assert.IsType(t, &HostKeyMismatchError{}, checker.Check("127.0.0.1:9022", nil, cert))
+}
+
+func TestHostKeyChecker_Certificate(t *testing.T) {
+	ca := newTestHostKey(t)
+	checker, _, cleanup := newTestHostKeyChecker(t, ca.PublicKey())
+	defer cleanup()
+	key := newTestHostKey(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9022}
+
+	// Certificates signed by the CA are accepted without being saved
+	cert := newTestHostCertificate(t, ca, key, time.Now().Add(time.Hour), "127.0.0.1", "db1.example.com")
+	assert.Nil(t, checker.Check("127.0.0.1:9022", remote, cert))
+	assert.Nil(t, checker.Check("db1.example.com:9022", remote, cert))
+	assert.Empty(t, checker.KnownHosts.Lookup("127.0.0.1:9022"))
+
+	// Certificates for other hosts are rejected
+	assert.NotNil(t, checker.Check("10.0.0.1:9022", remote, cert))
+
+	// Expired certificates are rejected
+	expired := newTestHostCertificate(t, ca, key, time.Now().Add(-time.Minute), "127.0.0.1")
+	assert.NotNil(t, checker.Check("127.0.0.1:9022", remote, expired))
+
+	// Certificates signed by another CA are rejected rather than trusted on first use
+	other := newTestHostCertificate(t, newTestHostKey(t), key, time.Now().Add(time.Hour), "127.0.0.1")
+	assert.NotNil(t, checker.Check("127.0.0.1:9022", remote, other))
+	assert.Empty(t, checker.KnownHosts.Lookup("127.0.0.1:9022"))
+}
+
+func TestVerifyHostCertificate(t *testing.T) {
+	ca := newTestHostKey(t)
+	authorities := []ssh.PublicKey{ca.PublicKey()}
+	key := newTestHostKey(t).PublicKey()
+
+	// The key ID names the host
+	cert := newTestHostCertificate(t, ca, key, time.Now().Add(time.Hour), "127.0.0.1", "node-1")
+	name, err := VerifyHostCertificate(authorities, cert)
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1", name)
+
+	// Plain keys, expired certificates and certificates of other CAs are rejected
+	_, err = VerifyHostCertificate(authorities, key)
+	assert.NotNil(t, err)
+	expired := newTestHostCertificate(t, ca, key, time.Now().Add(-time.Minute), "node-1")
+	_, err = VerifyHostCertificate(authorities, expired)
+	assert.NotNil(t, err)
+	other := newTestHostCertificate(t, newTestHostKey(t), key, time.Now().Add(time.Hour), "node-1")
+	_, err = VerifyHostCertificate(authorities, other)
+	assert.NotNil(t, err)
+
+	// The name must be a principal
+	unnamed := newTestHostCertificate(t, ca, key, time.Now().Add(time.Hour), "127.0.0.1")
+	_, err = VerifyHostCertificate(authorities, unnamed)
+	assert.NotNil(t, err)
+
+	// User certificates are not host certificates
+	user := newTestHostCertificate(t, ca, key, time.Now().Add(time.Hour), "node-1")
+	user.CertType = ssh.UserCert
+	requireNil(t, user.SignCert(rand.Reader, ca))
+	_, err = VerifyHostCertificate(authorities, user)
+	assert.NotNil(t, err)
+}
+
+func TestCreateHostCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	_, _, caFile, caKeyFile := newTestAuthority(t, dir, 1)
+	cert := newTestCertificate(t, caFile, caKeyFile, "127.0.0.1,node-1")
+
+	hostCert, err := CreateHostCertificate(log.NullLog, caKeyFile, nil, cert, "node-1")
+	requireNil(t, err)
+	assert.Equal(t, []string{"127.0.0.1", "node-1"}, hostCert.ValidPrincipals)
+	assert.Equal(t, uint32(ssh.HostCert), hostCert.CertType)
+
+	// The certificate is saved and read back in the OpenSSH format
+	filename := filepath.Join(dir, "node-1-cert.pub")
+	requireNil(t, SaveHostCertificate(log.NullLog, hostCert, filename))
+	saved, err := ReadHostCertificate(filename)
+	requireNil(t, err)
+	assert.Equal(t, hostCert.Marshal(), saved.Marshal())
+
+	// Clients trusting the CA certificate accept it
+	checker, err := NewHostKeyChecker(caFile, filepath.Join(dir, "known_hosts"), nil)
+	requireNil(t, err)
+	assert.Nil(t, checker.Check("node-1:9022", nil, saved))
+	assert.NotNil(t, checker.Check("node-2:9022", nil, saved))
+
+	// and so do servers, which add the name to the principals if it is not a host
+	name, err := VerifyHostCertificate(checker.Authorities, saved)
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1", name)
+
+	hostCert, err = CreateHostCertificate(log.NullLog, caKeyFile, nil, cert, "node-2")
+	requireNil(t, err)
+	assert.Equal(t, []string{"127.0.0.1", "node-1", "node-2"}, hostCert.ValidPrincipals)
+	name, err = VerifyHostCertificate(checker.Authorities, hostCert)
+	assert.Nil(t, err)
+	assert.Equal(t, "node-2", name)
+}
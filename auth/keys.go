@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
@@ -23,6 +27,50 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// Supported private key types
+const (
+	KeyTypeRSA       = "rsa"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+)
+
+// KeyTypes lists all the key types which can be generated
+var KeyTypes = []string{KeyTypeRSA, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519}
+
+// GenerateKey creates a new private key of the given type. The number of bits is only used for RSA keys.
+func GenerateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA, "":
+		return rsa.GenerateKey(rand.Reader, bits)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s': expected one of %s", keyType, strings.Join(KeyTypes, ", "))
+	}
+}
+
+// SignatureAlgorithm returns the x509 signature algorithm used when signing with the given key.
+func SignatureAlgorithm(key crypto.Signer) x509.SignatureAlgorithm {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return x509.SHA512WithRSA
+	case *ecdsa.PublicKey:
+		if pub.Curve == elliptic.P384() {
+			return x509.ECDSAWithSHA384
+		}
+		return x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
 // CreateFingerprint generates an md5 fingerprint
 func CreateFingerprint(key []byte) string {
 	// Hash key
@@ -73,7 +121,7 @@ func CreatePkiDirectories(logger log.Logger, root string) error {
 }
 
 // CreateCertificateAuthority generates a new CA
-func CreateCertificateAuthority(logger log.Logger, key *rsa.PrivateKey, years int, org, country, hostList string) ([]byte, error) {
+func CreateCertificateAuthority(logger log.Logger, key crypto.Signer, years int, org, country, hostList string) ([]byte, error) {
 
 	// Generate subject key id
 	logger.Info("Generating SubjectKeyID")
@@ -101,8 +149,7 @@ func CreateCertificateAuthority(logger log.Logger, key *rsa.PrivateKey, years in
 			Country:      []string{country},
 			Organization: []string{org},
 		},
-		PublicKeyAlgorithm: x509.RSA,
-		SignatureAlgorithm: x509.SHA512WithRSA,
+		SignatureAlgorithm: SignatureAlgorithm(key),
 		NotBefore:          time.Now().Add(-600).UTC(),
 		NotAfter:           time.Now().AddDate(years, 0, 0).UTC(),
 
@@ -124,7 +171,63 @@ func CreateCertificateAuthority(logger log.Logger, key *rsa.PrivateKey, years in
 
 	// Create cert
 	logger.Info("Generating Certificate")
-	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// CreateIntermediateAuthority generates a new CA signed by an existing root CA. The intermediate
+// can sign certificates but not other CAs, which allows the root key to be kept offline.
+func CreateIntermediateAuthority(logger log.Logger, key crypto.Signer, root *x509.Certificate, rootKey crypto.Signer, years int, org, country string) ([]byte, error) {
+
+	// Generate subject key id
+	logger.Info("Generating SubjectKeyID")
+	subjectKeyID, err := GenerateSubjectKeyID(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create serial number
+	logger.Info("Generating Serial Number")
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %s", err.Error())
+	}
+
+	// Create template
+	logger.Info("Creating Certificate template")
+	template := &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          subjectKeyID,
+		SerialNumber:          serialNumber,
+		Subject: pkix.Name{
+			Country:            []string{country},
+			Organization:       []string{org},
+			OrganizationalUnit: []string{"intermediate"},
+		},
+		SignatureAlgorithm: SignatureAlgorithm(rootKey),
+		NotBefore:          time.Now().Add(-600).UTC(),
+		NotAfter:           time.Now().AddDate(years, 0, 0).UTC(),
+
+		// see http://golang.org/pkg/crypto/x509/#KeyUsage
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	// Intermediates cannot outlive the root
+	if template.NotAfter.After(root.NotAfter) {
+		template.NotAfter = root.NotAfter
+	}
+
+	// Create cert
+	logger.Info("Generating Certificate")
+	cert, err := x509.CreateCertificate(rand.Reader, template, root, key.Public(), rootKey)
 	if err != nil {
 		return nil, err
 	}
@@ -133,35 +236,135 @@ func CreateCertificateAuthority(logger log.Logger, key *rsa.PrivateKey, years in
 }
 
 // GenerateSubjectKeyID creates a subject id based on a private key.
-func GenerateSubjectKeyID(key *rsa.PrivateKey) (bytes []byte, err error) {
-	pub, err := asn1.Marshal(key.PublicKey)
+func GenerateSubjectKeyID(key crypto.Signer) (bytes []byte, err error) {
+	return generateSubjectKeyID(key.Public())
+}
+
+// generateSubjectKeyID creates a subject id from the SHA-1 hash of the
+// subject public key bit string (RFC 5280, section 4.2.1.2).
+func generateSubjectKeyID(pub crypto.PublicKey) (bytes []byte, err error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
 		return
 	}
-	hash := sha1.Sum(pub)
+
+	// Extract the public key bit string
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err = asn1.Unmarshal(der, &info); err != nil {
+		return
+	}
+	hash := sha1.Sum(info.PublicKey.Bytes)
 	bytes = hash[:]
 	return
 }
 
+// MarshalPrivateKey encodes a private key as a PEM block. RSA keys are stored in the PKCS#1
+// format, ECDSA keys in the SEC 1 format and all others as PKCS#8.
+func MarshalPrivateKey(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		bytes, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: bytes}, nil
+	default:
+		bytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: bytes}, nil
+	}
+}
+
+// ParsePrivateKey decodes an unencrypted private key from a PEM block.
+func ParsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return privateKeySigner(key)
+	case "OPENSSH PRIVATE KEY":
+		key, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, err
+		}
+		return privateKeySigner(key)
+	default:
+		return nil, fmt.Errorf("unsupported private key header: %s", block.Type)
+	}
+}
+
+// LoadPrivateKey reads a PEM encoded private key file.
+func LoadPrivateKey(filename string) (crypto.Signer, error) {
+	return LoadEncryptedPrivateKey(filename, nil)
+}
+
+// LoadEncryptedPrivateKey reads a PEM encoded private key file which may be encrypted. The
+// passphrase function is only called if the key is encrypted.
+func LoadEncryptedPrivateKey(filename string, passphrase PassphraseFunc) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file")
+	}
+
+	// Decode PEM file
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("error decoding PEM format")
+	}
+
+	return DecryptPrivateKey(pemBlock, filename, passphrase)
+}
+
 // SavePrivateKey saves a PrivateKey in the PEM format.
-func SavePrivateKey(logger log.Logger, key *rsa.PrivateKey, filename string) {
+func SavePrivateKey(logger log.Logger, key crypto.Signer, filename string) error {
+	return SaveEncryptedPrivateKey(logger, key, filename, nil)
+}
+
+// SaveEncryptedPrivateKey saves a PrivateKey in the PEM format. The key is encrypted in the
+// OpenSSH format if the passphrase is not empty.
+func SaveEncryptedPrivateKey(logger log.Logger, key crypto.Signer, filename string, passphrase []byte) error {
 	logger.Info("Saving Private Key")
-	pemfile, _ := os.Create(filename)
-	pemkey := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key)}
-	pem.Encode(pemfile, pemkey)
-	pemfile.Close()
+	var pemkey *pem.Block
+	var err error
+	if len(passphrase) > 0 {
+		logger.Info("Encrypting Private Key")
+		pemkey, err = EncryptPrivateKey(key, passphrase)
+	} else {
+		pemkey, err = MarshalPrivateKey(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	pemfile, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer pemfile.Close()
+	return pem.Encode(pemfile, pemkey)
 }
 
 // SavePublicKey saves a public key in the PEM format.
-func SavePublicKey(logger log.Logger, key *rsa.PrivateKey, filename string) {
+func SavePublicKey(logger log.Logger, key crypto.Signer, filename string) {
 	logger.Info("Saving Public Key")
 	pemfile, _ := os.Create(filename)
-	bytes, _ := x509.MarshalPKIXPublicKey(key.PublicKey)
+	bytes, _ := x509.MarshalPKIXPublicKey(key.Public())
 
 	pemkey := &pem.Block{
-		Type:  "RSA PUBLIC KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: bytes}
 	pem.Encode(pemfile, pemkey)
 	pemfile.Close()
@@ -169,17 +372,24 @@ func SavePublicKey(logger log.Logger, key *rsa.PrivateKey, filename string) {
 
 // SaveCertificate saves a certificate in the PEM format.
 func SaveCertificate(logger log.Logger, cert []byte, filename string) {
+	SaveCertificateChain(logger, [][]byte{cert}, filename)
+}
+
+// SaveCertificateChain saves a certificate followed by its issuers in the PEM format.
+func SaveCertificateChain(logger log.Logger, certs [][]byte, filename string) {
 	logger.Info("Saving Certificate")
 	pemfile, _ := os.Create(filename)
-	pemkey := &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: cert}
-	pem.Encode(pemfile, pemkey)
+	for _, cert := range certs {
+		pemkey := &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert}
+		pem.Encode(pemfile, pemkey)
+	}
 	pemfile.Close()
 }
 
 // CreateCertificateRequest generates a new certificate request
-func CreateCertificateRequest(logger log.Logger, key *rsa.PrivateKey, name, org, country, hostList string) (*x509.CertificateRequest, []byte, error) {
+func CreateCertificateRequest(logger log.Logger, key crypto.Signer, name, org, country, hostList string) (*x509.CertificateRequest, []byte, error) {
 
 	// Create template
 	logger.Info("Creating Certificate template")
@@ -243,6 +453,12 @@ func ReadCertificate(filename string, certType string) (*pem.Block, error) {
 
 // ReadPrivateKey reads a private key file
 func ReadPrivateKey(logger log.Logger, keyFile string) (privateKey ssh.Signer, err error) {
+	return ReadEncryptedPrivateKey(logger, keyFile, nil)
+}
+
+// ReadEncryptedPrivateKey reads a private key file which may be encrypted. The passphrase
+// function is only called if the key is encrypted.
+func ReadEncryptedPrivateKey(logger log.Logger, keyFile string, passphrase PassphraseFunc) (privateKey ssh.Signer, err error) {
 
 	// Read SSH Key
 	keyBytes, err := ioutil.ReadFile(keyFile)
@@ -251,20 +467,39 @@ func ReadPrivateKey(logger log.Logger, keyFile string) (privateKey ssh.Signer, e
 		return
 	}
 
-	// Get private key
-	privateKey, err = ssh.ParsePrivateKey(keyBytes)
+	// Unencrypted keys may be in any format supported by the ssh package
+	pemBlock, _ := pem.Decode(keyBytes)
+	if pemBlock == nil || !IsEncryptedPrivateKey(pemBlock) {
+		privateKey, err = ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			logger.Warn("Private key could not be parsed", "error", err.Error())
+		}
+		return
+	}
+
+	// Decrypt private key
+	key, err := DecryptPrivateKey(pemBlock, keyFile, passphrase)
 	if err != nil {
-		logger.Warn("Private key could not be parsed", "error", err.Error())
+		logger.Warn("Private key could not be decrypted", "error", err.Error())
+		return
 	}
-	return
+	return ssh.NewSignerFromSigner(key)
 }
 
-// CreateCertificate generates a new cert
-func CreateCertificate(logger log.Logger, req *x509.CertificateRequest, key *rsa.PrivateKey, years int, hostList string) ([]byte, error) {
+// CreateCertificate generates a new cert signed by the CA in the given files. The passphrase
+// function is only called if the CA private key is encrypted.
+func CreateCertificate(logger log.Logger, caCertFile, caKeyFile string, caPassphrase PassphraseFunc, req *x509.CertificateRequest, key crypto.Signer, years int, hostList string) ([]byte, error) {
+	return SignCertificateRequest(logger, caCertFile, caKeyFile, caPassphrase, req, key.Public(), years, hostList)
+}
+
+// SignCertificateRequest issues a certificate for the public key and subject of a certificate request.
+// The certificate is signed by the CA in the given files, which may be a root or an intermediate CA.
+// The passphrase function is only called if the CA private key is encrypted.
+func SignCertificateRequest(logger log.Logger, caCertFile, caKeyFile string, caPassphrase PassphraseFunc, req *x509.CertificateRequest, pub crypto.PublicKey, years int, hostList string) ([]byte, error) {
 
 	// Read CA
 	logger.Info("Reading Certificate Authority")
-	pemBlock, err := ReadCertificate(path.Join(".", "pki", "ca.crt"), "CERTIFICATE")
+	pemBlock, err := ReadCertificate(caCertFile, "CERTIFICATE")
 	if err != nil {
 		return nil, err
 	}
@@ -277,20 +512,14 @@ func CreateCertificate(logger log.Logger, req *x509.CertificateRequest, key *rsa
 	}
 
 	logger.Info("Reading Certificate Authority Private Key")
-	pemBlock, err = ReadCertificate(path.Join(".", "pki", "private", "ca.key"), "RSA PRIVATE KEY")
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Info("Parsing Certificate Authority Private Key")
-	priv, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	priv, err := LoadEncryptedPrivateKey(caKeyFile, caPassphrase)
 	if err != nil {
 		return nil, err
 	}
 
 	// Generate subject key id
 	logger.Info("Generating SubjectKeyID")
-	subjectKeyID, err := GenerateSubjectKeyID(key)
+	subjectKeyID, err := generateSubjectKeyID(pub)
 	if err != nil {
 		return nil, err
 	}
@@ -311,8 +540,7 @@ func CreateCertificate(logger log.Logger, req *x509.CertificateRequest, key *rsa
 		SubjectKeyId:          subjectKeyID,
 		SerialNumber:          serialNumber,
 		Subject:               req.Subject,
-		PublicKeyAlgorithm:    x509.RSA,
-		SignatureAlgorithm:    x509.SHA512WithRSA,
+		SignatureAlgorithm:    SignatureAlgorithm(priv),
 		NotBefore:             time.Now().Add(-600).UTC(),
 		NotAfter:              time.Now().AddDate(years, 0, 0).UTC(),
 
@@ -342,7 +570,7 @@ func CreateCertificate(logger log.Logger, req *x509.CertificateRequest, key *rsa
 
 	// Create cert
 	logger.Info("Generating Certificate")
-	cert, err := x509.CreateCertificate(rand.Reader, template, authority, &key.PublicKey, priv)
+	cert, err := x509.CreateCertificate(rand.Reader, template, authority, pub, priv)
 	if err != nil {
 		return nil, err
 	}
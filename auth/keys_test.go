@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateKey(t *testing.T) {
+	for _, test := range []struct {
+		keyType   string
+		algorithm x509.SignatureAlgorithm
+		header    string
+	}{
+		{KeyTypeRSA, x509.SHA512WithRSA, "RSA PRIVATE KEY"},
+		{KeyTypeECDSAP256, x509.ECDSAWithSHA256, "EC PRIVATE KEY"},
+		{KeyTypeECDSAP384, x509.ECDSAWithSHA384, "EC PRIVATE KEY"},
+		{KeyTypeEd25519, x509.PureEd25519, "PRIVATE KEY"},
+	} {
+		key, err := GenerateKey(test.keyType, 1024)
+		requireNil(t, err)
+		assert.Equal(t, test.algorithm, SignatureAlgorithm(key), test.keyType)
+
+		// Keys are read back as they were written
+		block, err := MarshalPrivateKey(key)
+		requireNil(t, err)
+		assert.Equal(t, test.header, block.Type, test.keyType)
+
+		parsed, err := ParsePrivateKey(block)
+		requireNil(t, err)
+		assert.Equal(t, key, parsed, test.keyType)
+	}
+}
+
+func TestGenerateKey_Types(t *testing.T) {
+	key, err := GenerateKey("", 1024)
+	requireNil(t, err)
+	if assert.IsType(t, &rsa.PrivateKey{}, key) {
+		assert.Equal(t, 1024, key.(*rsa.PrivateKey).N.BitLen())
+	}
+
+	key, err = GenerateKey(KeyTypeECDSAP384, 0)
+	requireNil(t, err)
+	if assert.IsType(t, &ecdsa.PrivateKey{}, key) {
+		assert.Equal(t, elliptic.P384(), key.(*ecdsa.PrivateKey).Curve)
+	}
+
+	key, err = GenerateKey(KeyTypeEd25519, 0)
+	requireNil(t, err)
+	assert.IsType(t, ed25519.PrivateKey{}, key)
+}
+
+func TestGenerateKey_UnknownType(t *testing.T) {
+	key, err := GenerateKey("dsa", 1024)
+	assert.Nil(t, key)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "unsupported key type 'dsa'")
+	}
+}
+
+func TestSignatureAlgorithm_UnknownKey(t *testing.T) {
+	assert.Equal(t, x509.UnknownSignatureAlgorithm, SignatureAlgorithm(unknownSigner{}))
+}
+
+func TestParsePrivateKey_UnknownHeader(t *testing.T) {
+	_, err := ParsePrivateKey(&pem.Block{Type: "DSA PRIVATE KEY", Bytes: []byte{1, 2, 3}})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "unsupported private key header: DSA PRIVATE KEY")
+	}
+}
+
+// unknownSigner is a signer with a public key type which cannot be used for certificates.
+type unknownSigner struct {
+	crypto.Signer
+}
+
+func (unknownSigner) Public() crypto.PublicKey {
+	return struct{}{}
+}
+
+// requireNil stops the test if err is not nil.
+func requireNil(t *testing.T, err error) {
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+}
+
+// newTestAuthority creates a root CA valid for the given years and saves its certificate
+// and private key in dir.
+func newTestAuthority(t *testing.T, dir string, years int) (*x509.Certificate, crypto.Signer, string, string) {
+	key, err := GenerateKey(KeyTypeECDSAP256, 0)
+	requireNil(t, err)
+	der, err := CreateCertificateAuthority(log.NullLog, key, years, "kappa", "US", "127.0.0.1")
+	requireNil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	requireNil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	SaveCertificate(log.NullLog, der, certFile)
+	requireNil(t, SavePrivateKey(log.NullLog, key, keyFile))
+	return cert, key, certFile, keyFile
+}
+
+func TestCreateIntermediateAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	root, rootKey, rootFile, _ := newTestAuthority(t, dir, 1)
+
+	// The intermediate cannot outlive the root
+	key, err := GenerateKey(KeyTypeEd25519, 0)
+	requireNil(t, err)
+	der, err := CreateIntermediateAuthority(log.NullLog, key, root, rootKey, 5, "kappa", "US")
+	requireNil(t, err)
+	intermediate, err := x509.ParseCertificate(der)
+	requireNil(t, err)
+	assert.True(t, intermediate.IsCA)
+	assert.True(t, intermediate.MaxPathLenZero)
+	assert.Equal(t, 0, intermediate.MaxPathLen)
+	assert.Equal(t, root.NotAfter, intermediate.NotAfter)
+	assert.Nil(t, intermediate.CheckSignatureFrom(root))
+
+	// The CA file holds the intermediate followed by the root, as init-ca writes it
+	caFile, caKeyFile := filepath.Join(dir, "intermediate.crt"), filepath.Join(dir, "intermediate.key")
+	SaveCertificateChain(log.NullLog, [][]byte{der, root.Raw}, caFile)
+	requireNil(t, SavePrivateKey(log.NullLog, key, caKeyFile))
+
+	// Certificates signed by the intermediate are verified through the pools
+	leafKey, err := GenerateKey(KeyTypeRSA, 1024)
+	requireNil(t, err)
+	req := &x509.CertificateRequest{Subject: pkix.Name{OrganizationalUnit: []string{"node-1"}}}
+	leafDer, err := SignCertificateRequest(log.NullLog, caFile, caKeyFile, nil, req, leafKey.Public(), 1, "127.0.0.1,node-1")
+	requireNil(t, err)
+	leaf, err := x509.ParseCertificate(leafDer)
+	requireNil(t, err)
+	assert.Equal(t, "127.0.0.1,node-1", CertificateHosts(leaf))
+
+	roots, intermediates, err := LoadCertPool(caFile)
+	requireNil(t, err)
+	assert.Nil(t, VerifyCertificate([]*x509.Certificate{leaf}, roots, intermediates))
+
+	// Only the root is trusted by clients which were not given the intermediate
+	roots, intermediates, err = LoadCertPool(rootFile)
+	requireNil(t, err)
+	assert.NotNil(t, VerifyCertificate([]*x509.Certificate{leaf}, roots, intermediates))
+	assert.Nil(t, VerifyCertificate([]*x509.Certificate{leaf, intermediate}, roots, intermediates))
+
+	// The intermediate cannot issue other CAs
+	subKey, err := GenerateKey(KeyTypeECDSAP256, 0)
+	requireNil(t, err)
+	subDer, err := CreateIntermediateAuthority(log.NullLog, subKey, intermediate, key, 1, "kappa", "US")
+	requireNil(t, err)
+	sub, err := x509.ParseCertificate(subDer)
+	requireNil(t, err)
+	subLeafDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, sub, leafKey.Public(), subKey)
+	requireNil(t, err)
+	subLeaf, err := x509.ParseCertificate(subLeafDer)
+	requireNil(t, err)
+	roots, intermediates, err = LoadCertPool(caFile)
+	requireNil(t, err)
+	assert.NotNil(t, VerifyCertificate([]*x509.Certificate{subLeaf, sub}, roots, intermediates))
+}
+
+func TestSignCertificateRequest_MissingAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey(KeyTypeEd25519, 0)
+	requireNil(t, err)
+	_, err = SignCertificateRequest(log.NullLog, filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), nil,
+		&x509.CertificateRequest{}, key.Public(), 1, "127.0.0.1")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrPassphraseRequired is returned when an encrypted private key is read without a passphrase.
+var ErrPassphraseRequired = errors.New("private key is encrypted and requires a passphrase")
+
+// PassphraseFunc returns the passphrase for an encrypted private key file.
+type PassphraseFunc func(filename string) ([]byte, error)
+
+// IsEncryptedPrivateKey determines if a PEM encoded private key has been encrypted with a
+// passphrase, either in the OpenSSH format or with the legacy PEM encryption of OpenSSL.
+func IsEncryptedPrivateKey(block *pem.Block) bool {
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		_, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+		_, missing := err.(*ssh.PassphraseMissingError)
+		return missing
+	}
+	return strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+}
+
+// EncryptPrivateKey encodes a private key in the OpenSSH format, encrypted with AES-256 using
+// a key derived from the passphrase with bcrypt.
+func EncryptPrivateKey(key crypto.Signer, passphrase []byte) (*pem.Block, error) {
+	return ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+}
+
+// DecryptPrivateKey decodes a private key from a PEM block which may be encrypted. The
+// passphrase function is only called if the key is encrypted.
+func DecryptPrivateKey(block *pem.Block, filename string, passphrase PassphraseFunc) (crypto.Signer, error) {
+	if !IsEncryptedPrivateKey(block) {
+		return ParsePrivateKey(block)
+	} else if passphrase == nil {
+		return nil, ErrPassphraseRequired
+	}
+
+	// Get passphrase
+	secret, err := passphrase(filename)
+	if err != nil {
+		return nil, err
+	} else if len(secret) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+
+	// Decrypt key
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(pem.EncodeToMemory(block), secret)
+	if err != nil {
+		return nil, err
+	}
+	return privateKeySigner(key)
+}
+
+// privateKeySigner returns the signer for a private key parsed by the ssh package, which
+// returns Ed25519 keys in the OpenSSH format by reference.
+func privateKeySigner(key interface{}) (crypto.Signer, error) {
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		key = *k
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// passphrase returns a passphrase function which counts how often it is called.
+func passphrase(secret string, calls *int) PassphraseFunc {
+	return func(filename string) ([]byte, error) {
+		*calls++
+		return []byte(secret), nil
+	}
+}
+
+func TestEncryptPrivateKey(t *testing.T) {
+	for _, keyType := range KeyTypes {
+		key, err := GenerateKey(keyType, 1024)
+		requireNil(t, err)
+
+		block, err := EncryptPrivateKey(key, []byte("secret"))
+		requireNil(t, err)
+		assert.Equal(t, "OPENSSH PRIVATE KEY", block.Type, keyType)
+		assert.True(t, IsEncryptedPrivateKey(block), keyType)
+
+		// Keys are decrypted with the passphrase
+		var calls int
+		decrypted, err := DecryptPrivateKey(block, "key", passphrase("secret", &calls))
+		requireNil(t, err)
+		assert.Equal(t, key, decrypted, keyType)
+		assert.Equal(t, 1, calls, keyType)
+
+		// Wrong and missing passphrases are rejected
+		_, err = DecryptPrivateKey(block, "key", passphrase("wrong", &calls))
+		assert.Equal(t, x509.IncorrectPasswordError, err, keyType)
+		_, err = DecryptPrivateKey(block, "key", passphrase("", &calls))
+		assert.Equal(t, ErrPassphraseRequired, err, keyType)
+		_, err = DecryptPrivateKey(block, "key", nil)
+		assert.Equal(t, ErrPassphraseRequired, err, keyType)
+		_, err = ParsePrivateKey(block)
+		assert.NotNil(t, err, keyType)
+	}
+}
+
+func TestDecryptPrivateKey_Unencrypted(t *testing.T) {
+	key, err := GenerateKey(KeyTypeECDSAP256, 0)
+	requireNil(t, err)
+	block, err := MarshalPrivateKey(key)
+	requireNil(t, err)
+	assert.False(t, IsEncryptedPrivateKey(block))
+
+	// The passphrase is not asked for
+	var calls int
+	decrypted, err := DecryptPrivateKey(block, "key", passphrase("secret", &calls))
+	requireNil(t, err)
+	assert.Equal(t, key, decrypted)
+	assert.Equal(t, 0, calls)
+
+	// Unencrypted keys in the OpenSSH format are read as well
+	block, err = ssh.MarshalPrivateKey(key, "")
+	requireNil(t, err)
+	assert.False(t, IsEncryptedPrivateKey(block))
+	decrypted, err = DecryptPrivateKey(block, "key", nil)
+	requireNil(t, err)
+	assert.Equal(t, key, decrypted)
+}
+
+func TestSaveEncryptedPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-auth")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "admin.key")
+
+	key, err := GenerateKey(KeyTypeEd25519, 0)
+	requireNil(t, err)
+	requireNil(t, SaveEncryptedPrivateKey(log.NullLog, key, filename, []byte("secret")))
+
+	// Keys are loaded for certificates
+	var calls int
+	loaded, err := LoadEncryptedPrivateKey(filename, passphrase("secret", &calls))
+	requireNil(t, err)
+	assert.Equal(t, key, loaded)
+	_, err = LoadPrivateKey(filename)
+	assert.Equal(t, ErrPassphraseRequired, err)
+
+	// and as SSH signers for clients and servers
+	signer, err := ReadEncryptedPrivateKey(log.NullLog, filename, passphrase("secret", &calls))
+	requireNil(t, err)
+	pub, err := ssh.NewPublicKey(key.Public())
+	requireNil(t, err)
+	assert.Equal(t, pub.Marshal(), signer.PublicKey().Marshal())
+
+	_, err = ReadEncryptedPrivateKey(log.NullLog, filename, passphrase("wrong", &calls))
+	assert.NotNil(t, err)
+	_, err = ReadPrivateKey(log.NullLog, filename)
+	assert.Equal(t, ErrPassphraseRequired, err)
+	assert.Equal(t, 3, calls)
+
+	// The passphrase function may fail
+	_, err = LoadEncryptedPrivateKey(filename, func(string) ([]byte, error) {
+		return nil, errors.New("no terminal")
+	})
+	assert.EqualError(t, err, "no terminal")
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/blacklabeldata/kappa/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// adminChannel is the channel type used to manage the membership of the cluster
+const adminChannel = "kappa-admin"
+
+// Member is a member of the cluster as seen by the server the client is connected to.
+// Only the name, status and tags are known for members which are not kappa servers.
+type Member struct {
+	Name      string
+	Role      string
+	Cluster   string
+	Addr      string
+	Bootstrap bool
+	Status    string
+	Tags      map[string]string
+}
+
+// Keyring lists the gossip encryption keys installed on the servers of the cluster.
+type Keyring struct {
+
+	// Keys maps each base64 encoded key to the number of servers it is installed on
+	Keys map[string]int
+
+	// Servers is the number of servers in the cluster, and Responses the number which
+	// answered
+	Servers   int
+	Responses int
+}
+
+// Members lists the members of the cluster. Only the admin can manage the cluster.
+func (c *Client) Members(ctx context.Context) ([]Member, error) {
+	var members []Member
+	err := c.admin(ctx, "kappa-members", nil, &members)
+	return members, err
+}
+
+// Join makes the server join the cluster through the servers listening for gossip at the
+// given addresses. It returns the number of servers contacted.
+func (c *Client) Join(ctx context.Context, addrs ...string) (int, error) {
+	var answer struct{ Joined int }
+	err := c.admin(ctx, "kappa-join", ssh.Marshal(&struct{ Addrs []string }{addrs}), &answer)
+	return answer.Joined, err
+}
+
+// Leave makes the server leave the cluster gracefully. The server shuts down once it has
+// left, which closes the connection.
+func (c *Client) Leave(ctx context.Context) error {
+	return c.admin(ctx, "kappa-leave", nil, nil)
+}
+
+// ForceLeave marks a failed server as having left the cluster, so that its replicas are
+// moved at once rather than once it is reaped.
+func (c *Client) ForceLeave(ctx context.Context, node string) error {
+	return c.admin(ctx, "kappa-force-leave", ssh.Marshal(&struct{ Node string }{node}), nil)
+}
+
+// ListKeys lists the gossip encryption keys installed on the servers.
+func (c *Client) ListKeys(ctx context.Context) (Keyring, error) {
+	return c.keyring(ctx, "kappa-list-keys", nil)
+}
+
+// InstallKey adds a base64 encoded gossip encryption key to the keyring of every server.
+// The servers accept messages encrypted with any installed key.
+func (c *Client) InstallKey(ctx context.Context, key string) (Keyring, error) {
+	return c.keyring(ctx, "kappa-install-key", ssh.Marshal(&struct{ Key string }{key}))
+}
+
+// UseKey makes an installed key the primary key, which the servers encrypt messages with.
+func (c *Client) UseKey(ctx context.Context, key string) (Keyring, error) {
+	return c.keyring(ctx, "kappa-use-key", ssh.Marshal(&struct{ Key string }{key}))
+}
+
+// RemoveKey removes a key from the keyring of every server. The primary key cannot be
+// removed.
+func (c *Client) RemoveKey(ctx context.Context, key string) (Keyring, error) {
+	return c.keyring(ctx, "kappa-remove-key", ssh.Marshal(&struct{ Key string }{key}))
+}
+
+// keyring sends a keyring request and returns the keys installed on the servers.
+func (c *Client) keyring(ctx context.Context, request string, payload []byte) (Keyring, error) {
+	var answer struct {
+		Keys     map[string]int
+		NumNodes int
+		NumResp  int
+	}
+	err := c.admin(ctx, request, payload, &answer)
+	return Keyring{answer.Keys, answer.NumNodes, answer.NumResp}, err
+}
+
+// admin sends a request on a new kappa-admin channel and decodes the answer into answer
+// unless it is nil.
+func (c *Client) admin(ctx context.Context, request string, payload []byte, answer interface{}) error {
+	if err := c.checkOpen(ctx); err != nil {
+		return err
+	}
+
+	conn, release, err := c.sideConn()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ch, err := c.openSSHChannel(ctx, conn, adminChannel)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	stop := watch(ctx, ch)
+	defer stop()
+
+	// The answer is written to the channel, which is closed once it is complete
+	ok, err := ch.SendRequest(request, true, payload)
+	if err != nil {
+		return c.requestError(ctx, err)
+	}
+	reply, err := ioutil.ReadAll(ch)
+	if err != nil || ctx.Err() != nil {
+		return c.requestError(ctx, err)
+	}
+
+	if !ok {
+		e := &Error{Code: common.ProtocolError, Message: "request failed"}
+		json.Unmarshal(reply, e)
+		return e
+	} else if answer != nil {
+		return json.Unmarshal(reply, answer)
+	}
+	return nil
+}
@@ -0,0 +1,530 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/kappa/protocol"
+	"github.com/blacklabeldata/namedtuple"
+	"golang.org/x/crypto/ssh"
+)
+
+// Options configures a client connection.
+type Options struct {
+
+	// HostKeyCallback verifies the server's host key. It is required; use
+	// auth.NewHostKeyChecker to check CA host certificates and known hosts.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Timeout limits the time taken to establish the SSH connection. Zero means no limit.
+	Timeout time.Duration
+
+	// MaxFrameSize is the largest protocol frame accepted from the server. The server may
+	// negotiate a smaller size. Defaults to protocol.DefaultMaxFrameSize.
+	MaxFrameSize uint32
+
+	// Redial opens a new SSH connection to the server. Subscriptions and cluster
+	// administration each use a connection of their own, as the server serves a single
+	// channel at a time on a connection. Dial sets it to connect to the same server. If it
+	// is nil, they use the client's connection instead.
+	Redial func() (*ssh.Client, error)
+}
+
+// Client executes statements on a kappa server. Requests are sent one at a time over a
+// single kappa-client channel, so session state such as the namespace selected with USE
+// is kept between requests. A Client is safe for concurrent use: requests wait for the
+// response to the previous request to be read, or for their context to be done.
+//
+// Cancelling the context of a request closes the channel it was sent on and the next
+// request opens a new one, which resets the session namespace. Closing the client ends
+// the responses being read.
+type Client struct {
+	conn *ssh.Client
+	opts Options
+
+	// slot is held by the request whose response is being read, and done is closed once
+	// the client is closed
+	slot chan struct{}
+	done chan struct{}
+
+	mutex     sync.Mutex
+	ch        *channel
+	requestID uint32
+	closed    bool
+	conns     map[*ssh.Client]struct{}
+}
+
+// channel is a kappa-client channel which has completed the protocol handshake.
+type channel struct {
+	ssh.Channel
+	enc   *protocol.Encoder
+	dec   *protocol.Decoder
+	hello protocol.Hello
+}
+
+// Dial connects to the server at addr and authenticates as user with the given key.
+func Dial(addr, user string, signer ssh.Signer, opts Options) (*Client, error) {
+	if opts.HostKeyCallback == nil {
+		return nil, errors.New("kappa: Options.HostKeyCallback is required")
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: opts.HostKeyCallback,
+		Timeout:         opts.Timeout,
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Redial == nil {
+		opts.Redial = func() (*ssh.Client, error) {
+			return ssh.Dial("tcp", addr, config)
+		}
+	}
+
+	c, err := NewClient(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient creates a client on an established SSH connection. The connection is closed
+// when the client is closed.
+func NewClient(conn *ssh.Client, opts Options) (*Client, error) {
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = protocol.DefaultMaxFrameSize
+	}
+
+	c := &Client{
+		conn:  conn,
+		opts:  opts,
+		slot:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		conns: make(map[*ssh.Client]struct{}),
+	}
+	ch, err := c.openChannel(context.Background(), conn)
+	if err != nil {
+		return nil, err
+	}
+	c.ch = ch
+	return c, nil
+}
+
+// Close closes the channels and SSH connections. Responses which are being read and
+// requests waiting to be sent fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	ch, conns := c.ch, c.conns
+	c.ch, c.conns = nil, nil
+	c.mutex.Unlock()
+
+	if ch != nil {
+		ch.Close()
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+	return c.conn.Close()
+}
+
+// Exec executes one or more semicolon separated statements and returns the status of the
+// last one. Rows are discarded. The first failed statement is returned as an *Error.
+func (c *Client) Exec(ctx context.Context, stmt string) (Result, error) {
+	rows, err := c.Query(ctx, stmt)
+	if err != nil {
+		return Result{}, err
+	}
+	return rows.drain()
+}
+
+// Query executes statements and returns an iterator over the rows of their result sets.
+// The client is busy until the rows are read to the end or closed.
+func (c *Client) Query(ctx context.Context, stmt string) (*Rows, error) {
+	return c.request(ctx, &protocol.Query{Statement: stmt})
+}
+
+// Insert appends tuples to a log which is not clustered by a key.
+func (c *Client) Insert(ctx context.Context, log string, tuples ...namedtuple.Tuple) error {
+	return c.InsertClustered(ctx, log, "", tuples...)
+}
+
+// InsertClustered appends tuples to a log clustered by the given field. The value of the
+// field is sent with each tuple, so that tuples with the same value are stored in the same
+// partition. Tuples without a value are stored in the partition of the empty key. The
+// tuples are not clustered if field is empty.
+func (c *Client) InsertClustered(ctx context.Context, log, field string, tuples ...namedtuple.Tuple) error {
+	insert := protocol.Insert{Log: log}
+	for _, tuple := range tuples {
+		var buf bytes.Buffer
+		if err := namedtuple.NewEncoder(&buf).Encode(tuple); err != nil {
+			return err
+		}
+		insert.Tuples = append(insert.Tuples, buf.Bytes())
+
+		if field != "" {
+			key, err := tupleKey(tuple, field)
+			if err != nil {
+				return err
+			}
+			insert.Keys = append(insert.Keys, key)
+		}
+	}
+
+	rows, err := c.request(ctx, &insert)
+	if err != nil {
+		return err
+	}
+	_, err = rows.drain()
+	return err
+}
+
+// tupleKey returns the encoded value of a field. The value ends where the next field
+// starts, or at the end of the tuple.
+func tupleKey(tuple namedtuple.Tuple, field string) ([]byte, error) {
+	offset, err := tuple.Offset(field)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := tuple.Payload()
+	if offset < 0 || offset >= len(payload) {
+		return []byte{}, nil
+	}
+	end := len(payload)
+	for _, o := range tuple.Header.Offsets {
+		if next := int(o); next > offset && next < end {
+			end = next
+		}
+	}
+	return payload[offset:end], nil
+}
+
+// Event is a record received from a subscription. Offsets are counted per partition. The
+// last event on the channel has Err set if the subscription ended because of an error.
+type Event struct {
+	Partition int
+	Offset    uint64
+	Data      []byte
+	Err       error
+}
+
+// Tuple decodes the record with the types in the registry.
+func (e Event) Tuple(registry *namedtuple.Registry) (namedtuple.Tuple, error) {
+	return namedtuple.NewDecoderSize(*registry, uint64(len(e.Data)), bytes.NewReader(e.Data)).Decode()
+}
+
+// Subscribe streams the records of every partition of a log starting at the given offset
+// of each partition. Records are ordered within a partition only. Each subscription uses
+// its own channel, which is closed when the context is cancelled. The returned channel is
+// closed when the subscription ends.
+func (c *Client) Subscribe(ctx context.Context, log string, from uint64) (<-chan Event, error) {
+	return c.subscribe(ctx, &protocol.Subscribe{Log: log, Partition: protocol.AllPartitions, From: from})
+}
+
+// SubscribePartition streams the records of one partition of a log starting at the given
+// offset.
+func (c *Client) SubscribePartition(ctx context.Context, log string, partition int, from uint64) (<-chan Event, error) {
+	return c.subscribe(ctx, &protocol.Subscribe{Log: log, Partition: uint32(partition), From: from})
+}
+
+// subscribe starts a subscription on a new channel.
+func (c *Client) subscribe(ctx context.Context, subscribe *protocol.Subscribe) (<-chan Event, error) {
+	if err := c.checkOpen(ctx); err != nil {
+		return nil, err
+	}
+
+	conn, release, err := c.sideConn()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := c.openChannel(ctx, conn)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	stop := watch(ctx, ch)
+	end := func() {
+		stop()
+		ch.Close()
+		release()
+	}
+
+	// Wait for the subscription to start
+	if err := ch.enc.EncodeMessage(1, subscribe); err != nil {
+		end()
+		return nil, c.requestError(ctx, err)
+	}
+	for {
+		f, err := ch.dec.Decode()
+		if err != nil {
+			end()
+			return nil, c.requestError(ctx, err)
+		}
+
+		if f.Type == protocol.StatusFrame {
+			break
+		} else if f.Type == protocol.ErrorFrame {
+			end()
+			return nil, decodeError(f)
+		}
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer end()
+
+		for {
+			var event Event
+			f, err := ch.dec.Decode()
+			if err != nil {
+				event.Err = c.requestError(ctx, err)
+			} else if f.Type == protocol.EventFrame {
+				var e protocol.Event
+				if event.Err = e.UnmarshalBinary(f.Payload); event.Err == nil {
+					event.Partition, event.Offset, event.Data = int(e.Partition), e.Offset, e.Data
+				}
+			} else if f.Type == protocol.ErrorFrame {
+				event.Err = decodeError(f)
+			} else if f.Type == protocol.EndFrame {
+				return
+			} else {
+				continue
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+			if event.Err != nil {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// request sends a message on the client's channel and returns the response. The request
+// waits until the response to the previous request has been read, and holds the client's
+// slot until its own response has been read.
+func (c *Client) request(ctx context.Context, m protocol.Message) (*Rows, error) {
+	if err := c.checkOpen(ctx); err != nil {
+		return nil, err
+	}
+
+	select {
+	case c.slot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+
+	// Reopen the channel after a cancelled request
+	c.mutex.Lock()
+	ch, closed := c.ch, c.closed
+	c.mutex.Unlock()
+	if closed {
+		<-c.slot
+		return nil, ErrClosed
+	} else if ch == nil {
+		var err error
+		if ch, err = c.openChannel(ctx, c.conn); err != nil {
+			<-c.slot
+			return nil, err
+		}
+
+		c.mutex.Lock()
+		closed = c.closed
+		if !closed {
+			c.ch = ch
+		}
+		c.mutex.Unlock()
+		if closed {
+			ch.Close()
+			<-c.slot
+			return nil, ErrClosed
+		}
+	}
+
+	c.requestID++
+	rows := &Rows{client: c, ch: ch, ctx: ctx, requestID: c.requestID, stop: watch(ctx, ch)}
+	if err := ch.enc.EncodeMessage(c.requestID, m); err != nil {
+		rows.finish(err)
+		return nil, rows.err
+	}
+	return rows, nil
+}
+
+// release frees the client's slot after a response. Channels which failed are discarded.
+func (c *Client) release(ch *channel, broken bool) {
+	if broken {
+		ch.Close()
+		c.mutex.Lock()
+		if c.ch == ch {
+			c.ch = nil
+		}
+		c.mutex.Unlock()
+	}
+	<-c.slot
+}
+
+// checkOpen returns an error if the context is done or the client is closed.
+func (c *Client) checkOpen(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// requestError returns the error which ended a request: the context's error if it was
+// cancelled, ErrClosed if the client was closed and err otherwise.
+func (c *Client) requestError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return err
+}
+
+// sideConn returns the connection used for a subscription or an admin request, which is
+// a new connection unless Options.Redial is nil. The returned function closes it.
+func (c *Client) sideConn() (*ssh.Client, func(), error) {
+	if c.opts.Redial == nil {
+		return c.conn, func() {}, nil
+	}
+
+	conn, err := c.opts.Redial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, nil, ErrClosed
+	}
+	c.conns[conn] = struct{}{}
+
+	var once sync.Once
+	return conn, func() {
+		once.Do(func() {
+			c.mutex.Lock()
+			delete(c.conns, conn)
+			c.mutex.Unlock()
+			conn.Close()
+		})
+	}, nil
+}
+
+// openSSHChannel opens a channel on a connection. It gives up once the context is done or
+// the client is closed, as the server may not accept further channels on the connection.
+func (c *Client) openSSHChannel(ctx context.Context, conn *ssh.Client, channelType string) (ssh.Channel, error) {
+	type opened struct {
+		ch  ssh.Channel
+		err error
+	}
+	result := make(chan opened, 1)
+	go func() {
+		ch, requests, err := conn.OpenChannel(channelType, nil)
+		if err == nil {
+			go ssh.DiscardRequests(requests)
+		}
+		result <- opened{ch, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.ch, r.err
+	case <-ctx.Done():
+	case <-c.done:
+	}
+
+	// Close the channel if it is opened after all
+	go func() {
+		if r := <-result; r.err == nil {
+			r.ch.Close()
+		}
+	}()
+	return nil, c.requestError(ctx, ErrClosed)
+}
+
+// openChannel opens a kappa-client channel on a connection and performs the handshake.
+func (c *Client) openChannel(ctx context.Context, conn *ssh.Client) (*channel, error) {
+	ch, err := c.openSSHChannel(ctx, conn, "kappa-client")
+	if err != nil {
+		return nil, err
+	}
+	stop := watch(ctx, ch)
+	defer stop()
+
+	enc := protocol.NewEncoder(ch, c.opts.MaxFrameSize)
+	dec := protocol.NewDecoder(ch, c.opts.MaxFrameSize)
+	hello, err := protocol.ClientHandshake(enc, dec, protocol.CapabilityMultiStatement, c.opts.MaxFrameSize)
+	if err != nil {
+		ch.Close()
+		if e, ok := err.(*protocol.Error); ok {
+			return nil, &Error{e.Code, e.Message}
+		}
+		return nil, c.requestError(ctx, err)
+	}
+	return &channel{ch, enc, dec, hello}, nil
+}
+
+// watch closes the channel if the context is cancelled before stop is called.
+func watch(ctx context.Context, ch io.Closer) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.Close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// decodeError converts an Error frame to an *Error.
+func decodeError(f protocol.Frame) error {
+	var e protocol.Error
+	if err := e.UnmarshalBinary(f.Payload); err != nil {
+		return err
+	}
+	return &Error{e.Code, e.Message}
+}
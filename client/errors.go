@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/blacklabeldata/kappa/common"
+)
+
+var (
+	// ErrClosed is returned when a request is made after the client was closed.
+	ErrClosed = errors.New("kappa: client is closed")
+
+	// Errors matching the status codes sent by the server. Use errors.Is to compare them
+	// with the *Error values returned by requests.
+	ErrUnauthorized          = errors.New("kappa: unauthorized")
+	ErrInternalServerError   = errors.New("kappa: internal server error")
+	ErrInvalidStatement      = errors.New("kappa: invalid statement")
+	ErrNamespaceDoesNotExist = errors.New("kappa: namespace does not exist")
+	ErrUserDoesNotExist      = errors.New("kappa: user does not exist")
+	ErrCreateNamespace       = errors.New("kappa: namespace could not be created")
+	ErrProtocol              = errors.New("kappa: protocol error")
+	ErrLogDoesNotExist       = errors.New("kappa: log does not exist")
+	ErrNoClusterLeader       = errors.New("kappa: no cluster leader")
+	ErrInvalidOptions        = errors.New("kappa: invalid options")
+	ErrLogNotAvailable       = errors.New("kappa: log not available")
+	ErrNotEnoughReplicas     = errors.New("kappa: not enough replicas")
+	ErrPartitionDoesNotExist = errors.New("kappa: partition does not exist")
+	ErrKeyRequired           = errors.New("kappa: key required")
+)
+
+var statusErrors = map[common.StatusCode]error{
+	common.Unauthorized:          ErrUnauthorized,
+	common.InternalServerError:   ErrInternalServerError,
+	common.InvalidStatementType:  ErrInvalidStatement,
+	common.NamespaceDoesNotExist: ErrNamespaceDoesNotExist,
+	common.UserDoesNotExist:      ErrUserDoesNotExist,
+	common.CreateNamespaceError:  ErrCreateNamespace,
+	common.ProtocolError:         ErrProtocol,
+	common.LogDoesNotExist:       ErrLogDoesNotExist,
+	common.NoClusterLeader:       ErrNoClusterLeader,
+	common.InvalidOptions:        ErrInvalidOptions,
+	common.LogNotAvailable:       ErrLogNotAvailable,
+	common.NotEnoughReplicas:     ErrNotEnoughReplicas,
+	common.PartitionDoesNotExist: ErrPartitionDoesNotExist,
+	common.KeyRequired:           ErrKeyRequired,
+}
+
+// Error is a failure reported by the server.
+type Error struct {
+	Code    common.StatusCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	if len(e.Message) == 0 {
+		return "kappa: " + e.Code.String()
+	}
+	return "kappa: " + e.Code.String() + ": " + e.Message
+}
+
+// Is reports whether the error's status code corresponds to the target error.
+func (e *Error) Is(target error) bool {
+	err, ok := statusErrors[e.Code]
+	return ok && err == target
+}
+
+// Result is the status of a single statement.
+type Result struct {
+	Code    common.StatusCode
+	Message string
+
+	// Columns are the column names of the statement's result set, which is nil if the
+	// statement returned no result set. They are set even if the result set has no rows.
+	Columns []string
+}
+
+// Err returns an *Error if the status code is an error code.
+func (r Result) Err() error {
+	if r.Code < common.Unauthorized {
+		return nil
+	}
+	return &Error{r.Code, r.Message}
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blacklabeldata/kappa/protocol"
+)
+
+// Rows iterates over the rows returned by a query. Status codes are collected as each
+// statement finishes and are available from Results once Next returns false.
+type Rows struct {
+	client    *Client
+	ch        *channel
+	ctx       context.Context
+	requestID uint32
+	stop      func()
+
+	columns []string
+	header  []string
+	values  []string
+	results []Result
+	err     error
+	done    bool
+}
+
+// Next reads the next row and returns false when there are no more rows or an error occurred.
+func (r *Rows) Next() bool {
+	for !r.done {
+		if err := r.ctx.Err(); err != nil {
+			r.finish(err)
+			return false
+		}
+
+		f, err := r.ch.dec.Decode()
+		if err != nil {
+			r.finish(err)
+			return false
+		} else if f.RequestID != r.requestID {
+
+			// Errors for request 0 are sent before the server closes the channel
+			if f.Type == protocol.ErrorFrame {
+				r.finish(decodeError(f))
+			} else {
+				r.finish(fmt.Errorf("kappa: unexpected response for request %d", f.RequestID))
+			}
+			return false
+		}
+
+		switch f.Type {
+		case protocol.ColumnHeaderFrame:
+			var header protocol.ColumnHeader
+			if err := header.UnmarshalBinary(f.Payload); err != nil {
+				r.finish(err)
+				return false
+			}
+			r.columns, r.header = header.Columns, header.Columns
+
+		case protocol.RowFrame:
+			row := protocol.Row{Columns: r.columns}
+			if err := row.UnmarshalBinary(f.Payload); err != nil {
+				r.finish(err)
+				return false
+			}
+			r.values = row.Values
+			return true
+
+		case protocol.StatusFrame:
+			var status protocol.Status
+			if err := status.UnmarshalBinary(f.Payload); err != nil {
+				r.finish(err)
+				return false
+			}
+			r.results = append(r.results, Result{status.Code, status.Message, r.header})
+			r.header = nil
+
+		case protocol.ErrorFrame:
+			var e protocol.Error
+			if err := e.UnmarshalBinary(f.Payload); err != nil {
+				r.finish(err)
+				return false
+			}
+			r.results = append(r.results, Result{e.Code, e.Message, r.header})
+			r.header = nil
+
+		case protocol.EndFrame:
+			r.finish(nil)
+
+		default:
+			r.finish(fmt.Errorf("kappa: unexpected %s frame", f.Type))
+		}
+	}
+	return false
+}
+
+// Columns returns the column names of the current result set.
+func (r *Rows) Columns() []string {
+	return r.columns
+}
+
+// Values returns the values of the current row.
+func (r *Rows) Values() []string {
+	return r.values
+}
+
+// Scan copies the values of the current row into dest.
+func (r *Rows) Scan(dest ...*string) error {
+	if len(dest) != len(r.values) {
+		return fmt.Errorf("kappa: expected %d destinations, got %d", len(r.values), len(dest))
+	}
+	for i, value := range r.values {
+		*dest[i] = value
+	}
+	return nil
+}
+
+// Results returns the status of each statement which has finished.
+func (r *Rows) Results() []Result {
+	return r.results
+}
+
+// Err returns the error which stopped the iteration, or the first statement which failed.
+func (r *Rows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	for _, result := range r.results {
+		if err := result.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close reads the remaining rows so the client can send another request.
+func (r *Rows) Close() error {
+	for r.Next() {
+	}
+	return r.err
+}
+
+// drain closes the rows and returns the status of the last statement.
+func (r *Rows) drain() (Result, error) {
+	r.Close()
+
+	var last Result
+	if len(r.results) > 0 {
+		last = r.results[len(r.results)-1]
+	}
+	return last, r.Err()
+}
+
+// finish ends the response and releases the client. Errors other than statement failures
+// leave the channel in an unknown state, so it is closed.
+func (r *Rows) finish(err error) {
+	if r.done {
+		return
+	}
+	r.done = true
+	r.stop()
+
+	if err != nil {
+		r.err = r.client.requestError(r.ctx, err)
+	}
+	r.client.release(r.ch, err != nil)
+}
@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/blacklabeldata/kappa/auth"
+)
+
+// CertStatusCmd lists the certificates in the PKI directory.
+var CertStatusCmd = &cobra.Command{
+	Use:   "cert-status",
+	Short: "cert-status lists all certificates with their expiry and CA chain status",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Create logger
+		writer := log.NewConcurrentWriter(os.Stderr)
+		logger := log.NewLogger(writer, "cert-status")
+
+		err := InitializeConfig(writer)
+		if err != nil {
+			return
+		}
+
+		// Find certificates
+		pki := path.Join(".", "pki")
+		caFile := path.Join(pki, "ca.crt")
+		files, err := filepath.Glob(path.Join(pki, "public", "*.crt"))
+		if err != nil {
+			logger.Warn("Error listing certificates", "err", err.Error())
+			return
+		}
+		files = append([]string{caFile}, files...)
+
+		// Load CA certificates for chain verification
+		roots, intermediates, err := auth.LoadCertPool(caFile)
+		if err != nil {
+			logger.Warn("Error reading CA certificate", "file", caFile, "err", err.Error())
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSUBJECT\tHOSTS\tEXPIRES\tSTATUS")
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), ".crt")
+
+			chain, err := auth.ReadCertificateChain(file)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t\t\t\tunreadable: %s\n", name, err)
+				continue
+			}
+
+			cert := chain[0]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, cert.Subject.String(), auth.CertificateHosts(cert),
+				cert.NotAfter.Local().Format("2006-01-02"), certificateStatus(chain, roots, intermediates, viper.GetDuration("CertExpiryWarning")))
+		}
+		w.Flush()
+	},
+}
+
+// certificateStatus describes the expiry and CA chain status of a certificate.
+func certificateStatus(chain []*x509.Certificate, roots, intermediates *x509.CertPool, warning time.Duration) string {
+	cert := chain[0]
+	days := int(cert.NotAfter.Sub(time.Now()).Hours() / 24)
+
+	switch {
+	case auth.ExpiresWithin(cert, 0):
+		return "expired"
+	case roots == nil:
+		return "unverified: CA certificate unavailable"
+	}
+
+	if err := auth.VerifyCertificate(chain, roots, intermediates); err != nil {
+		return "invalid: " + err.Error()
+	} else if auth.ExpiresWithin(cert, warning) {
+		return fmt.Sprintf("valid, expires in %d days", days)
+	}
+	return "valid"
+}
+
+// Pointer to CertStatusCmd used in initialization
+var certStatusCmd *cobra.Command
+
+// Command line args
+var (
+	CertExpiryWarning time.Duration
+)
+
+func init() {
+	CertStatusCmd.PersistentFlags().DurationVarP(&CertExpiryWarning, "expiry-warning", "", 30*24*time.Hour, "Warn about certificates which expire within this duration")
+	certStatusCmd = CertStatusCmd
+}
+
+// InitializeCertStatusConfig sets up the command line options for listing certificates
+func InitializeCertStatusConfig(logger log.Logger) error {
+	viper.SetDefault("CertExpiryWarning", "720h")
+	viper.BindEnv("CertExpiryWarning", "KAPPA_CERT_EXPIRY_WARNING")
+
+	if certStatusCmd.PersistentFlags().Lookup("expiry-warning").Changed {
+		logger.Info("", "CertExpiryWarning", CertExpiryWarning)
+		viper.Set("CertExpiryWarning", CertExpiryWarning)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/viper"
+
+	"github.com/blacklabeldata/kappa/auth"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultIdentityFiles are tried when no identity file is given. Files which are missing or
+// cannot be read are skipped.
+var defaultIdentityFiles = []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"}
+
+// identityFiles is a flag which may be repeated to try several private keys in order.
+type identityFiles []string
+
+func (i *identityFiles) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *identityFiles) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func (i *identityFiles) Type() string {
+	return "identityFiles"
+}
+
+// clientAuth returns the keys used to authenticate: those held by the ssh-agent listening
+// on SSH_AUTH_SOCK, followed by the identity files. Identity files which were not set
+// explicitly are skipped if they do not exist or cannot be read, so that the agent keys
+// can still be used. The returned function closes the agent connection once the handshake
+// is complete.
+func clientAuth(logger log.Logger, keyFiles []string, explicit bool) (ssh.AuthMethod, func(), error) {
+	var signers []ssh.Signer
+	closeAgent := func() {}
+
+	// Use the keys held by ssh-agent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" && !viper.GetBool("NoAgent") {
+		if conn, err := net.Dial("unix", sock); err != nil {
+			logger.Debug("Error connecting to ssh-agent", "err", err.Error())
+		} else if agentSigners, err := agent.NewClient(conn).Signers(); err != nil {
+			logger.Debug("Error listing ssh-agent keys", "err", err.Error())
+			conn.Close()
+		} else {
+			signers = append(signers, agentSigners...)
+			closeAgent = func() { conn.Close() }
+		}
+	}
+
+	// Read identity files, prompting for the passphrase of encrypted keys
+	for _, keyFile := range keyFiles {
+		keyFile = expandHome(keyFile)
+		if _, err := os.Stat(keyFile); os.IsNotExist(err) && !explicit {
+			continue
+		}
+
+		signer, err := auth.ReadEncryptedPrivateKey(logger, keyFile, keyPassphrase)
+		if err != nil && !explicit {
+			logger.Info("Skipping identity file", "file", keyFile, "err", err.Error())
+			continue
+		} else if err != nil {
+			closeAgent()
+			return nil, nil, fmt.Errorf("Error reading private key %s: %s", keyFile, err.Error())
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		closeAgent()
+		return nil, nil, errors.New("No identities found - start ssh-agent or set an identity file with -i")
+	}
+
+	// Keys are offered in order by a single method since the SSH client does not retry
+	// methods of the same type
+	return ssh.PublicKeys(signers...), closeAgent, nil
+}
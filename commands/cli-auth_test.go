@@ -0,0 +1,57 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/blacklabeldata/kappa/auth"
+)
+
+func TestClientAuth_DefaultIdentityFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-commands")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	// The encrypted key is read with the wrong passphrase rather than prompting for one
+	viper.Set("Passphrase", "wrong")
+	defer viper.Set("Passphrase", "")
+
+	// Write a valid key, an encrypted key, an invalid key and an unreadable directory
+	key, err := auth.GenerateKey(auth.KeyTypeEd25519, 0)
+	assert.Nil(t, err)
+	valid, encrypted := filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "id_ecdsa")
+	assert.Nil(t, auth.SavePrivateKey(log.NullLog, key, valid))
+	assert.Nil(t, auth.SaveEncryptedPrivateKey(log.NullLog, key, encrypted, []byte("secret")))
+	invalid := filepath.Join(dir, "id_rsa")
+	assert.Nil(t, ioutil.WriteFile(invalid, []byte("not a key"), 0600))
+	missing := filepath.Join(dir, "id_dsa")
+
+	// Default files which cannot be used are skipped
+	method, closeAgent, err := clientAuth(log.NullLog, []string{invalid, encrypted, dir, missing, valid}, false)
+	if assert.Nil(t, err) {
+		assert.NotNil(t, method)
+		closeAgent()
+	}
+
+	_, _, err = clientAuth(log.NullLog, []string{invalid, encrypted, missing}, false)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "No identities found")
+	}
+
+	// Identity files given explicitly must be usable
+	_, _, err = clientAuth(log.NullLog, []string{invalid, valid}, true)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Error reading private key "+invalid)
+	}
+	_, _, err = clientAuth(log.NullLog, []string{missing}, true)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/eliquious/lexer"
+	"github.com/subsilent/crypto/ssh/terminal"
+
+	"github.com/blacklabeldata/kappa/skl"
+)
+
+// completionTimeout limits the time spent fetching names from the server
+const completionTimeout = 2 * time.Second
+
+// grammarNode is a position in a statement. Keywords lead to the following positions,
+// while names are listed with a SHOW statement such as SHOW NAMESPACES.
+type grammarNode struct {
+	keywords map[lexer.Token]*grammarNode
+	names    lexer.Token
+}
+
+// statementGrammar describes the statements understood by the parser.
+var statementGrammar = &grammarNode{keywords: map[lexer.Token]*grammarNode{
+	skl.USE: {names: skl.NAMESPACES},
+	skl.CREATE: {keywords: map[lexer.Token]*grammarNode{
+		skl.NAMESPACE: {},
+		skl.LOG:       {},
+	}},
+	skl.DROP: {keywords: map[lexer.Token]*grammarNode{
+		skl.NAMESPACE: {names: skl.NAMESPACES},
+	}},
+	skl.SHOW: {keywords: map[lexer.Token]*grammarNode{
+		skl.NAMESPACES: {},
+		skl.LOGS:       {},
+		skl.PARTITIONS: {names: skl.LOGS},
+		skl.NODES:      {},
+		skl.CLUSTER: {keywords: map[lexer.Token]*grammarNode{
+			skl.HEALTH: {},
+		}},
+		skl.SESSIONS: {keywords: map[lexer.Token]*grammarNode{
+			skl.ON: {keywords: map[lexer.Token]*grammarNode{
+				skl.CLUSTER: {},
+			}},
+		}},
+	}},
+}}
+
+// completer completes keywords and names when Tab is pressed. Names are fetched from the
+// server for the session namespace and cached until the next statement is executed.
+type completer struct {
+	session *clientSession
+	term    *terminal.Terminal
+	names   map[lexer.Token][]string
+
+	// continued holds the previous lines of a statement spanning several lines
+	continued string
+}
+
+func newCompleter(session *clientSession, term *terminal.Terminal) *completer {
+	return &completer{session: session, term: term, names: make(map[lexer.Token][]string)}
+}
+
+// reset clears the cached names after a statement which may have changed them.
+func (c *completer) reset() {
+	c.names = make(map[lexer.Token][]string)
+}
+
+// complete is the terminal's AutoCompleteCallback. A single match is completed, while
+// several matches are completed to their common prefix or listed below the prompt.
+func (c *completer) complete(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	// Split the current statement into the words before the cursor and the word being typed
+	head := line[:pos]
+	stmt := head[strings.LastIndex(head, ";")+1:]
+	words := strings.Fields(stmt)
+	if !strings.Contains(head, ";") {
+		words = append(strings.Fields(c.continued), words...)
+	}
+	var partial string
+	if len(stmt) > 0 && !unicode.IsSpace(rune(stmt[len(stmt)-1])) && len(words) > 0 {
+		partial = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	// Find the candidates which match the word being typed
+	var matches []string
+	for _, candidate := range c.candidates(words) {
+		if len(candidate) >= len(partial) && strings.EqualFold(candidate[:len(partial)], partial) {
+			matches = append(matches, candidate)
+		}
+	}
+
+	var completion string
+	switch len(matches) {
+	case 0:
+		return "", 0, false
+	case 1:
+		completion = matches[0] + " "
+	default:
+		completion = commonPrefix(matches)
+		if len(completion) <= len(partial) {
+			c.term.Write([]byte(" " + strings.Join(matches, "  ") + "\r\n"))
+			return "", 0, false
+		}
+	}
+
+	start := len(head) - len(partial)
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+// candidates returns the keywords or names which may follow the given words.
+func (c *completer) candidates(words []string) []string {
+	node := statementGrammar
+	for _, word := range words {
+		next, ok := node.keywords[lexer.Lookup(word)]
+		if !ok {
+			return nil
+		}
+		node = next
+	}
+
+	if node.names != 0 {
+		return c.fetchNames(node.names)
+	}
+
+	keywords := make([]string, 0, len(node.keywords))
+	for tok := range node.keywords {
+		keywords = append(keywords, tok.String())
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+// fetchNames lists names with a SHOW statement. Errors are ignored so completion never
+// interrupts the prompt.
+func (c *completer) fetchNames(tok lexer.Token) []string {
+	if names, ok := c.names[tok]; ok {
+		return names
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+
+	rows, err := c.session.client.Query(ctx, skl.SHOW.String()+" "+tok.String())
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for rows.Next() {
+		if values := rows.Values(); len(values) > 0 {
+			names = append(names, values[0])
+		}
+	}
+	if err := rows.Close(); err != nil || rows.Err() != nil {
+		return nil
+	}
+
+	sort.Strings(names)
+	c.names[tok] = names
+	return names
+}
+
+// commonPrefix returns the longest prefix shared by the strings, ignoring case.
+func commonPrefix(values []string) string {
+	prefix := values[0]
+	for _, value := range values[1:] {
+		i := 0
+		for i < len(prefix) && i < len(value) && unicode.ToLower(rune(prefix[i])) == unicode.ToLower(rune(value[i])) {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	return prefix
+}
@@ -0,0 +1,258 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+
+	cli "github.com/blacklabeldata/kappa/client"
+	"github.com/blacklabeldata/kappa/common"
+)
+
+// Output formats supported by the client
+const (
+	tableFormat = "table"
+	jsonFormat  = "json"
+	jsonlFormat = "jsonl"
+	csvFormat   = "csv"
+)
+
+var outputFormats = []string{tableFormat, jsonFormat, jsonlFormat, csvFormat}
+
+// clientColors returns the color palette, which is empty if --no-color is set.
+func clientColors() common.ColorCodes {
+	if viper.GetBool("NoColor") {
+		return common.NoColorCodes
+	}
+	return common.DefaultColorCodes
+}
+
+// output renders the results of statements. Tables are written with colored status codes,
+// while the JSON and CSV formats only write data to out so they can be piped into other
+// tools. Status codes of failed statements are written to errOut in those formats.
+type output struct {
+	format string
+	colors common.ColorCodes
+	out    io.Writer
+	errOut io.Writer
+}
+
+// checkFormat returns an error if the output format is not supported.
+func checkFormat(format string) error {
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q - expected one of %s", format, strings.Join(outputFormats, ", "))
+}
+
+// setFormat changes the output format.
+func (o *output) setFormat(format string) error {
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+	o.format = format
+	return nil
+}
+
+// resultSet holds the rows of a result set until it can be rendered.
+type resultSet struct {
+	columns []string
+	rows    [][]string
+}
+
+// runQuery executes a statement and writes its rows and status codes. It returns whether
+// a statement failed, and errors which are not statement failures.
+func runQuery(client *cli.Client, statement string, o *output) (failed bool, err error) {
+	rows, err := client.Query(context.Background(), statement)
+	if err != nil {
+		return false, err
+	}
+
+	// Statuses arrive after the rows of their statement, so a new status marks the end of
+	// the previous result set
+	var set resultSet
+	written := 0
+	flush := func() {
+		for _, result := range rows.Results()[written:] {
+			failed = o.writeStatement(&set, result) || failed
+		}
+		written = len(rows.Results())
+	}
+
+	for rows.Next() {
+		if len(rows.Results()) > written {
+			flush()
+		}
+		set.columns = rows.Columns()
+
+		// JSON lines are written as they arrive, so subscriptions can be followed
+		if o.format == jsonlFormat {
+			o.writeResultSet(resultSet{columns: set.columns, rows: [][]string{rows.Values()}})
+			continue
+		}
+		set.rows = append(set.rows, rows.Values())
+	}
+	if err := rows.Close(); err != nil {
+		return false, err
+	}
+	flush()
+	if len(set.rows) > 0 {
+		o.writeResultSet(set)
+	}
+	return failed, nil
+}
+
+// writeStatement writes the result set read for a statement which finished, followed by
+// its status code, and returns whether it failed. Result sets without rows are written
+// as well, so their column header or empty array is not lost.
+func (o *output) writeStatement(set *resultSet, result cli.Result) bool {
+	if len(set.rows) > 0 || result.Columns != nil {
+		if len(set.rows) == 0 {
+			set.columns = result.Columns
+		}
+		o.writeResultSet(*set)
+		*set = resultSet{}
+	}
+	return o.writeResult(result)
+}
+
+// writeResult writes the status code of a statement and returns whether it failed.
+func (o *output) writeResult(result cli.Result) bool {
+	if result.Err() == nil {
+		if o.format == tableFormat {
+			w := common.ResponseWriter{Colors: o.colors, Writer: o.out}
+			writeStatus(w.Success, result.Code, result.Message)
+		}
+		return false
+	}
+
+	w := common.ResponseWriter{Colors: o.colors, Writer: o.out}
+	if o.format != tableFormat {
+		w.Writer = o.errOut
+	}
+	writeStatus(w.Fail, result.Code, result.Message)
+	return true
+}
+
+// writeTiming writes the time taken by a statement. It is written with status codes so
+// that the JSON and CSV output only contains rows.
+func (o *output) writeTiming(d time.Duration) {
+	w := o.out
+	if o.format != tableFormat {
+		w = o.errOut
+	}
+	w.Write([]byte(" Time: " + d.String() + "\r\n"))
+}
+
+// writeStatus writes a status code with an optional message.
+func writeStatus(write func(common.StatusCode, string, ...interface{}), code common.StatusCode, message string) {
+	if len(message) == 0 {
+		write(code, "")
+	} else {
+		write(code, "%s", message)
+	}
+}
+
+// writeResultSet renders the rows of a result set in the current format.
+func (o *output) writeResultSet(set resultSet) {
+	switch o.format {
+	case tableFormat:
+		o.writeTable(set)
+
+	case jsonFormat:
+		objects := make([][]byte, len(set.rows))
+		for i, row := range set.rows {
+			objects[i] = jsonObject(set.columns, row)
+		}
+		o.out.Write([]byte("["))
+		o.out.Write(bytes.Join(objects, []byte(",")))
+		o.out.Write([]byte("]\r\n"))
+
+	case jsonlFormat:
+		for _, row := range set.rows {
+			o.out.Write(jsonObject(set.columns, row))
+			o.out.Write([]byte("\r\n"))
+		}
+
+	case csvFormat:
+		w := csv.NewWriter(o.out)
+		w.UseCRLF = true
+		w.Write(set.columns)
+		w.WriteAll(set.rows)
+	}
+}
+
+// writeTable writes a result set as aligned columns below a header.
+func (o *output) writeTable(set resultSet) {
+
+	// Size columns to fit the widest value
+	widths := make([]int, len(set.columns))
+	for i, name := range set.columns {
+		widths[i] = utf8.RuneCountInString(name)
+	}
+	for _, row := range set.rows {
+		for i, value := range row {
+			if i < len(widths) && utf8.RuneCountInString(value) > widths[i] {
+				widths[i] = utf8.RuneCountInString(value)
+			}
+		}
+	}
+
+	writeLine := func(color []byte, values []string, sep string) {
+		cells := make([]string, len(widths))
+		for i, width := range widths {
+			var value string
+			if i < len(values) {
+				value = values[i]
+			}
+			cells[i] = value + strings.Repeat(" ", width-utf8.RuneCountInString(value))
+		}
+		o.out.Write(color)
+		o.out.Write([]byte(" " + strings.TrimRight(strings.Join(cells, sep), " ")))
+		o.out.Write(o.colors.Reset)
+		o.out.Write([]byte("\r\n"))
+	}
+
+	dashes := make([]string, len(widths))
+	for i, width := range widths {
+		dashes[i] = strings.Repeat("-", width)
+	}
+
+	writeLine(o.colors.LightCyan, set.columns, " | ")
+	writeLine(o.colors.LightGrey, dashes, "-+-")
+	for _, row := range set.rows {
+		writeLine(o.colors.LightYellow, row, " | ")
+	}
+}
+
+// jsonObject encodes a row as a JSON object, keeping the order of the columns.
+func jsonObject(columns, values []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		key, _ := json.Marshal(name)
+		val, _ := json.Marshal(value)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
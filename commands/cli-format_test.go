@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	cli "github.com/blacklabeldata/kappa/client"
+	"github.com/blacklabeldata/kappa/common"
+)
+
+func TestWriteStatement_EmptyResultSet(t *testing.T) {
+	result := cli.Result{Code: common.OK, Columns: []string{"log", "partition"}}
+
+	for format, expected := range map[string]string{
+		jsonFormat:  "[]\r\n",
+		csvFormat:   "log,partition\r\n",
+		jsonlFormat: "",
+		tableFormat: " log | partition\r\n ----+----------\r\n OK (2000)\r\n",
+	} {
+		var out, errOut bytes.Buffer
+		o := &output{format: format, colors: common.NoColorCodes, out: &out, errOut: &errOut}
+
+		var set resultSet
+		assert.False(t, o.writeStatement(&set, result))
+		assert.Equal(t, expected, out.String(), format)
+		assert.Empty(t, errOut.String(), format)
+	}
+}
+
+func TestWriteStatement_Rows(t *testing.T) {
+	var out, errOut bytes.Buffer
+	o := &output{format: jsonFormat, colors: common.NoColorCodes, out: &out, errOut: &errOut}
+
+	// Rows are written with the column names read with them
+	set := resultSet{columns: []string{"namespace"}, rows: [][]string{{"acme"}}}
+	assert.False(t, o.writeStatement(&set, cli.Result{Code: common.OK, Columns: []string{"namespace"}}))
+	assert.Equal(t, `[{"namespace":"acme"}]`+"\r\n", out.String())
+	assert.Equal(t, resultSet{}, set)
+
+	// Statements without a result set only write their status
+	out.Reset()
+	assert.True(t, o.writeStatement(&set, cli.Result{Code: common.NamespaceDoesNotExist, Message: "acme"}))
+	assert.Empty(t, out.String())
+	assert.NotEmpty(t, errOut.String())
+}
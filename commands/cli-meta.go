@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/viper"
+
+	cli "github.com/blacklabeldata/kappa/client"
+)
+
+// metaCommands are the backslash commands understood by the client
+var metaCommands = []struct {
+	name, args, description string
+}{
+	{`\connect`, "<profile|url>", "Connect to another server"},
+	{`\use`, "<namespace>", "Select the session namespace"},
+	{`\format`, "[table|json|jsonl|csv]", "Show or change the output format"},
+	{`\timing`, "[on|off]", "Show the time taken by each statement"},
+	{`\source`, "<file>", "Execute the statements in a file"},
+	{`\help`, "", "Show this help"},
+}
+
+// clientSession holds the connection and settings shared by the prompt and scripts.
+type clientSession struct {
+	logger log.Logger
+	client *cli.Client
+	out    *output
+	timing bool
+}
+
+// execute runs a statement and writes the results. It returns whether a statement failed,
+// and errors which are not statement failures.
+func (s *clientSession) execute(statement string) (failed bool, err error) {
+	start := time.Now()
+	if failed, err = runQuery(s.client, statement, s.out); err != nil {
+		return
+	}
+	if s.timing {
+		s.out.writeTiming(time.Since(start))
+	}
+	return
+}
+
+// command runs a meta-command. Statement failures are written like those of other
+// statements and reported by the failed result.
+func (s *clientSession) command(line string) (failed bool, err error) {
+	fields := strings.Fields(line)
+	args := fields[1:]
+	switch fields[0] {
+	case `\connect`:
+		if len(args) != 1 {
+			return false, usageError(fields[0])
+		}
+		client, err := connect(s.logger, args[0])
+		if err != nil {
+			return false, err
+		}
+		s.client.Close()
+		s.client = client
+		s.out.out.Write([]byte(" Connected to " + args[0] + "\r\n"))
+
+	case `\use`:
+		if len(args) != 1 {
+			return false, usageError(fields[0])
+		}
+		return s.execute("USE " + args[0])
+
+	case `\format`:
+		if len(args) == 0 {
+			s.out.out.Write([]byte(" Output format: " + s.out.format + "\r\n"))
+		} else if len(args) > 1 {
+			return false, usageError(fields[0])
+		} else {
+			return false, s.out.setFormat(args[0])
+		}
+
+	case `\timing`:
+		if len(args) > 1 || len(args) == 1 && args[0] != "on" && args[0] != "off" {
+			return false, usageError(fields[0])
+		}
+		s.timing = !s.timing
+		if len(args) == 1 {
+			s.timing = args[0] == "on"
+		}
+		if s.timing {
+			s.out.out.Write([]byte(" Timing is on\r\n"))
+		} else {
+			s.out.out.Write([]byte(" Timing is off\r\n"))
+		}
+
+	case `\source`:
+		if len(args) != 1 {
+			return false, usageError(fields[0])
+		}
+		file, err := os.Open(expandHome(args[0]))
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+
+		runner := scriptRunner{session: s, errOut: s.out.errOut, continueOnError: viper.GetBool("ContinueOnError")}
+		runner.run(args[0], file)
+		return runner.failed, nil
+
+	case `\help`:
+		for _, c := range metaCommands {
+			s.out.out.Write([]byte(fmt.Sprintf(" %-32s %s\r\n", c.name+" "+c.args, c.description)))
+		}
+
+	default:
+		return false, fmt.Errorf(`unknown command %s - use \help to list commands`, fields[0])
+	}
+	return false, nil
+}
+
+// usageError returns the usage of a meta-command.
+func usageError(name string) error {
+	for _, c := range metaCommands {
+		if c.name == name {
+			return fmt.Errorf("usage: %s %s", c.name, c.args)
+		}
+	}
+	return fmt.Errorf("unknown command %s", name)
+}
@@ -0,0 +1,167 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+
+	cli "github.com/blacklabeldata/kappa/client"
+	"golang.org/x/crypto/ssh"
+)
+
+// clientProfile is a named connection in the client configuration file:
+//
+//	profiles:
+//	  prod:
+//	    hosts:
+//	      - db1.example.com:9022
+//	      - db2.example.com:9022
+//	    user: admin
+//	    identity-file: ~/.kappa/prod.key
+//	    namespace: acme.prod
+type clientProfile struct {
+	Hosts        []string `yaml:"hosts"`
+	User         string   `yaml:"user"`
+	IdentityFile string   `yaml:"identity-file"`
+	Namespace    string   `yaml:"namespace"`
+}
+
+// connection describes the server to connect to. Hosts are tried in order.
+type connection struct {
+	hosts        []string
+	user         string
+	keyFiles     []string
+	explicitKeys bool
+	namespace    string
+}
+
+// readProfiles reads the profiles in the client configuration file. A missing file
+// defines no profiles unless it was set explicitly.
+func readProfiles() (map[string]clientProfile, error) {
+	filename := expandHome(viper.GetString("ClientConfig"))
+	if _, err := os.Stat(filename); os.IsNotExist(err) && !clientCmd.PersistentFlags().Lookup("client-config").Changed {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Profiles map[string]clientProfile `yaml:"profiles"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Error reading profiles in %s: %s", filename, err.Error())
+	}
+	return config.Profiles, nil
+}
+
+// resolveTarget returns the connection for an ssh://username@host:port URL or the name of a
+// profile. Identity files given with -i take precedence over the profile's.
+func resolveTarget(target string) (connection, error) {
+	conn := connection{
+		keyFiles:     viper.GetStringSlice("ClientKeys"),
+		explicitKeys: clientCmd.PersistentFlags().Lookup("identity-file").Changed,
+	}
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return conn, fmt.Errorf("Error parsing host - expected format ssh://username@host:port : %s", err.Error())
+		} else if u.User == nil || u.User.Username() == "" {
+			return conn, errors.New("Missing username - expected format: ssh://username@host:port")
+		}
+		conn.hosts, conn.user = []string{u.Host}, u.User.Username()
+		return conn, nil
+	}
+
+	profiles, err := readProfiles()
+	if err != nil {
+		return conn, err
+	}
+	profile, ok := profiles[target]
+	if !ok {
+		return conn, fmt.Errorf("Unknown profile %q - expected a profile name or ssh://username@host:port", target)
+	} else if len(profile.Hosts) == 0 || profile.User == "" {
+		return conn, fmt.Errorf("Profile %q requires hosts and a user", target)
+	}
+
+	conn.hosts, conn.user, conn.namespace = profile.Hosts, profile.User, profile.Namespace
+	if profile.IdentityFile != "" && !conn.explicitKeys {
+		conn.keyFiles, conn.explicitKeys = []string{profile.IdentityFile}, true
+	}
+	return conn, nil
+}
+
+// connect resolves the target and connects to the first of its hosts which accepts the
+// connection. The profile's default namespace is selected once connected.
+func connect(logger log.Logger, target string) (*cli.Client, error) {
+	conn, err := resolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticate with ssh-agent and identity files
+	authMethod, closeAgent, err := clientAuth(logger, conn.keyFiles, conn.explicitKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the server's host key
+	hostKeyCallback, err := clientHostKeyCallback()
+	if err != nil {
+		return nil, fmt.Errorf("Host key verification could not be configured: %s", err.Error())
+	}
+	config := &ssh.ClientConfig{
+		User:            conn.user,
+		Auth:            []ssh.AuthMethod{authMethod},
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	// Connect to the first host which accepts the connection
+	var sshConn *ssh.Client
+	var addr string
+	for _, addr = range conn.hosts {
+		if sshConn, err = ssh.Dial("tcp", addr, config); err == nil {
+			break
+		}
+		logger.Debug("Error connecting to host", "host", addr, "err", err.Error())
+	}
+	if err != nil {
+		closeAgent()
+		return nil, fmt.Errorf("Error connecting to server: %s", err.Error())
+	}
+
+	// Subscriptions and cluster administration connect to the same host, so the agent is
+	// kept until the client is closed
+	go func() {
+		sshConn.Wait()
+		closeAgent()
+	}()
+	client, err := cli.NewClient(sshConn, cli.Options{
+		HostKeyCallback: hostKeyCallback,
+		Redial: func() (*ssh.Client, error) {
+			return ssh.Dial("tcp", addr, config)
+		},
+	})
+	if err != nil {
+		sshConn.Close()
+		return nil, fmt.Errorf("Error connecting to server: %s", err.Error())
+	}
+
+	if conn.namespace != "" {
+		if _, err := client.Exec(context.Background(), "USE "+conn.namespace); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
@@ -0,0 +1,197 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/subsilent/crypto/ssh/terminal"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/skl"
+)
+
+// interactive determines if the client should start a REPL. Statements given with
+// --execute or --file, or piped on stdin, are executed without one.
+func interactive() bool {
+	return viper.GetString("Execute") == "" && viper.GetString("ScriptFile") == "" && terminal.IsTerminal(0)
+}
+
+// runScripts executes the statements given with --execute, then those in the --file
+// script, or otherwise those read from stdin. It returns false if any statement failed.
+func runScripts(session *clientSession) bool {
+	session.out = &output{
+		format: viper.GetString("Format"),
+		colors: common.NoColorCodes,
+		out:    common.NewlineWriter(os.Stdout),
+		errOut: common.NewlineWriter(os.Stderr),
+	}
+	if terminal.IsTerminal(1) {
+		session.out.colors = clientColors()
+	}
+	runner := scriptRunner{session: session, errOut: session.out.errOut, continueOnError: viper.GetBool("ContinueOnError")}
+
+	execute, scriptFile := viper.GetString("Execute"), viper.GetString("ScriptFile")
+	if execute == "" && scriptFile == "" {
+		runner.run("stdin", os.Stdin)
+		return !runner.failed
+	}
+
+	if execute != "" && !runner.run("execute", strings.NewReader(execute)) {
+		return false
+	}
+	if scriptFile != "" {
+		file, err := os.Open(scriptFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return false
+		}
+		defer file.Close()
+		runner.run(scriptFile, file)
+	}
+	return !runner.failed
+}
+
+// scriptRunner executes the statements and meta-commands read by a statementScanner.
+type scriptRunner struct {
+	session         *clientSession
+	errOut          io.Writer
+	continueOnError bool
+	failed          bool
+}
+
+// run executes the statements read from r and returns false if execution should stop.
+func (s *scriptRunner) run(name string, r io.Reader) bool {
+	scanner := newStatementScanner(r)
+	for scanner.Scan() {
+		lineNum, text := scanner.Line(), scanner.Text()
+
+		// Run meta-commands
+		if strings.HasPrefix(text, `\`) {
+			failed, err := s.session.command(text)
+			if err != nil {
+				fmt.Fprintf(s.errOut, "%s:%d: %s\r\n", name, lineNum, err.Error())
+				failed = true
+			}
+			if failed {
+				s.failed = true
+				if !s.continueOnError {
+					return false
+				}
+			}
+			continue
+		}
+
+		// Parse statements
+		stmts, err := skl.ParseStatements(text)
+		if err != nil {
+			fmt.Fprintf(s.errOut, "%s:%d: %s\r\n", name, lineNum, err.Error())
+			s.failed = true
+			if !s.continueOnError {
+				return false
+			}
+			continue
+		}
+
+		// Execute statements
+		for _, stmt := range stmts {
+			failed, err := s.session.execute(stmt.String())
+			if err != nil {
+
+				// The connection cannot be used after other errors
+				fmt.Fprintf(s.errOut, "%s:%d: %s\r\n", name, lineNum, err.Error())
+				s.failed = true
+				return false
+			} else if failed {
+				s.failed = true
+				if !s.continueOnError {
+					return false
+				}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(s.errOut, "%s: %s\r\n", name, err.Error())
+		s.failed = true
+		return false
+	}
+	return true
+}
+
+// statementScanner reads the statements and meta-commands of a script. As at the prompt,
+// statements end with a line ending in a semicolon and may span several lines, while
+// meta-commands take a single line. Empty lines and comments are skipped.
+type statementScanner struct {
+	reader *bufio.Reader
+	line   int
+	start  int
+	text   string
+	err    error
+}
+
+// newStatementScanner returns a scanner reading from r. Lines may be of any length.
+func newStatementScanner(r io.Reader) *statementScanner {
+	return &statementScanner{reader: bufio.NewReader(r)}
+}
+
+// Scan reads the next statement or meta-command. It returns false at the end of the input
+// or if reading failed. The statement read last is ended by the end of the input.
+func (s *statementScanner) Scan() bool {
+	var lines []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			s.err = err
+			return false
+		} else if err == io.EOF && line == "" {
+			break
+		}
+		s.line++
+
+		line = strings.TrimSpace(line)
+		switch {
+		case len(line) == 0 || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "--"):
+		case len(lines) == 0 && strings.HasPrefix(line, `\`):
+			s.start, s.text = s.line, line
+			return true
+		default:
+			if len(lines) == 0 {
+				s.start = s.line
+			}
+			lines = append(lines, line)
+			if strings.HasSuffix(line, ";") {
+				s.text = strings.Join(lines, "\n")
+				return true
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if len(lines) == 0 {
+		return false
+	}
+	s.text = strings.Join(lines, "\n")
+	return true
+}
+
+// Text returns the statement or meta-command read by the last call to Scan.
+func (s *statementScanner) Text() string {
+	return s.text
+}
+
+// Line returns the line number the text returned by Text starts on.
+func (s *statementScanner) Line() int {
+	return s.start
+}
+
+// Err returns the error which stopped Scan, if any.
+func (s *statementScanner) Err() error {
+	return s.err
+}
@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatementScanner(t *testing.T) {
+	script := `-- Create a log
+CREATE LOG acme.events
+  CLUSTERED BY (id) INTO 4 PARTITIONS;
+
+\format json
+// Several statements on a line
+SHOW NAMESPACES; SHOW LOGS;
+SHOW NODES`
+
+	scanner := newStatementScanner(strings.NewReader(script))
+	var lines []int
+	var texts []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Line())
+		texts = append(texts, scanner.Text())
+	}
+	assert.Nil(t, scanner.Err())
+	assert.Equal(t, []int{2, 5, 7, 8}, lines)
+	assert.Equal(t, []string{
+		"CREATE LOG acme.events\nCLUSTERED BY (id) INTO 4 PARTITIONS;",
+		`\format json`,
+		"SHOW NAMESPACES; SHOW LOGS;",
+		"SHOW NODES",
+	}, texts)
+}
+
+func TestStatementScanner_LongLine(t *testing.T) {
+	statement := "CREATE NAMESPACE " + strings.Repeat("a", 100*1024) + ";"
+	scanner := newStatementScanner(strings.NewReader(statement + "\n"))
+
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, statement, scanner.Text())
+	assert.False(t, scanner.Scan())
+	assert.Nil(t, scanner.Err())
+}
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/subsilent/crypto/ssh/terminal"
+)
+
+// Control keys handled by the history search
+const (
+	keyCtrlG = 7
+	keyCtrlR = 18
+)
+
+// historySearch implements incremental reverse search over the statement history. Ctrl-R
+// starts a search or moves to the next older match, typed characters narrow the search
+// and Ctrl-G restores the line as it was. Any other key accepts the match.
+type historySearch struct {
+	term    *terminal.Terminal
+	history *History
+	prompt  string
+
+	active   bool
+	query    string
+	index    int
+	original string
+	line     string
+	pos      int
+}
+
+// setPrompt sets the prompt shown when no search is active and ends any search.
+func (s *historySearch) setPrompt(prompt string) {
+	s.prompt = prompt
+	s.active = false
+	s.term.SetPrompt(prompt)
+}
+
+// handle is called by the terminal's AutoCompleteCallback for keys it does not handle
+// itself. It returns ok=false for keys which are not part of a search.
+func (s *historySearch) handle(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+
+	// Editing keys such as Backspace or the arrows accept the match
+	if s.active && (line != s.line || pos != s.pos) {
+		s.end()
+	}
+
+	switch {
+	case key == keyCtrlR:
+		if !s.active {
+			s.active, s.query, s.index, s.original = true, "", -1, line
+			s.line, s.pos = line, pos
+		}
+		return s.find(s.index+1, true)
+	case !s.active:
+		return "", 0, false
+	case key == keyCtrlG:
+		s.end()
+		return s.original, len(s.original), true
+	case unicode.IsPrint(key):
+		s.query += string(key)
+		if s.index < 0 {
+			return s.find(0, false)
+		}
+		return s.find(s.index, false)
+	}
+
+	s.end()
+	return "", 0, false
+}
+
+// find shows the newest entry which contains the query, starting from the given number
+// of entries back. Entries repeating the current match are skipped if skipSame is set.
+func (s *historySearch) find(from int, skipSame bool) (string, int, bool) {
+	entries := s.entries()
+	if len(s.query) > 0 {
+		for i := from; i < len(entries); i++ {
+			if skipSame && entries[i] == s.line {
+				continue
+			} else if strings.Contains(entries[i], s.query) {
+				s.index = i
+				s.line, s.pos = entries[i], len(entries[i])
+				s.showPrompt("(reverse-i-search)`" + s.query + "': ")
+				return s.line, s.pos, true
+			}
+		}
+		s.showPrompt("(failing reverse-i-search)`" + s.query + "': ")
+	} else {
+		s.showPrompt("(reverse-i-search)`': ")
+	}
+	return s.line, s.pos, true
+}
+
+// end stops the search and restores the prompt.
+func (s *historySearch) end() {
+	s.active = false
+	s.showPrompt(s.prompt)
+}
+
+// showPrompt changes the prompt of the line being edited.
+func (s *historySearch) showPrompt(prompt string) {
+	s.term.SetPrompt(prompt)
+
+	// Writing nothing repaints the prompt and line
+	s.term.Write(nil)
+}
+
+// entries returns the statement history, newest first.
+func (s *historySearch) entries() []string {
+	all := append(append([]string{}, s.history.oldEntries...), s.history.newEntries...)
+	entries := make([]string, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		if entry := strings.TrimSpace(all[i]); len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
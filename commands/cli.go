@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"os/user"
 	"path"
@@ -13,10 +12,10 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/blacklabeldata/kappa/auth"
 	cli "github.com/blacklabeldata/kappa/client"
 	"github.com/blacklabeldata/kappa/common"
 	"github.com/blacklabeldata/kappa/skl"
-	"github.com/blacklabeldata/xbinary"
 	"golang.org/x/crypto/ssh"
 	// "golang.org/x/crypto/ssh/terminal"
 	"github.com/subsilent/crypto/ssh/terminal"
@@ -24,81 +23,69 @@ import (
 
 // ClientCmd is the CLI command
 var ClientCmd = &cobra.Command{
-	Use:   "client [ssh://username@host:port]",
+	Use:   "client [ssh://username@host:port | profile]",
 	Short: "client starts a terminal with the given kappa server",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
 
+		// Exit with a non-zero status once the deferred cleanup has run
+		status := 0
+		defer func() {
+			if status != 0 {
+				os.Exit(status)
+			}
+		}()
+
 		// Create logger
 		writer := log.NewConcurrentWriter(os.Stdout)
 		logger := log.NewLogger(writer, "cli")
 
 		err := InitializeClientConfig(logger)
 		if err != nil {
+			status = 1
 			return
 		}
 
-		// Get SSH Key file
-		keyFile := viper.GetString("ClientKey")
-		// logger.Info("Reading private key", "file", sshKeyFile)
-
-		// Read SSH Key
-		keyBytes, err := ioutil.ReadFile(keyFile)
-		if err != nil {
-			fmt.Println("Private key could not be read:", err.Error())
-			fmt.Println(cmd.Help())
-			return
-		}
-
-		// Get private key
-		privateKey, err := ssh.ParsePrivateKey(keyBytes)
-		if err != nil {
-			fmt.Println("Private key is invalid:", err.Error())
-			fmt.Println(cmd.Help())
+		// Check the output format before connecting
+		if err := checkFormat(viper.GetString("Format")); err != nil {
+			fmt.Println(err.Error())
+			status = 1
 			return
 		}
 
-		// get username and host
+		// Get the server URL or profile
 		if len(args) < 1 {
-			fmt.Println("Missing server URL")
+			fmt.Println("Missing server URL or profile")
 			fmt.Println(cmd.Help())
+			status = 1
 			return
-		}
-
-		u, err := url.Parse(args[0])
-		if err != nil {
-			fmt.Println("Error parsing host - expected format ssh://username@host:port : ", err.Error())
-			fmt.Println(cmd.Help())
-			return
-		} else if u.User == nil {
-			fmt.Println("Missing username - expected format: ssh://username@host:port")
-			fmt.Println(cmd.Help())
-			return
-		} else if u.User.Username() == "" {
-			fmt.Println("Missing username - expected format: ssh://username@host:port")
+		} else if _, err := resolveTarget(args[0]); err != nil {
+			fmt.Println(err.Error())
 			fmt.Println(cmd.Help())
+			status = 1
 			return
 		}
 
-		// Configure client connection
-		config := &ssh.ClientConfig{
-			User: u.User.Username(),
-			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(privateKey),
-			},
-		}
-
-		// Create client connection
-		client, err := ssh.Dial("tcp", u.Host, config)
+		// Connect to the server
+		client, err := connect(logger, args[0])
 		if err != nil {
 			fmt.Println(err.Error())
+			status = 1
 			return
 		}
-		defer client.Close()
-
-		// Open channel
-		channel, requests, err := client.OpenChannel("kappa-client", []byte{})
-		go ssh.DiscardRequests(requests)
+		session := &clientSession{logger: logger, client: client}
+		defer func() {
+			session.client.Close()
+		}()
+
+		// Run statements from the command line, a file or stdin without a terminal
+		if !interactive() {
+			if !runScripts(session) {
+				status = 1
+			}
+			return
+		}
+		colors := clientColors()
 
 		// Read history
 		var entries []string
@@ -118,15 +105,28 @@ var ClientCmd = &cobra.Command{
 		history := History{entries, make([]string, 0)}
 
 		// Create terminal
-		term := terminal.NewTerminal(os.Stdin, string(common.DefaultColorCodes.LightBlue)+"kappa > "+string(common.DefaultColorCodes.Reset))
+		prompt := string(colors.LightBlue) + "kappa > " + string(colors.Reset)
+		continuationPrompt := string(colors.LightBlue) + "   ...> " + string(colors.Reset)
+		term := terminal.NewTerminal(os.Stdin, prompt)
 		term.LoadInitialHistory(entries)
 
+		// Search history with Ctrl-R and complete keywords and names with Tab
+		search := &historySearch{term: term, history: &history, prompt: prompt}
+		completion := newCompleter(session, term)
+		term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+			if newLine, newPos, ok := search.handle(line, pos, key); ok {
+				return newLine, newPos, true
+			}
+			return completion.complete(line, pos, key)
+		}
+
 		// Try to make the terminal raw
 		oldState, err := terminal.MakeRaw(0)
 		if err != nil {
 			logger.Warn("Error making terminal raw: ", err.Error())
+		} else {
+			defer terminal.Restore(0, oldState)
 		}
-		defer terminal.Restore(0, oldState)
 
 		// Write ascii text
 		term.Write([]byte("\r\n"))
@@ -137,20 +137,36 @@ var ClientCmd = &cobra.Command{
 
 		// Write login message
 		term.Write([]byte("\r\n\n"))
-		cli.GetMessage(term, common.DefaultColorCodes)
+		cli.GetMessage(term, colors)
 		term.Write([]byte("\n"))
 
+		// Render results in the selected format
+		session.out = &output{format: viper.GetString("Format"), colors: colors, out: term, errOut: term}
+
 		// Start REPL
+		var lines []string
+		var historyLines int
 		for {
-			input, err := term.ReadLine()
+			if len(lines) == 0 {
+				search.setPrompt(prompt)
+			} else {
+				search.setPrompt(continuationPrompt)
+			}
+			completion.continued = strings.Join(lines, " ")
 
+			input, err := term.ReadLine()
 			if err != nil {
 				break
 			}
 
 			// Process line
 			line := strings.TrimSpace(string(input))
-			if len(line) > 0 {
+			if len(input) > 0 {
+				historyLines++
+			}
+			if len(line) == 0 {
+				continue
+			} else if len(lines) == 0 {
 
 				// Log input and handle exit requests
 				if line == "exit" || line == "quit" {
@@ -162,75 +178,110 @@ var ClientCmd = &cobra.Command{
 					for _, e := range history.newEntries {
 						term.Write([]byte(" " + e + "\r\n"))
 					}
+					historyLines = 0
 					continue
-				} else if strings.HasPrefix(line, "//") || strings.HasPrefix(line, "--") {
-
-					term.Write(common.DefaultColorCodes.LightGrey)
-					term.Write([]byte(line + "\r\n"))
-					term.Write(common.DefaultColorCodes.Reset)
-					continue
-				}
-
-				// Parse statement
-				stmt, err := skl.ParseStatement(line)
-
-				// Return parse error in red
-				if err != nil {
-					term.Write(common.DefaultColorCodes.LightRed)
-					term.Write([]byte(" " + err.Error()))
-					term.Write([]byte("\r\n"))
-					term.Write(common.DefaultColorCodes.Reset)
-					term.RemoveLastLine()
+				} else if strings.HasPrefix(line, `\`) {
+					if _, err := session.command(line); err != nil {
+						term.Write(colors.LightRed)
+						term.Write([]byte(" " + err.Error() + "\r\n"))
+						term.Write(colors.Reset)
+					} else {
+						history.Append(line + "\n")
+					}
+					completion.reset()
+					historyLines = 0
 					continue
 				}
+			}
+			if strings.HasPrefix(line, "//") || strings.HasPrefix(line, "--") {
 
-				w := common.ResponseWriter{common.DefaultColorCodes, term}
-
-				length := make([]byte, 4)
-				xbinary.LittleEndian.PutInt32(length, 0, int32(len(line)))
-
-				// Write data
-				channel.Write(length)
-				channel.Write([]byte(line))
-
-				// term.Write(common.DefaultColorCodes.LightBlue)
-				// term.Write([]byte(fmt.Sprintf("%d : '%s'\r\n", length, line)))
-				// term.Write(common.DefaultColorCodes.Reset)
+				term.Write(colors.LightGrey)
+				term.Write([]byte(line + "\r\n"))
+				term.Write(colors.Reset)
+				continue
+			}
 
-				channel.Read(length)
+			// Read continuation lines until the statement is terminated
+			lines = append(lines, line)
+			if !strings.HasSuffix(line, ";") {
+				continue
+			}
+			statement, entry := strings.Join(lines, "\n"), strings.Join(lines, " ")
 
-				size, err := xbinary.LittleEndian.Int32(length, 0)
-				data := make([]byte, int(size))
-				channel.Read(data)
+			// Keep the whole statement as one history entry
+			for ; historyLines > 0; historyLines-- {
+				term.RemoveLastLine()
+			}
+			lines = nil
 
-				// term.Write(common.DefaultColorCodes.Green)
-				// term.Write([]byte(fmt.Sprintf("%d : '%s'\r\n", length, string(data))))
-				// term.Write(common.DefaultColorCodes.Reset)
-				// if err != nil {
-				// 	w.Fail(common.InternalServerError, err.Error())
-				// }
-				// channel.SendRequest("skl", true, []byte(line))
+			// Parse statement
+			_, err = skl.ParseStatements(statement)
 
-				// Execute statements
-				// w.Success(common.OK, string(data))
-				w.Success(common.OK, stmt.String())
-				// executor.Execute(&w, stmt)
+			// Return parse error in red
+			if err != nil {
+				term.Write(colors.LightRed)
+				term.Write([]byte(" " + err.Error()))
+				term.Write([]byte("\r\n"))
+				term.Write(colors.Reset)
+				continue
+			}
+			term.LoadInitialHistory([]string{entry})
 
-				// Write line to history file
-				// historyFile.WriteString(line + "\n")
-				history.Append(line + "\n")
+			// Execute statement on the server
+			if _, err := session.execute(statement); err != nil {
+				w := common.ResponseWriter{Colors: colors, Writer: term}
+				w.Fail(common.ProtocolError, "%s", err.Error())
+				break
 			}
+			completion.reset()
+
+			// Write line to history file
+			// historyFile.WriteString(line + "\n")
+			history.Append(entry + "\n")
 		}
 
 		history.WriteToFile(historyPath)
-		os.Stdout.Write(common.DefaultColorCodes.LightGreen)
+		os.Stdout.Write(colors.LightGreen)
 		os.Stdout.Write([]byte("\r\n"))
 		os.Stdout.Write([]byte(" Yo homes, smell you later!"))
 		os.Stdout.Write([]byte("\r\n"))
-		os.Stdout.Write(common.DefaultColorCodes.Reset)
+		os.Stdout.Write(colors.Reset)
 	},
 }
 
+// clientHostKeyCallback creates the callback which verifies the server's host key.
+func clientHostKeyCallback() (ssh.HostKeyCallback, error) {
+	if viper.GetBool("InsecureSkipHostCheck") {
+		fmt.Fprintln(os.Stderr, "WARNING: Host key verification is disabled. The connection is open to man-in-the-middle attacks.")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	// The CA certificate is optional unless it was set explicitly
+	caFile := expandHome(viper.GetString("ClientCACert"))
+	if _, err := os.Stat(caFile); os.IsNotExist(err) && !clientCmd.PersistentFlags().Lookup("ca-cert").Changed {
+		caFile = ""
+	}
+
+	checker, err := auth.NewHostKeyChecker(caFile, expandHome(viper.GetString("KnownHosts")), os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return checker.Check, nil
+}
+
+// expandHome replaces a leading ~ with the current user's home directory.
+func expandHome(filename string) string {
+	if !strings.HasPrefix(filename, "~/") {
+		return filename
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return filename
+	}
+	return path.Join(usr.HomeDir, filename[2:])
+}
+
 type History struct {
 	oldEntries []string
 	newEntries []string
@@ -268,11 +319,32 @@ var clientCmd *cobra.Command
 
 // Command line args
 var (
-	ClientKey string
+	ClientKeys            identityFiles
+	ClientCACert          string
+	KnownHosts            string
+	InsecureSkipHostCheck bool
+	NoAgent               bool
+	ExecuteStatements     string
+	ScriptFile            string
+	ContinueOnError       bool
+	ClientConfig          string
+	OutputFormat          string
+	NoColor               bool
 )
 
 func init() {
-	ClientCmd.PersistentFlags().StringVarP(&ClientKey, "identity-file", "i", "", "Private key to identify client")
+	ClientCmd.PersistentFlags().VarP(&ClientKeys, "identity-file", "i", "Private key to identify client, may be repeated to try several keys")
+	ClientCmd.PersistentFlags().BoolVarP(&NoAgent, "no-agent", "", false, "Do not authenticate with the keys held by ssh-agent")
+	ClientCmd.PersistentFlags().StringVarP(&PassphraseFile, "passphrase-file", "", "", "File containing the passphrase for an encrypted private key")
+	ClientCmd.PersistentFlags().StringVarP(&ClientCACert, "ca-cert", "", "~/.kappa/ca.crt", "CA certificate used to verify server host certificates")
+	ClientCmd.PersistentFlags().StringVarP(&KnownHosts, "known-hosts", "", "~/.kappa/known_hosts", "File of trusted server host keys")
+	ClientCmd.PersistentFlags().BoolVarP(&InsecureSkipHostCheck, "insecure-skip-host-check", "", false, "Do not verify the server's host key (for local development only)")
+	ClientCmd.PersistentFlags().StringVarP(&ExecuteStatements, "execute", "e", "", "Execute the statements and exit")
+	ClientCmd.PersistentFlags().StringVarP(&ScriptFile, "file", "f", "", "Execute the statements in a file and exit")
+	ClientCmd.PersistentFlags().BoolVarP(&ContinueOnError, "continue-on-error", "", false, "Keep executing statements after one fails")
+	ClientCmd.PersistentFlags().StringVarP(&ClientConfig, "client-config", "", "~/.kappa/config.yml", "File defining connection profiles")
+	ClientCmd.PersistentFlags().StringVarP(&OutputFormat, "format", "", "table", "Output format of result sets (table, json, jsonl or csv)")
+	ClientCmd.PersistentFlags().BoolVarP(&NoColor, "no-color", "", false, "Disable colored output")
 	clientCmd = ClientCmd
 }
 
@@ -287,10 +359,70 @@ func InitializeClientConfig(logger log.Logger) error {
 	// kappa cli -i pki/private/admin.key ssh://admin@127.0.0.1:9022
 	// kappa cli -i pki/private/admin.key -u admin -H 127.0.0.1:9022
 
-	viper.SetDefault("ClientKey", "~/.ssh/id_rsa")
+	viper.SetDefault("ClientKeys", defaultIdentityFiles)
+	viper.SetDefault("NoAgent", false)
 
 	if clientCmd.PersistentFlags().Lookup("identity-file").Changed {
-		viper.Set("ClientKey", ClientKey)
+		viper.Set("ClientKeys", []string(ClientKeys))
+	}
+	if clientCmd.PersistentFlags().Lookup("no-agent").Changed {
+		viper.Set("NoAgent", NoAgent)
+	}
+
+	// Host key verification
+	viper.SetDefault("ClientCACert", "~/.kappa/ca.crt")
+	viper.SetDefault("KnownHosts", "~/.kappa/known_hosts")
+	viper.SetDefault("InsecureSkipHostCheck", false)
+
+	if clientCmd.PersistentFlags().Lookup("ca-cert").Changed {
+		viper.Set("ClientCACert", ClientCACert)
+	}
+	if clientCmd.PersistentFlags().Lookup("known-hosts").Changed {
+		viper.Set("KnownHosts", KnownHosts)
+	}
+	if clientCmd.PersistentFlags().Lookup("insecure-skip-host-check").Changed {
+		viper.Set("InsecureSkipHostCheck", InsecureSkipHostCheck)
+	}
+
+	// Non-interactive execution
+	viper.SetDefault("Execute", "")
+	viper.SetDefault("ScriptFile", "")
+	viper.SetDefault("ContinueOnError", false)
+
+	if clientCmd.PersistentFlags().Lookup("execute").Changed {
+		viper.Set("Execute", ExecuteStatements)
+	}
+	if clientCmd.PersistentFlags().Lookup("file").Changed {
+		viper.Set("ScriptFile", ScriptFile)
+	}
+	if clientCmd.PersistentFlags().Lookup("continue-on-error").Changed {
+		viper.Set("ContinueOnError", ContinueOnError)
+	}
+
+	// Connection profiles
+	viper.SetDefault("ClientConfig", "~/.kappa/config.yml")
+
+	if clientCmd.PersistentFlags().Lookup("client-config").Changed {
+		viper.Set("ClientConfig", ClientConfig)
+	}
+
+	// Output
+	viper.SetDefault("Format", "table")
+	viper.SetDefault("NoColor", false)
+
+	if clientCmd.PersistentFlags().Lookup("format").Changed {
+		viper.Set("Format", OutputFormat)
+	}
+	if clientCmd.PersistentFlags().Lookup("no-color").Changed {
+		viper.Set("NoColor", NoColor)
+	}
+
+	// Private key passphrase
+	if err := InitializePassphraseConfig(logger); err != nil {
+		return err
+	}
+	if clientCmd.PersistentFlags().Lookup("passphrase-file").Changed {
+		viper.Set("PassphraseFile", PassphraseFile)
 	}
 	return nil
 }
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"os"
+	"path"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/blacklabeldata/kappa/auth"
+)
+
+// HostCertCmd issues an SSH host certificate for a server.
+var HostCertCmd = &cobra.Command{
+	Use:   "host-cert",
+	Short: "host-cert signs a server's SSH host key with the certificate authority",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Create logger
+		writer := log.NewConcurrentWriter(os.Stdout)
+		logger := log.NewLogger(writer, "host-cert")
+
+		err := InitializeConfig(writer)
+		if err != nil {
+			return
+		}
+
+		// Create file paths
+		pki := path.Join(".", "pki")
+		crtFile := path.Join(pki, "public", viper.GetString("Name")+".crt")
+		hostCertFile := path.Join(pki, "public", viper.GetString("Name")+"-cert.pub")
+		caKeyFile := path.Join(pki, "private", "ca.key")
+
+		// Read existing certificate
+		cert, err := auth.ReadX509Certificate(crtFile)
+		if err != nil {
+			logger.Warn("Error reading certificate", "file", crtFile, "err", err.Error())
+			return
+		}
+
+		// Create host certificate
+		hostCert, err := auth.CreateHostCertificate(logger, caKeyFile, caPassphrase, cert, viper.GetString("Name"))
+		if err != nil {
+			logger.Warn("Error creating host certificate", "err", err.Error())
+			return
+		}
+
+		// Save host certificate
+		if err := auth.SaveHostCertificate(logger, hostCert, hostCertFile); err != nil {
+			logger.Warn("Error saving host certificate", "err", err.Error())
+			return
+		}
+	},
+}
+
+// Pointer to HostCertCmd used in initialization
+var hostCertCmd *cobra.Command
+
+func init() {
+
+	HostCertCmd.PersistentFlags().StringVarP(&Name, "name", "", "localhost", "Name of the server certificate")
+	hostCertCmd = HostCertCmd
+}
+
+// InitializeHostCertConfig sets up the command line options for creating a host certificate
+func InitializeHostCertConfig(logger log.Logger) error {
+
+	if hostCertCmd.PersistentFlags().Lookup("name").Changed {
+		logger.Info("", "Name", Name)
+		viper.Set("Name", Name)
+	}
+
+	return nil
+}
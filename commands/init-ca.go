@@ -1,8 +1,6 @@
 package commands
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"fmt"
 	"os"
 	"path"
@@ -66,26 +64,59 @@ var InitCACmd = &cobra.Command{
 		}
 
 		// generate private key
-		privatekey, err := rsa.GenerateKey(rand.Reader, viper.GetInt("Bits"))
+		privatekey, err := auth.GenerateKey(viper.GetString("KeyType"), viper.GetInt("Bits"))
 		if err != nil {
-			logger.Warn("Error generating private key")
+			logger.Warn("Error generating private key", "err", err.Error())
 			return
 		}
 
 		// Create CA
-		cert, err := auth.CreateCertificateAuthority(logger, privatekey,
-			viper.GetInt("Years"), viper.GetString("Organization"),
-			viper.GetString("Country"), viper.GetString("Hosts"))
-		if err != nil {
-			logger.Warn("Error creating CA", "err", err.Error())
-			return
+		var certs [][]byte
+		if viper.GetBool("Intermediate") {
+
+			// Read root CA, which may be kept offline
+			root, err := auth.ReadX509Certificate(viper.GetString("RootCert"))
+			if err != nil {
+				logger.Warn("Error reading root certificate", "file", viper.GetString("RootCert"), "err", err.Error())
+				return
+			}
+			rootKey, err := auth.LoadEncryptedPrivateKey(viper.GetString("RootKey"), caPassphrase)
+			if err != nil {
+				logger.Warn("Error reading root private key", "file", viper.GetString("RootKey"), "err", err.Error())
+				return
+			}
+
+			cert, err := auth.CreateIntermediateAuthority(logger, privatekey, root, rootKey,
+				viper.GetInt("Years"), viper.GetString("Organization"), viper.GetString("Country"))
+			if err != nil {
+				logger.Warn("Error creating intermediate CA", "err", err.Error())
+				return
+			}
+			certs = [][]byte{cert, root.Raw}
+		} else {
+			cert, err := auth.CreateCertificateAuthority(logger, privatekey,
+				viper.GetInt("Years"), viper.GetString("Organization"),
+				viper.GetString("Country"), viper.GetString("Hosts"))
+			if err != nil {
+				logger.Warn("Error creating CA", "err", err.Error())
+				return
+			}
+			certs = [][]byte{cert}
 		}
 
 		// Save cert
-		auth.SaveCertificate(logger, cert, crtFile)
+		auth.SaveCertificateChain(logger, certs, crtFile)
 
 		// Save private key
-		auth.SavePrivateKey(logger, privatekey, privFile)
+		passphrase, err := newKeyPassphrase(privFile)
+		if err != nil {
+			logger.Warn("Error reading passphrase", "err", err.Error())
+			return
+		}
+		if err := auth.SaveEncryptedPrivateKey(logger, privatekey, privFile, passphrase); err != nil {
+			logger.Warn("Error saving private key", "err", err.Error())
+			return
+		}
 
 	},
 }
@@ -96,20 +127,30 @@ var initCmd *cobra.Command
 // Command line args
 var (
 	KeyBits      int
+	KeyType      string
 	Years        int
 	Organization string
 	Country      string
 	Hosts        string
+	Intermediate bool
+	RootCert     string
+	RootKey      string
 )
 
 func init() {
 
 	InitCACmd.PersistentFlags().IntVarP(&KeyBits, "bits", "", 4096, "Number of bits in key")
+	InitCACmd.PersistentFlags().StringVarP(&KeyType, "key-type", "", "rsa", "Type of key: rsa, ecdsa-p256, ecdsa-p384 or ed25519")
 	InitCACmd.PersistentFlags().IntVarP(&Years, "years", "", 10, "Number of years until the CA certificate expires")
 	InitCACmd.PersistentFlags().StringVarP(&Organization, "organization", "", "kappa-ca", "Organization for CA")
 	InitCACmd.PersistentFlags().StringVarP(&Country, "country", "", "USA", "Country of origin for CA")
 	InitCACmd.PersistentFlags().StringVarP(&Hosts, "hosts", "", "127.0.0.1", "Comma delimited list of IPs or domains")
 	InitCACmd.PersistentFlags().BoolVarP(&ForceOverwrite, "overwrite", "", false, "Overwrite replaces existing certs")
+	InitCACmd.PersistentFlags().BoolVarP(&EncryptKey, "encrypt", "", false, "Encrypt the private key with a passphrase")
+	InitCACmd.PersistentFlags().StringVarP(&PassphraseFile, "passphrase-file", "", "", "File containing the passphrase used to encrypt the private key")
+	InitCACmd.PersistentFlags().BoolVarP(&Intermediate, "intermediate", "", false, "Create an intermediate CA signed by an existing root CA")
+	InitCACmd.PersistentFlags().StringVarP(&RootCert, "root-cert", "", "", "Root CA certificate used to sign an intermediate CA")
+	InitCACmd.PersistentFlags().StringVarP(&RootKey, "root-key", "", "", "Root CA private key used to sign an intermediate CA")
 	initCmd = InitCACmd
 }
 
@@ -117,14 +158,21 @@ func init() {
 func InitializeCertAuthConfig(logger log.Logger) error {
 
 	viper.SetDefault("Bits", "4096")
+	viper.SetDefault("KeyType", "rsa")
 	viper.SetDefault("Years", "10")
 	viper.SetDefault("Organization", "kappa-ca")
 	viper.SetDefault("Country", "USA")
+	viper.SetDefault("Hosts", "127.0.0.1")
+	viper.SetDefault("Intermediate", "false")
 
 	if initCmd.PersistentFlags().Lookup("bits").Changed {
 		logger.Info("", "Bits", KeyBits)
 		viper.Set("Bits", KeyBits)
 	}
+	if initCmd.PersistentFlags().Lookup("key-type").Changed {
+		logger.Info("", "KeyType", KeyType)
+		viper.Set("KeyType", KeyType)
+	}
 	if initCmd.PersistentFlags().Lookup("years").Changed {
 		logger.Info("", "Years", Years)
 		viper.Set("Years", Years)
@@ -141,6 +189,26 @@ func InitializeCertAuthConfig(logger log.Logger) error {
 		logger.Info("", "Hosts", Hosts)
 		viper.Set("Hosts", Hosts)
 	}
+	if initCmd.PersistentFlags().Lookup("encrypt").Changed {
+		logger.Info("", "EncryptKey", EncryptKey)
+		viper.Set("EncryptKey", EncryptKey)
+	}
+	if initCmd.PersistentFlags().Lookup("passphrase-file").Changed {
+		logger.Info("", "PassphraseFile", PassphraseFile)
+		viper.Set("PassphraseFile", PassphraseFile)
+	}
+	if initCmd.PersistentFlags().Lookup("intermediate").Changed {
+		logger.Info("", "Intermediate", Intermediate)
+		viper.Set("Intermediate", Intermediate)
+	}
+	if initCmd.PersistentFlags().Lookup("root-cert").Changed {
+		logger.Info("", "RootCert", RootCert)
+		viper.Set("RootCert", RootCert)
+	}
+	if initCmd.PersistentFlags().Lookup("root-key").Changed {
+		logger.Info("", "RootKey", RootKey)
+		viper.Set("RootKey", RootKey)
+	}
 
 	return nil
 }
@@ -33,7 +33,16 @@ func AddCommands() {
 	KappaCmd.AddCommand(ServerCmd)
 	KappaCmd.AddCommand(InitCACmd)
 	KappaCmd.AddCommand(NewCertCmd)
+	KappaCmd.AddCommand(SignCSRCmd)
+	KappaCmd.AddCommand(HostCertCmd)
+	KappaCmd.AddCommand(RenewCertCmd)
+	KappaCmd.AddCommand(CertStatusCmd)
 	KappaCmd.AddCommand(ClientCmd)
+	KappaCmd.AddCommand(MembersCmd)
+	KappaCmd.AddCommand(JoinCmd)
+	KappaCmd.AddCommand(LeaveCmd)
+	KappaCmd.AddCommand(ForceLeaveCmd)
+	KappaCmd.AddCommand(KeyringCmd)
 }
 
 // Command line args
@@ -82,6 +91,11 @@ func InitializeConfig(writer io.Writer) error {
 		return err
 	}
 
+	if err := InitializePassphraseConfig(logger); err != nil {
+		logger.Warn("Failed to initialize passphrase settings")
+		return err
+	}
+
 	if err := InitializeServerConfig(logger); err != nil {
 		logger.Warn("Failed to initialize server command line flags")
 		return err
@@ -97,5 +111,25 @@ func InitializeConfig(writer io.Writer) error {
 		return err
 	}
 
+	if err := InitializeSignCSRConfig(logger); err != nil {
+		logger.Warn("Failed to initialize sign-csr command line flags")
+		return err
+	}
+
+	if err := InitializeHostCertConfig(logger); err != nil {
+		logger.Warn("Failed to initialize host-cert command line flags")
+		return err
+	}
+
+	if err := InitializeRenewCertConfig(logger); err != nil {
+		logger.Warn("Failed to initialize renew-cert command line flags")
+		return err
+	}
+
+	if err := InitializeCertStatusConfig(logger); err != nil {
+		logger.Warn("Failed to initialize cert-status command line flags")
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	cli "github.com/blacklabeldata/kappa/client"
+)
+
+// KeyringCmd manages the gossip encryption keys of the cluster.
+var KeyringCmd = &cobra.Command{
+	Use:   "keyring [ssh://admin@host:port | profile]",
+	Short: "keyring installs, uses, removes or lists the gossip encryption keys of every server",
+	Long: `Keys are rotated without downtime by installing the new key, using it once it is
+installed on every server and then removing the old key.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runAdmin(cmd, args, 0, func(ctx context.Context, client *cli.Client, args []string) error {
+			var actions int
+			for _, set := range []bool{InstallKey != "", UseKey != "", RemoveKey != "", ListKeys} {
+				if set {
+					actions++
+				}
+			}
+			if actions != 1 {
+				return errors.New("Expected exactly one of --install, --use, --remove or --list")
+			}
+
+			switch {
+			case InstallKey != "":
+				keyring, err := client.InstallKey(ctx, InstallKey)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Installed the key on %d servers\n", keyring.Responses)
+			case UseKey != "":
+				keyring, err := client.UseKey(ctx, UseKey)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%d servers encrypt gossip with the key\n", keyring.Responses)
+			case RemoveKey != "":
+				keyring, err := client.RemoveKey(ctx, RemoveKey)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Removed the key from %d servers\n", keyring.Responses)
+			default:
+				keyring, err := client.ListKeys(ctx)
+				if err != nil {
+					return err
+				}
+				return writeKeyring(keyring)
+			}
+			return nil
+		})
+	},
+}
+
+// writeKeyring lists the keys with the number of servers they are installed on.
+func writeKeyring(keyring cli.Keyring) error {
+	keys := make([]string, 0, len(keyring.Keys))
+	for key := range keyring.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSERVERS")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%d/%d\n", key, keyring.Keys[key], keyring.Servers)
+	}
+	return w.Flush()
+}
+
+// Command line args
+var (
+	InstallKey string
+	UseKey     string
+	RemoveKey  string
+	ListKeys   bool
+)
+
+func init() {
+	KeyringCmd.PersistentFlags().StringVarP(&InstallKey, "install", "", "", "Install a base64 encoded key on every server")
+	KeyringCmd.PersistentFlags().StringVarP(&UseKey, "use", "", "", "Encrypt gossip with an installed key")
+	KeyringCmd.PersistentFlags().StringVarP(&RemoveKey, "remove", "", "", "Remove a key which is no longer used")
+	KeyringCmd.PersistentFlags().BoolVarP(&ListKeys, "list", "", false, "List the keys installed on the servers")
+}
@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/cobra"
+
+	cli "github.com/blacklabeldata/kappa/client"
+)
+
+// MembersCmd lists the members of the cluster.
+var MembersCmd = &cobra.Command{
+	Use:   "members [ssh://admin@host:port | profile]",
+	Short: "members lists the servers of the cluster as seen by the given server",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		runAdmin(cmd, args, 0, func(ctx context.Context, client *cli.Client, args []string) error {
+			members, err := client.Members(ctx)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tROLE\tCLUSTER\tADDRESS\tBOOTSTRAP\tSTATUS\tTAGS")
+			for _, m := range members {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n", m.Name, m.Role, m.Cluster, m.Addr, m.Bootstrap, m.Status, formatTags(m.Tags))
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// JoinCmd joins a server to the cluster.
+var JoinCmd = &cobra.Command{
+	Use:   "join [ssh://admin@host:port | profile] gossip-addr...",
+	Short: "join makes the given server join the cluster through the servers at the gossip addresses",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		runAdmin(cmd, args, 1, func(ctx context.Context, client *cli.Client, args []string) error {
+			n, err := client.Join(ctx, args...)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Joined the cluster through %d of %d servers\n", n, len(args))
+			return nil
+		})
+	},
+}
+
+// LeaveCmd makes a server leave the cluster.
+var LeaveCmd = &cobra.Command{
+	Use:   "leave [ssh://admin@host:port | profile]",
+	Short: "leave makes the given server leave the cluster gracefully and shut down",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		runAdmin(cmd, args, 0, func(ctx context.Context, client *cli.Client, args []string) error {
+			if err := client.Leave(ctx); err != nil {
+				return err
+			}
+			fmt.Println("Server left the cluster and is shutting down")
+			return nil
+		})
+	},
+}
+
+// ForceLeaveCmd removes a failed server from the cluster.
+var ForceLeaveCmd = &cobra.Command{
+	Use:   "force-leave [ssh://admin@host:port | profile] node",
+	Short: "force-leave marks a failed server as having left the cluster",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		runAdmin(cmd, args, 1, func(ctx context.Context, client *cli.Client, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("Expected a single node name, got %d", len(args))
+			}
+			if err := client.ForceLeave(ctx, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Marked %s as having left the cluster\n", args[0])
+			return nil
+		})
+	},
+}
+
+// runAdmin connects to the server given by the first argument and runs fn with at least
+// minArgs remaining arguments. The process exits with a non-zero status if fn fails.
+func runAdmin(cmd *cobra.Command, args []string, minArgs int, fn func(context.Context, *cli.Client, []string) error) {
+	writer := log.NewConcurrentWriter(os.Stderr)
+	logger := log.NewLogger(writer, cmd.Name())
+
+	if err := InitializeClientConfig(logger); err != nil {
+		os.Exit(1)
+	}
+
+	if len(args) < minArgs+1 {
+		fmt.Println("Missing arguments")
+		fmt.Println(cmd.Help())
+		os.Exit(1)
+	} else if _, err := resolveTarget(args[0]); err != nil {
+		fmt.Println(err.Error())
+		fmt.Println(cmd.Help())
+		os.Exit(1)
+	}
+
+	client, err := connect(logger, args[0])
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	err = fn(context.Background(), client, args[1:])
+	client.Close()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+// formatTags lists tags as key=value pairs sorted by key.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// adminFlags are the connection flags of the client command which the cluster commands
+// share. Shared flags are marked as changed on the client command as well, so the client
+// configuration applies to both.
+var adminFlags = []string{"identity-file", "no-agent", "passphrase-file", "ca-cert", "known-hosts", "insecure-skip-host-check", "client-config"}
+
+func init() {
+	for _, cmd := range []*cobra.Command{MembersCmd, JoinCmd, LeaveCmd, ForceLeaveCmd, KeyringCmd} {
+		for _, name := range adminFlags {
+			cmd.PersistentFlags().AddFlag(ClientCmd.PersistentFlags().Lookup(name))
+		}
+	}
+}
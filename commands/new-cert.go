@@ -1,8 +1,6 @@
 package commands
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"fmt"
 	"os"
 	"path"
@@ -41,6 +39,8 @@ var NewCertCmd = &cobra.Command{
 		reqFile := path.Join(pki, "reqs", viper.GetString("Name")+".req")
 		privFile := path.Join(pki, "private", viper.GetString("Name")+".key")
 		crtFile := path.Join(pki, "public", viper.GetString("Name")+".crt")
+		caCrtFile := path.Join(pki, "ca.crt")
+		caKeyFile := path.Join(pki, "private", "ca.key")
 
 		// Verify it is ok to delete files if they exist
 		if !viper.GetBool("ForceOverwrite") {
@@ -68,9 +68,9 @@ var NewCertCmd = &cobra.Command{
 		}
 
 		// generate private key
-		privatekey, err := rsa.GenerateKey(rand.Reader, viper.GetInt("Bits"))
+		privatekey, err := auth.GenerateKey(viper.GetString("KeyType"), viper.GetInt("Bits"))
 		if err != nil {
-			logger.Warn("Error generating private key")
+			logger.Warn("Error generating private key", "err", err.Error())
 			return
 		}
 
@@ -84,7 +84,7 @@ var NewCertCmd = &cobra.Command{
 		}
 
 		// Create Certificate
-		crt, err := auth.CreateCertificate(logger, csr, privatekey,
+		crt, err := auth.CreateCertificate(logger, caCrtFile, caKeyFile, caPassphrase, csr, privatekey,
 			viper.GetInt("Years"), viper.GetString("Hosts"))
 		if err != nil {
 			logger.Warn("Error creating certificate", "err", err.Error())
@@ -95,10 +95,23 @@ var NewCertCmd = &cobra.Command{
 		auth.SaveCertificateRequest(logger, req, reqFile)
 
 		// Save private key
-		auth.SavePrivateKey(logger, privatekey, privFile)
+		passphrase, err := newKeyPassphrase(privFile)
+		if err != nil {
+			logger.Warn("Error reading passphrase", "err", err.Error())
+			return
+		}
+		if err := auth.SaveEncryptedPrivateKey(logger, privatekey, privFile, passphrase); err != nil {
+			logger.Warn("Error saving private key", "err", err.Error())
+			return
+		}
 
-		// Save certificate
-		auth.SaveCertificate(logger, crt, crtFile)
+		// Save certificate with any intermediate CAs
+		chain, err := auth.CertificateChain(caCrtFile, crt)
+		if err != nil {
+			logger.Warn("Error reading CA certificate chain", "err", err.Error())
+			return
+		}
+		auth.SaveCertificateChain(logger, chain, crtFile)
 	},
 }
 
@@ -114,12 +127,15 @@ var (
 func init() {
 
 	NewCertCmd.PersistentFlags().IntVarP(&KeyBits, "bits", "", 4096, "Number of bits in key")
+	NewCertCmd.PersistentFlags().StringVarP(&KeyType, "key-type", "", "rsa", "Type of key: rsa, ecdsa-p256, ecdsa-p384 or ed25519")
 	NewCertCmd.PersistentFlags().StringVarP(&Hosts, "hosts", "", "127.0.0.1", "IP of cert")
 	NewCertCmd.PersistentFlags().IntVarP(&Years, "years", "", 10, "Number of years until the certificate expires")
 	NewCertCmd.PersistentFlags().StringVarP(&Organization, "organization", "", "kappa-ca", "Organization for CA")
 	NewCertCmd.PersistentFlags().StringVarP(&Country, "country", "", "USA", "Country of origin for CA")
 	NewCertCmd.PersistentFlags().StringVarP(&Name, "name", "", "localhost", "Name of certificate")
 	NewCertCmd.PersistentFlags().BoolVarP(&ForceOverwrite, "overwrite", "", false, "Overwrite replaces existing certs")
+	NewCertCmd.PersistentFlags().BoolVarP(&EncryptKey, "encrypt", "", false, "Encrypt the private key with a passphrase")
+	NewCertCmd.PersistentFlags().StringVarP(&PassphraseFile, "passphrase-file", "", "", "File containing the passphrase used to encrypt the private key")
 	newCertCmd = NewCertCmd
 }
 
@@ -128,6 +144,18 @@ func InitializeNewCertConfig(logger log.Logger) error {
 	viper.SetDefault("Name", "localhost")
 	viper.SetDefault("ForceOverwrite", "false")
 
+	if newCertCmd.PersistentFlags().Lookup("encrypt").Changed {
+		logger.Info("", "EncryptKey", EncryptKey)
+		viper.Set("EncryptKey", EncryptKey)
+	}
+	if newCertCmd.PersistentFlags().Lookup("passphrase-file").Changed {
+		logger.Info("", "PassphraseFile", PassphraseFile)
+		viper.Set("PassphraseFile", PassphraseFile)
+	}
+	if newCertCmd.PersistentFlags().Lookup("key-type").Changed {
+		logger.Info("", "KeyType", KeyType)
+		viper.Set("KeyType", KeyType)
+	}
 	if newCertCmd.PersistentFlags().Lookup("name").Changed {
 		logger.Info("", "Name", Name)
 		viper.Set("Name", Name)
@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/viper"
+
+	"github.com/blacklabeldata/kappa/auth"
+	"github.com/subsilent/crypto/ssh/terminal"
+)
+
+// Command line args
+var (
+	EncryptKey     bool
+	PassphraseFile string
+)
+
+// InitializePassphraseConfig sets up the config options for private key passphrases.
+func InitializePassphraseConfig(logger log.Logger) error {
+
+	// Passphrase encrypts and decrypts private keys. It can only be set with
+	// an environment variable so that it does not show up in the process list.
+	viper.BindEnv("Passphrase", "KAPPA_PASSPHRASE")
+
+	// PassphraseFile is a file containing the private key passphrase
+	viper.SetDefault("PassphraseFile", "")
+	viper.BindEnv("PassphraseFile", "KAPPA_PASSPHRASE_FILE")
+
+	// CAPassphrase decrypts the CA private key when signing certificates
+	viper.BindEnv("CAPassphrase", "KAPPA_CA_PASSPHRASE")
+
+	// EncryptKey encrypts newly generated private keys
+	viper.SetDefault("EncryptKey", "false")
+	return nil
+}
+
+// keyPassphrase returns the passphrase used to decrypt a private key. The passphrase is read
+// from the environment or passphrase file, otherwise the user is prompted for it.
+func keyPassphrase(filename string) ([]byte, error) {
+	if passphrase, err := configuredPassphrase(); err != nil || passphrase != nil {
+		return passphrase, err
+	}
+	return promptPassphrase(fmt.Sprintf("Enter passphrase for %s: ", filename))
+}
+
+// newKeyPassphrase returns the passphrase used to encrypt a new private key, or nil if new
+// keys should not be encrypted. The user is asked to confirm prompted passphrases.
+func newKeyPassphrase(filename string) ([]byte, error) {
+	if !viper.GetBool("EncryptKey") {
+		return nil, nil
+	} else if passphrase, err := configuredPassphrase(); err != nil || passphrase != nil {
+		return passphrase, err
+	}
+
+	passphrase, err := promptPassphrase(fmt.Sprintf("Enter new passphrase for %s: ", filename))
+	if err != nil {
+		return nil, err
+	} else if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase cannot be empty")
+	}
+
+	confirm, err := promptPassphrase("Enter same passphrase again: ")
+	if err != nil {
+		return nil, err
+	} else if !bytes.Equal(passphrase, confirm) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// caPassphrase returns the passphrase for the CA private key. This is separate from the
+// passphrase for other keys as new-cert may decrypt the CA key and encrypt a new key.
+func caPassphrase(filename string) ([]byte, error) {
+	if passphrase := viper.GetString("CAPassphrase"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return promptPassphrase(fmt.Sprintf("Enter passphrase for %s: ", filename))
+}
+
+// configuredPassphrase reads the passphrase from the environment or passphrase file.
+// It returns nil if neither is set.
+func configuredPassphrase() ([]byte, error) {
+	if passphrase := viper.GetString("Passphrase"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if filename := viper.GetString("PassphraseFile"); filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase file: %s", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	return nil, nil
+}
+
+// promptPassphrase reads a passphrase from the terminal without echoing it.
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, auth.ErrPassphraseRequired
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"crypto"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/blacklabeldata/kappa/auth"
+)
+
+// RenewCertCmd reissues an existing certificate.
+var RenewCertCmd = &cobra.Command{
+	Use:   "renew-cert",
+	Short: "renew-cert reissues an existing certificate with the same or a new key",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Create logger
+		writer := log.NewConcurrentWriter(os.Stdout)
+		logger := log.NewLogger(writer, "renew-cert")
+
+		err := InitializeConfig(writer)
+		if err != nil {
+			return
+		}
+
+		// Create file paths
+		pki := path.Join(".", "pki")
+		reqFile := path.Join(pki, "reqs", viper.GetString("Name")+".req")
+		privFile := path.Join(pki, "private", viper.GetString("Name")+".key")
+		crtFile := path.Join(pki, "public", viper.GetString("Name")+".crt")
+		caCrtFile := path.Join(pki, "ca.crt")
+		caKeyFile := path.Join(pki, "private", "ca.key")
+
+		// Read existing certificate
+		cert, err := auth.ReadX509Certificate(crtFile)
+		if err != nil {
+			logger.Warn("Error reading certificate", "file", crtFile, "err", err.Error())
+			return
+		}
+
+		// Load the existing key or generate a new one
+		var privatekey crypto.Signer
+		rekey := viper.GetBool("Rekey")
+		if rekey {
+			privatekey, err = auth.GenerateKey(viper.GetString("KeyType"), viper.GetInt("Bits"))
+		} else {
+			privatekey, err = auth.LoadEncryptedPrivateKey(privFile, keyPassphrase)
+		}
+		if err != nil {
+			logger.Warn("Error loading private key", "err", err.Error())
+			return
+		}
+
+		// Create Certificate
+		crt, err := auth.RenewCertificate(logger, caCrtFile, caKeyFile, caPassphrase, cert, privatekey, viper.GetInt("Years"))
+		if err != nil {
+			logger.Warn("Error renewing certificate", "err", err.Error())
+			return
+		}
+
+		// Save new key and certificate request if the key was rotated
+		if rekey {
+			_, req, err := auth.CreateCertificateRequest(logger, privatekey, viper.GetString("Name"),
+				strings.Join(cert.Subject.Organization, ","), strings.Join(cert.Subject.Country, ","),
+				auth.CertificateHosts(cert))
+			if err != nil {
+				logger.Warn("Error creating certificate request", "err", err.Error())
+				return
+			}
+
+			// Save cert request
+			auth.SaveCertificateRequest(logger, req, reqFile)
+
+			// Save private key
+			passphrase, err := newKeyPassphrase(privFile)
+			if err != nil {
+				logger.Warn("Error reading passphrase", "err", err.Error())
+				return
+			}
+			if err := auth.SaveEncryptedPrivateKey(logger, privatekey, privFile, passphrase); err != nil {
+				logger.Warn("Error saving private key", "err", err.Error())
+				return
+			}
+		}
+
+		// Save certificate with any intermediate CAs
+		chain, err := auth.CertificateChain(caCrtFile, crt)
+		if err != nil {
+			logger.Warn("Error reading CA certificate chain", "err", err.Error())
+			return
+		}
+		auth.SaveCertificateChain(logger, chain, crtFile)
+	},
+}
+
+// Pointer to RenewCertCmd used in initialization
+var renewCertCmd *cobra.Command
+
+// Command line args
+var (
+	Rekey bool
+)
+
+func init() {
+
+	RenewCertCmd.PersistentFlags().StringVarP(&Name, "name", "", "localhost", "Name of certificate")
+	RenewCertCmd.PersistentFlags().IntVarP(&Years, "years", "", 10, "Number of years until the certificate expires")
+	RenewCertCmd.PersistentFlags().BoolVarP(&Rekey, "rekey", "", false, "Generate a new private key for the certificate")
+	RenewCertCmd.PersistentFlags().StringVarP(&KeyType, "key-type", "", "rsa", "Type of new key: rsa, ecdsa-p256, ecdsa-p384 or ed25519")
+	RenewCertCmd.PersistentFlags().IntVarP(&KeyBits, "bits", "", 4096, "Number of bits in new key")
+	RenewCertCmd.PersistentFlags().BoolVarP(&EncryptKey, "encrypt", "", false, "Encrypt the new private key with a passphrase")
+	RenewCertCmd.PersistentFlags().StringVarP(&PassphraseFile, "passphrase-file", "", "", "File containing the private key passphrase")
+	renewCertCmd = RenewCertCmd
+}
+
+// InitializeRenewCertConfig sets up the command line options for renewing a certificate
+func InitializeRenewCertConfig(logger log.Logger) error {
+	viper.SetDefault("Rekey", "false")
+
+	if renewCertCmd.PersistentFlags().Lookup("name").Changed {
+		logger.Info("", "Name", Name)
+		viper.Set("Name", Name)
+	}
+	if renewCertCmd.PersistentFlags().Lookup("years").Changed {
+		logger.Info("", "Years", Years)
+		viper.Set("Years", Years)
+	}
+	if renewCertCmd.PersistentFlags().Lookup("rekey").Changed {
+		logger.Info("", "Rekey", Rekey)
+		viper.Set("Rekey", Rekey)
+	}
+	if renewCertCmd.PersistentFlags().Lookup("key-type").Changed {
+		logger.Info("", "KeyType", KeyType)
+		viper.Set("KeyType", KeyType)
+	}
+	if renewCertCmd.PersistentFlags().Lookup("encrypt").Changed {
+		logger.Info("", "EncryptKey", EncryptKey)
+		viper.Set("EncryptKey", EncryptKey)
+	}
+	if renewCertCmd.PersistentFlags().Lookup("passphrase-file").Changed {
+		logger.Info("", "PassphraseFile", PassphraseFile)
+		viper.Set("PassphraseFile", PassphraseFile)
+	}
+	if renewCertCmd.PersistentFlags().Lookup("bits").Changed {
+		logger.Info("", "Bits", KeyBits)
+		viper.Set("Bits", KeyBits)
+	}
+
+	return nil
+}
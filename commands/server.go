@@ -31,22 +31,30 @@ var ServerCmd = &cobra.Command{
 
 		// Create server config
 		cfg := server.DatabaseConfig{
-			LogOutput:             writer,
-			NodeName:              viper.GetString("NodeName"),
-			ClusterName:           viper.GetString("ClusterName"),
-			ExistingNodes:         strings.Split(viper.GetString("ClusterNodes"), ","),
-			Bootstrap:             viper.GetBool("Bootstrap"),
-			BootstrapExpect:       viper.GetInt("BootstrapExpect"),
-			AdminCertificateFile:  viper.GetString("AdminCert"),
-			CACertificateFile:     viper.GetString("CACert"),
-			DataPath:              viper.GetString("DataPath"),
-			SSHBindAddress:        viper.GetString("SSHListen"),
-			SSHPrivateKeyFile:     viper.GetString("SSHKey"),
-			SSHConnectionDeadline: time.Second,
-			GossipBindAddr:        viper.GetString("GossipBindAddr"),
-			GossipBindPort:        viper.GetInt("GossipBindPort"),
-			GossipAdvertiseAddr:   viper.GetString("GossipAdvertiseAddr"),
-			GossipAdvertisePort:   viper.GetInt("GossipAdvertisePort"),
+			LogOutput:                writer,
+			NodeName:                 viper.GetString("NodeName"),
+			ClusterName:              viper.GetString("ClusterName"),
+			ExistingNodes:            strings.Split(viper.GetString("ClusterNodes"), ","),
+			Bootstrap:                viper.GetBool("Bootstrap"),
+			BootstrapExpect:          viper.GetInt("BootstrapExpect"),
+			DiscardMetadata:          viper.GetBool("DiscardMetadata"),
+			AdminCertificateFile:     viper.GetString("AdminCert"),
+			CACertificateFile:        viper.GetString("CACert"),
+			DataPath:                 viper.GetString("DataPath"),
+			SSHBindAddress:           viper.GetString("SSHListen"),
+			SSHPrivateKeyFile:        viper.GetString("SSHKey"),
+			SSHPrivateKeyPassphrase:  keyPassphrase,
+			SSHCertificateFile:       viper.GetString("SSHCert"),
+			SSHHostCertificateFile:   viper.GetString("SSHHostCert"),
+			SSHConnectionDeadline:    time.Second,
+			CertificateExpiryWarning: viper.GetDuration("CertExpiryWarning"),
+			GossipBindAddr:           viper.GetString("GossipBindAddr"),
+			GossipBindPort:           viper.GetInt("GossipBindPort"),
+			GossipAdvertiseAddr:      viper.GetString("GossipAdvertiseAddr"),
+			GossipAdvertisePort:      viper.GetInt("GossipAdvertisePort"),
+			GossipEncryptKey:         viper.GetString("GossipEncryptKey"),
+			RaftBindAddr:             viper.GetString("RaftBindAddr"),
+			RaftBindPort:             viper.GetInt("RaftBindPort"),
 		}
 
 		// Create server
@@ -69,8 +77,12 @@ var ServerCmd = &cobra.Command{
 		// Wait for signal
 		logger.Info("Ready to serve requests")
 
-		// Block until signal is received
-		<-sig
+		// Block until signal is received or the server left the cluster
+		select {
+		case <-sig:
+		case <-svr.ShutdownCh():
+			logger.Info("Server left the cluster")
+		}
 
 		// Stop listening for signals and close channel
 		signal.Stop(sig)
@@ -89,6 +101,8 @@ var serverCmd *cobra.Command
 // Command line args
 var (
 	SSHKey              string
+	SSHCert             string
+	SSHHostCert         string
 	AdminCert           string
 	CACert              string
 	TLSCert             string
@@ -101,15 +115,22 @@ var (
 	ClusterNodes        string
 	Bootstrap           bool
 	BootstrapExpect     int
+	DiscardMetadata     bool
 	GossipBindAddr      string
 	GossipBindPort      int
 	GossipAdvertiseAddr string
 	GossipAdvertisePort int
+	GossipEncryptKey    string
+	RaftBindAddr        string
+	RaftBindPort        int
 )
 
 func init() {
 
 	ServerCmd.PersistentFlags().StringVarP(&SSHKey, "ssh-key", "", "", "Private key to identify server with")
+	ServerCmd.PersistentFlags().StringVarP(&PassphraseFile, "passphrase-file", "", "", "File containing the passphrase for an encrypted SSH key")
+	ServerCmd.PersistentFlags().StringVarP(&SSHCert, "ssh-cert", "", "", "Certificate for the server's private key")
+	ServerCmd.PersistentFlags().StringVarP(&SSHHostCert, "ssh-host-cert", "", "", "SSH host certificate signed by the CA")
 	ServerCmd.PersistentFlags().StringVarP(&AdminCert, "admin-cert", "", "", "Public certificate for admin user")
 	ServerCmd.PersistentFlags().StringVarP(&CACert, "ca-cert", "", "", "Root Certificate")
 	ServerCmd.PersistentFlags().StringVarP(&TLSCert, "tls-cert", "", "", "TLS certificate file")
@@ -123,13 +144,19 @@ func init() {
 	ServerCmd.PersistentFlags().StringVarP(&ClusterName, "cluster", "", "", "Cluster name")
 	ServerCmd.PersistentFlags().StringVarP(&ClusterNodes, "nodes", "", "", "Comma delimited list of IPs or domains")
 	ServerCmd.PersistentFlags().BoolVarP(&Bootstrap, "bootstrap", "", false, "Bootstrap node")
-	ServerCmd.PersistentFlags().IntVarP(&BootstrapExpect, "bootstrap-expect", "", 0, "Bootstrap node")
+	ServerCmd.PersistentFlags().IntVarP(&BootstrapExpect, "bootstrap-expect", "", 0, "Number of servers to wait for before bootstrapping")
+	ServerCmd.PersistentFlags().BoolVarP(&DiscardMetadata, "discard-metadata", "", false, "Discard local users and namespaces when joining a cluster")
 
 	// Memberlist
 	ServerCmd.PersistentFlags().StringVarP(&GossipBindAddr, "gossip-bind-addr", "", "", "Address for gossip")
 	ServerCmd.PersistentFlags().IntVarP(&GossipBindPort, "gossip-bind-port", "", 7946, "Port for gossip")
 	ServerCmd.PersistentFlags().StringVarP(&GossipAdvertiseAddr, "gossip-advert-addr", "", "", "Address to advertise gossip")
 	ServerCmd.PersistentFlags().IntVarP(&GossipAdvertisePort, "gossip-advert-port", "", 7946, "Port to advertise gossip")
+	ServerCmd.PersistentFlags().StringVarP(&GossipEncryptKey, "gossip-encrypt-key", "", "", "Base64 encoded key to encrypt gossip with until the keyring is created")
+
+	// Raft
+	ServerCmd.PersistentFlags().StringVarP(&RaftBindAddr, "raft-bind-addr", "", "", "Address for Raft replication")
+	ServerCmd.PersistentFlags().IntVarP(&RaftBindPort, "raft-bind-port", "", 7947, "Port for Raft replication")
 	serverCmd = ServerCmd
 }
 
@@ -151,6 +178,14 @@ func InitializeServerConfig(logger log.Logger) error {
 	viper.SetDefault("SSHKey", "ssh-identity.key")
 	viper.BindEnv("SSHKey", "KAPPA_SSH_KEY")
 
+	// SSHCert sets the certificate for the SSH server's private key
+	viper.SetDefault("SSHCert", "")
+	viper.BindEnv("SSHCert", "KAPPA_SSH_CERT")
+
+	// SSHHostCert sets the SSH host certificate presented to clients
+	viper.SetDefault("SSHHostCert", "")
+	viper.BindEnv("SSHHostCert", "KAPPA_SSH_HOST_CERT")
+
 	// TLSCert sets the certificate for HTTPS
 	viper.SetDefault("TLSCert", "tls-identity.crt")
 	viper.BindEnv("TLSCert", "KAPPA_TLS_CERT")
@@ -191,6 +226,10 @@ func InitializeServerConfig(logger log.Logger) error {
 	// BootstrapExpect is an argument used by Serf.
 	viper.SetDefault("BootstrapExpect", 0)
 
+	// DiscardMetadata allows a joining server to discard its unreplicated metadata.
+	viper.SetDefault("DiscardMetadata", false)
+	viper.BindEnv("DiscardMetadata", "KAPPA_DISCARD_METADATA")
+
 	// Memberlist config
 	// GossipBindAddr sets the Addr for cluster gossip.
 	viper.SetDefault("GossipBindAddr", "0.0.0.0")
@@ -210,6 +249,21 @@ func InitializeServerConfig(logger log.Logger) error {
 	viper.SetDefault("GossipAdvertisePort", 7946)
 	viper.BindEnv("GossipAdvertisePort", "KAPPA_GOSSIP_ADVERTISE_PORT")
 
+	// GossipEncryptKey encrypts gossip. It is saved to the keyring in the data
+	// directory, which is used instead once it exists.
+	viper.SetDefault("GossipEncryptKey", "")
+	viper.BindEnv("GossipEncryptKey", "KAPPA_GOSSIP_ENCRYPT_KEY")
+
+	// Raft config
+	// RaftBindAddr sets the Addr for replicating the system metadata.
+	viper.SetDefault("RaftBindAddr", "0.0.0.0")
+	viper.BindEnv("RaftBindAddr", "KAPPA_RAFT_BIND_ADDR")
+
+	// RaftBindPort sets the port for replicating the system metadata. The port
+	// is advertised to the other servers with the gossip address.
+	viper.SetDefault("RaftBindPort", 7947)
+	viper.BindEnv("RaftBindPort", "KAPPA_RAFT_BIND_PORT")
+
 	// Set viper flags
 	if serverCmd.PersistentFlags().Lookup("ca-cert").Changed {
 		logger.Info("", "CACert", CACert)
@@ -223,6 +277,18 @@ func InitializeServerConfig(logger log.Logger) error {
 		logger.Info("", "SSHKey", SSHKey)
 		viper.Set("SSHKey", SSHKey)
 	}
+	if serverCmd.PersistentFlags().Lookup("passphrase-file").Changed {
+		logger.Info("", "PassphraseFile", PassphraseFile)
+		viper.Set("PassphraseFile", PassphraseFile)
+	}
+	if serverCmd.PersistentFlags().Lookup("ssh-cert").Changed {
+		logger.Info("", "SSHCert", SSHCert)
+		viper.Set("SSHCert", SSHCert)
+	}
+	if serverCmd.PersistentFlags().Lookup("ssh-host-cert").Changed {
+		logger.Info("", "SSHHostCert", SSHHostCert)
+		viper.Set("SSHHostCert", SSHHostCert)
+	}
 	if serverCmd.PersistentFlags().Lookup("tls-cert").Changed {
 		logger.Info("", "TLSCert", TLSCert)
 		viper.Set("TLSCert", TLSCert)
@@ -265,6 +331,10 @@ func InitializeServerConfig(logger log.Logger) error {
 		logger.Info("", "BootstrapExpect", BootstrapExpect)
 		viper.Set("BootstrapExpect", BootstrapExpect)
 	}
+	if serverCmd.PersistentFlags().Lookup("discard-metadata").Changed {
+		logger.Info("", "DiscardMetadata", DiscardMetadata)
+		viper.Set("DiscardMetadata", DiscardMetadata)
+	}
 
 	// Memberlist Config
 	if serverCmd.PersistentFlags().Lookup("gossip-bind-addr").Changed {
@@ -283,6 +353,19 @@ func InitializeServerConfig(logger log.Logger) error {
 		logger.Info("", "GossipAdvertisePort", GossipAdvertisePort)
 		viper.Set("GossipAdvertisePort", GossipAdvertisePort)
 	}
+	if serverCmd.PersistentFlags().Lookup("gossip-encrypt-key").Changed {
+		viper.Set("GossipEncryptKey", GossipEncryptKey)
+	}
+
+	// Raft Config
+	if serverCmd.PersistentFlags().Lookup("raft-bind-addr").Changed {
+		logger.Info("", "RaftBindAddr", RaftBindAddr)
+		viper.Set("RaftBindAddr", RaftBindAddr)
+	}
+	if serverCmd.PersistentFlags().Lookup("raft-bind-port").Changed {
+		logger.Info("", "RaftBindPort", RaftBindPort)
+		viper.Set("RaftBindPort", RaftBindPort)
+	}
 
 	return nil
 }
@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/mgutz/logxi/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/blacklabeldata/kappa/auth"
+)
+
+// SignCSRCmd issues a certificate from an externally generated certificate request.
+var SignCSRCmd = &cobra.Command{
+	Use:   "sign-csr",
+	Short: "sign-csr issues a certificate from a certificate request generated on another machine",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Create logger
+		writer := log.NewConcurrentWriter(os.Stdout)
+		logger := log.NewLogger(writer, "sign-csr")
+
+		err := InitializeConfig(writer)
+		if err != nil {
+			return
+		}
+
+		// Setup directory structure
+		if err := auth.CreatePkiDirectories(logger, "."); err != nil {
+			return
+		}
+
+		// Read certificate request
+		csrFile := viper.GetString("CSR")
+		if csrFile == "" {
+			logger.Warn("A certificate request is required", "flag", "--csr")
+			return
+		}
+		csr, err := auth.ReadCertificateRequest(csrFile)
+		if err != nil {
+			logger.Warn("Error reading certificate request", "file", csrFile, "err", err.Error())
+			return
+		}
+
+		// Default the name and hosts to those in the request
+		name := csr.Subject.CommonName
+		if len(csr.Subject.OrganizationalUnit) > 0 {
+			name = csr.Subject.OrganizationalUnit[0]
+		}
+		if signCSRCmd.PersistentFlags().Lookup("name").Changed || name == "" {
+			name = viper.GetString("Name")
+		}
+		hosts := auth.CertificateHosts(&x509.Certificate{IPAddresses: csr.IPAddresses, DNSNames: csr.DNSNames})
+		if signCSRCmd.PersistentFlags().Lookup("hosts").Changed || hosts == "" {
+			hosts = viper.GetString("Hosts")
+		}
+		if name == "" || strings.ContainsAny(name, `/\`) || name == ".." {
+			logger.Warn("Invalid certificate name", "name", name)
+			return
+		}
+
+		// Create file paths
+		pki := path.Join(".", "pki")
+		reqFile := path.Join(pki, "reqs", name+".req")
+		crtFile := path.Join(pki, "public", name+".crt")
+		caCrtFile := path.Join(pki, "ca.crt")
+		caKeyFile := path.Join(pki, "private", "ca.key")
+
+		// Create Certificate
+		crt, err := auth.SignCertificateRequest(logger, caCrtFile, caKeyFile, caPassphrase, csr, csr.PublicKey, viper.GetInt("Years"), hosts)
+		if err != nil {
+			logger.Warn("Error creating certificate", "err", err.Error())
+			return
+		}
+
+		// Keep a copy of the cert request
+		req, err := ioutil.ReadFile(csrFile)
+		if err != nil {
+			logger.Warn("Error reading certificate request", "file", csrFile, "err", err.Error())
+			return
+		}
+		if err := ioutil.WriteFile(reqFile, req, 0644); err != nil {
+			logger.Warn("Error saving certificate request", "file", reqFile, "err", err.Error())
+			return
+		}
+
+		// Save certificate with any intermediate CAs
+		chain, err := auth.CertificateChain(caCrtFile, crt)
+		if err != nil {
+			logger.Warn("Error reading CA certificate chain", "err", err.Error())
+			return
+		}
+		auth.SaveCertificateChain(logger, chain, crtFile)
+	},
+}
+
+// Pointer to SignCSRCmd used in initialization
+var signCSRCmd *cobra.Command
+
+// Command line args
+var (
+	CSRFile string
+)
+
+func init() {
+
+	SignCSRCmd.PersistentFlags().StringVarP(&CSRFile, "csr", "", "", "Certificate request to sign")
+	SignCSRCmd.PersistentFlags().StringVarP(&Name, "name", "", "localhost", "Name of certificate, defaults to the name in the request")
+	SignCSRCmd.PersistentFlags().IntVarP(&Years, "years", "", 10, "Number of years until the certificate expires")
+	SignCSRCmd.PersistentFlags().StringVarP(&Hosts, "hosts", "", "127.0.0.1", "Comma delimited list of IPs or domains, defaults to the hosts in the request")
+	signCSRCmd = SignCSRCmd
+}
+
+// InitializeSignCSRConfig sets up the command line options for signing a certificate request
+func InitializeSignCSRConfig(logger log.Logger) error {
+
+	if signCSRCmd.PersistentFlags().Lookup("csr").Changed {
+		logger.Info("", "CSR", CSRFile)
+		viper.Set("CSR", CSRFile)
+	}
+	if signCSRCmd.PersistentFlags().Lookup("name").Changed {
+		logger.Info("", "Name", Name)
+		viper.Set("Name", Name)
+	}
+	if signCSRCmd.PersistentFlags().Lookup("years").Changed {
+		logger.Info("", "Years", Years)
+		viper.Set("Years", Years)
+	}
+	if signCSRCmd.PersistentFlags().Lookup("hosts").Changed {
+		logger.Info("", "Hosts", Hosts)
+		viper.Set("Hosts", Hosts)
+	}
+
+	return nil
+}
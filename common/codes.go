@@ -7,6 +7,7 @@ const (
 	OK StatusCode = iota + 2000
 	NamespaceAlreadyExists
 	UserAlreadyExists
+	LogAlreadyExists
 )
 
 // Authentication related error codes
@@ -21,6 +22,14 @@ const (
 	NamespaceDoesNotExist
 	UserDoesNotExist
 	CreateNamespaceError
+	ProtocolError
+	LogDoesNotExist
+	NoClusterLeader
+	InvalidOptions
+	LogNotAvailable
+	NotEnoughReplicas
+	PartitionDoesNotExist
+	KeyRequired
 )
 
 var statusCodes = map[StatusCode]string{
@@ -29,6 +38,7 @@ var statusCodes = map[StatusCode]string{
 	OK: "OK",
 	NamespaceAlreadyExists: "NamespaceAlreadyExists",
 	UserAlreadyExists:      "UserAlreadyExists",
+	LogAlreadyExists:       "LogAlreadyExists",
 
 	// Security errors
 	Unauthorized: "Unauthorized",
@@ -39,4 +49,20 @@ var statusCodes = map[StatusCode]string{
 	NamespaceDoesNotExist: "NamespaceDoesNotExist",
 	UserDoesNotExist:      "UserDoesNotExist",
 	CreateNamespaceError:  "CreateNamespaceError",
+	ProtocolError:         "ProtocolError",
+	LogDoesNotExist:       "LogDoesNotExist",
+	NoClusterLeader:       "NoClusterLeader",
+	InvalidOptions:        "InvalidOptions",
+	LogNotAvailable:       "LogNotAvailable",
+	NotEnoughReplicas:     "NotEnoughReplicas",
+	PartitionDoesNotExist: "PartitionDoesNotExist",
+	KeyRequired:           "KeyRequired",
+}
+
+// String returns the name of the status code
+func (c StatusCode) String() string {
+	if t, ok := statusCodes[c]; ok {
+		return t
+	}
+	return "Unknown"
 }
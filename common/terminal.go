@@ -33,3 +33,26 @@ func (t *basicTerminal) SetPrompt(p string) {
 	t.currentPrompt = p
 	t.term.SetPrompt(p)
 }
+
+// NewHeadlessTerminal creates a Terminal for sessions without a terminal, such as exec requests.
+// Prompt changes are recorded but never displayed.
+func NewHeadlessTerminal(prompt string) Terminal {
+	return &headlessTerminal{prompt, prompt}
+}
+
+type headlessTerminal struct {
+	defaultPrompt string
+	currentPrompt string
+}
+
+func (t *headlessTerminal) GetPrompt() string {
+	return t.currentPrompt
+}
+
+func (t *headlessTerminal) ResetPrompt() {
+	t.currentPrompt = t.defaultPrompt
+}
+
+func (t *headlessTerminal) SetPrompt(p string) {
+	t.currentPrompt = p
+}
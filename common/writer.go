@@ -1,8 +1,10 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
 )
 
 type ColorCodes struct {
@@ -40,10 +42,25 @@ var DefaultColorCodes = ColorCodes{
 	Reset:        []byte{keyEscape, '[', '0', 'm'},
 }
 
-// ResponseWriter writes data and status codes to the client
+// NoColorCodes disables colors for clients without a terminal
+var NoColorCodes = ColorCodes{}
+
+// ResultHandler receives structured responses, such as those sent over the binary protocol
+type ResultHandler interface {
+	Status(code StatusCode, message string) error
+	Error(code StatusCode, message string) error
+	Columns(names ...string) error
+	Row(values ...string) error
+}
+
+// ResponseWriter writes data and status codes to the client. If a Handler is set,
+// responses are passed to it instead of being written as text.
 type ResponseWriter struct {
-	Colors ColorCodes
-	Writer io.Writer
+	Colors  ColorCodes
+	Writer  io.Writer
+	Handler ResultHandler
+
+	failed bool
 }
 
 func (r *ResponseWriter) colorCode(color []byte, code StatusCode, format string, args ...interface{}) {
@@ -71,15 +88,66 @@ func (r *ResponseWriter) colorCode(color []byte, code StatusCode, format string,
 
 // Fail writes the error status code to the Writer
 func (r *ResponseWriter) Fail(code StatusCode, format string, args ...interface{}) {
+	r.failed = true
+	if r.Handler != nil {
+		r.Handler.Error(code, fmt.Sprintf(format, args...))
+		return
+	}
 	r.colorCode(r.Colors.LightRed, code, format, args...)
 }
 
 // Success writes the status code to the Writer
 func (r *ResponseWriter) Success(code StatusCode, format string, args ...interface{}) {
+	if r.Handler != nil {
+		r.Handler.Status(code, fmt.Sprintf(format, args...))
+		return
+	}
 	r.colorCode(r.Colors.LightGreen, code, format, args...)
 }
 
-// Write is a pass through function into the underlying Writer
+// Failed returns whether Fail has been called since the writer was created
+func (r *ResponseWriter) Failed() bool {
+	return r.failed
+}
+
+// Columns starts a result set. Column names are only sent to a Handler.
+func (r *ResponseWriter) Columns(names ...string) {
+	if r.Handler != nil {
+		r.Handler.Columns(names...)
+	}
+}
+
+// Row writes a row of the current result set
+func (r *ResponseWriter) Row(values ...string) {
+	if r.Handler != nil {
+		r.Handler.Row(values...)
+		return
+	}
+	r.Writer.Write([]byte(" " + strings.Join(values, " ") + "\r\n"))
+}
+
+// Write is a pass through function into the underlying Writer. Raw output is discarded
+// when a Handler is set.
 func (r *ResponseWriter) Write(data []byte) (int, error) {
+	if r.Handler != nil {
+		return len(data), nil
+	}
 	return r.Writer.Write(data)
 }
+
+// NewlineWriter converts the terminal line endings written by a ResponseWriter to plain
+// newlines for clients without a terminal
+func NewlineWriter(w io.Writer) io.Writer {
+	return &newlineWriter{w}
+}
+
+type newlineWriter struct {
+	w io.Writer
+}
+
+func (n *newlineWriter) Write(data []byte) (int, error) {
+	if _, err := n.w.Write(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
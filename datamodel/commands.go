@@ -0,0 +1,204 @@
+package datamodel
+
+import "fmt"
+
+// CommandType identifies a change to the system metadata
+type CommandType uint8
+
+const (
+	// CreateUserCommand creates the user named by Username
+	CreateUserCommand CommandType = iota
+
+	// DeleteUserCommand deletes the user named by Username
+	DeleteUserCommand
+
+	// SetPasswordCommand stores the Salt and SaltedPassword of a user
+	SetPasswordCommand
+
+	// AddUserRoleCommand gives a user a Role in a Namespace
+	AddUserRoleCommand
+
+	// RemoveUserRoleCommand removes a user's Role in a Namespace
+	RemoveUserRoleCommand
+
+	// AddPublicKeyCommand adds the PEM encoded certificate in Data to a user's key ring
+	AddPublicKeyCommand
+
+	// RemovePublicKeyCommand removes the key with the given Fingerprint from a user's key ring
+	RemovePublicKeyCommand
+
+	// CreateNamespaceCommand creates the namespace named by Namespace
+	CreateNamespaceCommand
+
+	// DeleteNamespaceCommand deletes the namespace named by Namespace
+	DeleteNamespaceCommand
+
+	// CreateChildNamespaceCommand creates the Child namespace of a Namespace
+	CreateChildNamespaceCommand
+
+	// AddNamespaceRoleCommand adds a Role to a Namespace
+	AddNamespaceRoleCommand
+
+	// RemoveNamespaceRoleCommand removes a Role from a Namespace
+	RemoveNamespaceRoleCommand
+
+	// GrantPermissionsCommand grants Permissions to a Role of a Namespace
+	GrantPermissionsCommand
+
+	// RevokePermissionCommand revokes a Permission from a Role of a Namespace
+	RevokePermissionCommand
+
+	// AddNamespaceUserCommand gives the user named by Username access to a Namespace
+	AddNamespaceUserCommand
+
+	// RemoveNamespaceUserCommand removes the access of the user named by Username to a Namespace
+	RemoveNamespaceUserCommand
+
+	// CreateLogCommand creates the Log
+	CreateLogCommand
+
+	// AssignLogCommand places the replicas of the partitions of the Log on servers
+	AssignLogCommand
+
+	// SetInSyncCommand stores the in-sync replicas of a Partition of the Log. The Log has
+	// the epoch and in-sync replicas as its only partition.
+	SetInSyncCommand
+)
+
+// Command is a change to the system metadata. Commands are replicated to every node and
+// applied to each node's store in the same order, so applying one must not depend on
+// anything other than the command and the store.
+type Command struct {
+	Type           CommandType
+	Username       string   `json:",omitempty"`
+	Namespace      string   `json:",omitempty"`
+	Child          string   `json:",omitempty"`
+	Role           string   `json:",omitempty"`
+	Permissions    []string `json:",omitempty"`
+	Permission     string   `json:",omitempty"`
+	Fingerprint    string   `json:",omitempty"`
+	Data           []byte   `json:",omitempty"`
+	Salt           []byte   `json:",omitempty"`
+	SaltedPassword []byte   `json:",omitempty"`
+	Log            *Log     `json:",omitempty"`
+	Partition      int      `json:",omitempty"`
+}
+
+// Apply makes the change described by the command. The fingerprint of an added public key
+// is returned as the result.
+func (s BoltSystemStore) Apply(cmd Command) (result string, err error) {
+	switch cmd.Type {
+	case CreateUserCommand, DeleteUserCommand, SetPasswordCommand, AddUserRoleCommand,
+		RemoveUserRoleCommand, AddPublicKeyCommand, RemovePublicKeyCommand:
+		return s.applyUserCommand(cmd)
+	case CreateNamespaceCommand, DeleteNamespaceCommand, CreateChildNamespaceCommand,
+		AddNamespaceRoleCommand, RemoveNamespaceRoleCommand, GrantPermissionsCommand,
+		RevokePermissionCommand, AddNamespaceUserCommand, RemoveNamespaceUserCommand:
+		return s.applyNamespaceCommand(cmd)
+	case CreateLogCommand, AssignLogCommand, SetInSyncCommand:
+		return s.applyLogCommand(cmd)
+	}
+	return "", fmt.Errorf("unknown command type %d", cmd.Type)
+}
+
+// applyUserCommand applies a change to the users keyspace
+func (s BoltSystemStore) applyUserCommand(cmd Command) (result string, err error) {
+	users, err := s.Users()
+	if err != nil {
+		return
+	}
+
+	switch cmd.Type {
+	case CreateUserCommand:
+		_, err = users.Create(cmd.Username)
+		return
+	case DeleteUserCommand:
+		err = users.Delete(cmd.Username)
+		return
+	}
+
+	user, err := users.Get(cmd.Username)
+	if err != nil {
+		return
+	}
+
+	switch cmd.Type {
+	case SetPasswordCommand:
+		err = user.(boltUser).setPassword(cmd.Salt, cmd.SaltedPassword)
+	case AddUserRoleCommand:
+		err = user.AddRole(cmd.Namespace, cmd.Role)
+	case RemoveUserRoleCommand:
+		err = user.RemoveRole(cmd.Namespace, cmd.Role)
+	case AddPublicKeyCommand:
+		result, err = user.KeyRing().AddPublicKey(cmd.Data)
+	case RemovePublicKeyCommand:
+		err = user.KeyRing().RemovePublicKey(cmd.Fingerprint)
+	}
+	return
+}
+
+// applyNamespaceCommand applies a change to the namespaces keyspace
+func (s BoltSystemStore) applyNamespaceCommand(cmd Command) (result string, err error) {
+	namespaces, err := s.Namespaces()
+	if err != nil {
+		return
+	}
+
+	switch cmd.Type {
+	case CreateNamespaceCommand:
+		_, err = namespaces.Create(cmd.Namespace)
+		return
+	case DeleteNamespaceCommand:
+		err = namespaces.Delete(cmd.Namespace)
+		return
+	}
+
+	ns, err := namespaces.Get(cmd.Namespace)
+	if err != nil {
+		return
+	}
+
+	switch cmd.Type {
+	case CreateChildNamespaceCommand:
+		_, err = ns.CreateChild(cmd.Child)
+	case AddNamespaceRoleCommand:
+		err = ns.AddRole(cmd.Role)
+	case RemoveNamespaceRoleCommand:
+		err = ns.RemoveRole(cmd.Role)
+	case GrantPermissionsCommand:
+		err = ns.GrantPermissions(cmd.Role, cmd.Permissions...)
+	case RevokePermissionCommand:
+		err = ns.RevokePermission(cmd.Role, cmd.Permission)
+	case AddNamespaceUserCommand:
+		err = ns.AddUser(cmd.Username)
+	case RemoveNamespaceUserCommand:
+		err = ns.RemoveUser(cmd.Username)
+	}
+	return
+}
+
+// applyLogCommand applies a change to the logs keyspace
+func (s BoltSystemStore) applyLogCommand(cmd Command) (result string, err error) {
+	if cmd.Log == nil {
+		return "", fmt.Errorf("command %d has no log", cmd.Type)
+	}
+
+	logs, err := s.Logs()
+	if err != nil {
+		return
+	}
+
+	switch cmd.Type {
+	case CreateLogCommand:
+		err = logs.Create(*cmd.Log)
+	case AssignLogCommand:
+		err = logs.Assign(cmd.Log.Name, cmd.Log.Partitions)
+	case SetInSyncCommand:
+		if len(cmd.Log.Partitions) != 1 {
+			return "", fmt.Errorf("command %d has %d partitions", cmd.Type, len(cmd.Log.Partitions))
+		}
+		p := cmd.Log.Partitions[0]
+		err = logs.SetInSync(cmd.Log.Name, cmd.Partition, p.Epoch, p.InSync)
+	}
+	return
+}
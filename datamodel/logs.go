@@ -0,0 +1,325 @@
+package datamodel
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/eliquious/leaf"
+)
+
+var (
+
+	// ErrLogDoesNotExist is returned if a log does not exist
+	ErrLogDoesNotExist = fmt.Errorf("log does not exist")
+
+	// ErrLogAlreadyExists is returned when a log is created twice
+	ErrLogAlreadyExists = fmt.Errorf("log already exists")
+
+	// ErrStaleEpoch is returned when the in-sync replicas of an older leader epoch are stored
+	ErrStaleEpoch = fmt.Errorf("partition has a newer leader epoch")
+)
+
+// AckLevel determines how many replicas must store a record before an insert succeeds.
+type AckLevel uint8
+
+const (
+	// AckQuorum waits for a majority of the replicas, including the leader
+	AckQuorum AckLevel = iota
+
+	// AckLeader only waits for the leader
+	AckLeader
+
+	// AckAll waits for every replica which is in sync with the leader
+	AckAll
+)
+
+var ackLevels = map[AckLevel]string{
+	AckQuorum: "quorum",
+	AckLeader: "leader",
+	AckAll:    "all",
+}
+
+// String returns the name of the ack level
+func (a AckLevel) String() string {
+	if name, ok := ackLevels[a]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseAckLevel returns the ack level with the given name
+func ParseAckLevel(name string) (AckLevel, error) {
+	for level, n := range ackLevels {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid acks '%s': must be leader, quorum or all", name)
+}
+
+// Log describes a log and the servers holding its replicas. Logs belong to a namespace
+// and are named "namespace.log". The records of a log are split into partitions by the
+// hash of their key, and each partition is replicated on its own servers.
+type Log struct {
+
+	// Name is the qualified name of the log
+	Name string
+
+	// Replicas is the number of servers holding a copy of each partition
+	Replicas int
+
+	// Acks is the number of replicas which acknowledge an insert
+	Acks AckLevel
+
+	// Key is the field records are clustered by. Logs without a key have one partition.
+	Key string `json:",omitempty"`
+
+	// Partitions are the partitions of the log. Their servers are assigned by the
+	// cluster leader after the log is created.
+	Partitions []Partition
+}
+
+// Partition is the placement of a partition of a log
+type Partition struct {
+
+	// Servers are the names of the servers holding a replica
+	Servers []string `json:",omitempty"`
+
+	// Leader is the server which appends records and replicates them to the others
+	Leader string `json:",omitempty"`
+
+	// Epoch increases every time the partition is given a new leader. Replicas tag
+	// records with it to find the ones a previous leader appended but never replicated.
+	Epoch uint64 `json:",omitempty"`
+
+	// InSync are the replicas, including the leader, which hold every acknowledged record
+	// as reported by the leader. Only they may take over as leader. If the leader never
+	// reported them, any replica may.
+	InSync []string `json:",omitempty"`
+}
+
+// Assigned determines if the partition's replicas have been placed on servers
+func (p Partition) Assigned() bool {
+	return p.Leader != ""
+}
+
+// HasReplica determines if the server holds a replica of the partition
+func (p Partition) HasReplica(server string) bool {
+	for _, s := range p.Servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+// CanLead determines if the server may take over as the leader of the partition
+func (p Partition) CanLead(server string) bool {
+	if !p.HasReplica(server) {
+		return false
+	} else if len(p.InSync) == 0 {
+		return true
+	}
+	for _, s := range p.InSync {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+// inSync returns the in-sync replicas which still hold a replica of the partition
+func (p Partition) inSync(servers []string) (inSync []string) {
+	for _, server := range servers {
+		if p.HasReplica(server) {
+			inSync = append(inSync, server)
+		}
+	}
+	return
+}
+
+// Namespace returns the namespace of the log
+func (l Log) Namespace() string {
+	if i := strings.LastIndex(l.Name, "."); i >= 0 {
+		return l.Name[:i]
+	}
+	return ""
+}
+
+// Assigned determines if the replicas of every partition have been placed on servers
+func (l Log) Assigned() bool {
+	for _, p := range l.Partitions {
+		if !p.Assigned() {
+			return false
+		}
+	}
+	return len(l.Partitions) > 0
+}
+
+// PartitionName returns the name under which a partition of the log is stored
+func (l Log) PartitionName(partition int) string {
+	return fmt.Sprintf("%s/%d", l.Name, partition)
+}
+
+// Partition returns the partition of a record with the given key. Keys are hashed with
+// 32-bit FNV-1a, so the same key is always stored in the same partition.
+func (l Log) Partition(key []byte) int {
+	if len(l.Partitions) <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(l.Partitions)))
+}
+
+// LogStore contains the logs of every namespace
+type LogStore interface {
+
+	// Get returns a log by name
+	Get(name string) (Log, error)
+
+	// Create adds a log to an existing namespace. The placement of its partitions is
+	// ignored, and a log without partitions is given one.
+	Create(log Log) error
+
+	// Assign places the replicas of every partition of a log on servers. The epoch of
+	// a partition increases when its leader changes; the given epochs are ignored.
+	// Servers which no longer hold a replica are removed from the in-sync replicas.
+	Assign(name string, partitions []Partition) error
+
+	// SetInSync stores the in-sync replicas of a partition reported by the leader of the
+	// given epoch. Reports of older epochs fail with ErrStaleEpoch.
+	SetInSync(name string, partition int, epoch uint64, servers []string) error
+
+	// List returns the logs sorted by name
+	List() ([]Log, error)
+}
+
+// NewBoltLogStore creates a new LogStore using the given keyspaces
+func NewBoltLogStore(logs, namespaces leaf.Keyspace) LogStore {
+	return &boltLogStore{logs, namespaces}
+}
+
+// boltLogStore stores each log as JSON under its name
+type boltLogStore struct {
+	ks         leaf.Keyspace
+	namespaces leaf.Keyspace
+}
+
+// Get returns a log by name
+func (b boltLogStore) Get(name string) (log Log, err error) {
+	err = ErrLogDoesNotExist
+	b.ks.ReadTx(func(bkt *bolt.Bucket) {
+		if data := bkt.Get([]byte(name)); data != nil {
+			err = json.Unmarshal(data, &log)
+		}
+	})
+	return
+}
+
+// Create adds a log to an existing namespace
+func (b boltLogStore) Create(log Log) (err error) {
+	if _, err = NewBoltNamespaceStore(b.namespaces).Get(log.Namespace()); err != nil {
+		return
+	}
+
+	if len(log.Partitions) == 0 {
+		log.Partitions = make([]Partition, 1)
+	} else {
+		log.Partitions = make([]Partition, len(log.Partitions))
+	}
+	data, err := json.Marshal(log)
+	if err != nil {
+		return
+	}
+
+	b.ks.WriteTx(func(bkt *bolt.Bucket) {
+		if bkt.Get([]byte(log.Name)) != nil {
+			err = ErrLogAlreadyExists
+			return
+		}
+		err = bkt.Put([]byte(log.Name), data)
+	})
+	return
+}
+
+// Assign places the replicas of every partition of a log on servers
+func (b boltLogStore) Assign(name string, partitions []Partition) (err error) {
+	b.ks.WriteTx(func(bkt *bolt.Bucket) {
+		data := bkt.Get([]byte(name))
+		if data == nil {
+			err = ErrLogDoesNotExist
+			return
+		}
+
+		var log Log
+		if err = json.Unmarshal(data, &log); err != nil {
+			return
+		}
+		if len(partitions) != len(log.Partitions) {
+			err = fmt.Errorf("log %s has %d partitions, got %d", name, len(log.Partitions), len(partitions))
+			return
+		}
+		for i, p := range partitions {
+			old := log.Partitions[i]
+			p.Epoch = old.Epoch
+			if p.Leader != old.Leader {
+				p.Epoch++
+			}
+			p.InSync = p.inSync(p.InSync)
+			log.Partitions[i] = p
+		}
+		if data, err = json.Marshal(log); err == nil {
+			err = bkt.Put([]byte(name), data)
+		}
+	})
+	return
+}
+
+// SetInSync stores the in-sync replicas of a partition reported by its leader
+func (b boltLogStore) SetInSync(name string, partition int, epoch uint64, servers []string) (err error) {
+	b.ks.WriteTx(func(bkt *bolt.Bucket) {
+		data := bkt.Get([]byte(name))
+		if data == nil {
+			err = ErrLogDoesNotExist
+			return
+		}
+
+		var log Log
+		if err = json.Unmarshal(data, &log); err != nil {
+			return
+		}
+		if partition < 0 || partition >= len(log.Partitions) {
+			err = fmt.Errorf("log %s has no partition %d", name, partition)
+			return
+		}
+		p := &log.Partitions[partition]
+		if epoch != p.Epoch {
+			err = ErrStaleEpoch
+			return
+		}
+		p.InSync = p.inSync(servers)
+		if data, err = json.Marshal(log); err == nil {
+			err = bkt.Put([]byte(name), data)
+		}
+	})
+	return
+}
+
+// List returns the logs sorted by name
+func (b boltLogStore) List() (logs []Log, err error) {
+	b.ks.ReadTx(func(bkt *bolt.Bucket) {
+		err = bkt.ForEach(func(k, v []byte) error {
+			var log Log
+			if err := json.Unmarshal(v, &log); err != nil {
+				return err
+			}
+			logs = append(logs, log)
+			return nil
+		})
+	})
+	return
+}
@@ -0,0 +1,162 @@
+package datamodel
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestLogTestSuite runs the LogTestSuite
+func TestLogTestSuite(t *testing.T) {
+	suite.Run(t, new(LogTestSuite))
+}
+
+// LogTestSuite tests the log metadata
+type LogTestSuite struct {
+	suite.Suite
+	Dir   string
+	Store *BoltSystemStore
+	Logs  LogStore
+}
+
+// SetupTest creates a store with the acme namespace
+func (suite *LogTestSuite) SetupTest() {
+	suite.Dir, _ = ioutil.TempDir("", "datamodel.test")
+
+	store, err := NewBoltSystemStore(path.Join(suite.Dir, "test.db"))
+	if err != nil {
+		suite.T().Log("Error creating database")
+		suite.T().FailNow()
+	}
+	suite.Store = store
+
+	namespaces, _ := store.Namespaces()
+	_, err = namespaces.Create("acme")
+	suite.Nil(err)
+	suite.Logs, err = store.Logs()
+	suite.Nil(err)
+}
+
+// TearDownTest closes the store and clears the test directory
+func (suite *LogTestSuite) TearDownTest() {
+	suite.Store.Close()
+	os.RemoveAll(suite.Dir)
+}
+
+// TestCreate ensures logs are created in existing namespaces
+func (suite *LogTestSuite) TestCreate() {
+	suite.Nil(suite.Logs.Create(Log{Name: "acme.events", Replicas: 3, Acks: AckAll, Partitions: []Partition{{Leader: "ignored"}}}))
+
+	log, err := suite.Logs.Get("acme.events")
+	suite.Nil(err)
+	suite.Equal(Log{Name: "acme.events", Replicas: 3, Acks: AckAll, Partitions: []Partition{{}}}, log)
+	suite.Equal("acme", log.Namespace())
+	suite.False(log.Assigned())
+
+	suite.Equal(ErrLogAlreadyExists, suite.Logs.Create(Log{Name: "acme.events", Replicas: 1}))
+	suite.Equal(ErrNamespaceDoesNotExist, suite.Logs.Create(Log{Name: "other.events", Replicas: 1}))
+
+	_, err = suite.Logs.Get("acme.missing")
+	suite.Equal(ErrLogDoesNotExist, err)
+}
+
+// TestCreatePartitioned ensures partitioned logs keep their key and partition count
+func (suite *LogTestSuite) TestCreatePartitioned() {
+	suite.Nil(suite.Logs.Create(Log{Name: "acme.events", Replicas: 1, Key: "user", Partitions: make([]Partition, 4)}))
+
+	log, err := suite.Logs.Get("acme.events")
+	suite.Nil(err)
+	suite.Equal("user", log.Key)
+	suite.Len(log.Partitions, 4)
+	suite.Equal("acme.events/3", log.PartitionName(3))
+}
+
+// TestAssign ensures the replicas of every partition are placed on servers
+func (suite *LogTestSuite) TestAssign() {
+	suite.Nil(suite.Logs.Create(Log{Name: "acme.events", Replicas: 2, Key: "user", Partitions: make([]Partition, 2)}))
+	suite.NotNil(suite.Logs.Assign("acme.events", []Partition{{Servers: []string{"node-1"}, Leader: "node-1"}}))
+
+	partitions := []Partition{
+		{Servers: []string{"node-1", "node-2"}, Leader: "node-1"},
+		{Servers: []string{"node-2", "node-3"}, Leader: "node-2"},
+	}
+	suite.Nil(suite.Logs.Assign("acme.events", partitions))
+
+	log, err := suite.Logs.Get("acme.events")
+	suite.Nil(err)
+	suite.True(log.Assigned())
+	suite.Equal("node-1", log.Partitions[0].Leader)
+	suite.True(log.Partitions[0].HasReplica("node-2"))
+	suite.False(log.Partitions[0].HasReplica("node-3"))
+	suite.True(log.Partitions[1].HasReplica("node-3"))
+
+	suite.Equal(ErrLogDoesNotExist, suite.Logs.Assign("acme.missing", partitions))
+}
+
+// TestSetInSync ensures the leader of the current epoch stores the in-sync replicas
+func (suite *LogTestSuite) TestSetInSync() {
+	suite.Nil(suite.Logs.Create(Log{Name: "acme.events", Replicas: 3}))
+	suite.Nil(suite.Logs.Assign("acme.events", []Partition{{Servers: []string{"node-1", "node-2", "node-3"}, Leader: "node-1"}}))
+
+	// Servers without a replica are ignored
+	suite.Nil(suite.Logs.SetInSync("acme.events", 0, 1, []string{"node-1", "node-3", "node-4"}))
+	log, _ := suite.Logs.Get("acme.events")
+	suite.Equal([]string{"node-1", "node-3"}, log.Partitions[0].InSync)
+	suite.True(log.Partitions[0].CanLead("node-3"))
+	suite.False(log.Partitions[0].CanLead("node-2"))
+
+	// Moved replicas are no longer in sync
+	suite.Nil(suite.Logs.Assign("acme.events", []Partition{{Servers: []string{"node-1", "node-2", "node-4"}, Leader: "node-1", InSync: log.Partitions[0].InSync}}))
+	log, _ = suite.Logs.Get("acme.events")
+	suite.Equal([]string{"node-1"}, log.Partitions[0].InSync)
+
+	// Reports of older epochs are rejected
+	suite.Nil(suite.Logs.Assign("acme.events", []Partition{{Servers: []string{"node-1", "node-2", "node-4"}, Leader: "node-2", InSync: []string{"node-1", "node-2"}}}))
+	suite.Equal(ErrStaleEpoch, suite.Logs.SetInSync("acme.events", 0, 1, []string{"node-1"}))
+	suite.NotNil(suite.Logs.SetInSync("acme.events", 1, 2, []string{"node-2"}))
+	suite.Equal(ErrLogDoesNotExist, suite.Logs.SetInSync("acme.missing", 0, 1, nil))
+}
+
+// TestPartition ensures records with the same key are stored in the same partition
+func (suite *LogTestSuite) TestPartition() {
+	log := Log{Name: "acme.events", Partitions: make([]Partition, 8)}
+	seen := make(map[int]bool)
+	for _, key := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		p := log.Partition([]byte(key))
+		suite.True(p >= 0 && p < 8)
+		suite.Equal(p, log.Partition([]byte(key)))
+		seen[p] = true
+	}
+	suite.True(len(seen) > 1)
+
+	// The hash is stable across releases
+	suite.Equal(int(0x4f9f2cab%8), log.Partition([]byte("hello")))
+	suite.Equal(0, Log{Name: "acme.events", Partitions: make([]Partition, 1)}.Partition([]byte("hello")))
+}
+
+// TestList ensures logs are listed by name
+func (suite *LogTestSuite) TestList() {
+	suite.Nil(suite.Logs.Create(Log{Name: "acme.views", Replicas: 1}))
+	suite.Nil(suite.Logs.Create(Log{Name: "acme.clicks", Replicas: 1}))
+
+	logs, err := suite.Logs.List()
+	suite.Nil(err)
+	suite.Len(logs, 2)
+	suite.Equal("acme.clicks", logs[0].Name)
+	suite.Equal("acme.views", logs[1].Name)
+}
+
+// TestParseAckLevel ensures ack levels are parsed by name
+func (suite *LogTestSuite) TestParseAckLevel() {
+	for name, level := range map[string]AckLevel{"leader": AckLeader, "QUORUM": AckQuorum, "all": AckAll} {
+		parsed, err := ParseAckLevel(name)
+		suite.Nil(err)
+		suite.Equal(level, parsed)
+	}
+	_, err := ParseAckLevel("some")
+	suite.NotNil(err)
+	suite.Equal("quorum", AckQuorum.String())
+}
@@ -0,0 +1,239 @@
+package datamodel
+
+// Applier applies a command to the system metadata of every node. It returns once the
+// command has been applied locally.
+type Applier func(cmd Command) (string, error)
+
+// NewReplicatedSystem returns a System which reads from the local store and makes changes
+// by applying commands, so that the changes can be replicated.
+func NewReplicatedSystem(local System, apply Applier) System {
+	return &replicatedSystem{local, apply}
+}
+
+// replicatedSystem implements the System interface on top of a local store and an Applier
+type replicatedSystem struct {
+	local System
+	apply Applier
+}
+
+// Users returns a UserStore
+func (s *replicatedSystem) Users() (UserStore, error) {
+	users, err := s.local.Users()
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedUserStore{users, s.apply}, nil
+}
+
+// Namespaces returns a NamespaceStore
+func (s *replicatedSystem) Namespaces() (NamespaceStore, error) {
+	namespaces, err := s.local.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedNamespaceStore{namespaces, s.apply}, nil
+}
+
+// Logs returns a LogStore
+func (s *replicatedSystem) Logs() (LogStore, error) {
+	logs, err := s.local.Logs()
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedLogStore{logs, s.apply}, nil
+}
+
+// Close closes the local store
+func (s *replicatedSystem) Close() {
+	s.local.Close()
+}
+
+// replicatedUserStore applies user changes as commands
+type replicatedUserStore struct {
+	local UserStore
+	apply Applier
+}
+
+// Get returns a User by username
+func (s *replicatedUserStore) Get(username string) (User, error) {
+	user, err := s.local.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedUser{user, s.apply}, nil
+}
+
+// Create inserts a new user
+func (s *replicatedUserStore) Create(username string) (User, error) {
+	if _, err := s.apply(Command{Type: CreateUserCommand, Username: username}); err != nil {
+		return nil, err
+	}
+	return s.Get(username)
+}
+
+// Delete removes a user account
+func (s *replicatedUserStore) Delete(username string) error {
+	_, err := s.apply(Command{Type: DeleteUserCommand, Username: username})
+	return err
+}
+
+// replicatedUser reads from the local user and applies changes as commands
+type replicatedUser struct {
+	User
+	apply Applier
+}
+
+// UpdatePassword salts the password before it is replicated so every node stores the same salt
+func (u *replicatedUser) UpdatePassword(password string) error {
+	salt, saltedpw, err := GenerateSalt([]byte(password))
+	if err != nil {
+		return err
+	}
+	_, err = u.apply(Command{Type: SetPasswordCommand, Username: u.Username(), Salt: salt, SaltedPassword: saltedpw})
+	return err
+}
+
+// KeyRing returns a PublicKeyRing containing all of a user's public keys
+func (u *replicatedUser) KeyRing() PublicKeyRing {
+	return &replicatedKeyRing{u.User.KeyRing(), u.Username(), u.apply}
+}
+
+// AddRole appends a role to namespace
+func (u *replicatedUser) AddRole(namespace, role string) error {
+	_, err := u.apply(Command{Type: AddUserRoleCommand, Username: u.Username(), Namespace: namespace, Role: role})
+	return err
+}
+
+// RemoveRole removed a role for a namespace
+func (u *replicatedUser) RemoveRole(namespace, role string) error {
+	_, err := u.apply(Command{Type: RemoveUserRoleCommand, Username: u.Username(), Namespace: namespace, Role: role})
+	return err
+}
+
+// replicatedKeyRing reads from the local key ring and applies changes as commands
+type replicatedKeyRing struct {
+	PublicKeyRing
+	username string
+	apply    Applier
+}
+
+// AddPublicKey adds a public key to the user's key ring
+func (k *replicatedKeyRing) AddPublicKey(pemBytes []byte) (string, error) {
+	return k.apply(Command{Type: AddPublicKeyCommand, Username: k.username, Data: pemBytes})
+}
+
+// RemovePublicKey removes a public key from the user's key ring
+func (k *replicatedKeyRing) RemovePublicKey(fingerprint string) error {
+	_, err := k.apply(Command{Type: RemovePublicKeyCommand, Username: k.username, Fingerprint: fingerprint})
+	return err
+}
+
+// replicatedNamespaceStore applies namespace changes as commands
+type replicatedNamespaceStore struct {
+	local NamespaceStore
+	apply Applier
+}
+
+// Get returns a Namespace by name
+func (s *replicatedNamespaceStore) Get(name string) (Namespace, error) {
+	ns, err := s.local.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedNamespace{ns, name, s}, nil
+}
+
+// Create inserts a new namespace
+func (s *replicatedNamespaceStore) Create(name string) (Namespace, error) {
+	if _, err := s.apply(Command{Type: CreateNamespaceCommand, Namespace: name}); err != nil {
+		return nil, err
+	}
+	return s.Get(name)
+}
+
+// Delete removes a namespace
+func (s *replicatedNamespaceStore) Delete(name string) error {
+	_, err := s.apply(Command{Type: DeleteNamespaceCommand, Namespace: name})
+	return err
+}
+
+// Stream returns a channel of namespaces
+func (s *replicatedNamespaceStore) Stream() chan string {
+	return s.local.Stream()
+}
+
+// replicatedNamespace reads from the local namespace and applies changes as commands
+type replicatedNamespace struct {
+	Namespace
+	name  string
+	store *replicatedNamespaceStore
+}
+
+// AddRole adds a new role to the namespace
+func (n *replicatedNamespace) AddRole(name string) error {
+	_, err := n.store.apply(Command{Type: AddNamespaceRoleCommand, Namespace: n.name, Role: name})
+	return err
+}
+
+// RemoveRole deletes a role from the namespace
+func (n *replicatedNamespace) RemoveRole(name string) error {
+	_, err := n.store.apply(Command{Type: RemoveNamespaceRoleCommand, Namespace: n.name, Role: name})
+	return err
+}
+
+// GrantPermissions appends permissions for the given role
+func (n *replicatedNamespace) GrantPermissions(role string, permissions ...string) error {
+	_, err := n.store.apply(Command{Type: GrantPermissionsCommand, Namespace: n.name, Role: role, Permissions: permissions})
+	return err
+}
+
+// RevokePermission removes a permission from the given role
+func (n *replicatedNamespace) RevokePermission(role string, permission string) error {
+	_, err := n.store.apply(Command{Type: RevokePermissionCommand, Namespace: n.name, Role: role, Permission: permission})
+	return err
+}
+
+// AddUser registers a user with the namespace
+func (n *replicatedNamespace) AddUser(username string) error {
+	_, err := n.store.apply(Command{Type: AddNamespaceUserCommand, Namespace: n.name, Username: username})
+	return err
+}
+
+// RemoveUser unregisters a user with the namespace
+func (n *replicatedNamespace) RemoveUser(username string) error {
+	_, err := n.store.apply(Command{Type: RemoveNamespaceUserCommand, Namespace: n.name, Username: username})
+	return err
+}
+
+// CreateChild makes a new child namespace with the same users and roles
+func (n *replicatedNamespace) CreateChild(child string) (Namespace, error) {
+	if _, err := n.store.apply(Command{Type: CreateChildNamespaceCommand, Namespace: n.name, Child: child}); err != nil {
+		return nil, err
+	}
+	return n.store.Get(child)
+}
+
+// replicatedLogStore applies log changes as commands
+type replicatedLogStore struct {
+	LogStore
+	apply Applier
+}
+
+// Create adds a log to an existing namespace
+func (s *replicatedLogStore) Create(log Log) error {
+	_, err := s.apply(Command{Type: CreateLogCommand, Log: &log})
+	return err
+}
+
+// Assign places the replicas of every partition of a log on servers
+func (s *replicatedLogStore) Assign(name string, partitions []Partition) error {
+	_, err := s.apply(Command{Type: AssignLogCommand, Log: &Log{Name: name, Partitions: partitions}})
+	return err
+}
+
+// SetInSync stores the in-sync replicas of a partition reported by its leader
+func (s *replicatedLogStore) SetInSync(name string, partition int, epoch uint64, servers []string) error {
+	placement := Partition{Epoch: epoch, InSync: servers}
+	_, err := s.apply(Command{Type: SetInSyncCommand, Log: &Log{Name: name, Partitions: []Partition{placement}}, Partition: partition})
+	return err
+}
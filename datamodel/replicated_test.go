@@ -0,0 +1,214 @@
+package datamodel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// TestReplicatedTestSuite runs the ReplicatedTestSuite
+func TestReplicatedTestSuite(t *testing.T) {
+	suite.Run(t, new(ReplicatedTestSuite))
+}
+
+// ReplicatedTestSuite tests changes made through commands and snapshots of the store
+type ReplicatedTestSuite struct {
+	suite.Suite
+	Dir      string
+	Store    *BoltSystemStore
+	System   System
+	Commands []Command
+}
+
+// SetupTest creates a store whose changes are recorded and applied directly
+func (suite *ReplicatedTestSuite) SetupTest() {
+	suite.Dir, _ = ioutil.TempDir("", "datamodel.test")
+
+	store, err := NewBoltSystemStore(path.Join(suite.Dir, "test.db"))
+	if err != nil {
+		suite.T().Log("Error creating database")
+		suite.T().FailNow()
+	}
+	suite.Store = store
+	suite.Commands = nil
+	suite.System = NewReplicatedSystem(store, func(cmd Command) (string, error) {
+		suite.Commands = append(suite.Commands, cmd)
+		return store.Apply(cmd)
+	})
+}
+
+// TearDownTest closes the store and clears the test directory
+func (suite *ReplicatedTestSuite) TearDownTest() {
+	suite.Store.Close()
+	os.RemoveAll(suite.Dir)
+}
+
+// TestUserCommands ensures user changes are applied as commands
+func (suite *ReplicatedTestSuite) TestUserCommands() {
+	users, err := suite.System.Users()
+	suite.Nil(err)
+
+	user, err := users.Create("bob")
+	suite.Nil(err)
+	suite.Nil(user.UpdatePassword("secret"))
+	suite.Nil(user.AddRole("acme", "reader"))
+
+	suite.True(user.ValidatePassword("secret"))
+	suite.Equal([]string{"reader"}, user.Roles("acme"))
+	suite.Equal([]CommandType{CreateUserCommand, SetPasswordCommand, AddUserRoleCommand}, suite.commandTypes())
+
+	suite.Nil(users.Delete("bob"))
+	_, err = users.Get("bob")
+	suite.Equal(ErrUserDoesNotExist, err)
+}
+
+// TestPasswordIsSaltedOnce ensures replaying a password change stores the same salt
+func (suite *ReplicatedTestSuite) TestPasswordIsSaltedOnce() {
+	users, _ := suite.System.Users()
+	user, err := users.Create("bob")
+	suite.Nil(err)
+	suite.Nil(user.UpdatePassword("secret"))
+
+	// Replay the change on another store
+	other, err := NewBoltSystemStore(path.Join(suite.Dir, "other.db"))
+	suite.Nil(err)
+	defer other.Close()
+	for _, cmd := range suite.Commands {
+		_, err := other.Apply(cmd)
+		suite.Nil(err)
+	}
+
+	otherUsers, _ := other.Users()
+	otherUser, err := otherUsers.Get("bob")
+	suite.Nil(err)
+	suite.True(otherUser.ValidatePassword("secret"))
+	suite.False(otherUser.ValidatePassword("other"))
+}
+
+// TestNamespaceCommands ensures namespace changes are applied as commands
+func (suite *ReplicatedTestSuite) TestNamespaceCommands() {
+	namespaces, err := suite.System.Namespaces()
+	suite.Nil(err)
+
+	ns, err := namespaces.Create("acme")
+	suite.Nil(err)
+	suite.Nil(ns.AddUser("bob"))
+	suite.Nil(ns.AddRole("admin"))
+	suite.Nil(ns.GrantPermissions("admin", "read", "write"))
+	suite.Nil(ns.RevokePermission("admin", "write"))
+
+	suite.True(ns.HasAccess("bob"))
+	suite.True(ns.HasPermission("admin", "read"))
+	suite.False(ns.HasPermission("admin", "write"))
+
+	child, err := ns.CreateChild("acme.prod")
+	suite.Nil(err)
+	suite.True(child.HasPermission("admin", "read"))
+	suite.Nil(child.AddUser("bob"))
+	suite.True(child.HasAccess("bob"))
+	suite.Nil(child.RemoveUser("bob"))
+	suite.False(child.HasAccess("bob"))
+
+	suite.Nil(namespaces.Delete("acme"))
+	_, err = namespaces.Get("acme")
+	suite.Equal(ErrNamespaceDoesNotExist, err)
+}
+
+// TestLogCommands ensures log changes are applied as commands
+func (suite *ReplicatedTestSuite) TestLogCommands() {
+	namespaces, _ := suite.System.Namespaces()
+	_, err := namespaces.Create("acme")
+	suite.Nil(err)
+
+	logs, err := suite.System.Logs()
+	suite.Nil(err)
+	suite.Nil(logs.Create(Log{Name: "acme.events", Replicas: 2, Acks: AckLeader}))
+	placement := []Partition{{Servers: []string{"node-1", "node-2"}, Leader: "node-2"}}
+	suite.Nil(logs.Assign("acme.events", placement))
+	suite.Equal(ErrLogAlreadyExists, logs.Create(Log{Name: "acme.events", Replicas: 1}))
+
+	log, err := logs.Get("acme.events")
+	suite.Nil(err)
+	placement[0].Epoch = 1
+	suite.Equal(Log{Name: "acme.events", Replicas: 2, Acks: AckLeader, Partitions: placement}, log)
+
+	suite.Nil(logs.SetInSync("acme.events", 0, 1, []string{"node-2"}))
+	log, err = logs.Get("acme.events")
+	suite.Nil(err)
+	suite.Equal([]string{"node-2"}, log.Partitions[0].InSync)
+	suite.Equal([]CommandType{CreateNamespaceCommand, CreateLogCommand, AssignLogCommand, CreateLogCommand, SetInSyncCommand}, suite.commandTypes())
+
+	// Logs are part of snapshots
+	snapshot, err := suite.Store.Snapshot()
+	suite.Nil(err)
+	var buf bytes.Buffer
+	suite.Nil(snapshot.Write(&buf))
+	other, err := NewBoltSystemStore(path.Join(suite.Dir, "other.db"))
+	suite.Nil(err)
+	defer other.Close()
+	suite.Nil(other.Restore(&buf))
+	otherLogs, _ := other.Logs()
+	restored, err := otherLogs.Get("acme.events")
+	suite.Nil(err)
+	suite.Equal(log, restored)
+}
+
+// TestFailedCommand ensures errors of applied commands are returned
+func (suite *ReplicatedTestSuite) TestFailedCommand() {
+	_, err := suite.Store.Apply(Command{Type: AddUserRoleCommand, Username: "nobody"})
+	suite.Equal(ErrUserDoesNotExist, err)
+
+	_, err = suite.Store.Apply(Command{Type: CommandType(255)})
+	suite.NotNil(err)
+}
+
+// TestSnapshotRestore ensures a snapshot replaces the contents of another store
+func (suite *ReplicatedTestSuite) TestSnapshotRestore() {
+	users, _ := suite.System.Users()
+	_, err := users.Create("bob")
+	suite.Nil(err)
+	namespaces, _ := suite.System.Namespaces()
+	ns, err := namespaces.Create("acme")
+	suite.Nil(err)
+	suite.Nil(ns.AddRole("admin"))
+
+	snapshot, err := suite.Store.Snapshot()
+	suite.Nil(err)
+	var buf bytes.Buffer
+	suite.Nil(snapshot.Write(&buf))
+
+	// Restore into a store with other data
+	other, err := NewBoltSystemStore(path.Join(suite.Dir, "other.db"))
+	suite.Nil(err)
+	defer other.Close()
+	otherUsers, _ := other.Users()
+	_, err = otherUsers.Create("alice")
+	suite.Nil(err)
+	suite.Nil(other.Restore(&buf))
+
+	_, err = otherUsers.Get("alice")
+	suite.Equal(ErrUserDoesNotExist, err)
+	_, err = otherUsers.Get("bob")
+	suite.Nil(err)
+	otherNamespaces, _ := other.Namespaces()
+	otherNS, err := otherNamespaces.Get("acme")
+	suite.Nil(err)
+	suite.Equal([]string{"admin"}, otherNS.Roles())
+
+	// Clear the store
+	suite.Nil(other.Clear())
+	_, err = otherUsers.Get("bob")
+	suite.Equal(ErrUserDoesNotExist, err)
+}
+
+// commandTypes returns the types of the applied commands
+func (suite *ReplicatedTestSuite) commandTypes() (types []CommandType) {
+	for _, cmd := range suite.Commands {
+		types = append(types, cmd.Type)
+	}
+	return
+}
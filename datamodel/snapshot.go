@@ -0,0 +1,154 @@
+package datamodel
+
+import (
+	"encoding/gob"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// keyspaces lists the keyspaces holding system metadata
+var keyspaces = []string{Users, Namespaces, Logs}
+
+// bucketCopy holds the keys and nested buckets of a bolt bucket
+type bucketCopy struct {
+	Values  map[string][]byte
+	Buckets map[string]*bucketCopy
+}
+
+// Snapshot is a point-in-time copy of the system metadata
+type Snapshot struct {
+	keyspaces map[string]*bucketCopy
+}
+
+// Snapshot copies the system metadata. The copy is held in memory so it can be written
+// while the store continues to change.
+func (s BoltSystemStore) Snapshot() (*Snapshot, error) {
+	snapshot := &Snapshot{make(map[string]*bucketCopy)}
+	for _, name := range keyspaces {
+		ks, err := s.db.GetOrCreateKeyspace(name)
+		if err != nil {
+			return nil, err
+		}
+
+		ks.ReadTx(func(bkt *bolt.Bucket) {
+			snapshot.keyspaces[name] = copyBucket(bkt)
+		})
+	}
+	return snapshot, nil
+}
+
+// Write encodes the snapshot so it can be read by Restore
+func (s *Snapshot) Write(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(s.keyspaces)
+}
+
+// Restore replaces the system metadata with a snapshot written by Snapshot.Write
+func (s BoltSystemStore) Restore(r io.Reader) error {
+	copies := make(map[string]*bucketCopy)
+	if err := gob.NewDecoder(r).Decode(&copies); err != nil {
+		return err
+	}
+	return s.load(copies)
+}
+
+// Empty determines if the store holds no system metadata
+func (s BoltSystemStore) Empty() (bool, error) {
+	empty := true
+	for _, name := range keyspaces {
+		ks, err := s.db.GetOrCreateKeyspace(name)
+		if err != nil {
+			return false, err
+		}
+
+		ks.ReadTx(func(bkt *bolt.Bucket) {
+			if k, _ := bkt.Cursor().First(); k != nil {
+				empty = false
+			}
+		})
+	}
+	return empty, nil
+}
+
+// Clear removes all the system metadata
+func (s BoltSystemStore) Clear() error {
+	return s.load(nil)
+}
+
+// load replaces the contents of each keyspace with its copy
+func (s BoltSystemStore) load(copies map[string]*bucketCopy) error {
+	for _, name := range keyspaces {
+		ks, err := s.db.GetOrCreateKeyspace(name)
+		if err != nil {
+			return err
+		}
+
+		ks.WriteTx(func(bkt *bolt.Bucket) {
+			if err = clearBucket(bkt); err == nil && copies[name] != nil {
+				err = writeBucket(bkt, copies[name])
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBucket recursively copies a bucket
+func copyBucket(bkt *bolt.Bucket) *bucketCopy {
+	c := &bucketCopy{make(map[string][]byte), make(map[string]*bucketCopy)}
+	bkt.ForEach(func(k, v []byte) error {
+		if v == nil {
+			c.Buckets[string(k)] = copyBucket(bkt.Bucket(k))
+		} else {
+			c.Values[string(k)] = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return c
+}
+
+// clearBucket deletes the keys and nested buckets of a bucket
+func clearBucket(bkt *bolt.Bucket) error {
+	var keys, buckets [][]byte
+	bkt.ForEach(func(k, v []byte) error {
+		if v == nil {
+			buckets = append(buckets, append([]byte{}, k...))
+		} else {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+
+	for _, k := range keys {
+		if err := bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	for _, k := range buckets {
+		if err := bkt.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBucket recursively writes a copy into an empty bucket
+func writeBucket(bkt *bolt.Bucket, c *bucketCopy) error {
+	for k, v := range c.Values {
+		if err := bkt.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	for k, nested := range c.Buckets {
+		child, err := bkt.CreateBucket([]byte(k))
+		if err != nil {
+			return err
+		}
+		if err := writeBucket(child, nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,18 +9,31 @@ const (
 
     // Namespaces is the name of the namespace keyspace
     Namespaces = "namespaces"
+
+    // Logs is the name of the log keyspace
+    Logs = "logs"
 )
 
 // System provides an interface for accessing information about the database.
 type System interface {
     Users() (UserStore, error)
     Namespaces() (NamespaceStore, error)
+    Logs() (LogStore, error)
 
     Close()
 }
 
 // NewSystem creates a database connection to access system metadata
 func NewSystem(filename string) (System, error) {
+    store, err := NewBoltSystemStore(filename)
+    if err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+// NewBoltSystemStore creates a database connection to access and replicate system metadata
+func NewBoltSystemStore(filename string) (*BoltSystemStore, error) {
     leaf, err := leaf.NewLeaf(filename)
     if err != nil {
         return nil, err
@@ -51,6 +64,19 @@ func (s BoltSystemStore) Namespaces() (NamespaceStore, error) {
     return NewBoltNamespaceStore(ks), nil
 }
 
+// Logs returns a LogStore
+func (s BoltSystemStore) Logs() (LogStore, error) {
+    ks, err := s.db.GetOrCreateKeyspace(Logs)
+    if err != nil {
+        return nil, err
+    }
+    namespaces, err := s.db.GetOrCreateKeyspace(Namespaces)
+    if err != nil {
+        return nil, err
+    }
+    return NewBoltLogStore(ks, namespaces), nil
+}
+
 // Close closes the database connection
 func (s BoltSystemStore) Close() {
     s.db.Close()
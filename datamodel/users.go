@@ -205,7 +205,19 @@ func (b boltUser) ValidatePassword(password string) (match bool) {
 }
 
 // UpdatePassword updates a user's password. This password is only used to log into the web ui.
-func (b boltUser) UpdatePassword(password string) (err error) {
+func (b boltUser) UpdatePassword(password string) error {
+
+    // Generate salt and salted password
+    salt, saltedpw, err := GenerateSalt([]byte(password))
+    if err != nil {
+        return err
+    }
+    return b.setPassword(salt, saltedpw)
+}
+
+// setPassword stores a salted password. It is separate from UpdatePassword so a
+// replicated password change stores the same salt on every node.
+func (b boltUser) setPassword(salt, saltedpw []byte) (err error) {
     b.users.WriteTx(func(bkt *bolt.Bucket) {
 
         // Get user bucket
@@ -217,12 +229,6 @@ func (b boltUser) UpdatePassword(password string) (err error) {
             return
         }
 
-        // Generate salt and salted password
-        salt, saltedpw, err := GenerateSalt([]byte(password))
-        if err != nil {
-            return
-        }
-
         // Save salt
         if err = user.Put([]byte("salt"), salt); err != nil {
             return
@@ -3,7 +3,6 @@ package datamodel
 import (
     "bytes"
     "crypto/rand"
-    "crypto/rsa"
     "crypto/sha256"
     "crypto/x509"
     "encoding/pem"
@@ -520,9 +519,13 @@ func (suite *UserTestSuite) TestRemoveRoleMultiple() {
 }
 
 func (suite *UserTestSuite) generateCertificate() []byte {
+    return suite.generateCertificateWithKeyType(auth.KeyTypeRSA)
+}
+
+func (suite *UserTestSuite) generateCertificateWithKeyType(keyType string) []byte {
 
     // generate private key
-    privatekey, err := rsa.GenerateKey(rand.Reader, 2048)
+    privatekey, err := auth.GenerateKey(keyType, 2048)
     suite.Nil(err)
 
     // Create Certificate request
@@ -545,8 +548,7 @@ func (suite *UserTestSuite) generateCertificate() []byte {
         SubjectKeyId:          subjectKeyID,
         SerialNumber:          serialNumber,
         Subject:               csr.Subject,
-        PublicKeyAlgorithm:    x509.RSA,
-        SignatureAlgorithm:    x509.SHA512WithRSA,
+        SignatureAlgorithm:    auth.SignatureAlgorithm(privatekey),
         NotBefore:             time.Now().Add(-600).UTC(),
         NotAfter:              time.Now().AddDate(10, 0, 0).UTC(),
         IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
@@ -564,7 +566,7 @@ func (suite *UserTestSuite) generateCertificate() []byte {
     }
 
     // Create cert
-    crt, err := x509.CreateCertificate(rand.Reader, template, template, &privatekey.PublicKey, privatekey)
+    crt, err := x509.CreateCertificate(rand.Reader, template, template, privatekey.Public(), privatekey)
     suite.Nil(err)
 
     return crt
@@ -623,6 +625,35 @@ func (suite *UserTestSuite) TestAddPublicKey() {
     })
 }
 
+func (suite *UserTestSuite) TestAddPublicKeyTypes() {
+    for _, keyType := range []string{auth.KeyTypeECDSAP256, auth.KeyTypeECDSAP384, auth.KeyTypeEd25519} {
+        name := "acme.user.add." + keyType
+
+        // Create Certificate
+        crt := suite.generateCertificateWithKeyType(keyType)
+
+        // Create user
+        user, err := suite.US.Create(name)
+        suite.Nil(err)
+
+        // Encode cert
+        pemFile := new(bytes.Buffer)
+        pem.Encode(pemFile, &pem.Block{Type: "CERTIFICATE", Bytes: crt})
+
+        // Add key
+        keyRing := user.KeyRing()
+        _, err = keyRing.AddPublicKey(pemFile.Bytes())
+        suite.Nil(err, keyType)
+
+        // Verify the SSH formatted key is in the key ring
+        pub, err := x509.ParseCertificate(crt)
+        suite.Nil(err)
+        sshKey, err := ssh.NewPublicKey(pub.PublicKey)
+        suite.Nil(err)
+        suite.True(keyRing.Contains(sshKey.Marshal()), keyType)
+    }
+}
+
 func (suite *UserTestSuite) TestAddPublicKeyInvalidCertificate() {
     name := "acme.user.add.key"
 
@@ -0,0 +1,262 @@
+package executor
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/skl"
+)
+
+// Cluster gathers information from the servers of the cluster.
+type Cluster interface {
+
+	// Nodes asks every server for its status. Servers which did not answer in time are
+	// returned without their status.
+	Nodes() ([]NodeStatus, error)
+
+	// Sessions returns the client sessions of this server, or of every server if cluster
+	// is set.
+	Sessions(cluster bool) ([]NodeSessions, error)
+}
+
+// NodeStatus describes a server of the cluster. Only the name, address and gossip status
+// are known for servers which did not answer.
+type NodeStatus struct {
+	Name     string
+	Addr     string
+	Gossip   string
+	Answered bool
+
+	Build     string
+	Started   time.Time
+	Raft      string
+	DiskUsage int64
+	Sessions  int
+	Replicas  int
+	Leading   int
+}
+
+// NodeSessions lists the client sessions of a server. Total may exceed the number of
+// sessions listed if the list was cut short.
+type NodeSessions struct {
+	Name     string
+	Answered bool
+	Sessions []SessionInfo
+	Total    int
+}
+
+// SessionInfo describes a client session
+type SessionInfo struct {
+	User    string
+	Kind    string
+	Remote  string
+	Started time.Time
+}
+
+// The servers of the cluster are listed with their status. Only the admin can see them.
+func (e *Executor) handleShowNodes(w *common.ResponseWriter, stmt skl.Statement) {
+	if _, ok := stmt.(*skl.ShowNodesStatement); !ok {
+		w.Fail(common.InvalidStatementType, "expected *ShowNodesStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+	nodes, ok := e.nodes(w)
+	if !ok {
+		return
+	}
+
+	// Stream nodes
+	w.Columns("node", "address", "gossip", "answered", "raft", "build", "uptime", "sessions", "disk", "replicas", "leading")
+	w.Write(w.Colors.LightYellow)
+	for _, n := range nodes {
+		if !n.Answered {
+			w.Row(n.Name, n.Addr, n.Gossip, "no", "", "", "", "", "", "", "")
+			continue
+		}
+		w.Row(n.Name, n.Addr, n.Gossip, "yes", n.Raft, n.Build, uptime(n.Started), strconv.Itoa(n.Sessions),
+			formatBytes(n.DiskUsage), strconv.Itoa(n.Replicas), strconv.Itoa(n.Leading))
+	}
+	w.Write(w.Colors.Reset)
+
+	w.Success(common.OK, "%s", unanswered(nodes))
+}
+
+// The health of each server is listed, followed by a summary of the cluster. A server is
+// healthy if it is alive and answered. The partitions led by other servers are offline.
+func (e *Executor) handleShowHealth(w *common.ResponseWriter, stmt skl.Statement) {
+	if _, ok := stmt.(*skl.ShowHealthStatement); !ok {
+		w.Fail(common.InvalidStatementType, "expected *ShowHealthStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+	nodes, ok := e.nodes(w)
+	if !ok {
+		return
+	}
+
+	// Stream the health of the nodes
+	healthy := make(map[string]bool)
+	var leaders []string
+	w.Columns("node", "gossip", "answered", "raft", "health")
+	w.Write(w.Colors.LightYellow)
+	for _, n := range nodes {
+		health := n.Gossip
+		if n.Answered && n.Gossip == "alive" {
+			health = "ok"
+			healthy[n.Name] = true
+		} else if n.Gossip == "alive" {
+			health = "unreachable"
+		}
+		if n.Answered && n.Raft == "Leader" {
+			leaders = append(leaders, n.Name)
+		}
+
+		answered := "no"
+		if n.Answered {
+			answered = "yes"
+		}
+		w.Row(n.Name, n.Gossip, answered, n.Raft, health)
+	}
+	w.Write(w.Colors.Reset)
+
+	// Count the partitions without an available leader
+	logStore, err := e.system.Logs()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return
+	}
+	logs, err := logStore.List()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return
+	}
+	offline := 0
+	for _, log := range logs {
+		for _, p := range log.Partitions {
+			if p.Assigned() && !healthy[p.Leader] {
+				offline++
+			}
+		}
+	}
+
+	// Summarize
+	var problems []string
+	if len(healthy) < len(nodes) {
+		problems = append(problems, fmt.Sprintf("%d of %d nodes are unhealthy", len(nodes)-len(healthy), len(nodes)))
+	}
+	if len(leaders) == 0 {
+		problems = append(problems, "no leader answered")
+	}
+	if offline > 0 {
+		problems = append(problems, fmt.Sprintf("%d partitions are offline", offline))
+	}
+	if len(problems) > 0 {
+		w.Success(common.OK, "cluster is degraded: %s", strings.Join(problems, ", "))
+		return
+	}
+	w.Success(common.OK, "cluster is healthy: %d nodes, leader %s", len(nodes), leaders[0])
+}
+
+// The client sessions of this server, or of every server, are listed. Only the admin can
+// see them.
+func (e *Executor) handleShowSessions(w *common.ResponseWriter, stmt skl.Statement) {
+	showStatement, ok := stmt.(*skl.ShowSessionsStatement)
+	if !ok {
+		w.Fail(common.InvalidStatementType, "expected *ShowSessionsStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+	if !e.clusterAccess(w) {
+		return
+	}
+
+	nodes, err := e.cluster.Sessions(showStatement.OnCluster())
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not query the cluster: %s", err.Error())
+		return
+	}
+
+	// Stream sessions
+	var missing, truncated []string
+	w.Columns("node", "user", "kind", "remote", "since")
+	w.Write(w.Colors.LightYellow)
+	for _, n := range nodes {
+		if !n.Answered {
+			missing = append(missing, n.Name)
+			continue
+		} else if n.Total > len(n.Sessions) {
+			truncated = append(truncated, fmt.Sprintf("%d more on %s", n.Total-len(n.Sessions), n.Name))
+		}
+		for _, s := range n.Sessions {
+			w.Row(n.Name, s.User, s.Kind, s.Remote, s.Started.UTC().Format(time.RFC3339))
+		}
+	}
+	w.Write(w.Colors.Reset)
+
+	var notes []string
+	notes = append(notes, truncated...)
+	if len(missing) > 0 {
+		notes = append(notes, "no answer from "+strings.Join(missing, ", "))
+	}
+	w.Success(common.OK, "%s", strings.Join(notes, "; "))
+}
+
+// nodes queries the status of the servers. It returns false if the response failed.
+func (e *Executor) nodes(w *common.ResponseWriter) ([]NodeStatus, bool) {
+	if !e.clusterAccess(w) {
+		return nil, false
+	}
+
+	nodes, err := e.cluster.Nodes()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not query the cluster: %s", err.Error())
+		return nil, false
+	}
+	return nodes, true
+}
+
+// clusterAccess ensures the session user is the admin and the cluster can be queried.
+func (e *Executor) clusterAccess(w *common.ResponseWriter) bool {
+	if !e.session.user.IsAdmin() {
+		w.Fail(common.Unauthorized, "only the admin can inspect the cluster")
+		return false
+	} else if e.cluster == nil {
+		w.Fail(common.InternalServerError, "cluster information is not available")
+		return false
+	}
+	return true
+}
+
+// unanswered lists the servers which did not answer.
+func unanswered(nodes []NodeStatus) string {
+	var missing []string
+	for _, n := range nodes {
+		if !n.Answered {
+			missing = append(missing, n.Name)
+		}
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+	return "no answer from " + strings.Join(missing, ", ")
+}
+
+// uptime returns the time since a server started, in whole seconds.
+func uptime(started time.Time) string {
+	return (time.Since(started) / time.Second * time.Second).String()
+}
+
+// formatBytes returns a size with a binary unit.
+func formatBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size, unit := float64(n), 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
@@ -14,8 +14,11 @@ func NewSession(ns string, user datamodel.User) Session {
 	return Session{ns, user}
 }
 
-func NewExecutor(session Session, term common.Terminal, sys datamodel.System) *Executor {
-	return &Executor{session, term, sys}
+// NewExecutor creates an Executor. If forwarder is nil, every statement is executed locally.
+// Statements about the servers of the cluster fail if cluster is nil, and logs cannot be
+// read if logs is nil.
+func NewExecutor(session Session, term common.Terminal, sys datamodel.System, forwarder Forwarder, cluster Cluster, logs LogReader) *Executor {
+	return &Executor{session, term, sys, forwarder, cluster, logs}
 }
 
 // Session provides session and connection related information
@@ -24,11 +27,24 @@ type Session struct {
 	user      datamodel.User
 }
 
+// Namespace returns the namespace selected by the session
+func (s Session) Namespace() string {
+	return s.namespace
+}
+
+// User returns the session user
+func (s Session) User() datamodel.User {
+	return s.user
+}
+
 // Executor executes successfully parsed queries
 type Executor struct {
-	session  Session
-	terminal common.Terminal
-	system   datamodel.System
+	session   Session
+	terminal  common.Terminal
+	system    datamodel.System
+	forwarder Forwarder
+	cluster   Cluster
+	logs      LogReader
 }
 
 // Execute processes each statement
@@ -40,6 +56,11 @@ func (e *Executor) Execute(w *common.ResponseWriter, stmt skl.Statement) {
 		return
 	}
 
+	// Writes are executed by the cluster leader
+	if e.forwarder != nil && IsWrite(stmt) && e.forwarder.Forward(w, e.session, stmt) {
+		return
+	}
+
 	switch stmt.NodeType() {
 	case skl.UseNamespaceType:
 		e.handleUseStatement(w, stmt)
@@ -47,6 +68,24 @@ func (e *Executor) Execute(w *common.ResponseWriter, stmt skl.Statement) {
 		e.handleCreateNamespace(w, stmt)
 	case skl.ShowNamespaceType:
 		e.handleShowNamespace(w, stmt)
+	case skl.CreateLogType:
+		e.handleCreateLog(w, stmt)
+	case skl.ShowLogsType:
+		e.handleShowLogs(w, stmt)
+	case skl.ShowPartitionsType:
+		e.handleShowPartitions(w, stmt)
+	case skl.ShowNodesType:
+		e.handleShowNodes(w, stmt)
+	case skl.ShowHealthType:
+		e.handleShowHealth(w, stmt)
+	case skl.ShowSessionsType:
+		e.handleShowSessions(w, stmt)
+	case skl.SelectType:
+		e.handleSelect(w, stmt)
+	case skl.SubscribeType:
+		e.handleSubscribe(w, stmt)
+	default:
+		w.Fail(common.InvalidStatementType, "statement is not supported: %s", stmt.String())
 	}
 }
 
@@ -225,18 +264,20 @@ func (e *Executor) handleShowNamespace(w *common.ResponseWriter, stmt skl.Statem
 		}
 
 		// Stream namespaces
+		w.Columns("namespace")
 		w.Write(w.Colors.LightYellow)
 		namespaces := namespaceStore.Stream()
 		for name := range namespaces {
-			w.Write([]byte(" " + name + "\r\n"))
+			w.Row(name)
 		}
 		w.Write(w.Colors.Reset)
 	} else {
 
 		// List namespaces
+		w.Columns("namespace")
 		w.Write(w.Colors.Yellow)
 		for _, name := range user.Namespaces() {
-			w.Write([]byte(" " + name + "\r\n"))
+			w.Row(name)
 		}
 		w.Write(w.Colors.Reset)
 	}
@@ -0,0 +1,24 @@
+package executor
+
+import (
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/skl"
+)
+
+// Forwarder sends statements which change the cluster to the leader.
+type Forwarder interface {
+
+	// Forward executes the statement on the leader as the session user and writes the
+	// leader's response. It returns false if the statement should be executed locally
+	// because this server is the leader.
+	Forward(w *common.ResponseWriter, session Session, stmt skl.Statement) bool
+}
+
+// IsWrite determines if a statement changes the system metadata or appends to a log.
+func IsWrite(stmt skl.Statement) bool {
+	switch stmt.NodeType() {
+	case skl.CreateNamespaceType, skl.DropNamespaceType, skl.CreateLogType:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package executor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/skl"
+)
+
+// LogReader reads the records of logs.
+type LogReader interface {
+
+	// Read passes the records of one partition of a log, or of every partition if partition
+	// is skl.AllPartitions, to emit as they arrive, starting at the offset from. The records
+	// of several partitions are merged. Unless follow is true, Read returns once the records
+	// which were committed when it started have been passed. Otherwise it returns when emit
+	// returns false or the session ends. Failures are written and false is returned.
+	Read(w *common.ResponseWriter, user datamodel.User, log string, partition int, from uint64, follow bool, emit func(Record) bool) bool
+}
+
+// Record is a record read from a partition of a log.
+type Record struct {
+	Partition int
+	Offset    uint64
+	Data      []byte
+}
+
+// The admin can create logs in any namespace. Other users must have the 'create.log'
+// permission for the namespace of the log. Unqualified names are created in the session
+// namespace.
+func (e *Executor) handleCreateLog(w *common.ResponseWriter, stmt skl.Statement) {
+	createStatement, ok := stmt.(*skl.CreateLogStatement)
+	if !ok {
+		w.Fail(common.InvalidStatementType, "expected *CreateLogStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+
+	// Qualify the name of the log
+	name := createStatement.Name()
+	if !strings.Contains(name, ".") {
+		if e.session.namespace == "" {
+			w.Fail(common.NamespaceDoesNotExist, "no namespace selected for log '%s'", name)
+			return
+		}
+		name = e.session.namespace + "." + name
+	}
+
+	// Validate options
+	log, err := newLog(name, createStatement.Options())
+	if err == nil {
+		log.Key = createStatement.Key()
+		log.Partitions = make([]datamodel.Partition, createStatement.Partitions())
+	}
+	if err != nil {
+		w.Fail(common.InvalidOptions, "%s", err.Error())
+		return
+	}
+
+	// Get namespace store
+	namespaceStore, err := e.system.Namespaces()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access namespace data")
+		return
+	}
+
+	// Determine if the namespace exists
+	ns, err := namespaceStore.Get(log.Namespace())
+	if err == datamodel.ErrNamespaceDoesNotExist {
+		w.Fail(common.NamespaceDoesNotExist, "%s", log.Namespace())
+		return
+	} else if err != nil {
+		w.Fail(common.InternalServerError, "could not access namespace data")
+		return
+	}
+
+	// If the user is not an admin check their permissions for the namespace
+	user := e.session.user
+	access := user.IsAdmin()
+	for _, role := range user.Roles(log.Namespace()) {
+		if ns.HasPermission(role, createStatement.RequiredPermissions()) {
+			access = true
+		}
+	}
+	if !access {
+		w.Fail(common.Unauthorized, "cannot create log '%s'", name)
+		return
+	}
+
+	// Get log store
+	logStore, err := e.system.Logs()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return
+	}
+
+	// Partitions are placed on servers by the cluster leader
+	err = logStore.Create(log)
+	if err == datamodel.ErrLogAlreadyExists {
+		w.Success(common.LogAlreadyExists, "%s", name)
+		return
+	} else if err == datamodel.ErrNamespaceDoesNotExist {
+		w.Fail(common.NamespaceDoesNotExist, "%s", log.Namespace())
+		return
+	} else if err != nil {
+		w.Fail(common.InternalServerError, "could not create log '%s'", name)
+		return
+	}
+
+	w.Success(common.OK, "log created")
+}
+
+// newLog creates a log from the options of a CREATE LOG statement. A log has a single
+// replica and waits for a quorum of the replicas unless the options say otherwise.
+func newLog(name string, options map[string]string) (log datamodel.Log, err error) {
+	log = datamodel.Log{Name: name, Replicas: 1, Acks: datamodel.AckQuorum}
+	for option, value := range options {
+		switch option {
+		case "replicas":
+			if log.Replicas, err = strconv.Atoi(value); err != nil || log.Replicas < 1 {
+				return log, fmt.Errorf("invalid replicas '%s': must be a positive number", value)
+			}
+		case "acks":
+			if log.Acks, err = datamodel.ParseAckLevel(value); err != nil {
+				return
+			}
+		default:
+			return log, fmt.Errorf("unknown option '%s'", option)
+		}
+	}
+	return
+}
+
+// The logs of the session namespace are listed. Without a namespace, the admin sees every
+// log and other users see the logs of their namespaces.
+func (e *Executor) handleShowLogs(w *common.ResponseWriter, stmt skl.Statement) {
+	if _, ok := stmt.(*skl.ShowLogsStatement); !ok {
+		w.Fail(common.InvalidStatementType, "expected *ShowLogsStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+
+	// Get log store
+	logStore, err := e.system.Logs()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return
+	}
+	logs, err := logStore.List()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return
+	}
+
+	// Determine which namespaces are visible
+	user := e.session.user
+	visible := func(namespace string) bool {
+		if e.session.namespace != "" {
+			return namespace == e.session.namespace
+		} else if user.IsAdmin() {
+			return true
+		}
+		for _, ns := range user.Namespaces() {
+			if ns == namespace {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Stream logs
+	w.Columns("log", "key", "partitions", "replicas", "acks", "leaders", "servers")
+	w.Write(w.Colors.LightYellow)
+	for _, log := range logs {
+		if visible(log.Namespace()) {
+			leaders, servers := placement(log)
+			w.Row(log.Name, log.Key, strconv.Itoa(len(log.Partitions)), strconv.Itoa(log.Replicas), log.Acks.String(), leaders, servers)
+		}
+	}
+	w.Write(w.Colors.Reset)
+
+	w.Success(common.OK, "")
+}
+
+// The partitions of the visible logs are listed, or those of a single log if one is
+// named. Unqualified names refer to the session namespace.
+func (e *Executor) handleShowPartitions(w *common.ResponseWriter, stmt skl.Statement) {
+	showStatement, ok := stmt.(*skl.ShowPartitionsStatement)
+	if !ok {
+		w.Fail(common.InvalidStatementType, "expected *ShowPartitionsStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+
+	// Qualify the name of the log
+	name := showStatement.Log()
+	if name != "" && !strings.Contains(name, ".") {
+		if e.session.namespace == "" {
+			w.Fail(common.NamespaceDoesNotExist, "no namespace selected for log '%s'", name)
+			return
+		}
+		name = e.session.namespace + "." + name
+	}
+
+	// Get log store
+	logStore, err := e.system.Logs()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return
+	}
+	logs, err := logStore.List()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return
+	}
+
+	// Named logs must exist and be visible to the user
+	user := e.session.user
+	visible := func(namespace string) bool {
+		if name == "" && e.session.namespace != "" {
+			return namespace == e.session.namespace
+		} else if user.IsAdmin() {
+			return true
+		}
+		for _, ns := range user.Namespaces() {
+			if ns == namespace {
+				return true
+			}
+		}
+		return false
+	}
+	if name != "" {
+		found := false
+		for _, log := range logs {
+			if log.Name == name && visible(log.Namespace()) {
+				found = true
+			}
+		}
+		if !found {
+			w.Fail(common.LogDoesNotExist, "%s", name)
+			return
+		}
+	}
+
+	// Stream partitions
+	w.Columns("log", "partition", "leader", "servers", "in_sync")
+	w.Write(w.Colors.LightYellow)
+	for _, log := range logs {
+		if (name == "" || log.Name == name) && visible(log.Namespace()) {
+			for p, partition := range log.Partitions {
+				w.Row(log.Name, strconv.Itoa(p), partition.Leader, strings.Join(partition.Servers, ","), strings.Join(partition.InSync, ","))
+			}
+		}
+	}
+	w.Write(w.Colors.Reset)
+
+	w.Success(common.OK, "")
+}
+
+// placement returns the leaders of the partitions of a log in partition order, and the
+// servers holding any of its replicas sorted by name.
+func placement(log datamodel.Log) (string, string) {
+	var leaders, servers []string
+	seen := make(map[string]bool)
+	for _, p := range log.Partitions {
+		leaders = append(leaders, p.Leader)
+		for _, server := range p.Servers {
+			if !seen[server] {
+				seen[server] = true
+				servers = append(servers, server)
+			}
+		}
+	}
+	sort.Strings(servers)
+
+	if !log.Assigned() {
+		return "", strings.Join(servers, ",")
+	}
+	return strings.Join(leaders, ","), strings.Join(servers, ",")
+}
+
+// The committed records of a log are listed from an offset. Unqualified names refer to
+// the session namespace.
+func (e *Executor) handleSelect(w *common.ResponseWriter, stmt skl.Statement) {
+	selectStatement, ok := stmt.(*skl.SelectStatement)
+	if !ok {
+		w.Fail(common.InvalidStatementType, "expected *SelectStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+	e.readLog(w, selectStatement.Log(), selectStatement.Partition(), selectStatement.Offset(), selectStatement.Limit(), false)
+}
+
+// The records of a log are listed from an offset as they are committed, until the limit
+// is reached or the session ends. Unqualified names refer to the session namespace.
+func (e *Executor) handleSubscribe(w *common.ResponseWriter, stmt skl.Statement) {
+	subscribeStatement, ok := stmt.(*skl.SubscribeStatement)
+	if !ok {
+		w.Fail(common.InvalidStatementType, "expected *SubscribeStatement, got %s instead", reflect.TypeOf(stmt))
+		return
+	}
+	e.readLog(w, subscribeStatement.Log(), subscribeStatement.Partition(), subscribeStatement.Offset(), subscribeStatement.Limit(), true)
+}
+
+// readLog writes the records of a log as rows, stopping after limit records unless limit
+// is 0. Records are binary tuples, so they are written in base64.
+func (e *Executor) readLog(w *common.ResponseWriter, name string, partition int, from uint64, limit int, follow bool) {
+
+	// Qualify the name of the log
+	if !strings.Contains(name, ".") {
+		if e.session.namespace == "" {
+			w.Fail(common.NamespaceDoesNotExist, "no namespace selected for log '%s'", name)
+			return
+		}
+		name = e.session.namespace + "." + name
+	}
+	if e.logs == nil {
+		w.Fail(common.LogDoesNotExist, "%s", name)
+		return
+	}
+
+	// The result set starts with the first record, so failures are reported without one
+	started := false
+	start := func() {
+		if !started {
+			started = true
+			w.Columns("partition", "offset", "record")
+			w.Write(w.Colors.LightYellow)
+		}
+	}
+
+	// Stream records
+	count := 0
+	ok := e.logs.Read(w, e.session.user, name, partition, from, follow, func(r Record) bool {
+		start()
+		w.Row(strconv.Itoa(r.Partition), strconv.FormatUint(r.Offset, 10), base64.StdEncoding.EncodeToString(r.Data))
+		count++
+		return limit == 0 || count < limit
+	})
+	if !ok {
+		return
+	}
+	start()
+	w.Write(w.Colors.Reset)
+
+	w.Success(common.OK, "")
+}
@@ -0,0 +1,196 @@
+// Package protocol implements the binary protocol spoken on "kappa-client" SSH channels.
+//
+// Every message is sent as a frame. All integers are little endian and the length
+// counts the type, request ID and payload bytes:
+//
+//	uint32 length | uint8 type | uint32 request ID | payload
+//
+// A session starts with the client sending a Hello frame containing the highest protocol
+// version it speaks, its capabilities and the largest frame it accepts. The server replies
+// with a Hello frame containing the negotiated values, or an Error frame if it cannot speak
+// the client's version.
+//
+// Afterwards the client sends Query frames. The server answers each query with frames
+// carrying the same request ID: a ColumnHeader followed by Row frames for result sets, a
+// Status or Error frame for each statement and finally an End frame.
+//
+// Insert frames append tuples to a log and are answered like queries. Logs clustered by a
+// key are split into partitions, so each tuple is sent with its key and the server answers
+// with a Status or Error frame for every partition it was routed to. A Subscribe frame for
+// one or all partitions is answered with a Status frame once the subscription starts,
+// followed by an Event frame for each record until the channel is closed or an Error and
+// End frame end the subscription. A bounded subscription also ends with an End frame once
+// the records committed when it started have been sent. Records are ordered within each
+// partition only.
+//
+// Servers replicate partitions with Fetch frames. The leader of the partition answers with
+// an Event frame for each record starting at the requested offset, followed by an End frame.
+// If the replica holds records from an older leader epoch which the leader does not have,
+// the leader answers with a Truncate frame and an End frame instead.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the newest protocol version implemented by this package.
+const Version uint8 = 1
+
+// DefaultMaxFrameSize is the largest frame accepted unless a smaller size is negotiated.
+const DefaultMaxFrameSize uint32 = 1 << 20
+
+// frameHeaderSize is the size of the length, type and request ID fields.
+const frameHeaderSize = 9
+
+var (
+	// ErrFrameTooLarge is returned when a frame is larger than the maximum frame size.
+	ErrFrameTooLarge = errors.New("protocol: frame exceeds maximum size")
+
+	// ErrInvalidFrame is returned when a frame or its payload is malformed.
+	ErrInvalidFrame = errors.New("protocol: invalid frame")
+
+	// ErrUnsupportedVersion is returned when the peers have no protocol version in common.
+	ErrUnsupportedVersion = errors.New("protocol: unsupported version")
+)
+
+// FrameType identifies the message contained in a frame.
+type FrameType uint8
+
+// Frame types
+const (
+	HelloFrame FrameType = iota + 1
+	QueryFrame
+	StatusFrame
+	ColumnHeaderFrame
+	RowFrame
+	ErrorFrame
+	EndFrame
+	InsertFrame
+	SubscribeFrame
+	EventFrame
+	FetchFrame
+	TruncateFrame
+)
+
+var frameTypes = map[FrameType]string{
+	HelloFrame:        "Hello",
+	QueryFrame:        "Query",
+	StatusFrame:       "Status",
+	ColumnHeaderFrame: "ColumnHeader",
+	RowFrame:          "Row",
+	ErrorFrame:        "Error",
+	EndFrame:          "End",
+	InsertFrame:       "Insert",
+	SubscribeFrame:    "Subscribe",
+	EventFrame:        "Event",
+	FetchFrame:        "Fetch",
+	TruncateFrame:     "Truncate",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypes[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", uint8(t))
+}
+
+// Frame is a single message on the wire.
+type Frame struct {
+	Type      FrameType
+	RequestID uint32
+	Payload   []byte
+}
+
+// Encoder writes frames to an io.Writer.
+type Encoder struct {
+	w            io.Writer
+	maxFrameSize uint32
+}
+
+// NewEncoder creates an Encoder which refuses to write frames larger than maxFrameSize.
+func NewEncoder(w io.Writer, maxFrameSize uint32) *Encoder {
+	return &Encoder{w, maxFrameSize}
+}
+
+// SetMaxFrameSize changes the maximum frame size, usually after the handshake.
+func (e *Encoder) SetMaxFrameSize(size uint32) {
+	e.maxFrameSize = size
+}
+
+// Encode writes a frame.
+func (e *Encoder) Encode(f Frame) error {
+	size := frameHeaderSize + len(f.Payload)
+	if uint64(size) > uint64(e.maxFrameSize) {
+		return ErrFrameTooLarge
+	}
+
+	// The frame is written with a single call so frames from different goroutines do not interleave
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(size-4))
+	buf[4] = byte(f.Type)
+	binary.LittleEndian.PutUint32(buf[5:], f.RequestID)
+	copy(buf[frameHeaderSize:], f.Payload)
+
+	_, err := e.w.Write(buf)
+	return err
+}
+
+// EncodeMessage writes a message in a frame with the given request ID.
+func (e *Encoder) EncodeMessage(requestID uint32, m Message) error {
+	payload, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return e.Encode(Frame{m.FrameType(), requestID, payload})
+}
+
+// Decoder reads frames from an io.Reader.
+type Decoder struct {
+	r            io.Reader
+	maxFrameSize uint32
+	header       []byte
+}
+
+// NewDecoder creates a Decoder which rejects frames larger than maxFrameSize before reading them.
+func NewDecoder(r io.Reader, maxFrameSize uint32) *Decoder {
+	return &Decoder{r, maxFrameSize, make([]byte, frameHeaderSize)}
+}
+
+// SetMaxFrameSize changes the maximum frame size, usually after the handshake.
+func (d *Decoder) SetMaxFrameSize(size uint32) {
+	d.maxFrameSize = size
+}
+
+// Decode reads the next frame. io.EOF is returned if the reader is closed between frames.
+func (d *Decoder) Decode() (Frame, error) {
+	if _, err := io.ReadFull(d.r, d.header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Frame{}, ErrInvalidFrame
+		}
+		return Frame{}, err
+	}
+
+	// Validate length before allocating the payload
+	length := binary.LittleEndian.Uint32(d.header)
+	if length < frameHeaderSize-4 {
+		return Frame{}, ErrInvalidFrame
+	} else if uint64(length)+4 > uint64(d.maxFrameSize) {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	f := Frame{
+		Type:      FrameType(d.header[4]),
+		RequestID: binary.LittleEndian.Uint32(d.header[5:]),
+		Payload:   make([]byte, length-(frameHeaderSize-4)),
+	}
+	if _, err := io.ReadFull(d.r, f.Payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Frame{}, ErrInvalidFrame
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
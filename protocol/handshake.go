@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/blacklabeldata/kappa/common"
+)
+
+// ClientHandshake sends the client's Hello frame and waits for the server's reply. The
+// negotiated settings are returned and the maximum frame size of the encoder and decoder
+// is updated.
+func ClientHandshake(enc *Encoder, dec *Decoder, capabilities Capability, maxFrameSize uint32) (Hello, error) {
+	hello := Hello{Version, capabilities, maxFrameSize}
+	if err := enc.EncodeMessage(0, &hello); err != nil {
+		return Hello{}, err
+	}
+
+	// Read reply
+	f, err := dec.Decode()
+	if err != nil {
+		return Hello{}, err
+	}
+
+	switch f.Type {
+	case HelloFrame:
+		var reply Hello
+		if err := reply.UnmarshalBinary(f.Payload); err != nil {
+			return Hello{}, err
+		} else if reply.Version == 0 || reply.Version > Version {
+			return Hello{}, ErrUnsupportedVersion
+		}
+
+		enc.SetMaxFrameSize(reply.MaxFrameSize)
+		dec.SetMaxFrameSize(reply.MaxFrameSize)
+		return reply, nil
+
+	case ErrorFrame:
+		var e Error
+		if err := e.UnmarshalBinary(f.Payload); err != nil {
+			return Hello{}, err
+		}
+		return Hello{}, &e
+
+	default:
+		return Hello{}, fmt.Errorf("protocol: expected Hello frame, got %s", f.Type)
+	}
+}
+
+// ServerHandshake reads the client's Hello frame and replies with the negotiated settings: the
+// lower of the two versions and frame sizes and the capabilities both peers support. If the
+// client's version is not supported an Error frame is sent and ErrUnsupportedVersion is returned.
+func ServerHandshake(enc *Encoder, dec *Decoder, capabilities Capability, maxFrameSize uint32) (Hello, error) {
+	f, err := dec.Decode()
+	if err != nil {
+		return Hello{}, err
+	} else if f.Type != HelloFrame {
+		enc.EncodeMessage(f.RequestID, &Error{common.ProtocolError, "expected Hello frame, got " + f.Type.String()})
+		return Hello{}, fmt.Errorf("protocol: expected Hello frame, got %s", f.Type)
+	}
+
+	var hello Hello
+	if err := hello.UnmarshalBinary(f.Payload); err != nil {
+		enc.EncodeMessage(f.RequestID, &Error{common.ProtocolError, "invalid Hello frame"})
+		return Hello{}, err
+	} else if hello.Version == 0 {
+		enc.EncodeMessage(f.RequestID, &Error{common.ProtocolError, fmt.Sprintf("unsupported protocol version %d", hello.Version)})
+		return Hello{}, ErrUnsupportedVersion
+	}
+
+	// Negotiate settings
+	reply := Hello{Version, hello.Capabilities & capabilities, maxFrameSize}
+	if hello.Version < reply.Version {
+		reply.Version = hello.Version
+	}
+	if hello.MaxFrameSize < reply.MaxFrameSize {
+		reply.MaxFrameSize = hello.MaxFrameSize
+	}
+	if reply.MaxFrameSize < frameHeaderSize {
+		enc.EncodeMessage(f.RequestID, &Error{common.ProtocolError, fmt.Sprintf("maximum frame size %d is too small", reply.MaxFrameSize)})
+		return Hello{}, ErrInvalidFrame
+	}
+
+	if err := enc.EncodeMessage(f.RequestID, &reply); err != nil {
+		return Hello{}, err
+	}
+	enc.SetMaxFrameSize(reply.MaxFrameSize)
+	dec.SetMaxFrameSize(reply.MaxFrameSize)
+	return reply, nil
+}
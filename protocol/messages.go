@@ -0,0 +1,564 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/namedtuple"
+)
+
+// Message is the payload of a frame.
+type Message interface {
+	FrameType() FrameType
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(data []byte) error
+}
+
+// Capability is a bit set of optional protocol features.
+type Capability uint32
+
+// Capabilities
+const (
+	// CapabilityMultiStatement allows a query to contain several statements separated by semicolons.
+	CapabilityMultiStatement Capability = 1 << iota
+)
+
+// Has determines if all the given capabilities are set.
+func (c Capability) Has(other Capability) bool {
+	return c&other == other
+}
+
+// Hello is exchanged during the handshake.
+type Hello struct {
+	Version      uint8
+	Capabilities Capability
+	MaxFrameSize uint32
+}
+
+// FrameType returns HelloFrame.
+func (h *Hello) FrameType() FrameType { return HelloFrame }
+
+// MarshalBinary encodes the version, capabilities and maximum frame size.
+func (h *Hello) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 9)
+	buf[0] = h.Version
+	binary.LittleEndian.PutUint32(buf[1:], uint32(h.Capabilities))
+	binary.LittleEndian.PutUint32(buf[5:], h.MaxFrameSize)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a Hello payload.
+func (h *Hello) UnmarshalBinary(data []byte) error {
+	if len(data) != 9 {
+		return ErrInvalidFrame
+	}
+	h.Version = data[0]
+	h.Capabilities = Capability(binary.LittleEndian.Uint32(data[1:]))
+	h.MaxFrameSize = binary.LittleEndian.Uint32(data[5:])
+	return nil
+}
+
+// Query contains the statements to execute.
+type Query struct {
+	Statement string
+}
+
+// FrameType returns QueryFrame.
+func (q *Query) FrameType() FrameType { return QueryFrame }
+
+// MarshalBinary encodes the statement.
+func (q *Query) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	writeString(&buf, q.Statement)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a Query payload.
+func (q *Query) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	q.Statement = r.readString()
+	return r.done()
+}
+
+// Status reports the successful execution of a statement.
+type Status struct {
+	Code    common.StatusCode
+	Message string
+}
+
+// FrameType returns StatusFrame.
+func (s *Status) FrameType() FrameType { return StatusFrame }
+
+// MarshalBinary encodes the status code and message.
+func (s *Status) MarshalBinary() ([]byte, error) {
+	return marshalCode(s.Code, s.Message), nil
+}
+
+// UnmarshalBinary decodes a Status payload.
+func (s *Status) UnmarshalBinary(data []byte) error {
+	return unmarshalCode(data, &s.Code, &s.Message)
+}
+
+// Error reports a failed statement or a protocol error.
+type Error struct {
+	Code    common.StatusCode
+	Message string
+}
+
+// FrameType returns ErrorFrame.
+func (e *Error) FrameType() FrameType { return ErrorFrame }
+
+// MarshalBinary encodes the error code and message.
+func (e *Error) MarshalBinary() ([]byte, error) {
+	return marshalCode(e.Code, e.Message), nil
+}
+
+// UnmarshalBinary decodes an Error payload.
+func (e *Error) UnmarshalBinary(data []byte) error {
+	return unmarshalCode(data, &e.Code, &e.Message)
+}
+
+// Error implements the error interface so failures can be returned directly.
+func (e *Error) Error() string {
+	return e.Code.String() + ": " + e.Message
+}
+
+// ColumnHeader starts a result set.
+type ColumnHeader struct {
+	Columns []string
+}
+
+// FrameType returns ColumnHeaderFrame.
+func (c *ColumnHeader) FrameType() FrameType { return ColumnHeaderFrame }
+
+// MarshalBinary encodes the number of columns followed by their names.
+func (c *ColumnHeader) MarshalBinary() ([]byte, error) {
+	if len(c.Columns) > math.MaxUint16 {
+		return nil, ErrInvalidFrame
+	}
+
+	var buf bytes.Buffer
+	count := make([]byte, 2)
+	binary.LittleEndian.PutUint16(count, uint16(len(c.Columns)))
+	buf.Write(count)
+	for _, column := range c.Columns {
+		writeString(&buf, column)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a ColumnHeader payload.
+func (c *ColumnHeader) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	count := int(r.readUint16())
+	c.Columns = nil
+	for i := 0; i < count && r.err == nil; i++ {
+		c.Columns = append(c.Columns, r.readString())
+	}
+	return r.done()
+}
+
+// Row is a single row of a result set. The values are encoded as a named tuple whose
+// fields are the columns of the preceding ColumnHeader, so Columns must be set before
+// the row is marshalled or unmarshalled.
+type Row struct {
+	Columns []string
+	Values  []string
+}
+
+// FrameType returns RowFrame.
+func (r *Row) FrameType() FrameType { return RowFrame }
+
+// MarshalBinary encodes the values as a named tuple.
+func (r *Row) MarshalBinary() ([]byte, error) {
+	if len(r.Values) != len(r.Columns) {
+		return nil, ErrInvalidFrame
+	}
+
+	// Build tuple
+	size := 0
+	for _, value := range r.Values {
+		size += len(value) + 9
+	}
+	rowType := newRowType(r.Columns)
+	builder := rowType.Builder(make([]byte, size))
+	for i, value := range r.Values {
+		if _, err := builder.PutString(r.Columns[i], value); err != nil {
+			return nil, err
+		}
+	}
+	tuple, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode tuple
+	var buf bytes.Buffer
+	if err := namedtuple.NewEncoder(&buf).Encode(tuple); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the named tuple in a Row payload.
+func (r *Row) UnmarshalBinary(data []byte) error {
+	rowType := newRowType(r.Columns)
+	registry := namedtuple.NewRegistry()
+	registry.Register(rowType)
+
+	tuple, err := namedtuple.NewDecoderSize(registry, uint64(len(data)), bytes.NewReader(data)).Decode()
+	if err != nil {
+		return ErrInvalidFrame
+	} else if int(tuple.Header.FieldCount) != len(r.Columns) {
+		return ErrInvalidFrame
+	}
+
+	r.Values = make([]string, len(r.Columns))
+	for i, column := range r.Columns {
+		offset, err := tuple.Offset(column)
+		if err != nil {
+			return ErrInvalidFrame
+		}
+		if r.Values[i], err = readStringField(tuple.Payload(), offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// End finishes the response to a query.
+type End struct{}
+
+// FrameType returns EndFrame.
+func (e *End) FrameType() FrameType { return EndFrame }
+
+// MarshalBinary returns an empty payload.
+func (e *End) MarshalBinary() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// UnmarshalBinary verifies the payload is empty.
+func (e *End) UnmarshalBinary(data []byte) error {
+	if len(data) != 0 {
+		return ErrInvalidFrame
+	}
+	return nil
+}
+
+// Insert appends named tuples to a log. Each tuple is encoded with a namedtuple.Encoder.
+// Logs clustered by a key require the encoded value of the key field of each tuple, which
+// determines the partition of the tuple.
+type Insert struct {
+	Log    string
+	Tuples [][]byte
+	Keys   [][]byte
+}
+
+// FrameType returns InsertFrame.
+func (i *Insert) FrameType() FrameType { return InsertFrame }
+
+// MarshalBinary encodes the log name, the number of tuples followed by the tuples and the
+// number of keys followed by the keys.
+func (i *Insert) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	writeString(&buf, i.Log)
+	writeList(&buf, i.Tuples)
+	writeList(&buf, i.Keys)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an Insert payload.
+func (i *Insert) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	i.Log = r.readString()
+	i.Tuples = r.readList()
+	i.Keys = r.readList()
+	return r.done()
+}
+
+// AllPartitions subscribes to the records of every partition of a log.
+const AllPartitions = math.MaxUint32
+
+// Subscribe starts streaming the records of one or all partitions of a log from the given
+// offset. Each partition has its own offsets, so From applies to every partition. A bounded
+// subscription ends with an End frame once the records which were committed when it started
+// have been sent.
+type Subscribe struct {
+	Log       string
+	Partition uint32
+	From      uint64
+	Bounded   bool
+}
+
+// FrameType returns SubscribeFrame.
+func (s *Subscribe) FrameType() FrameType { return SubscribeFrame }
+
+// MarshalBinary encodes the log name, partition, starting offset and whether the
+// subscription is bounded.
+func (s *Subscribe) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	writeString(&buf, s.Log)
+	writePosition(&buf, s.Partition, s.From)
+	if s.Bounded {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a Subscribe payload.
+func (s *Subscribe) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	s.Log = r.readString()
+	s.Partition = r.readUint32()
+	s.From = r.readUint64()
+	s.Bounded = r.readUint8() != 0
+	return r.done()
+}
+
+// Fetch requests the records of a partition starting at the given offset. Replicas send it
+// to the leader of the partition, which learns that the records before From have been copied.
+// Epoch is the newest leader epoch of the replica's records.
+type Fetch struct {
+	Log       string
+	Partition uint32
+	From      uint64
+	Epoch     uint64
+}
+
+// FrameType returns FetchFrame.
+func (f *Fetch) FrameType() FrameType { return FetchFrame }
+
+// MarshalBinary encodes the log name, partition, starting offset and epoch.
+func (f *Fetch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	writeString(&buf, f.Log)
+	writePosition(&buf, f.Partition, f.From)
+	epoch := make([]byte, 8)
+	binary.LittleEndian.PutUint64(epoch, f.Epoch)
+	buf.Write(epoch)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a Fetch payload.
+func (f *Fetch) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	f.Log = r.readString()
+	f.Partition = r.readUint32()
+	f.From = r.readUint64()
+	f.Epoch = r.readUint64()
+	return r.done()
+}
+
+// Truncate tells a replica that its records at and after Offset were never committed by
+// the leader and must be removed before fetching again.
+type Truncate struct {
+	Partition uint32
+	Offset    uint64
+}
+
+// FrameType returns TruncateFrame.
+func (t *Truncate) FrameType() FrameType { return TruncateFrame }
+
+// MarshalBinary encodes the partition and offset.
+func (t *Truncate) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	writePosition(&buf, t.Partition, t.Offset)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a Truncate payload.
+func (t *Truncate) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	t.Partition = r.readUint32()
+	t.Offset = r.readUint64()
+	return r.done()
+}
+
+// Event is a record sent to a subscriber.
+type Event struct {
+	Partition uint32
+	Offset    uint64
+	Data      []byte
+}
+
+// FrameType returns EventFrame.
+func (e *Event) FrameType() FrameType { return EventFrame }
+
+// MarshalBinary encodes the partition and offset followed by the encoded tuple.
+func (e *Event) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	writePosition(&buf, e.Partition, e.Offset)
+	writeBytes(&buf, e.Data)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an Event payload.
+func (e *Event) UnmarshalBinary(data []byte) error {
+	r := reader{data: data}
+	e.Partition = r.readUint32()
+	e.Offset = r.readUint64()
+	e.Data = r.readBytes()
+	return r.done()
+}
+
+// newRowType creates the tuple type for rows with the given columns.
+func newRowType(columns []string) namedtuple.TupleType {
+	fields := make([]namedtuple.Field, len(columns))
+	for i, column := range columns {
+		fields[i] = namedtuple.Field{Name: column, Required: true, Type: namedtuple.StringField}
+	}
+
+	rowType := namedtuple.New("kappa", "row")
+	rowType.AddVersion(fields...)
+	return rowType
+}
+
+// readStringField reads a string written by namedtuple.TupleBuilder.PutString.
+func readStringField(data []byte, offset int) (string, error) {
+	if offset < 0 || offset >= len(data) {
+		return "", ErrInvalidFrame
+	}
+
+	r := reader{data: data, pos: offset + 1}
+	var size uint64
+	switch data[offset] {
+	case namedtuple.String8Code.OpCode:
+		size = uint64(r.readUint8())
+	case namedtuple.String16Code.OpCode:
+		size = uint64(r.readUint16())
+	case namedtuple.String32Code.OpCode:
+		size = uint64(r.readUint32())
+	case namedtuple.String64Code.OpCode:
+		size = r.readUint64()
+	default:
+		return "", ErrInvalidFrame
+	}
+	return string(r.read(size)), r.err
+}
+
+func marshalCode(code common.StatusCode, message string) []byte {
+	var buf bytes.Buffer
+	c := make([]byte, 4)
+	binary.LittleEndian.PutUint32(c, uint32(code))
+	buf.Write(c)
+	writeString(&buf, message)
+	return buf.Bytes()
+}
+
+func unmarshalCode(data []byte, code *common.StatusCode, message *string) error {
+	r := reader{data: data}
+	*code = common.StatusCode(r.readUint32())
+	*message = r.readString()
+	return r.done()
+}
+
+// writeString writes a uint32 length followed by the string.
+func writeString(buf *bytes.Buffer, s string) {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(s)))
+	buf.Write(size)
+	buf.WriteString(s)
+}
+
+// writeBytes writes a uint32 length followed by the data.
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(data)))
+	buf.Write(size)
+	buf.Write(data)
+}
+
+// writeList writes the number of values followed by the values.
+func writeList(buf *bytes.Buffer, values [][]byte) {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(values)))
+	buf.Write(count)
+	for _, value := range values {
+		writeBytes(buf, value)
+	}
+}
+
+// writePosition writes a partition followed by an offset.
+func writePosition(buf *bytes.Buffer, partition uint32, offset uint64) {
+	position := make([]byte, 12)
+	binary.LittleEndian.PutUint32(position, partition)
+	binary.LittleEndian.PutUint64(position[4:], offset)
+	buf.Write(position)
+}
+
+// reader decodes payloads. The first error is kept and later reads return zero values.
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) read(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	} else if n > uint64(len(r.data)-r.pos) {
+		r.err = ErrInvalidFrame
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+func (r *reader) readUint8() uint8 {
+	if b := r.read(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) readUint16() uint16 {
+	if b := r.read(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) readUint32() uint32 {
+	if b := r.read(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) readUint64() uint64 {
+	if b := r.read(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) readString() string {
+	return string(r.readBytes())
+}
+
+func (r *reader) readBytes() []byte {
+	size := r.readUint32()
+	return r.read(uint64(size))
+}
+
+func (r *reader) readList() (values [][]byte) {
+	count := r.readUint32()
+	for n := uint32(0); n < count && r.err == nil; n++ {
+		values = append(values, r.readBytes())
+	}
+	return
+}
+
+// done returns the first error or ErrInvalidFrame if the payload was not fully read.
+func (r *reader) done() error {
+	if r.err == nil && r.pos != len(r.data) {
+		return ErrInvalidFrame
+	}
+	return r.err
+}
@@ -0,0 +1,258 @@
+package protocol
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// goldenMessages are encoded and compared against the files in testdata.
+var goldenMessages = []struct {
+	name      string
+	requestID uint32
+	message   Message
+	decoded   Message
+}{
+	{"hello", 0, &Hello{Version, CapabilityMultiStatement, DefaultMaxFrameSize}, &Hello{}},
+	{"query", 1, &Query{"CREATE NAMESPACE acme; USE acme"}, &Query{}},
+	{"status", 1, &Status{common.OK, "namespace created"}, &Status{}},
+	{"error", 2, &Error{common.NamespaceDoesNotExist, "acme"}, &Error{}},
+	{"column_header", 3, &ColumnHeader{[]string{"namespace", "owner"}}, &ColumnHeader{}},
+	{"row", 3, &Row{[]string{"namespace", "owner"}, []string{"acme", "admin"}}, &Row{Columns: []string{"namespace", "owner"}}},
+	{"row_long", 3, &Row{[]string{"namespace"}, []string{strings.Repeat("a", 300)}}, &Row{Columns: []string{"namespace"}}},
+	{"end", 3, &End{}, &End{}},
+	{"insert", 4, &Insert{"acme.events", [][]byte{{1, 2, 3}, {4, 5}}, nil}, &Insert{}},
+	{"insert_keys", 4, &Insert{"acme.events", [][]byte{{1, 2, 3}, {4, 5}}, [][]byte{{6}, {7, 8}}}, &Insert{}},
+	{"subscribe", 5, &Subscribe{"acme.events", AllPartitions, 42, true}, &Subscribe{}},
+	{"event", 5, &Event{3, 42, []byte{1, 2, 3}}, &Event{}},
+	{"fetch", 6, &Fetch{"acme.events", 3, 42, 2}, &Fetch{}},
+	{"truncate", 6, &Truncate{3, 40}, &Truncate{}},
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, tc := range goldenMessages {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, DefaultMaxFrameSize)
+		if !assert.Nil(t, enc.EncodeMessage(tc.requestID, tc.message), tc.name) {
+			continue
+		}
+
+		// Compare with golden file
+		golden := filepath.Join("testdata", tc.name+".golden")
+		if *update {
+			assert.Nil(t, ioutil.WriteFile(golden, buf.Bytes(), 0644))
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if !assert.Nil(t, err, tc.name) {
+			continue
+		}
+		assert.Equal(t, expected, buf.Bytes(), tc.name)
+
+		// Decode golden file
+		f, err := NewDecoder(bytes.NewReader(expected), DefaultMaxFrameSize).Decode()
+		if !assert.Nil(t, err, tc.name) {
+			continue
+		}
+		assert.Equal(t, tc.message.FrameType(), f.Type, tc.name)
+		assert.Equal(t, tc.requestID, f.RequestID, tc.name)
+		assert.Nil(t, tc.decoded.UnmarshalBinary(f.Payload), tc.name)
+		assert.Equal(t, tc.message, tc.decoded, tc.name)
+	}
+}
+
+func TestDecodeMultipleFrames(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, DefaultMaxFrameSize)
+	assert.Nil(t, enc.EncodeMessage(7, &Status{common.OK, ""}))
+	assert.Nil(t, enc.EncodeMessage(7, &End{}))
+
+	dec := NewDecoder(&buf, DefaultMaxFrameSize)
+	f, err := dec.Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFrame, f.Type)
+	f, err = dec.Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, EndFrame, f.Type)
+	_, err = dec.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Encoder refuses large frames
+	enc := NewEncoder(&buf, 32)
+	assert.Equal(t, ErrFrameTooLarge, enc.EncodeMessage(1, &Query{strings.Repeat("a", 32)}))
+	assert.Equal(t, 0, buf.Len())
+
+	// Decoder rejects the length before reading the payload
+	assert.Nil(t, NewEncoder(&buf, DefaultMaxFrameSize).EncodeMessage(1, &Query{strings.Repeat("a", 32)}))
+	_, err := NewDecoder(&buf, 32).Decode()
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	// A huge length is rejected without allocating
+	_, err = NewDecoder(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 2, 1, 0, 0, 0}), DefaultMaxFrameSize).Decode()
+	assert.Equal(t, ErrFrameTooLarge, err)
+}
+
+func TestInvalidFrames(t *testing.T) {
+
+	// Length smaller than the header
+	_, err := NewDecoder(bytes.NewReader([]byte{4, 0, 0, 0, 2, 1, 0, 0, 0}), DefaultMaxFrameSize).Decode()
+	assert.Equal(t, ErrInvalidFrame, err)
+
+	// Truncated header
+	_, err = NewDecoder(bytes.NewReader([]byte{5, 0, 0}), DefaultMaxFrameSize).Decode()
+	assert.Equal(t, ErrInvalidFrame, err)
+
+	// Truncated payload
+	_, err = NewDecoder(bytes.NewReader([]byte{9, 0, 0, 0, 2, 1, 0, 0, 0, 'a'}), DefaultMaxFrameSize).Decode()
+	assert.Equal(t, ErrInvalidFrame, err)
+
+	// Payloads with the wrong length
+	var q Query
+	assert.Equal(t, ErrInvalidFrame, q.UnmarshalBinary([]byte{5, 0, 0, 0, 'a'}))
+	assert.Equal(t, ErrInvalidFrame, q.UnmarshalBinary([]byte{1, 0, 0, 0, 'a', 'b'}))
+	var h Hello
+	assert.Equal(t, ErrInvalidFrame, h.UnmarshalBinary([]byte{1}))
+	var c ColumnHeader
+	assert.Equal(t, ErrInvalidFrame, c.UnmarshalBinary([]byte{0xff, 0xff}))
+
+	// Rows must match the column header
+	row := Row{Columns: []string{"namespace", "owner"}, Values: []string{"acme"}}
+	_, err = row.MarshalBinary()
+	assert.Equal(t, ErrInvalidFrame, err)
+
+	data, err := (&Row{[]string{"namespace"}, []string{"acme"}}).MarshalBinary()
+	assert.Nil(t, err)
+	row = Row{Columns: []string{"namespace", "owner"}}
+	assert.Equal(t, ErrInvalidFrame, row.UnmarshalBinary(data))
+	row = Row{Columns: []string{"namespace"}}
+	assert.Equal(t, ErrInvalidFrame, row.UnmarshalBinary(data[:len(data)-1]))
+}
+
+// handshake runs the client and server handshakes over a pipe.
+func handshake(client, server Hello) (Hello, Hello, error, error) {
+	clientConn, serverConn := newPipe()
+
+	type result struct {
+		hello Hello
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		enc := NewEncoder(serverConn, DefaultMaxFrameSize)
+		dec := NewDecoder(serverConn, DefaultMaxFrameSize)
+		hello, err := ServerHandshake(enc, dec, server.Capabilities, server.MaxFrameSize)
+		serverConn.Close()
+		done <- result{hello, err}
+	}()
+
+	enc := NewEncoder(clientConn, DefaultMaxFrameSize)
+	dec := NewDecoder(clientConn, DefaultMaxFrameSize)
+	enc.Encode(Frame{HelloFrame, 0, mustMarshal(&client)})
+	clientHello, clientErr := readHelloReply(dec)
+	r := <-done
+	return clientHello, r.hello, clientErr, r.err
+}
+
+func TestHandshake(t *testing.T) {
+	client, server, clientErr, serverErr := handshake(
+		Hello{Version, CapabilityMultiStatement | 1<<5, 4096},
+		Hello{Version, CapabilityMultiStatement, DefaultMaxFrameSize})
+	assert.Nil(t, clientErr)
+	assert.Nil(t, serverErr)
+
+	// Lowest settings are chosen
+	expected := Hello{Version, CapabilityMultiStatement, 4096}
+	assert.Equal(t, expected, client)
+	assert.Equal(t, expected, server)
+}
+
+func TestHandshakeNewerClient(t *testing.T) {
+	client, _, clientErr, serverErr := handshake(
+		Hello{Version + 1, 0, DefaultMaxFrameSize},
+		Hello{Version, 0, DefaultMaxFrameSize})
+	assert.Nil(t, clientErr)
+	assert.Nil(t, serverErr)
+	assert.Equal(t, Version, client.Version)
+}
+
+func TestHandshakeUnsupportedVersion(t *testing.T) {
+	_, _, clientErr, serverErr := handshake(
+		Hello{0, 0, DefaultMaxFrameSize},
+		Hello{Version, 0, DefaultMaxFrameSize})
+	assert.Equal(t, ErrUnsupportedVersion, serverErr)
+	if assert.IsType(t, &Error{}, clientErr) {
+		assert.Equal(t, common.ProtocolError, clientErr.(*Error).Code)
+	}
+}
+
+func TestClientHandshake(t *testing.T) {
+	clientConn, serverConn := newPipe()
+	go func() {
+		dec := NewDecoder(serverConn, DefaultMaxFrameSize)
+		dec.Decode()
+		NewEncoder(serverConn, DefaultMaxFrameSize).EncodeMessage(0, &Hello{Version, 0, 1024})
+	}()
+
+	enc := NewEncoder(clientConn, DefaultMaxFrameSize)
+	dec := NewDecoder(clientConn, DefaultMaxFrameSize)
+	hello, err := ClientHandshake(enc, dec, CapabilityMultiStatement, DefaultMaxFrameSize)
+	assert.Nil(t, err)
+	assert.Equal(t, Hello{Version, 0, 1024}, hello)
+
+	// Frame size limit applies after the handshake
+	assert.Equal(t, ErrFrameTooLarge, enc.EncodeMessage(1, &Query{strings.Repeat("a", 1024)}))
+}
+
+// readHelloReply decodes the server's reply as ClientHandshake does.
+func readHelloReply(dec *Decoder) (Hello, error) {
+	f, err := dec.Decode()
+	if err != nil {
+		return Hello{}, err
+	}
+
+	if f.Type == ErrorFrame {
+		var e Error
+		e.UnmarshalBinary(f.Payload)
+		return Hello{}, &e
+	}
+	var h Hello
+	err = h.UnmarshalBinary(f.Payload)
+	return h, err
+}
+
+func mustMarshal(m Message) []byte {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// pipeConn joins the ends of two pipes into a bidirectional connection.
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeConn) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+func newPipe() (pipeConn, pipeConn) {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	return pipeConn{clientReader, clientWriter}, pipeConn{serverReader, serverWriter}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	// adminChannel is the channel type opened by the cluster membership commands
+	adminChannel = "kappa-admin"
+
+	// membersRequest lists the members of the cluster
+	membersRequest = "kappa-members"
+
+	// joinRequest joins the server to the cluster through the given addresses
+	joinRequest = "kappa-join"
+
+	// leaveRequest makes the server leave the cluster gracefully and shut down
+	leaveRequest = "kappa-leave"
+
+	// forceLeaveRequest marks a failed server as having left the cluster
+	forceLeaveRequest = "kappa-force-leave"
+
+	// installKeyRequest adds a gossip encryption key to the keyring of every server
+	installKeyRequest = "kappa-install-key"
+
+	// useKeyRequest makes an installed key the primary key of every server
+	useKeyRequest = "kappa-use-key"
+
+	// removeKeyRequest removes a key which is no longer the primary key
+	removeKeyRequest = "kappa-remove-key"
+
+	// listKeysRequest lists the keys installed on the servers
+	listKeysRequest = "kappa-list-keys"
+)
+
+// joinPayload is the payload of a joinRequest.
+type joinPayload struct {
+	Addrs []string
+}
+
+// forceLeavePayload is the payload of a forceLeaveRequest.
+type forceLeavePayload struct {
+	Node string
+}
+
+// keyPayload is the payload of the requests which change the keyring.
+type keyPayload struct {
+	Key string
+}
+
+// keyringAnswer is the reply to the keyring requests. Keys counts the servers which have
+// each key installed.
+type keyringAnswer struct {
+	Keys     map[string]int
+	NumNodes int
+	NumResp  int
+}
+
+// joinAnswer is the reply to a joinRequest.
+type joinAnswer struct {
+	Joined int
+}
+
+// adminError is the reply to a failed request.
+type adminError struct {
+	Code    common.StatusCode
+	Message string
+}
+
+// memberDetails describes a member of the cluster in the reply to a membersRequest. Only
+// the name, status and tags are known for members which are not kappa servers.
+type memberDetails struct {
+	Name      string
+	Role      string
+	Cluster   string
+	Addr      string
+	Bootstrap bool
+	Status    string
+	Tags      map[string]string
+}
+
+// Membership changes the membership of the cluster. It is implemented by Server.
+type Membership interface {
+	Members() []serf.Member
+	Join(addrs []string) (int, error)
+	Leave() error
+	RemoveFailedNode(node string) error
+}
+
+// AdminHandler services "kappa-admin" channels opened by the admin to inspect and change
+// the membership of the cluster and its gossip encryption keys. A channel carries a single request. The request is
+// accepted if it succeeded and rejected otherwise, and the answer or the error is then
+// written to the channel as JSON before it is closed.
+type AdminHandler struct {
+	logger     log.Logger
+	system     datamodel.System
+	membership Membership
+	keyring    Keyring
+	left       func()
+}
+
+// NewAdminHandler creates a handler for kappa-admin channels. Once the server left the
+// cluster and the admin was told, left is called unless it is nil.
+func NewAdminHandler(logger log.Logger, system datamodel.System, membership Membership, keyring Keyring, left func()) *AdminHandler {
+	return &AdminHandler{logger, system, membership, keyring, left}
+}
+
+// Handle answers the request of the channel.
+func (h *AdminHandler) Handle(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+	defer channel.Close()
+
+	// Only the admin can change the cluster
+	user, err := connectionUser(h.system, sshConn)
+	if err == nil && !user.IsAdmin() {
+		err = errors.New("only the admin can manage the cluster")
+	}
+
+	// Wait for the request
+	var req *ssh.Request
+	select {
+	case r, ok := <-requests:
+		if !ok {
+			return nil
+		}
+		req = r
+	case <-parentTomb.Dying():
+		return nil
+	}
+	go ssh.DiscardRequests(requests)
+
+	var answer interface{}
+	if err != nil {
+		answer = &adminError{common.Unauthorized, err.Error()}
+	} else {
+		answer = h.answer(req)
+	}
+	_, failed := answer.(*adminError)
+	req.Reply(!failed, nil)
+
+	payload, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	if _, err := channel.Write(payload); err != nil {
+		return err
+	}
+	channel.Close()
+
+	// The server shuts down once the admin was told it left
+	if req.Type == leaveRequest && !failed && h.left != nil {
+		h.left()
+	}
+	return nil
+}
+
+// answer executes a request and returns its reply.
+func (h *AdminHandler) answer(req *ssh.Request) interface{} {
+	switch req.Type {
+	case membersRequest:
+		return members(h.membership.Members())
+
+	case joinRequest:
+		var payload joinPayload
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil || len(payload.Addrs) == 0 {
+			return &adminError{common.InvalidOptions, "expected the addresses of the servers to join"}
+		}
+
+		n, err := h.membership.Join(payload.Addrs)
+		if err != nil && n == 0 {
+			return &adminError{common.InternalServerError, err.Error()}
+		}
+		h.logger.Info("Joined cluster", "nodes", n)
+		return &joinAnswer{n}
+
+	case leaveRequest:
+		if err := h.membership.Leave(); err != nil {
+			return &adminError{common.InternalServerError, err.Error()}
+		}
+		h.logger.Info("Left the cluster")
+		return struct{}{}
+
+	case forceLeaveRequest:
+		var payload forceLeavePayload
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Node == "" {
+			return &adminError{common.InvalidOptions, "expected the name of the server to remove"}
+		}
+
+		if err := h.membership.RemoveFailedNode(payload.Node); err != nil {
+			return &adminError{common.InternalServerError, err.Error()}
+		}
+		h.logger.Info("Removed failed node", "node", payload.Node)
+		return struct{}{}
+
+	case listKeysRequest:
+		return keyringReply(h.keyring.ListKeys())
+
+	case installKeyRequest, useKeyRequest, removeKeyRequest:
+		var payload keyPayload
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Key == "" {
+			return &adminError{common.InvalidOptions, "expected a base64 encoded key"}
+		}
+
+		change := h.keyring.InstallKey
+		if req.Type == useKeyRequest {
+			change = h.keyring.UseKey
+		} else if req.Type == removeKeyRequest {
+			change = h.keyring.RemoveKey
+		}
+		answer := keyringReply(change(payload.Key))
+		if _, failed := answer.(*adminError); !failed {
+			h.logger.Info("Changed gossip keyring", "request", req.Type)
+		}
+		return answer
+	}
+	return &adminError{common.ProtocolError, fmt.Sprintf("unknown request %q", req.Type)}
+}
+
+// keyringReply returns the reply to a keyring request. The request failed if any server
+// failed to change its keyring.
+func keyringReply(resp *serf.KeyResponse, err error) interface{} {
+	if err != nil {
+		var failures []string
+		if resp != nil {
+			for node, message := range resp.Messages {
+				failures = append(failures, node+": "+message)
+			}
+		}
+		sort.Strings(failures)
+		return &adminError{common.InternalServerError, strings.Join(append([]string{err.Error()}, failures...), "; ")}
+	}
+	return &keyringAnswer{resp.Keys, resp.NumNodes, resp.NumResp}
+}
+
+// members describes the members of the cluster.
+func members(ms []serf.Member) []memberDetails {
+	details := make([]memberDetails, 0, len(ms))
+	for _, m := range ms {
+		d := memberDetails{Name: m.Name, Role: m.Tags["role"], Cluster: m.Tags["cluster"], Status: m.Status.String(), Tags: m.Tags}
+		if node, err := GetKappaServer(m); err == nil {
+			d.Addr = node.Addr.String()
+			d.Bootstrap = node.Bootstrap
+		}
+		details = append(details, d)
+	}
+	return details
+}
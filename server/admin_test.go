@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/kappa/client"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMembership records the membership changes requested through the admin handler.
+type fakeMembership struct {
+	lock    sync.Mutex
+	members []serf.Member
+	joined  []string
+	left    bool
+	removed []string
+}
+
+func (f *fakeMembership) Members() []serf.Member {
+	return f.members
+}
+
+func (f *fakeMembership) Join(addrs []string) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, addr := range addrs {
+		if addr == "unreachable:7946" {
+			return 0, errors.New("connection refused")
+		}
+	}
+	f.joined = append(f.joined, addrs...)
+	return len(addrs), nil
+}
+
+func (f *fakeMembership) Leave() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.left = true
+	return nil
+}
+
+func (f *fakeMembership) RemoveFailedNode(node string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.removed = append(f.removed, node)
+	return nil
+}
+
+// fakeKeyring keeps the keys of a cluster of three servers.
+type fakeKeyring struct {
+	lock    sync.Mutex
+	primary string
+	keys    map[string]bool
+}
+
+func (f *fakeKeyring) InstallKey(key string) (*serf.KeyResponse, error) {
+	return f.change(func() error {
+		f.keys[key] = true
+		return nil
+	})
+}
+
+func (f *fakeKeyring) UseKey(key string) (*serf.KeyResponse, error) {
+	return f.change(func() error {
+		if !f.keys[key] {
+			return errors.New("Requested key is not in the keyring")
+		}
+		f.primary = key
+		return nil
+	})
+}
+
+func (f *fakeKeyring) RemoveKey(key string) (*serf.KeyResponse, error) {
+	return f.change(func() error {
+		if key == f.primary {
+			return errors.New("Removing the primary key is not allowed")
+		}
+		delete(f.keys, key)
+		return nil
+	})
+}
+
+func (f *fakeKeyring) ListKeys() (*serf.KeyResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	resp := &serf.KeyResponse{Messages: map[string]string{}, Keys: map[string]int{}, NumNodes: 3, NumResp: 3}
+	for key := range f.keys {
+		resp.Keys[key] = 3
+	}
+	return resp, nil
+}
+
+// change applies a change on every server, which all fail in the same way.
+func (f *fakeKeyring) change(apply func() error) (*serf.KeyResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	resp := &serf.KeyResponse{Messages: map[string]string{}, Keys: map[string]int{}, NumNodes: 3, NumResp: 3}
+	if err := apply(); err != nil {
+		for _, node := range []string{"node-1", "node-2", "node-3"} {
+			resp.Messages[node] = err.Error()
+		}
+		resp.NumErr = 3
+		return resp, errors.New("3/3 nodes reported failure")
+	}
+	return resp, nil
+}
+
+// newAdminClient returns a client connected as the given user to an admin handler which
+// changes membership. The returned channel is closed once the server left.
+func newAdminClient(t *testing.T, username string, membership Membership) (*client.Client, <-chan struct{}, func()) {
+	return newKeyringClient(t, username, membership, &fakeKeyring{keys: map[string]bool{}})
+}
+
+// newKeyringClient returns a client connected to an admin handler which changes
+// membership and keyring.
+func newKeyringClient(t *testing.T, username string, membership Membership, keyring Keyring) (*client.Client, <-chan struct{}, func()) {
+	left := make(chan struct{})
+	conn, cleanup := newTestServer(t, username, func(system datamodel.System) map[string]testHandler {
+		return map[string]testHandler{
+			adminChannel: NewAdminHandler(log.NullLog, system, membership, keyring, func() { close(left) }),
+		}
+	})
+	c, err := client.NewClient(conn, client.Options{})
+	if err != nil {
+		cleanup()
+		requireNil(t, err)
+	}
+	return c, left, func() {
+		c.Close()
+		cleanup()
+	}
+}
+
+func TestAdminMembers(t *testing.T) {
+	membership := &fakeMembership{members: []serf.Member{
+		{
+			Name:   "node-1",
+			Addr:   net.ParseIP("127.0.0.1"),
+			Status: serf.StatusAlive,
+			Tags:   map[string]string{"role": "kappa-server", "cluster": "kappa", "port": "9022", "bootstrap": "1"},
+		},
+		{
+			Name:   "agent",
+			Addr:   net.ParseIP("127.0.0.2"),
+			Status: serf.StatusFailed,
+			Tags:   map[string]string{"role": "monitor"},
+		},
+	}}
+	c, _, cleanup := newAdminClient(t, "admin", membership)
+	defer cleanup()
+
+	members, err := c.Members(context.Background())
+	requireNil(t, err)
+	assert.Equal(t, []client.Member{
+		{
+			Name:      "node-1",
+			Role:      "kappa-server",
+			Cluster:   "kappa",
+			Addr:      "127.0.0.1:9022",
+			Bootstrap: true,
+			Status:    "alive",
+			Tags:      map[string]string{"role": "kappa-server", "cluster": "kappa", "port": "9022", "bootstrap": "1"},
+		},
+		{
+			Name:   "agent",
+			Role:   "monitor",
+			Status: "failed",
+			Tags:   map[string]string{"role": "monitor"},
+		},
+	}, members)
+}
+
+func TestAdminMembership(t *testing.T) {
+	membership := &fakeMembership{}
+	c, left, cleanup := newAdminClient(t, "admin", membership)
+	defer cleanup()
+	ctx := context.Background()
+
+	n, err := c.Join(ctx, "127.0.0.1:7946", "127.0.0.1:7956")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = c.Join(ctx, "unreachable:7946")
+	assert.True(t, errors.Is(err, client.ErrInternalServerError))
+	_, err = c.Join(ctx)
+	assert.True(t, errors.Is(err, client.ErrInvalidOptions))
+
+	assert.Nil(t, c.ForceLeave(ctx, "node-3"))
+	assert.True(t, errors.Is(c.ForceLeave(ctx, ""), client.ErrInvalidOptions))
+
+	// The server shuts down once it has left
+	assert.Nil(t, c.Leave(ctx))
+	select {
+	case <-left:
+	case <-time.After(time.Second):
+		t.Fatal("server did not shut down after leaving")
+	}
+
+	membership.lock.Lock()
+	defer membership.lock.Unlock()
+	assert.Equal(t, []string{"127.0.0.1:7946", "127.0.0.1:7956"}, membership.joined)
+	assert.Equal(t, []string{"node-3"}, membership.removed)
+	assert.True(t, membership.left)
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	membership := &fakeMembership{}
+	c, _, cleanup := newAdminClient(t, "bob", membership)
+	defer cleanup()
+	ctx := context.Background()
+
+	_, err := c.Members(ctx)
+	assert.True(t, errors.Is(err, client.ErrUnauthorized))
+	assert.True(t, errors.Is(c.Leave(ctx), client.ErrUnauthorized))
+
+	membership.lock.Lock()
+	defer membership.lock.Unlock()
+	assert.False(t, membership.left)
+}
+
+func TestAdminKeyring(t *testing.T) {
+	oldKey, newKey := "QHOYjmYlxSCBhdfiolhtDQ==", "T9jncgl9mbLus+baTTa7q7nPSUrXwbDi2dhbtqir37s="
+	keyring := &fakeKeyring{primary: oldKey, keys: map[string]bool{oldKey: true}}
+	c, _, cleanup := newKeyringClient(t, "admin", &fakeMembership{}, keyring)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Rotate the key
+	_, err := c.UseKey(ctx, newKey)
+	if assert.True(t, errors.Is(err, client.ErrInternalServerError)) {
+		assert.Contains(t, err.Error(), "node-2: Requested key is not in the keyring")
+	}
+	_, err = c.InstallKey(ctx, newKey)
+	assert.Nil(t, err)
+
+	keys, err := c.ListKeys(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, client.Keyring{Keys: map[string]int{oldKey: 3, newKey: 3}, Servers: 3, Responses: 3}, keys)
+
+	resp, err := c.UseKey(ctx, newKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, resp.Responses)
+	_, err = c.RemoveKey(ctx, newKey)
+	assert.True(t, errors.Is(err, client.ErrInternalServerError))
+	_, err = c.RemoveKey(ctx, oldKey)
+	assert.Nil(t, err)
+
+	keys, err = c.ListKeys(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{newKey: 3}, keys.Keys)
+
+	// Keys are required
+	_, err = c.InstallKey(ctx, "")
+	assert.True(t, errors.Is(err, client.ErrInvalidOptions))
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+)
+
+const (
+	// usersChangedEvent is broadcast after the users are changed
+	usersChangedEvent = "users-changed"
+
+	// namespacesChangedEvent is broadcast after the namespaces are changed
+	namespacesChangedEvent = "namespaces-changed"
+)
+
+// usersChanged reports that the users were changed by the Raft log entry at Index.
+type usersChanged struct {
+	Index uint64
+}
+
+// EventName returns the name of the event
+func (usersChanged) EventName() string { return usersChangedEvent }
+
+// namespacesChanged reports that the namespaces were changed by the Raft log entry at
+// Index.
+type namespacesChanged struct {
+	Index uint64
+}
+
+// EventName returns the name of the event
+func (namespacesChanged) EventName() string { return namespacesChangedEvent }
+
+// metadataCache keeps the users and namespaces looked up by this server, such as the user
+// of every login. The cache is flushed as each server applies a change through Raft. The
+// leader also broadcasts an event for every change, which flushes the caches again.
+type metadataCache struct {
+	datamodel.System
+
+	lock       sync.Mutex
+	users      map[string]datamodel.User
+	namespaces map[string]datamodel.Namespace
+
+	// generation is incremented on every flush, so that lookups which raced with a
+	// flush are not cached
+	generation uint64
+}
+
+// newMetadataCache creates a cache in front of a system store.
+func newMetadataCache(system datamodel.System) *metadataCache {
+	return &metadataCache{
+		System:     system,
+		users:      make(map[string]datamodel.User),
+		namespaces: make(map[string]datamodel.Namespace),
+	}
+}
+
+// Users returns a UserStore
+func (c *metadataCache) Users() (datamodel.UserStore, error) {
+	users, err := c.System.Users()
+	if err != nil {
+		return nil, err
+	}
+	return &cachedUserStore{users, c}, nil
+}
+
+// Namespaces returns a NamespaceStore
+func (c *metadataCache) Namespaces() (datamodel.NamespaceStore, error) {
+	namespaces, err := c.System.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	return &cachedNamespaceStore{namespaces, c}, nil
+}
+
+// flush removes the users or namespaces changed by an event.
+func (c *metadataCache) flush(e ClusterEvent) {
+	switch e.(type) {
+	case *usersChanged:
+		c.flushUsers()
+	case *namespacesChanged:
+		c.flushNamespaces()
+	}
+}
+
+// flushUsers removes the cached users.
+func (c *metadataCache) flushUsers() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.users = make(map[string]datamodel.User)
+	c.generation++
+}
+
+// flushNamespaces removes the cached namespaces.
+func (c *metadataCache) flushNamespaces() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.namespaces = make(map[string]datamodel.Namespace)
+	c.generation++
+}
+
+// cachedUserStore caches the users returned by Get
+type cachedUserStore struct {
+	datamodel.UserStore
+	cache *metadataCache
+}
+
+// Get returns a User by username
+func (s *cachedUserStore) Get(username string) (datamodel.User, error) {
+	c := s.cache
+	c.lock.Lock()
+	user, ok := c.users[username]
+	generation := c.generation
+	c.lock.Unlock()
+	if ok {
+		return user, nil
+	}
+
+	user, err := s.UserStore.Get(username)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if generation == c.generation {
+		c.users[username] = user
+	}
+	c.lock.Unlock()
+	return user, nil
+}
+
+// Delete removes a user account
+func (s *cachedUserStore) Delete(username string) error {
+	err := s.UserStore.Delete(username)
+	s.cache.flushUsers()
+	return err
+}
+
+// cachedNamespaceStore caches the namespaces returned by Get
+type cachedNamespaceStore struct {
+	datamodel.NamespaceStore
+	cache *metadataCache
+}
+
+// Get returns a Namespace by name
+func (s *cachedNamespaceStore) Get(name string) (datamodel.Namespace, error) {
+	c := s.cache
+	c.lock.Lock()
+	ns, ok := c.namespaces[name]
+	generation := c.generation
+	c.lock.Unlock()
+	if ok {
+		return ns, nil
+	}
+
+	ns, err := s.NamespaceStore.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if generation == c.generation {
+		c.namespaces[name] = ns
+	}
+	c.lock.Unlock()
+	return ns, nil
+}
+
+// Delete removes a namespace
+func (s *cachedNamespaceStore) Delete(name string) error {
+	err := s.NamespaceStore.Delete(name)
+	s.cache.flushNamespaces()
+	return err
+}
+
+// handleMetadataEvents flushes the cache when another server reports a change. Changes
+// made through Raft have already flushed it as they were applied, so the events are not
+// waited for.
+func (s *Server) handleMetadataEvents() {
+	s.events.Handle(usersChangedEvent, func() ClusterEvent { return &usersChanged{} }, s.cache.flush)
+	s.events.Handle(namespacesChangedEvent, func() ClusterEvent { return &namespacesChanged{} }, s.cache.flush)
+}
+
+// commandEvent returns the event reporting the change made by a command applied at index,
+// or nil if the command does not change the users or namespaces.
+func commandEvent(cmd datamodel.Command, index uint64) ClusterEvent {
+	switch cmd.Type {
+	case datamodel.CreateUserCommand, datamodel.DeleteUserCommand, datamodel.SetPasswordCommand,
+		datamodel.AddUserRoleCommand, datamodel.RemoveUserRoleCommand, datamodel.AddPublicKeyCommand,
+		datamodel.RemovePublicKeyCommand:
+		return &usersChanged{index}
+	case datamodel.CreateNamespaceCommand, datamodel.DeleteNamespaceCommand, datamodel.CreateChildNamespaceCommand,
+		datamodel.AddNamespaceRoleCommand, datamodel.RemoveNamespaceRoleCommand, datamodel.GrantPermissionsCommand,
+		datamodel.RevokePermissionCommand, datamodel.AddNamespaceUserCommand, datamodel.RemoveNamespaceUserCommand:
+		return &namespacesChanged{index}
+	}
+	return nil
+}
+
+// metadataChanged broadcasts the change made by a command applied at index. Bursts of
+// changes are coalesced into one event.
+func (s *Server) metadataChanged(cmd datamodel.Command, index uint64) {
+	event := commandEvent(cmd, index)
+	if event == nil {
+		return
+	}
+
+	if err := s.events.Broadcast(event, true); err != nil {
+		s.logger.Warn("Failed to broadcast event", "name", event.EventName(), "err", err.Error())
+	}
+}
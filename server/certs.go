@@ -0,0 +1,61 @@
+package server
+
+import (
+	"time"
+
+	"github.com/blacklabeldata/kappa/auth"
+)
+
+const (
+	// defaultCertificateExpiryWarning is used if the config does not set CertificateExpiryWarning.
+	defaultCertificateExpiryWarning = 30 * 24 * time.Hour
+
+	// certificateCheckInterval is how often the server certificates are checked for expiry.
+	certificateCheckInterval = 12 * time.Hour
+)
+
+// checkCertificates logs a warning for each server certificate which has expired or is about to expire.
+func (s *Server) checkCertificates() {
+	warning := s.config.CertificateExpiryWarning
+	if warning <= 0 {
+		warning = defaultCertificateExpiryWarning
+	}
+
+	files := map[string]string{
+		"CA certificate":   s.config.CACertificateFile,
+		"host certificate": s.config.SSHCertificateFile,
+	}
+	for desc, file := range files {
+		if file == "" {
+			continue
+		}
+
+		cert, err := auth.ReadX509Certificate(file)
+		if err != nil {
+			s.logger.Warn("could not read "+desc, "file", file, "error", err.Error())
+			continue
+		}
+
+		if auth.ExpiresWithin(cert, 0) {
+			s.logger.Warn(desc+" has expired", "file", file, "expired", cert.NotAfter)
+		} else if auth.ExpiresWithin(cert, warning) {
+			s.logger.Warn(desc+" is about to expire", "file", file, "expires", cert.NotAfter)
+		}
+	}
+}
+
+// watchCertificates periodically checks the server certificates for expiry until the server is stopped.
+func (s *Server) watchCertificates() error {
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+
+	s.checkCertificates()
+	for {
+		select {
+		case <-s.t.Dying():
+			return nil
+		case <-ticker.C:
+			s.checkCertificates()
+		}
+	}
+}
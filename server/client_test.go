@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/kappa/client"
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/namedtuple"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T) (*client.Client, func()) {
+	conn, cleanup := newTestSession(t, "admin")
+	c, err := client.NewClient(conn, client.Options{})
+	if err != nil {
+		cleanup()
+		requireNil(t, err)
+	}
+	return c, func() {
+		c.Close()
+		cleanup()
+	}
+}
+
+func TestClientExec(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	result, err := c.Exec(ctx, "CREATE NAMESPACE acme")
+	assert.Nil(t, err)
+	assert.Equal(t, client.Result{Code: common.OK, Message: "namespace created"}, result)
+
+	result, err = c.Exec(ctx, "CREATE NAMESPACE acme")
+	assert.Nil(t, err)
+	assert.Equal(t, common.NamespaceAlreadyExists, result.Code)
+
+	// Status codes are mapped to errors
+	_, err = c.Exec(ctx, "USE missing")
+	assert.True(t, errors.Is(err, client.ErrNamespaceDoesNotExist))
+	_, err = c.Exec(ctx, "UPDATE nothing")
+	assert.True(t, errors.Is(err, client.ErrInvalidStatement))
+	if assert.IsType(t, &client.Error{}, err) {
+		assert.Equal(t, common.InvalidStatementType, err.(*client.Error).Code)
+	}
+}
+
+func TestClientQuery(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	rows, err := c.Query(ctx, "CREATE NAMESPACE acme; CREATE NAMESPACE beta; SHOW NAMESPACES")
+	requireNil(t, err)
+
+	var names []string
+	for rows.Next() {
+		var name string
+		assert.Nil(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	assert.Nil(t, rows.Err())
+	assert.Equal(t, []string{"namespace"}, rows.Columns())
+	assert.Equal(t, []string{"acme", "beta"}, names)
+	assert.Len(t, rows.Results(), 3)
+
+	// The session is kept between requests
+	_, err = c.Exec(ctx, "USE acme")
+	assert.Nil(t, err)
+}
+
+func TestClientLogs(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	eventType := namedtuple.New("acme", "event")
+	eventType.AddVersion(namedtuple.Field{Name: "name", Required: true, Type: namedtuple.StringField})
+	builder := eventType.Builder(make([]byte, 64))
+	builder.PutString("name", "signup")
+	tuple, err := builder.Build()
+	requireNil(t, err)
+
+	// The server does not store logs
+	err = c.Insert(ctx, "acme.events", tuple)
+	assert.True(t, errors.Is(err, client.ErrLogDoesNotExist))
+
+	_, err = c.Subscribe(ctx, "acme.events", 0)
+	assert.True(t, errors.Is(err, client.ErrLogDoesNotExist))
+}
+
+func TestClientCancel(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Exec(ctx, "SHOW NAMESPACES")
+	assert.Equal(t, context.Canceled, err)
+
+	// Cancel a request while the rows are being read
+	ctx, cancel = context.WithCancel(context.Background())
+	rows, err := c.Query(ctx, "SHOW NAMESPACES")
+	requireNil(t, err)
+	cancel()
+	for rows.Next() {
+	}
+	assert.Equal(t, context.Canceled, rows.Err())
+
+	// The client opens a new channel for the next request
+	_, err = c.Exec(context.Background(), "SHOW NAMESPACES")
+	assert.Nil(t, err)
+
+	// Closed clients fail
+	c.Close()
+	_, err = c.Exec(context.Background(), "SHOW NAMESPACES")
+	assert.Equal(t, client.ErrClosed, err)
+}
+
+func TestClientQueue(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	rows, err := c.Query(context.Background(), "SHOW NAMESPACES")
+	requireNil(t, err)
+
+	// Requests wait for the rows to be read until their context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.Exec(ctx, "SHOW NAMESPACES")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	for rows.Next() {
+	}
+	assert.Nil(t, rows.Err())
+	_, err = c.Exec(context.Background(), "SHOW NAMESPACES")
+	assert.Nil(t, err)
+}
+
+func TestClientClose_OpenRows(t *testing.T) {
+	c, cleanup := newTestClient(t)
+	defer cleanup()
+
+	rows, err := c.Query(context.Background(), "SHOW NAMESPACES")
+	requireNil(t, err)
+	queued := make(chan error, 1)
+	go func() {
+		_, err := c.Exec(context.Background(), "SHOW NAMESPACES")
+		queued <- err
+	}()
+
+	// Closing the client does not wait for the rows and fails the queued request
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on open rows")
+	}
+
+	select {
+	case err := <-queued:
+		assert.Equal(t, client.ErrClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued request blocked after Close")
+	}
+
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		assert.Equal(t, client.ErrClosed, err)
+	}
+}
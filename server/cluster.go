@@ -0,0 +1,263 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/kappa/executor"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// statusQuery asks the servers for their status
+	statusQuery = "kappa-status"
+
+	// sessionsQuery asks the servers for their client sessions
+	sessionsQuery = "kappa-sessions"
+
+	// queryTimeout is how long the servers have to answer a query
+	queryTimeout = 2 * time.Second
+
+	// queryResponseLimit is the size of the largest answer. Serf limits responses to
+	// 1024 bytes including the message envelope.
+	queryResponseLimit = 768
+)
+
+// statusAnswer is the answer of a server to a status query
+type statusAnswer struct {
+	Build     string
+	Started   time.Time
+	Raft      string
+	DiskUsage int64
+	Sessions  int
+	Replicas  int
+	Leading   int
+}
+
+// sessionsAnswer is the answer of a server to a sessions query. The sessions are cut short
+// to fit the response, so Total may be larger.
+type sessionsAnswer struct {
+	Sessions []executor.SessionInfo
+	Total    int
+}
+
+// sessionList tracks the client sessions of a server.
+type sessionList struct {
+	lock     sync.Mutex
+	next     uint64
+	sessions map[uint64]executor.SessionInfo
+}
+
+// newSessionList creates an empty session list.
+func newSessionList() *sessionList {
+	return &sessionList{sessions: make(map[uint64]executor.SessionInfo)}
+}
+
+// add tracks a session until the returned function is called. Sessions are not tracked if
+// the list is nil.
+func (l *sessionList) add(info executor.SessionInfo) func() {
+	if l == nil {
+		return func() {}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	id := l.next
+	l.next++
+	l.sessions[id] = info
+
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		delete(l.sessions, id)
+	}
+}
+
+// list returns the sessions, oldest first.
+func (l *sessionList) list() []executor.SessionInfo {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	sessions := make([]executor.SessionInfo, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Sort(bySessionStart(sessions))
+	return sessions
+}
+
+// bySessionStart sorts sessions by the time they started
+type bySessionStart []executor.SessionInfo
+
+func (b bySessionStart) Len() int           { return len(b) }
+func (b bySessionStart) Less(i, j int) bool { return b[i].Started.Before(b[j].Started) }
+func (b bySessionStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Nodes asks every server of the cluster for its status.
+func (s *Server) Nodes() ([]executor.NodeStatus, error) {
+	answers, err := s.query(statusQuery)
+	if err != nil {
+		return nil, err
+	}
+	return nodeStatuses(s.serf.Members(), s.config.ClusterName, answers), nil
+}
+
+// Sessions returns the client sessions of this server, or of every server of the cluster.
+func (s *Server) Sessions(cluster bool) ([]executor.NodeSessions, error) {
+	if !cluster {
+		sessions := s.sessions.list()
+		return []executor.NodeSessions{{Name: s.config.NodeName, Answered: true, Sessions: sessions, Total: len(sessions)}}, nil
+	}
+
+	answers, err := s.query(sessionsQuery)
+	if err != nil {
+		return nil, err
+	}
+	return nodeSessions(s.serf.Members(), s.config.ClusterName, answers), nil
+}
+
+// query sends a query to the alive servers of the cluster and returns their answers by
+// server name. It returns once every server answered or the query timed out.
+func (s *Server) query(name string) (map[string][]byte, error) {
+	expected := 0
+	for _, m := range s.serf.Members() {
+		if details, err := GetKappaServer(m); err == nil && details.Cluster == s.config.ClusterName && m.Status == serf.StatusAlive {
+			expected++
+		}
+	}
+
+	params := s.serf.DefaultQueryParams()
+	params.Timeout = queryTimeout
+	params.FilterTags = map[string]string{
+		"role":    "^kappa-server$",
+		"cluster": "^" + regexp.QuoteMeta(s.config.ClusterName) + "$",
+	}
+	resp, err := s.serf.Query(name, nil, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serf closes the response channel once the query times out
+	answers := make(map[string][]byte)
+	for r := range resp.ResponseCh() {
+		answers[r.From] = r.Payload
+		if len(answers) == expected {
+			break
+		}
+	}
+	return answers, nil
+}
+
+// answerQuery returns the answer of this server to a query. It returns false if the query
+// is not a kappa query.
+func (s *Server) answerQuery(name string) ([]byte, bool, error) {
+	switch name {
+	case statusQuery:
+		replicas, leading := s.logs.counts()
+		answer, err := json.Marshal(&statusAnswer{
+			Build:     s.config.Build,
+			Started:   s.started,
+			Raft:      s.raft.State().String(),
+			DiskUsage: diskUsage(s.config.DataPath),
+			Sessions:  len(s.sessions.list()),
+			Replicas:  replicas,
+			Leading:   leading,
+		})
+		return answer, true, err
+	case sessionsQuery:
+		answer, err := fitSessions(s.sessions.list(), queryResponseLimit)
+		return answer, true, err
+	}
+	return nil, false, nil
+}
+
+// fitSessions encodes as many of the sessions as fit within limit bytes.
+func fitSessions(sessions []executor.SessionInfo, limit int) ([]byte, error) {
+	answer := sessionsAnswer{Sessions: sessions, Total: len(sessions)}
+	for {
+		data, err := json.Marshal(&answer)
+		if err != nil || len(data) <= limit || len(answer.Sessions) == 0 {
+			return data, err
+		}
+		answer.Sessions = answer.Sessions[:len(answer.Sessions)-1]
+	}
+}
+
+// diskUsage returns the size of the files in a directory.
+func diskUsage(dir string) (size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// nodeStatuses combines the servers of the cluster with their answers to a status query.
+func nodeStatuses(members []serf.Member, cluster string, answers map[string][]byte) []executor.NodeStatus {
+	var nodes []executor.NodeStatus
+	for _, m := range members {
+		details, err := GetKappaServer(m)
+		if err != nil || details.Cluster != cluster {
+			continue
+		}
+
+		node := executor.NodeStatus{Name: details.Name, Addr: details.Addr.String(), Gossip: m.Status.String()}
+		var answer statusAnswer
+		if data, ok := answers[details.Name]; ok && json.Unmarshal(data, &answer) == nil {
+			node.Answered = true
+			node.Build = answer.Build
+			node.Started = answer.Started
+			node.Raft = answer.Raft
+			node.DiskUsage = answer.DiskUsage
+			node.Sessions = answer.Sessions
+			node.Replicas = answer.Replicas
+			node.Leading = answer.Leading
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Sort(byNodeName(nodes))
+	return nodes
+}
+
+// nodeSessions combines the servers of the cluster with their answers to a sessions query.
+func nodeSessions(members []serf.Member, cluster string, answers map[string][]byte) []executor.NodeSessions {
+	var nodes []executor.NodeSessions
+	for _, m := range members {
+		details, err := GetKappaServer(m)
+		if err != nil || details.Cluster != cluster {
+			continue
+		}
+
+		node := executor.NodeSessions{Name: details.Name}
+		var answer sessionsAnswer
+		if data, ok := answers[details.Name]; ok && json.Unmarshal(data, &answer) == nil {
+			node.Answered = true
+			node.Sessions = answer.Sessions
+			node.Total = answer.Total
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Sort(bySessionsNode(nodes))
+	return nodes
+}
+
+// byNodeName sorts node statuses by name
+type byNodeName []executor.NodeStatus
+
+func (b byNodeName) Len() int           { return len(b) }
+func (b byNodeName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byNodeName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// bySessionsNode sorts the sessions of nodes by node name
+type bySessionsNode []executor.NodeSessions
+
+func (b bySessionsNode) Len() int           { return len(b) }
+func (b bySessionsNode) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b bySessionsNode) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
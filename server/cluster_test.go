@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/executor"
+	"github.com/blacklabeldata/kappa/skl"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+)
+
+// testClusterInfo answers cluster statements with fixed nodes and sessions
+type testClusterInfo struct {
+	nodes    []executor.NodeStatus
+	sessions []executor.NodeSessions
+	err      error
+}
+
+func (c *testClusterInfo) Nodes() ([]executor.NodeStatus, error) { return c.nodes, c.err }
+
+func (c *testClusterInfo) Sessions(cluster bool) ([]executor.NodeSessions, error) {
+	if !cluster {
+		return c.sessions[:1], c.err
+	}
+	return c.sessions, c.err
+}
+
+func TestSessionList(t *testing.T) {
+	sessions := newSessionList()
+	now := time.Now()
+	removeBob := sessions.add(executor.SessionInfo{User: "bob", Started: now})
+	removeAdmin := sessions.add(executor.SessionInfo{User: "admin", Started: now.Add(-time.Minute)})
+
+	// Sessions are listed oldest first until they are removed
+	assert.Equal(t, []executor.SessionInfo{{User: "admin", Started: now.Add(-time.Minute)}, {User: "bob", Started: now}}, sessions.list())
+	removeAdmin()
+	assert.Equal(t, []executor.SessionInfo{{User: "bob", Started: now}}, sessions.list())
+	removeBob()
+	assert.Empty(t, sessions.list())
+
+	// Sessions are not tracked without a list
+	var untracked *sessionList
+	untracked.add(executor.SessionInfo{User: "bob"})()
+}
+
+func TestFitSessions(t *testing.T) {
+	var sessions []executor.SessionInfo
+	for i := 0; i < 50; i++ {
+		sessions = append(sessions, executor.SessionInfo{User: "admin", Kind: "client", Remote: "127.0.0.1:50000", Started: time.Now()})
+	}
+
+	// Sessions are dropped until the answer fits
+	data, err := fitSessions(sessions, queryResponseLimit)
+	requireNil(t, err)
+	assert.True(t, len(data) <= queryResponseLimit)
+
+	var answer sessionsAnswer
+	requireNil(t, json.Unmarshal(data, &answer))
+	assert.Equal(t, 50, answer.Total)
+	assert.True(t, len(answer.Sessions) > 0 && len(answer.Sessions) < 50)
+}
+
+func TestNodeStatuses(t *testing.T) {
+	members := []serf.Member{expectMember("node-2", 3), expectMember("node-1", 3), expectMember("node-3", 3), expectMember("other", 3)}
+	members[2].Status = serf.StatusFailed
+	members[3].Tags["cluster"] = "other"
+
+	started := time.Now().UTC().Truncate(time.Second)
+	answer, err := json.Marshal(&statusAnswer{Build: "abc", Started: started, Raft: "Leader", Sessions: 2, Replicas: 3, Leading: 1})
+	requireNil(t, err)
+
+	// Servers which did not answer are listed with their gossip status
+	nodes := nodeStatuses(members, "kappa", map[string][]byte{"node-1": answer})
+	assert.Equal(t, []executor.NodeStatus{
+		{Name: "node-1", Addr: "127.0.0.1:9000", Gossip: "alive", Answered: true, Build: "abc", Started: started, Raft: "Leader", Sessions: 2, Replicas: 3, Leading: 1},
+		{Name: "node-2", Addr: "127.0.0.1:9000", Gossip: "alive"},
+		{Name: "node-3", Addr: "127.0.0.1:9000", Gossip: "failed"},
+	}, nodes)
+
+	answer, err = json.Marshal(&sessionsAnswer{Sessions: []executor.SessionInfo{{User: "bob", Started: started}}, Total: 2})
+	requireNil(t, err)
+	sessions := nodeSessions(members, "kappa", map[string][]byte{"node-2": answer, "node-3": []byte("{")})
+	assert.Equal(t, []executor.NodeSessions{
+		{Name: "node-1"},
+		{Name: "node-2", Answered: true, Sessions: []executor.SessionInfo{{User: "bob", Started: started}}, Total: 2},
+		{Name: "node-3"},
+	}, sessions)
+}
+
+func TestClusterStatements(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-cluster")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+
+	system, err := datamodel.NewSystem(path.Join(dir, "meta.db"))
+	requireNil(t, err)
+	defer system.Close()
+	users, err := system.Users()
+	requireNil(t, err)
+	admin, err := users.Create("admin")
+	requireNil(t, err)
+	bob, err := users.Create("bob")
+	requireNil(t, err)
+
+	// node-2 leads a partition but did not answer
+	namespaces, err := system.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Create("acme")
+	requireNil(t, err)
+	logs, err := system.Logs()
+	requireNil(t, err)
+	requireNil(t, logs.Create(datamodel.Log{Name: "acme.events", Replicas: 1, Partitions: make([]datamodel.Partition, 1)}))
+	requireNil(t, logs.Assign("acme.events", []datamodel.Partition{{Servers: []string{"node-2"}, Leader: "node-2"}}))
+
+	cluster := &testClusterInfo{
+		nodes: []executor.NodeStatus{
+			{Name: "node-1", Addr: "127.0.0.1:9022", Gossip: "alive", Answered: true, Raft: "Leader", Build: "abc", Started: time.Now(), DiskUsage: 2048},
+			{Name: "node-2", Addr: "127.0.0.1:9023", Gossip: "alive"},
+		},
+		sessions: []executor.NodeSessions{
+			{Name: "node-1", Answered: true, Sessions: []executor.SessionInfo{{User: "admin", Kind: "shell", Remote: "127.0.0.1:50000", Started: time.Now()}}, Total: 3},
+			{Name: "node-2"},
+		},
+	}
+	execute := func(user datamodel.User, cluster executor.Cluster, statement string) string {
+		stmt, err := skl.ParseStatement(statement)
+		requireNil(t, err)
+
+		var buf bytes.Buffer
+		w := common.ResponseWriter{Colors: common.NoColorCodes, Writer: &buf}
+		exec := executor.NewExecutor(executor.NewSession("", user), common.NewHeadlessTerminal(defaultPrompt), system, nil, cluster, nil)
+		exec.Execute(&w, stmt)
+		return buf.String()
+	}
+
+	// Servers which did not answer are shown
+	out := execute(admin, cluster, "SHOW NODES")
+	assert.Contains(t, out, "2.0 KiB")
+	assert.Contains(t, out, "no answer from node-2")
+
+	out = execute(admin, cluster, "SHOW CLUSTER HEALTH")
+	assert.Contains(t, out, "unreachable")
+	assert.Contains(t, out, "cluster is degraded: 1 of 2 nodes are unhealthy, 1 partitions are offline")
+
+	cluster.nodes[1].Answered = true
+	out = execute(admin, cluster, "SHOW CLUSTER HEALTH")
+	assert.Contains(t, out, "cluster is healthy: 2 nodes, leader node-1")
+
+	out = execute(admin, cluster, "SHOW SESSIONS ON CLUSTER")
+	assert.Contains(t, out, "127.0.0.1:50000")
+	assert.Contains(t, out, "2 more on node-1; no answer from node-2")
+
+	// Only the admin can inspect the cluster
+	assert.Contains(t, execute(bob, cluster, "SHOW NODES"), "Unauthorized")
+	assert.Contains(t, execute(admin, nil, "SHOW SESSIONS"), "cluster information is not available")
+
+	cluster.err = errors.New("serf is shutting down")
+	assert.Contains(t, execute(admin, cluster, "SHOW NODES"), "could not query the cluster: serf is shutting down")
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"io"
 	"time"
+
+	"github.com/blacklabeldata/kappa/auth"
 )
 
 // DatabaseConfig contains all the information to start the Kappa server.
@@ -23,6 +25,10 @@ type DatabaseConfig struct {
 
 	BootstrapExpect int
 
+	// DiscardMetadata allows a server which joins a cluster to discard the users and
+	// namespaces in its local store which were never replicated.
+	DiscardMetadata bool
+
 	// Build is the running server revision.
 	Build string
 
@@ -48,6 +54,21 @@ type DatabaseConfig struct {
 	// SSHPrivateKeyFile refers to the private key file of the SSH server.
 	SSHPrivateKeyFile string
 
+	// SSHPrivateKeyPassphrase returns the passphrase if the SSH private key is encrypted.
+	SSHPrivateKeyPassphrase auth.PassphraseFunc
+
+	// SSHCertificateFile refers to the certificate issued for the SSH server's private key.
+	// If it is empty, the host certificate is not checked for expiry.
+	SSHCertificateFile string
+
+	// SSHHostCertificateFile refers to an SSH certificate for the server's private key signed
+	// by the CA. If it is set, the certificate is presented to clients as the host key.
+	SSHHostCertificateFile string
+
+	// CertificateExpiryWarning is how long before the CA or host certificate
+	// expires that the server starts logging warnings.
+	CertificateExpiryWarning time.Duration
+
 	// GossipBindAddr
 	GossipBindAddr string
 
@@ -59,4 +80,15 @@ type DatabaseConfig struct {
 
 	// GossipAdvertisePort
 	GossipAdvertisePort int
+
+	// GossipEncryptKey is the base64 encoded key which encrypts gossip. It is only used
+	// to create the keyring in the data directory, which takes precedence once it exists.
+	GossipEncryptKey string
+
+	// RaftBindAddr is the address on which Raft listens for the other servers.
+	RaftBindAddr string
+
+	// RaftBindPort is the port on which Raft listens. It is advertised to the
+	// other servers with the gossip address.
+	RaftBindPort int
 }
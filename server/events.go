@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+)
+
+const (
+	// eventCoalescePeriod is the longest time coalesced events are held back
+	eventCoalescePeriod = time.Second
+
+	// eventQuiescentPeriod is the time without new events after which coalesced events
+	// are delivered
+	eventQuiescentPeriod = 100 * time.Millisecond
+)
+
+// ClusterEvent is the payload of an event broadcast to the servers of the cluster.
+type ClusterEvent interface {
+
+	// EventName returns the name of the event without the KappaEventPrefix
+	EventName() string
+}
+
+// Broadcaster sends a Serf user event to the cluster.
+type Broadcaster func(name string, payload []byte, coalesce bool) error
+
+// eventHandler decodes the payloads of an event into the values returned by newEvent
+type eventHandler struct {
+	newEvent func() ClusterEvent
+	handle   func(ClusterEvent)
+}
+
+// EventBus delivers typed events to every server of the cluster. Events are broadcast as
+// Serf user events named with the KappaEventPrefix, and their payloads are JSON encoded.
+// Serfer passes the kappa events on to the bus, while other user events are dropped.
+type EventBus struct {
+	logger    log.Logger
+	broadcast Broadcaster
+	events    <-chan serf.UserEvent
+
+	lock     sync.RWMutex
+	handlers map[string][]eventHandler
+}
+
+// NewEventBus creates an event bus which broadcasts events with broadcast and handles the
+// user events received on events.
+func NewEventBus(logger log.Logger, broadcast Broadcaster, events <-chan serf.UserEvent) *EventBus {
+	return &EventBus{
+		logger:    logger,
+		broadcast: broadcast,
+		events:    events,
+		handlers:  make(map[string][]eventHandler),
+	}
+}
+
+// Handle registers a handler for the events with the given name. Each payload is decoded
+// into a new event returned by newEvent before the handler is called.
+func (b *EventBus) Handle(name string, newEvent func() ClusterEvent, handler func(ClusterEvent)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers[name] = append(b.handlers[name], eventHandler{newEvent, handler})
+}
+
+// Broadcast sends an event to every server, including this one. Coalesced events which
+// are broadcast in quick succession are delivered once, with the payload of the last one.
+func (b *EventBus) Broadcast(event ClusterEvent, coalesce bool) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.broadcast(GetKappaEventName(event.EventName()), payload, coalesce)
+}
+
+// Run delivers the received events to their handlers until dying is closed.
+func (b *EventBus) Run(dying <-chan struct{}) error {
+	for {
+		select {
+		case event := <-b.events:
+			b.dispatch(event)
+		case <-dying:
+			return nil
+		}
+	}
+}
+
+// dispatch calls the handlers of a user event. Events without handlers are ignored.
+func (b *EventBus) dispatch(event serf.UserEvent) {
+	name := GetRawEventName(event.Name)
+
+	b.lock.RLock()
+	handlers := b.handlers[name]
+	b.lock.RUnlock()
+	if len(handlers) == 0 {
+		b.logger.Debug("No handler for event", "name", name)
+		return
+	}
+
+	for _, h := range handlers {
+		e := h.newEvent()
+		if err := json.Unmarshal(event.Payload, e); err != nil {
+			b.logger.Warn("Failed to decode event", "name", name, "err", err.Error())
+			continue
+		}
+		h.handle(e)
+	}
+}
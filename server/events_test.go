@@ -0,0 +1,95 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	events := make(chan serf.UserEvent, 8)
+	var coalesced []bool
+	bus := NewEventBus(log.NullLog, func(name string, payload []byte, coalesce bool) error {
+		coalesced = append(coalesced, coalesce)
+		events <- serf.UserEvent{Name: name, Payload: payload, Coalesce: coalesce}
+		return nil
+	}, events)
+
+	var received []uint64
+	bus.Handle(usersChangedEvent, func() ClusterEvent { return &usersChanged{} }, func(e ClusterEvent) {
+		received = append(received, e.(*usersChanged).Index)
+	})
+
+	// Events are broadcast with the kappa prefix and decoded for their handlers
+	requireNil(t, bus.Broadcast(&usersChanged{7}, true))
+	requireNil(t, bus.Broadcast(&namespacesChanged{8}, false))
+	assert.Equal(t, []bool{true, false}, coalesced)
+	event := <-events
+	assert.Equal(t, "kappa-event:users-changed", event.Name)
+	bus.dispatch(event)
+	bus.dispatch(<-events)
+	assert.Equal(t, []uint64{7}, received)
+
+	// Serfer strips the prefix before passing events on
+	bus.dispatch(serf.UserEvent{Name: usersChangedEvent, Payload: []byte(`{"Index": 9}`)})
+	assert.Equal(t, []uint64{7, 9}, received)
+
+	// Invalid payloads are ignored
+	bus.dispatch(serf.UserEvent{Name: usersChangedEvent, Payload: []byte("{")})
+	assert.Equal(t, []uint64{7, 9}, received)
+
+	// Run delivers events until it is stopped
+	dying := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- bus.Run(dying) }()
+	requireNil(t, bus.Broadcast(&usersChanged{10}, true))
+	close(dying)
+	requireNil(t, <-done)
+}
+
+func TestMetadataCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-cache")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := datamodel.NewBoltSystemStore(path.Join(dir, "meta.db"))
+	requireNil(t, err)
+	defer store.Close()
+	cache := newMetadataCache(store)
+
+	// Users are cached after they are looked up
+	users, err := cache.Users()
+	requireNil(t, err)
+	_, err = users.Create("alice")
+	requireNil(t, err)
+	_, err = users.Get("alice")
+	requireNil(t, err)
+	assert.Len(t, cache.users, 1)
+
+	// Changes made by other servers are seen once the cache is flushed
+	local, err := store.Users()
+	requireNil(t, err)
+	requireNil(t, local.Delete("alice"))
+	_, err = users.Get("alice")
+	assert.Nil(t, err)
+	cache.flushUsers()
+	_, err = users.Get("alice")
+	assert.Equal(t, datamodel.ErrUserDoesNotExist, err)
+
+	// Deleting through the cache flushes it
+	namespaces, err := cache.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Create("acme")
+	requireNil(t, err)
+	_, err = namespaces.Get("acme")
+	requireNil(t, err)
+	requireNil(t, namespaces.Delete("acme"))
+	_, err = namespaces.Get("acme")
+	assert.Equal(t, datamodel.ErrNamespaceDoesNotExist, err)
+}
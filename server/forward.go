@@ -0,0 +1,296 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/blacklabeldata/kappa/auth"
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/executor"
+	"github.com/blacklabeldata/kappa/protocol"
+	"github.com/blacklabeldata/kappa/skl"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	// forwardChannel is the channel type opened by followers to forward writes to the leader
+	forwardChannel = "kappa-forward"
+
+	// forwardUser is the reserved SSH user which servers log in as with their host
+	// certificate
+	forwardUser = "kappa-server"
+
+	// forwardRequest selects the user and namespace a forward channel executes as
+	forwardRequest = "kappa-session"
+)
+
+// forwardSession is the payload of a forwardRequest.
+type forwardSession struct {
+	User      string
+	Namespace string
+}
+
+// ServerPublicKeyCallback lets the servers of the cluster log in as the forward user with
+// their host certificate, which must be signed by one of the authorities. The server is
+// named by the certificate. Other users are authenticated by the users callback.
+func ServerPublicKeyCallback(authorities []ssh.PublicKey, users func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if conn.User() != forwardUser {
+			return users(conn, key)
+		}
+
+		name, err := auth.VerifyHostCertificate(authorities, key)
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Permissions{Extensions: map[string]string{"server": name}}, nil
+	}
+}
+
+// serverCredentials authenticate the servers of a cluster to each other. Servers log in
+// with their host certificate and verify the host certificate of the other server, which
+// must be signed by one of the authorities.
+type serverCredentials struct {
+	signer      ssh.Signer
+	authorities []ssh.PublicKey
+}
+
+// ForwardHandler services "kappa-forward" channels opened by other servers. After a
+// "kappa-session" request selects the user and namespace of the original session, the
+// channel speaks the binary protocol without a handshake.
+type ForwardHandler struct {
+	logger log.Logger
+	system datamodel.System
+	logs   *logManager
+}
+
+// NewForwardHandler creates a handler for kappa-forward channels. Inserts and
+// subscriptions are served by the log manager unless it is nil.
+func NewForwardHandler(logger log.Logger, system datamodel.System, logs *logManager) *ForwardHandler {
+	return &ForwardHandler{logger, system, logs}
+}
+
+// Handle executes the forwarded requests as the user of the original session.
+func (h *ForwardHandler) Handle(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+	defer channel.Close()
+
+	// Only servers can forward requests
+	if sshConn.Permissions == nil || sshConn.Permissions.Extensions["server"] == "" {
+		return errors.New("forward channel opened by a client")
+	}
+
+	// Wait for the session of the forwarded requests
+	var session forwardSession
+	var user datamodel.User
+	select {
+	case req, ok := <-requests:
+		if !ok {
+			return nil
+		}
+
+		err := errors.New("expected a " + forwardRequest + " request")
+		if req.Type == forwardRequest {
+			if err = ssh.Unmarshal(req.Payload, &session); err == nil {
+				user, err = h.user(session.User)
+			}
+		}
+		req.Reply(err == nil, nil)
+		if err != nil {
+			return err
+		}
+	case <-parentTomb.Dying():
+		return nil
+	}
+	go ssh.DiscardRequests(requests)
+
+	// Close the channel if the server is shutting down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-parentTomb.Dying():
+			channel.Close()
+		case <-done:
+		}
+	}()
+
+	// Requests are executed locally, even if this server is no longer the leader
+	s := executor.NewSession(session.Namespace, user)
+	exec := executor.NewExecutor(s, common.NewHeadlessTerminal(defaultPrompt), h.system, nil, nil, nil)
+	p := NewProtocolHandler(h.logger, h.system, nil, h.logs, nil, nil)
+
+	enc := protocol.NewEncoder(channel, protocol.DefaultMaxFrameSize)
+	dec := protocol.NewDecoder(channel, protocol.DefaultMaxFrameSize)
+	return p.serve(enc, dec, exec, user, serverCapabilities)
+}
+
+// user returns the user of a forwarded session.
+func (h *ForwardHandler) user(username string) (datamodel.User, error) {
+	users, err := h.system.Users()
+	if err != nil {
+		return nil, err
+	}
+	return users.Get(username)
+}
+
+// leaderForwarder forwards writes to the leader. Servers log in with their host certificate.
+// Each request uses a new connection, since the SSH server only serves one channel per
+// connection.
+type leaderForwarder struct {
+	logger   log.Logger
+	creds    *serverCredentials
+	isLeader func() bool
+	leader   func() (*NodeDetails, error)
+}
+
+// Forward executes a statement on the leader unless this server is the leader.
+func (f *leaderForwarder) Forward(w *common.ResponseWriter, session executor.Session, stmt skl.Statement) bool {
+	if f.isLeader() {
+		return false
+	}
+	f.forward(w, session.User(), session.Namespace(), &protocol.Query{Statement: stmt.String()})
+	return true
+}
+
+// forward sends a request to the leader and relays the response.
+func (f *leaderForwarder) forward(w *common.ResponseWriter, user datamodel.User, namespace string, m protocol.Message) {
+	leader, err := f.leader()
+	if err != nil {
+		w.Fail(common.NoClusterLeader, "%s", err.Error())
+		return
+	}
+
+	f.logger.Debug("Forwarding to leader", "node", leader.Name, "addr", leader.Addr.String())
+	if err := sendTo(w, f.creds, leader, user, namespace, m); err != nil {
+		w.Fail(common.NoClusterLeader, "%s", err.Error())
+	}
+}
+
+// sendTo executes a request on another server as the given user and relays the response.
+// An error is returned if the request could not be sent.
+func sendTo(w *common.ResponseWriter, creds *serverCredentials, node *NodeDetails, user datamodel.User, namespace string, m protocol.Message) error {
+	conn, err := dialServer(creds, node)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channel, err := openForwardChannel(conn, user.Username(), namespace)
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	if err := relay(w, channel, m); err != nil {
+		w.Fail(common.InternalServerError, "forwarding to %s failed: %s", node.Name, err.Error())
+	}
+	return nil
+}
+
+// dialServer opens a connection to another server of the cluster. Servers log in with
+// their host certificate and verify that the other server's host certificate names it.
+func dialServer(creds *serverCredentials, node *NodeDetails) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User: forwardUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(creds.signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			name, err := auth.VerifyHostCertificate(creds.authorities, key)
+			if err != nil {
+				return fmt.Errorf("host key of server %s was rejected: %s", node.Name, err)
+			} else if name != node.Name {
+				return fmt.Errorf("host certificate of server %s names %s", node.Name, name)
+			}
+			return nil
+		},
+		Timeout: raftTimeout,
+	}
+	return ssh.Dial("tcp", node.Addr.String(), config)
+}
+
+// leaderDetails returns the known server whose Raft ID is the current leader.
+func (s *Server) leaderDetails() (*NodeDetails, error) {
+	_, id := s.raft.LeaderWithID()
+	if id == "" {
+		return nil, errors.New("no cluster leader")
+	}
+
+	nodes := s.localKappas.Filter(func(d NodeDetails) bool {
+		return d.Name == string(id) && d.Cluster == s.config.ClusterName
+	})
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("leader %s is not a known server", id)
+	}
+	return &nodes[0], nil
+}
+
+// openForwardChannel opens a forward channel which executes as the given user.
+func openForwardChannel(conn *ssh.Client, username, namespace string) (ssh.Channel, error) {
+	channel, requests, err := conn.OpenChannel(forwardChannel, nil)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(requests)
+
+	ok, err := channel.SendRequest(forwardRequest, true, ssh.Marshal(&forwardSession{username, namespace}))
+	if err == nil && !ok {
+		err = errors.New("leader rejected the forwarded session")
+	}
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return channel, nil
+}
+
+// relay sends a request on a forward channel and writes the response until it ends.
+func relay(w *common.ResponseWriter, channel ssh.Channel, m protocol.Message) error {
+	enc := protocol.NewEncoder(channel, protocol.DefaultMaxFrameSize)
+	dec := protocol.NewDecoder(channel, protocol.DefaultMaxFrameSize)
+	if err := enc.EncodeMessage(0, m); err != nil {
+		return err
+	}
+
+	var columns []string
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			return err
+		}
+
+		switch f.Type {
+		case protocol.StatusFrame:
+			var status protocol.Status
+			if err := status.UnmarshalBinary(f.Payload); err != nil {
+				return err
+			}
+			w.Success(status.Code, "%s", status.Message)
+		case protocol.ErrorFrame:
+			var e protocol.Error
+			if err := e.UnmarshalBinary(f.Payload); err != nil {
+				return err
+			}
+			w.Fail(e.Code, "%s", e.Message)
+		case protocol.ColumnHeaderFrame:
+			var header protocol.ColumnHeader
+			if err := header.UnmarshalBinary(f.Payload); err != nil {
+				return err
+			}
+			columns = header.Columns
+			w.Columns(columns...)
+		case protocol.RowFrame:
+			row := protocol.Row{Columns: columns}
+			if err := row.UnmarshalBinary(f.Payload); err != nil {
+				return err
+			}
+			w.Row(row.Values...)
+		case protocol.EndFrame:
+			return nil
+		default:
+			return errors.New("unexpected " + f.Type.String() + " frame")
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/executor"
+	"github.com/blacklabeldata/kappa/protocol"
+	"github.com/blacklabeldata/kappa/skl"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// testLeader accepts forwarded requests from servers with a host certificate signed by
+// its CA
+type testLeader struct {
+	system  datamodel.System
+	details *NodeDetails
+	ca      ssh.Signer
+}
+
+// newTestSigner creates an SSH key
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	requireNil(t, err)
+	signer, err := ssh.NewSignerFromSigner(key)
+	requireNil(t, err)
+	return signer
+}
+
+// newTestCredentials creates a key with a host certificate signed by the CA, which names
+// the server, and trusts the host certificates signed by the CA.
+func newTestCredentials(t *testing.T, ca ssh.Signer, name string) *serverCredentials {
+	key := newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           name,
+		ValidPrincipals: []string{name, "127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	requireNil(t, cert.SignCert(rand.Reader, ca))
+	signer, err := ssh.NewCertSigner(cert, key)
+	requireNil(t, err)
+	return &serverCredentials{signer: signer, authorities: []ssh.PublicKey{ca.PublicKey()}}
+}
+
+// newTestLeader starts the forward handler on a local port. The admin and bob accounts
+// are created on the leader.
+func newTestLeader(t *testing.T) (*testLeader, func()) {
+	dir, err := ioutil.TempDir("", "kappa-forward")
+	requireNil(t, err)
+
+	system, err := datamodel.NewSystem(path.Join(dir, "meta.db"))
+	requireNil(t, err)
+	users, err := system.Users()
+	requireNil(t, err)
+	for _, username := range []string{"admin", "bob"} {
+		_, err = users.Create(username)
+		requireNil(t, err)
+	}
+
+	// Clients cannot log in
+	ca := newTestSigner(t)
+	creds := newTestCredentials(t, ca, "leader")
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: ServerPublicKeyCallback(creds.authorities, func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("invalid public key")
+		}),
+	}
+	serverConfig.AddHostKey(creds.signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requireNil(t, err)
+	handler := NewForwardHandler(log.NullLog, system, nil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				sshConn, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+
+				var tb tomb.Tomb
+				for ch := range channels {
+					if ch.ChannelType() != forwardChannel {
+						ch.Reject(ssh.UnknownChannelType, "unknown channel type")
+						continue
+					}
+
+					channel, reqs, err := ch.Accept()
+					if err != nil {
+						return
+					}
+					go handler.Handle(tb, sshConn, channel, reqs)
+				}
+			}()
+		}
+	}()
+
+	leader := &testLeader{
+		system: system,
+		details: &NodeDetails{
+			Name:    "leader",
+			Cluster: "kappa",
+			Addr:    *listener.Addr().(*net.TCPAddr),
+		},
+		ca: ca,
+	}
+	return leader, func() {
+		listener.Close()
+		system.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// forwarder returns a follower's forwarder which logs in with the given credentials.
+func (l *testLeader) forwarder(creds *serverCredentials) *leaderForwarder {
+	return &leaderForwarder{
+		logger:   log.NullLog,
+		creds:    creds,
+		isLeader: func() bool { return false },
+		leader:   func() (*NodeDetails, error) { return l.details, nil },
+	}
+}
+
+// follower returns the forwarder of a follower whose host certificate is signed by the
+// leader's CA.
+func (l *testLeader) follower(t *testing.T) *leaderForwarder {
+	return l.forwarder(newTestCredentials(t, l.ca, "follower"))
+}
+
+// user returns a user from the leader
+func (l *testLeader) user(t *testing.T, username string) datamodel.User {
+	users, err := l.system.Users()
+	requireNil(t, err)
+	user, err := users.Get(username)
+	requireNil(t, err)
+	return user
+}
+
+// forward forwards a statement and returns the response written by the forwarder
+func forward(t *testing.T, f *leaderForwarder, user datamodel.User, statement string) string {
+	stmt, err := skl.ParseStatement(statement)
+	requireNil(t, err)
+
+	var buf bytes.Buffer
+	w := common.ResponseWriter{Colors: common.NoColorCodes, Writer: &buf}
+	assert.True(t, f.Forward(&w, executor.NewSession("", user), stmt))
+	return buf.String()
+}
+
+func TestForwardStatement(t *testing.T) {
+	leader, cleanup := newTestLeader(t)
+	defer cleanup()
+
+	f := leader.follower(t)
+
+	// The statement is executed by the leader
+	admin := leader.user(t, "admin")
+	assert.Contains(t, forward(t, f, admin, "CREATE NAMESPACE acme"), "OK (2000)")
+	namespaces, err := leader.system.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Get("acme")
+	assert.Nil(t, err)
+
+	// Each statement is forwarded on a new connection
+	assert.Contains(t, forward(t, f, admin, "CREATE NAMESPACE acme"), "NamespaceAlreadyExists")
+}
+
+func TestForwardAsSessionUser(t *testing.T) {
+	leader, cleanup := newTestLeader(t)
+	defer cleanup()
+
+	f := leader.follower(t)
+
+	// Only the admin can create root namespaces
+	bob := leader.user(t, "bob")
+	assert.Contains(t, forward(t, f, bob, "CREATE NAMESPACE acme"), "Unauthorized (4000)")
+}
+
+func TestForwardUnknownServer(t *testing.T) {
+	leader, cleanup := newTestLeader(t)
+	defer cleanup()
+	admin := leader.user(t, "admin")
+
+	// A node which advertises itself as a server cannot log in with a plain host key
+	intruder := newTestSigner(t)
+	creds := &serverCredentials{signer: intruder, authorities: []ssh.PublicKey{leader.ca.PublicKey()}}
+	assert.Contains(t, forward(t, leader.forwarder(creds), admin, "CREATE NAMESPACE acme"), "NoClusterLeader")
+
+	// nor with a host certificate signed by another CA
+	other := newTestCredentials(t, newTestSigner(t), "follower")
+	other.authorities = creds.authorities
+	assert.Contains(t, forward(t, leader.forwarder(other), admin, "CREATE NAMESPACE acme"), "NoClusterLeader")
+
+	namespaces, err := leader.system.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Get("acme")
+	assert.Equal(t, datamodel.ErrNamespaceDoesNotExist, err)
+}
+
+func TestForwardLeaderHostKey(t *testing.T) {
+	leader, cleanup := newTestLeader(t)
+	defer cleanup()
+	f := leader.follower(t)
+
+	// The leader must present a host certificate signed by the CA
+	f.creds.authorities = []ssh.PublicKey{newTestSigner(t).PublicKey()}
+	assert.Contains(t, forward(t, f, leader.user(t, "admin"), "CREATE NAMESPACE acme"), "NoClusterLeader")
+
+	// which names the server
+	f = leader.follower(t)
+	leader.details.Name = "other"
+	assert.Contains(t, forward(t, f, leader.user(t, "admin"), "CREATE NAMESPACE acme"), "NoClusterLeader")
+}
+
+func TestServerPublicKeyCallback(t *testing.T) {
+	ca := newTestSigner(t)
+	creds := newTestCredentials(t, ca, "node-1")
+	users := func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return &ssh.Permissions{Extensions: map[string]string{"username": "bob"}}, nil
+	}
+	callback := ServerPublicKeyCallback(creds.authorities, users)
+
+	// Servers are named by their host certificate
+	perms, err := callback(testConnMetadata(forwardUser), creds.signer.PublicKey())
+	requireNil(t, err)
+	assert.Equal(t, map[string]string{"server": "node-1"}, perms.Extensions)
+
+	// Gossip does not matter: plain keys and certificates of other CAs are rejected
+	_, err = callback(testConnMetadata(forwardUser), newTestSigner(t).PublicKey())
+	assert.NotNil(t, err)
+	_, err = callback(testConnMetadata(forwardUser), newTestCredentials(t, newTestSigner(t), "node-1").signer.PublicKey())
+	assert.NotNil(t, err)
+
+	// Other users are authenticated as users
+	perms, err = callback(testConnMetadata("bob"), newTestSigner(t).PublicKey())
+	requireNil(t, err)
+	assert.Equal(t, "bob", perms.Extensions["username"])
+}
+
+// testConnMetadata is the metadata of a connection by a user
+type testConnMetadata string
+
+func (m testConnMetadata) User() string          { return string(m) }
+func (m testConnMetadata) SessionID() []byte     { return nil }
+func (m testConnMetadata) ClientVersion() []byte { return nil }
+func (m testConnMetadata) ServerVersion() []byte { return nil }
+func (m testConnMetadata) RemoteAddr() net.Addr  { return nil }
+func (m testConnMetadata) LocalAddr() net.Addr   { return nil }
+
+func TestForwardInsert(t *testing.T) {
+	leader, cleanup := newTestLeader(t)
+	defer cleanup()
+
+	f := leader.follower(t)
+
+	// Inserts are sent to the leader of the log, which has no logs here
+	var buf bytes.Buffer
+	w := common.ResponseWriter{Colors: common.NoColorCodes, Writer: &buf}
+	requireNil(t, sendTo(&w, f.creds, leader.details, leader.user(t, "admin"), "", &protocol.Insert{Log: "events"}))
+	assert.Contains(t, buf.String(), "LogDoesNotExist (5006): events")
+}
+
+func TestForwardOnLeader(t *testing.T) {
+	f := &leaderForwarder{isLeader: func() bool { return true }}
+
+	stmt, err := skl.ParseStatement("CREATE NAMESPACE acme")
+	requireNil(t, err)
+	var w common.ResponseWriter
+	assert.False(t, f.Forward(&w, executor.NewSession("", nil), stmt))
+}
+
+func TestIsWrite(t *testing.T) {
+	for statement, write := range map[string]bool{
+		"CREATE NAMESPACE acme":    true,
+		"DROP NAMESPACE acme":      true,
+		"USE acme":                 false,
+		"SHOW NAMESPACES":          false,
+		"CREATE LOG acme.posts":    true,
+		"SHOW LOGS":                false,
+		"SHOW PARTITIONS":          false,
+		"SHOW NODES":               false,
+		"SHOW CLUSTER HEALTH":      false,
+		"SHOW SESSIONS":            false,
+		"SHOW SESSIONS ON CLUSTER": false,
+	} {
+		stmt, err := skl.ParseStatement(statement)
+		requireNil(t, err)
+		assert.Equal(t, write, executor.IsWrite(stmt), statement)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+)
+
+// kappaFSM applies the replicated metadata commands to the local system store. The
+// results of Apply are returned to the server which submitted the command. logsChanged is
+// called after the logs change, unless it is nil, and the metadata cache is flushed after
+// the users or namespaces change, unless cache is nil.
+type kappaFSM struct {
+	logger      log.Logger
+	store       *datamodel.BoltSystemStore
+	logsChanged func()
+	cache       *metadataCache
+}
+
+// Apply applies a committed log entry. It returns the command's result or error.
+func (f *kappaFSM) Apply(l *raft.Log) interface{} {
+	var cmd datamodel.Command
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		f.logger.Error("Failed to decode command", "index", l.Index, "err", err.Error())
+		return err
+	}
+
+	result, err := f.store.Apply(cmd)
+	if err != nil {
+		return err
+	}
+
+	switch cmd.Type {
+	case datamodel.CreateLogCommand, datamodel.AssignLogCommand:
+		f.notify()
+	}
+	if f.cache != nil {
+		f.cache.flush(commandEvent(cmd, l.Index))
+	}
+	return result
+}
+
+// Snapshot copies the store so it can be persisted while commands are applied.
+func (f *kappaFSM) Snapshot() (raft.FSMSnapshot, error) {
+	snapshot, err := f.store.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &kappaSnapshot{snapshot}, nil
+}
+
+// Restore replaces the store with a snapshot.
+func (f *kappaFSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	if err := f.store.Restore(r); err != nil {
+		return err
+	}
+	if f.cache != nil {
+		f.cache.flushUsers()
+		f.cache.flushNamespaces()
+	}
+	f.notify()
+	return nil
+}
+
+// notify reports that the logs may have changed.
+func (f *kappaFSM) notify() {
+	if f.logsChanged != nil {
+		f.logsChanged()
+	}
+}
+
+// kappaSnapshot persists a copy of the system store
+type kappaSnapshot struct {
+	snapshot *datamodel.Snapshot
+}
+
+// Persist writes the snapshot to the sink.
+func (s *kappaSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.snapshot.Write(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release is called when the snapshot is no longer needed.
+func (s *kappaSnapshot) Release() {}
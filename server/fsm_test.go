@@ -0,0 +1,359 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/raft"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRaftNode is a Raft server replicating a system store
+type testRaftNode struct {
+	raft  *raft.Raft
+	store *datamodel.BoltSystemStore
+}
+
+// newTestRaftCluster starts Raft servers connected by an in-memory transport. The first
+// server bootstraps the cluster with all of them as peers.
+func newTestRaftCluster(t *testing.T, size int) ([]*testRaftNode, func()) {
+	dir, err := ioutil.TempDir("", "kappa-raft")
+	requireNil(t, err)
+
+	var configuration raft.Configuration
+	transports := make([]*raft.InmemTransport, size)
+	for i := range transports {
+		_, transports[i] = raft.NewInmemTransport("")
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			ID:      raft.ServerID(fmt.Sprintf("node-%d", i)),
+			Address: transports[i].LocalAddr(),
+		})
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			a.Connect(b.LocalAddr(), b)
+		}
+	}
+
+	nodes := make([]*testRaftNode, size)
+	for i := range nodes {
+		store, err := datamodel.NewBoltSystemStore(path.Join(dir, fmt.Sprintf("meta-%d.db", i)))
+		requireNil(t, err)
+
+		conf := raft.DefaultConfig()
+		conf.LocalID = configuration.Servers[i].ID
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.LogOutput = ioutil.Discard
+
+		logs := raft.NewInmemStore()
+		snapshots := raft.NewInmemSnapshotStore()
+		if i == 0 {
+			requireNil(t, raft.BootstrapCluster(conf, logs, logs, snapshots, transports[i], configuration))
+		}
+
+		fsm := &kappaFSM{log.NullLog, store, nil, nil}
+		r, err := raft.NewRaft(conf, fsm, logs, logs, snapshots, transports[i])
+		requireNil(t, err)
+		nodes[i] = &testRaftNode{r, store}
+	}
+
+	return nodes, func() {
+		for _, n := range nodes {
+			n.raft.Shutdown().Error()
+			n.store.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// waitForLeader returns the node which was elected leader.
+func waitForLeader(t *testing.T, nodes []*testRaftNode) *testRaftNode {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, n := range nodes {
+			if n.raft.State() == raft.Leader {
+				return n
+			}
+		}
+	}
+	t.Fatal("no leader was elected")
+	return nil
+}
+
+// applier returns an Applier which submits commands to the node like Server.apply.
+func (n *testRaftNode) applier() datamodel.Applier {
+	return func(cmd datamodel.Command) (string, error) {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return "", err
+		}
+		future := n.raft.Apply(data, time.Second)
+		if err := future.Error(); err != nil {
+			return "", err
+		}
+		if err, ok := future.Response().(error); ok {
+			return "", err
+		}
+		return future.Response().(string), nil
+	}
+}
+
+func TestFSMReplicatesSystem(t *testing.T) {
+	nodes, cleanup := newTestRaftCluster(t, 3)
+	defer cleanup()
+	leader := waitForLeader(t, nodes)
+
+	// Make changes on the leader
+	system := datamodel.NewReplicatedSystem(leader.store, leader.applier())
+	namespaces, err := system.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Create("acme")
+	requireNil(t, err)
+
+	// Errors of the applied command are returned
+	users, err := system.Users()
+	requireNil(t, err)
+	admin, err := users.Create("admin")
+	requireNil(t, err)
+	_, err = admin.KeyRing().AddPublicKey([]byte("not a certificate"))
+	assert.Equal(t, datamodel.ErrInvalidCertificate, err)
+
+	// Followers apply the changes
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		replicated := 0
+		for _, n := range nodes {
+			ns, _ := n.store.Namespaces()
+			us, _ := n.store.Users()
+			if _, err := ns.Get("acme"); err != nil {
+				continue
+			}
+			if _, err := us.Get("admin"); err != nil {
+				continue
+			}
+			replicated++
+		}
+		if replicated == len(nodes) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("changes were applied by %d of %d nodes", replicated, len(nodes))
+		}
+	}
+}
+
+func TestFSMFollowerRejectsChanges(t *testing.T) {
+	nodes, cleanup := newTestRaftCluster(t, 3)
+	defer cleanup()
+	leader := waitForLeader(t, nodes)
+
+	for _, n := range nodes {
+		if n == leader {
+			continue
+		}
+		system := datamodel.NewReplicatedSystem(n.store, n.applier())
+		namespaces, err := system.Namespaces()
+		requireNil(t, err)
+		_, err = namespaces.Create("acme")
+		assert.Equal(t, raft.ErrNotLeader, err)
+	}
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	nodes, cleanup := newTestRaftCluster(t, 1)
+	defer cleanup()
+	leader := waitForLeader(t, nodes)
+
+	system := datamodel.NewReplicatedSystem(leader.store, leader.applier())
+	namespaces, err := system.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Create("acme")
+	requireNil(t, err)
+
+	// Take a snapshot and make another change
+	future := leader.raft.Snapshot()
+	requireNil(t, future.Error())
+	_, err = namespaces.Create("other")
+	requireNil(t, err)
+
+	// Restore the snapshot into another store
+	_, snapshot, err := future.Open()
+	requireNil(t, err)
+	dir, err := ioutil.TempDir("", "kappa-raft")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	store, err := datamodel.NewBoltSystemStore(path.Join(dir, "restored.db"))
+	requireNil(t, err)
+	defer store.Close()
+	fsm := &kappaFSM{log.NullLog, store, nil, nil}
+	requireNil(t, fsm.Restore(snapshot))
+
+	restored, err := store.Namespaces()
+	requireNil(t, err)
+	_, err = restored.Get("acme")
+	assert.Nil(t, err)
+	_, err = restored.Get("other")
+	assert.Equal(t, datamodel.ErrNamespaceDoesNotExist, err)
+}
+
+func TestFSMFlushesCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-raft")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	store, err := datamodel.NewBoltSystemStore(path.Join(dir, "meta.db"))
+	requireNil(t, err)
+	defer store.Close()
+	cache := newMetadataCache(store)
+	fsm := &kappaFSM{log.NullLog, store, nil, cache}
+
+	apply := func(index uint64, cmd datamodel.Command) {
+		data, err := json.Marshal(cmd)
+		requireNil(t, err)
+		if err, ok := fsm.Apply(&raft.Log{Index: index, Data: data}).(error); ok {
+			requireNil(t, err)
+		}
+	}
+
+	// Cached users are flushed as soon as a change is applied
+	apply(1, datamodel.Command{Type: datamodel.CreateUserCommand, Username: "alice"})
+	users, err := cache.Users()
+	requireNil(t, err)
+	_, err = users.Get("alice")
+	requireNil(t, err)
+	assert.Len(t, cache.users, 1)
+	apply(2, datamodel.Command{Type: datamodel.DeleteUserCommand, Username: "alice"})
+	assert.Empty(t, cache.users)
+	_, err = users.Get("alice")
+	assert.Equal(t, datamodel.ErrUserDoesNotExist, err)
+
+	// Other changes keep the cached users
+	apply(3, datamodel.Command{Type: datamodel.CreateUserCommand, Username: "bob"})
+	_, err = users.Get("bob")
+	requireNil(t, err)
+	apply(4, datamodel.Command{Type: datamodel.CreateNamespaceCommand, Namespace: "acme"})
+	assert.Len(t, cache.users, 1)
+
+	// Restoring a snapshot flushes everything
+	namespaces, err := cache.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Get("acme")
+	requireNil(t, err)
+	snapshot, err := fsm.Snapshot()
+	requireNil(t, err)
+	sink := &testSnapshotSink{}
+	requireNil(t, snapshot.Persist(sink))
+	requireNil(t, fsm.Restore(ioutil.NopCloser(&sink.Buffer)))
+	assert.Empty(t, cache.users)
+	assert.Empty(t, cache.namespaces)
+}
+
+// testSnapshotSink keeps a snapshot in memory
+type testSnapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { return nil }
+func (s *testSnapshotSink) Close() error  { return nil }
+
+func TestBootstrapSeedsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-raft")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The first server has metadata from before it used Raft
+	seeded, err := datamodel.NewBoltSystemStore(path.Join(dir, "meta-0.db"))
+	requireNil(t, err)
+	defer seeded.Close()
+	namespaces, err := seeded.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Create("acme")
+	requireNil(t, err)
+	joined, err := datamodel.NewBoltSystemStore(path.Join(dir, "meta-1.db"))
+	requireNil(t, err)
+	defer joined.Close()
+
+	_, trans0 := raft.NewInmemTransport("")
+	_, trans1 := raft.NewInmemTransport("")
+	trans0.Connect(trans1.LocalAddr(), trans1)
+	trans1.Connect(trans0.LocalAddr(), trans0)
+
+	start := func(id string, store *datamodel.BoltSystemStore, trans *raft.InmemTransport, bootstrap bool) *testRaftNode {
+		conf := raft.DefaultConfig()
+		conf.LocalID = raft.ServerID(id)
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.LogOutput = ioutil.Discard
+
+		logs := raft.NewInmemStore()
+		snapshots := raft.NewInmemSnapshotStore()
+		fsm := &kappaFSM{log.NullLog, store, nil, nil}
+		if bootstrap {
+			s := &Server{config: &DatabaseConfig{NodeName: id}, logger: log.NullLog}
+			requireNil(t, s.bootstrapRaft(conf, fsm, logs, logs, snapshots, trans))
+		}
+		r, err := raft.NewRaft(conf, fsm, logs, logs, snapshots, trans)
+		requireNil(t, err)
+		return &testRaftNode{r, store}
+	}
+	nodes := []*testRaftNode{start("node-0", seeded, trans0, true), start("node-1", joined, trans1, false)}
+	defer func() {
+		for _, n := range nodes {
+			n.raft.Shutdown().Error()
+		}
+	}()
+
+	// The bootstrap server keeps its metadata and the joining server receives it
+	leader := waitForLeader(t, nodes)
+	assert.Equal(t, nodes[0], leader)
+	requireNil(t, leader.raft.AddVoter("node-1", trans1.LocalAddr(), 0, time.Second).Error())
+	for _, store := range []*datamodel.BoltSystemStore{seeded, joined} {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			ns, _ := store.Namespaces()
+			if _, err := ns.Get("acme"); err == nil {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatal("the metadata was not replicated")
+			}
+		}
+	}
+}
+
+func TestDiscardMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-raft")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := datamodel.NewBoltSystemStore(path.Join(dir, "meta.db"))
+	requireNil(t, err)
+	defer store.Close()
+	s := &Server{config: &DatabaseConfig{NodeName: "node-1"}, logger: log.NullLog, store: store}
+
+	// An empty store joins a cluster
+	requireNil(t, s.discardMetadata())
+
+	// Metadata which was never replicated is kept unless it may be discarded
+	namespaces, err := store.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Create("acme")
+	requireNil(t, err)
+	assert.Equal(t, errLocalMetadata, s.discardMetadata())
+	_, err = namespaces.Get("acme")
+	assert.Nil(t, err)
+
+	s.config.DiscardMetadata = true
+	requireNil(t, s.discardMetadata())
+	empty, err := store.Empty()
+	requireNil(t, err)
+	assert.True(t, empty)
+}
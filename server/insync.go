@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	// inSyncChannel is the channel type opened by the leaders of partitions to report their
+	// in-sync replicas to the cluster leader
+	inSyncChannel = "kappa-in-sync"
+
+	// inSyncRequest carries the report on an in-sync channel
+	inSyncRequest = "kappa-in-sync-report"
+)
+
+// inSyncReport names the in-sync replicas of a partition, including its leader, in the
+// leader's epoch.
+type inSyncReport struct {
+	Log       string
+	Partition uint32
+	Epoch     uint64
+	InSync    []string
+}
+
+// InSyncHandler services "kappa-in-sync" channels opened by the leaders of partitions.
+// The in-sync replicas reported by a "kappa-in-sync-report" request are stored through
+// Raft, so only the cluster leader accepts them.
+type InSyncHandler struct {
+	logger log.Logger
+	system datamodel.System
+}
+
+// NewInSyncHandler creates a handler for kappa-in-sync channels.
+func NewInSyncHandler(logger log.Logger, system datamodel.System) *InSyncHandler {
+	return &InSyncHandler{logger, system}
+}
+
+// Handle stores the reported in-sync replicas and replies whether they were stored.
+func (h *InSyncHandler) Handle(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+	defer channel.Close()
+
+	// Only servers can report in-sync replicas
+	if sshConn.Permissions == nil || sshConn.Permissions.Extensions["server"] == "" {
+		return errors.New("in-sync channel opened by a client")
+	}
+	server := sshConn.Permissions.Extensions["server"]
+
+	select {
+	case req, ok := <-requests:
+		if !ok {
+			return nil
+		}
+
+		err := errors.New("expected a " + inSyncRequest + " request")
+		if req.Type == inSyncRequest {
+			var report inSyncReport
+			if err = ssh.Unmarshal(req.Payload, &report); err == nil {
+				err = storeInSync(h.system, server, report)
+			}
+		}
+		req.Reply(err == nil, nil)
+		if err != nil {
+			h.logger.Debug("Rejected in-sync replicas", "server", server, "err", err.Error())
+		}
+		return err
+	case <-parentTomb.Dying():
+		return nil
+	}
+}
+
+// storeInSync stores the in-sync replicas of a partition reported by the named server,
+// which must lead the partition.
+func storeInSync(system datamodel.System, server string, report inSyncReport) error {
+	logs, err := system.Logs()
+	if err != nil {
+		return err
+	}
+	l, err := logs.Get(report.Log)
+	if err != nil {
+		return err
+	} else if int(report.Partition) >= len(l.Partitions) {
+		return fmt.Errorf("log %s has no partition %d", report.Log, report.Partition)
+	} else if leader := l.Partitions[report.Partition].Leader; leader != server {
+		return fmt.Errorf("%s does not lead partition %d of log %s", server, report.Partition, report.Log)
+	}
+	return logs.SetInSync(report.Log, int(report.Partition), report.Epoch, report.InSync)
+}
+
+// sendInSync reports the in-sync replicas of a partition to another server.
+func sendInSync(creds *serverCredentials, node *NodeDetails, report inSyncReport) error {
+	conn, err := dialServer(creds, node)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channel, requests, err := conn.OpenChannel(inSyncChannel, nil)
+	if err != nil {
+		return err
+	}
+	go ssh.DiscardRequests(requests)
+	defer channel.Close()
+
+	ok, err := channel.SendRequest(inSyncRequest, true, ssh.Marshal(&report))
+	if err == nil && !ok {
+		err = fmt.Errorf("%s rejected the in-sync replicas", node.Name)
+	}
+	return err
+}
+
+// reportInSync stores the in-sync replicas of a partition led by this server. Unless this
+// server is the cluster leader, they are sent to the leader.
+func (s *Server) reportInSync(report inSyncReport) error {
+	if s.IsLeader() {
+		return storeInSync(s.system, s.config.NodeName, report)
+	}
+
+	leader, err := s.leaderDetails()
+	if err != nil {
+		return err
+	}
+	return sendInSync(s.forwarder.creds, leader, report)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// serfKeyring is the file in the data directory which keeps the gossip encryption keys
+const serfKeyring = "serf/local.keyring"
+
+// Keyring manages the gossip encryption keys of every server in the cluster. It is
+// implemented by serf.KeyManager.
+type Keyring interface {
+	InstallKey(key string) (*serf.KeyResponse, error)
+	UseKey(key string) (*serf.KeyResponse, error)
+	RemoveKey(key string) (*serf.KeyResponse, error)
+	ListKeys() (*serf.KeyResponse, error)
+}
+
+// serverKeyring manages the keys with the Serf keyring manager of a server, which is
+// created after the SSH handlers.
+type serverKeyring struct {
+	s *Server
+}
+
+func (k serverKeyring) InstallKey(key string) (*serf.KeyResponse, error) {
+	return k.s.KeyManager().InstallKey(key)
+}
+
+func (k serverKeyring) UseKey(key string) (*serf.KeyResponse, error) {
+	return k.s.KeyManager().UseKey(key)
+}
+
+func (k serverKeyring) RemoveKey(key string) (*serf.KeyResponse, error) {
+	return k.s.KeyManager().RemoveKey(key)
+}
+
+func (k serverKeyring) ListKeys() (*serf.KeyResponse, error) {
+	return k.s.KeyManager().ListKeys()
+}
+
+// setupKeyring encrypts gossip with the keys in the keyring file of the data directory.
+// Serf keeps the file up to date as keys are installed, used and removed. Without a
+// keyring file, the file is created with the GossipEncryptKey, and gossip is not encrypted
+// if there is no key either.
+func (s *Server) setupKeyring(conf *serf.Config) error {
+	file := filepath.Join(s.config.DataPath, serfKeyring)
+	conf.KeyringFile = file
+
+	keys, err := readKeyring(file)
+	create := os.IsNotExist(err)
+	if create {
+		if s.config.GossipEncryptKey == "" {
+			s.logger.Warn("Gossip is not encrypted")
+			return nil
+		}
+		keys = []string{s.config.GossipEncryptKey}
+	} else if err != nil {
+		return err
+	} else if s.config.GossipEncryptKey != "" && !hasKey(keys, s.config.GossipEncryptKey) {
+		s.logger.Warn("GossipEncryptKey is not in the keyring and is ignored", "file", file)
+	}
+
+	keyring, err := newKeyring(keys)
+	if err != nil {
+		return fmt.Errorf("keyring %s: %s", file, err)
+	} else if create {
+		if err := writeKeyring(file, keys); err != nil {
+			return err
+		}
+	}
+	conf.MemberlistConfig.Keyring = keyring
+	s.logger.Info("Gossip is encrypted", "keys", len(keys))
+	return nil
+}
+
+// readKeyring returns the base64 encoded keys in a keyring file, primary key first.
+func readKeyring(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("keyring %s: %s", file, err)
+	}
+	return keys, nil
+}
+
+// writeKeyring creates a keyring file in the format written by Serf.
+func writeKeyring(file string, keys []string) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
+
+// newKeyring decodes base64 encoded keys into a keyring. The first key is the primary key,
+// which encrypts the messages sent by this server.
+func newKeyring(keys []string) (*memberlist.Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring has no keys")
+	}
+
+	decoded := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("key is not base64 encoded: %s", err)
+		}
+		decoded = append(decoded, k)
+	}
+	return memberlist.NewKeyring(decoded, decoded[0])
+}
+
+// hasKey returns whether a key is in a list of keys.
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
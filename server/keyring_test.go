@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kappa-keyring")
+	requireNil(t, err)
+	defer os.RemoveAll(dir)
+	requireNil(t, os.MkdirAll(filepath.Join(dir, "serf"), 0755))
+	file := filepath.Join(dir, serfKeyring)
+
+	key, other := "QHOYjmYlxSCBhdfiolhtDQ==", "T9jncgl9mbLus+baTTa7q7nPSUrXwbDi2dhbtqir37s="
+	s := &Server{config: &DatabaseConfig{DataPath: dir}, logger: log.NullLog}
+
+	// Gossip is not encrypted without a key
+	conf := serf.DefaultConfig()
+	requireNil(t, s.setupKeyring(conf))
+	assert.Nil(t, conf.MemberlistConfig.Keyring)
+	assert.Equal(t, file, conf.KeyringFile)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+
+	// Invalid keys are not saved
+	s.config.GossipEncryptKey = "c2hvcnQ="
+	assert.NotNil(t, s.setupKeyring(serf.DefaultConfig()))
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+
+	// The keyring is created with the key
+	s.config.GossipEncryptKey = key
+	conf = serf.DefaultConfig()
+	requireNil(t, s.setupKeyring(conf))
+	if assert.NotNil(t, conf.MemberlistConfig.Keyring) {
+		assert.Equal(t, key, base64.StdEncoding.EncodeToString(conf.MemberlistConfig.Keyring.GetPrimaryKey()))
+	}
+	keys, err := readKeyring(file)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	// The keyring takes precedence once it exists
+	requireNil(t, writeKeyring(file, []string{other, key}))
+	s.config.GossipEncryptKey = "bm90IGluIHRoZSBrZXlyaW5nIQ=="
+	conf = serf.DefaultConfig()
+	requireNil(t, s.setupKeyring(conf))
+	if assert.NotNil(t, conf.MemberlistConfig.Keyring) {
+		assert.Equal(t, other, base64.StdEncoding.EncodeToString(conf.MemberlistConfig.Keyring.GetPrimaryKey()))
+		assert.Len(t, conf.MemberlistConfig.Keyring.GetKeys(), 2)
+	}
+}
@@ -1,5 +1,14 @@
 package server
 
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/serf/serf"
+)
+
 const (
 	// SerfCheckID           = "serfHealth"
 	// SerfCheckName         = "Serf Health Status"
@@ -9,3 +18,214 @@ const (
 	KappaServiceName = "kappa"
 	LeaderEventName  = "kappa:new-leader"
 )
+
+// monitorLeadership starts the leader loop when this server is elected and stops it when
+// leadership is lost.
+func (s *Server) monitorLeadership() error {
+	var stopCh chan struct{}
+	for {
+		select {
+		case isLeader := <-s.leaderCh:
+			if isLeader && stopCh == nil {
+				s.logger.Info("Cluster leadership acquired")
+				stopCh = make(chan struct{})
+				ch := stopCh
+				s.t.Go(func() error {
+					s.leaderLoop(ch)
+					return nil
+				})
+			} else if !isLeader && stopCh != nil {
+				s.logger.Info("Cluster leadership lost")
+				close(stopCh)
+				stopCh = nil
+			}
+		case <-s.t.Dying():
+			if stopCh != nil {
+				close(stopCh)
+			}
+			return nil
+		}
+	}
+}
+
+// leaderLoop runs while this server is the leader. Once the local store has caught up
+// with the log, it creates the admin account and keeps the Raft peers in line with the
+// servers in the cluster. New logs are placed on servers as they are created, and the
+// partitions are rebalanced as servers join, leave or fail.
+func (s *Server) leaderLoop(stopCh chan struct{}) {
+	if err := s.raft.Barrier(raftApplyTimeout).Error(); err != nil {
+		s.logger.Warn("Failed to wait for the Raft log to be applied", "err", err.Error())
+	}
+
+	if err := s.createAdmin(); err != nil {
+		s.logger.Warn("Failed to create the admin account", "err", err.Error())
+	}
+
+	// Reconcile the servers which joined before this election
+	rb := newRebalancer(rebalanceDelay, rebalanceMoves)
+	for _, m := range s.serf.Members() {
+		s.reconcileMember(m)
+		rb.observe(m.Name, m.Status)
+	}
+	s.placeLogs(rb)
+
+	ticker := time.NewTicker(rebalanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-s.reconcileCh:
+			s.reconcileMember(m)
+			rb.observe(m.Name, m.Status)
+			s.placeLogs(rb)
+		case <-s.logsCh:
+			s.placeLogs(rb)
+		case <-ticker.C:
+			rb.refill()
+			s.placeLogs(rb)
+		case <-stopCh:
+			return
+		case <-s.t.Dying():
+			return
+		}
+	}
+}
+
+// createAdmin creates the admin account unless it exists, and adds the admin certificate
+// to its key ring.
+func (s *Server) createAdmin() error {
+	users, err := s.system.Users()
+	if err != nil {
+		return err
+	}
+
+	admin, err := users.Get("admin")
+	if err == datamodel.ErrUserDoesNotExist {
+		admin, err = users.Create("admin")
+	}
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := admin.KeyRing().AddPublicKey(s.adminCert)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Added admin certificate", "fingerprint", fingerprint)
+	return nil
+}
+
+// reconcileMember adds alive servers of this cluster to the Raft peers and removes the
+// servers which left. Failed servers remain peers until they are reaped.
+func (s *Server) reconcileMember(m serf.Member) {
+	details, err := GetKappaServer(m)
+	if err != nil || details.Cluster != s.config.ClusterName || details.RaftPort == 0 {
+		return
+	}
+
+	switch m.Status {
+	case serf.StatusAlive:
+		err = s.addRaftPeer(details)
+	case serf.StatusLeft, StatusReap:
+		err = s.removeRaftPeer(details)
+	}
+	if err != nil {
+		s.logger.Warn("Failed to reconcile member", "member", m.Name, "err", err.Error())
+	}
+}
+
+// placeLogs places the replicas of the partitions of the logs which have not been placed
+// on servers yet, and then rebalances the partitions of the other logs. Logs remain
+// unplaced until the cluster has enough servers.
+func (s *Server) placeLogs(rb *rebalancer) {
+	logStore, err := s.system.Logs()
+	if err != nil {
+		s.logger.Warn("Failed to access the logs", "err", err.Error())
+		return
+	}
+	logs, err := logStore.List()
+	if err != nil {
+		s.logger.Warn("Failed to list the logs", "err", err.Error())
+		return
+	}
+
+	var servers []string
+	for _, n := range s.localKappas.Filter(func(d NodeDetails) bool { return d.Cluster == s.config.ClusterName }) {
+		servers = append(servers, n.Name)
+	}
+
+	for i, l := range logs {
+		if l.Assigned() {
+			continue
+		}
+
+		partitions, err := placePartitions(l, servers, logs)
+		if err != nil {
+			s.logger.Debug("Cannot place log", "log", l.Name, "err", err.Error())
+			continue
+		}
+
+		if err := logStore.Assign(l.Name, partitions); err != nil {
+			s.logger.Warn("Failed to place log", "log", l.Name, "err", err.Error())
+			continue
+		}
+		for p, placement := range partitions {
+			s.logger.Info("Placed partition", "partition", l.PartitionName(p), "servers", placement.Servers, "leader", placement.Leader)
+		}
+		logs[i].Partitions = partitions
+	}
+
+	alive, down := rb.classify(s.serf.Members(), s.config.ClusterName)
+	for _, l := range rb.rebalance(logs, alive, down) {
+		if err := logStore.Assign(l.Name, l.Partitions); err != nil {
+			s.logger.Warn("Failed to rebalance log", "log", l.Name, "err", err.Error())
+			continue
+		}
+		for p, placement := range l.Partitions {
+			s.logger.Info("Rebalanced partition", "partition", l.PartitionName(p), "servers", placement.Servers, "leader", placement.Leader)
+		}
+	}
+}
+
+// placePartitions chooses the servers holding the replicas of each partition of a log.
+// The servers with the fewest replicas of other partitions are chosen first, and the least
+// loaded of them leads the partition.
+func placePartitions(l datamodel.Log, servers []string, logs []datamodel.Log) ([]datamodel.Partition, error) {
+	if len(servers) < l.Replicas {
+		return nil, fmt.Errorf("%d replicas requested but %d servers are available", l.Replicas, len(servers))
+	}
+
+	load := byLoad{servers: append([]string{}, servers...), replicas: make(map[string]int)}
+	for _, other := range logs {
+		for _, p := range other.Partitions {
+			for _, server := range p.Servers {
+				load.replicas[server]++
+			}
+		}
+	}
+
+	partitions := make([]datamodel.Partition, len(l.Partitions))
+	for p := range partitions {
+		sort.Sort(load)
+		replicas := append([]string{}, load.servers[:l.Replicas]...)
+		for _, server := range replicas {
+			load.replicas[server]++
+		}
+		partitions[p] = datamodel.Partition{Servers: replicas, Leader: replicas[0], InSync: replicas}
+	}
+	return partitions, nil
+}
+
+// byLoad sorts servers by their number of replicas and then by name
+type byLoad struct {
+	servers  []string
+	replicas map[string]int
+}
+
+func (b byLoad) Len() int      { return len(b.servers) }
+func (b byLoad) Swap(i, j int) { b.servers[i], b.servers[j] = b.servers[j], b.servers[i] }
+func (b byLoad) Less(i, j int) bool {
+	if b.replicas[b.servers[i]] != b.replicas[b.servers[j]] {
+		return b.replicas[b.servers[i]] < b.replicas[b.servers[j]]
+	}
+	return b.servers[i] < b.servers[j]
+}
@@ -0,0 +1,937 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/executor"
+	"github.com/blacklabeldata/kappa/protocol"
+	"github.com/blacklabeldata/kappa/skl"
+	"github.com/blacklabeldata/kappa/storage"
+	log "github.com/mgutz/logxi/v1"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	// replicaLagTime is how long a replica may fall behind the leader of a log before it
+	// is removed from the in-sync replicas
+	replicaLagTime = 10 * time.Second
+
+	// replicaAckTimeout limits the time an insert waits for the replicas to copy the records
+	replicaAckTimeout = 10 * time.Second
+
+	// replicaFetchWait is how long the leader holds a fetch when there are no new records
+	replicaFetchWait = 500 * time.Millisecond
+
+	// replicaFetchSize is the largest number of records returned by a fetch
+	replicaFetchSize = 512
+
+	// replicaRetryInterval is the time a replica waits before reconnecting to the leader
+	replicaRetryInterval = time.Second
+)
+
+// inSyncReporter stores the in-sync replicas of a partition led by this server in the
+// cluster metadata.
+type inSyncReporter func(report inSyncReport) error
+
+var (
+	// errNotEnoughReplicas is returned when an insert is not acknowledged in time
+	errNotEnoughReplicas = errors.New("not enough replicas acknowledged the insert")
+
+	// errReplicaStopped is returned when the log is no longer led by this server
+	errReplicaStopped = errors.New("the replica was stopped")
+)
+
+// logManager stores the replicas of the partitions placed on this server. The leader of a
+// partition appends the inserted records and tracks which replicas are in sync, while the
+// other replicas fetch the records from the leader.
+type logManager struct {
+	logger  log.Logger
+	name    string
+	cluster string
+	system  datamodel.System
+	store   *storage.Store
+	servers NodeList
+	creds   *serverCredentials
+
+	// report stores the in-sync replicas of the led partitions unless it is nil
+	report inSyncReporter
+
+	// Replication timing, which tests shorten
+	lagTime    time.Duration
+	ackTimeout time.Duration
+	fetchWait  time.Duration
+	retry      time.Duration
+
+	lock     sync.Mutex
+	replicas map[string]*replica
+	notifyCh chan struct{}
+	t        tomb.Tomb
+}
+
+// newLogManager creates the log manager of the named server. Other servers are found in
+// the node list and connected to with the server's host certificate.
+func newLogManager(logger log.Logger, name, cluster string, system datamodel.System, store *storage.Store, servers NodeList, creds *serverCredentials) *logManager {
+	return &logManager{
+		logger:     logger,
+		name:       name,
+		cluster:    cluster,
+		system:     system,
+		store:      store,
+		servers:    servers,
+		creds:      creds,
+		lagTime:    replicaLagTime,
+		ackTimeout: replicaAckTimeout,
+		fetchWait:  replicaFetchWait,
+		retry:      replicaRetryInterval,
+		replicas:   make(map[string]*replica),
+		notifyCh:   make(chan struct{}, 1),
+	}
+}
+
+// Start syncs the replicas with the log metadata, and again after every Notify.
+func (m *logManager) Start() {
+	m.t.Go(m.run)
+}
+
+// Stop stops the replicas and waits for them to finish.
+func (m *logManager) Stop() {
+	m.t.Kill(nil)
+	m.t.Wait()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name, r := range m.replicas {
+		r.close()
+		delete(m.replicas, name)
+	}
+}
+
+// Notify tells the manager that the log metadata has changed.
+func (m *logManager) Notify() {
+	select {
+	case m.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (m *logManager) run() error {
+	for {
+		m.sync()
+		select {
+		case <-m.notifyCh:
+		case <-m.t.Dying():
+			return nil
+		}
+	}
+}
+
+// sync starts a replica for each partition placed on this server and stops the replicas
+// of partitions which moved. The leader of a partition tracks its followers, which fetch
+// records from it.
+func (m *logManager) sync() {
+	logs, err := m.list()
+	if err != nil {
+		m.logger.Warn("Failed to list logs", "err", err.Error())
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	placed := make(map[string]bool)
+	for _, l := range logs {
+		for p, placement := range l.Partitions {
+			if placement.Assigned() && placement.HasReplica(m.name) {
+				placed[l.PartitionName(p)] = true
+				m.place(l, p)
+			}
+		}
+	}
+
+	for name, r := range m.replicas {
+		if !placed[name] {
+			r.close()
+			delete(m.replicas, name)
+		}
+	}
+}
+
+// counts returns the number of replicas on this server and how many of them it leads.
+func (m *logManager) counts() (replicas, leading int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, r := range m.replicas {
+		if r.placement.Leader == m.name {
+			leading++
+		}
+	}
+	return len(m.replicas), leading
+}
+
+// place starts the replica of a partition unless it is running with the same leader.
+// The lock must be held.
+func (m *logManager) place(l datamodel.Log, partition int) {
+	name := l.PartitionName(partition)
+	placement := l.Partitions[partition]
+
+	// Replicas are restarted when the leader of the partition changes
+	if r, ok := m.replicas[name]; ok && r.placement.Leader == placement.Leader {
+		if !r.placedLike(placement) {
+			m.logger.Info("Partition moved", "partition", name, "servers", placement.Servers)
+			r.reassign(placement.Servers)
+		}
+		return
+	} else if ok {
+		r.close()
+		delete(m.replicas, name)
+	}
+
+	stored, err := m.store.Log(name)
+	if err != nil {
+		m.logger.Warn("Failed to open partition", "partition", name, "err", err.Error())
+		return
+	}
+
+	r := newReplica(l, partition, stored)
+	m.replicas[name] = r
+	if placement.Leader == m.name {
+		// Records appended from now on belong to the leader's epoch
+		if err := stored.StartEpoch(placement.Epoch); err != nil {
+			m.logger.Warn("Failed to start epoch", "partition", name, "epoch", placement.Epoch, "err", err.Error())
+		}
+		m.logger.Info("Leading partition", "partition", name, "servers", placement.Servers, "epoch", placement.Epoch)
+		m.t.Go(func() error {
+			r.monitor(m.lagTime, m.t.Dying(), m.report)
+			return nil
+		})
+	} else {
+		m.logger.Info("Following partition", "partition", name, "leader", placement.Leader)
+		m.t.Go(func() error {
+			m.follow(r)
+			return nil
+		})
+	}
+}
+
+// list returns the metadata of every log.
+func (m *logManager) list() ([]datamodel.Log, error) {
+	logs, err := m.system.Logs()
+	if err != nil {
+		return nil, err
+	}
+	return logs.List()
+}
+
+// leading returns the replica of a partition led by this server, or nil.
+func (m *logManager) leading(name string, partition int) *replica {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if r, ok := m.replicas[datamodel.Log{Name: name}.PartitionName(partition)]; ok && r.placement.Leader == m.name {
+		return r
+	}
+	return nil
+}
+
+// server returns a known server of the cluster by name.
+func (m *logManager) server(name string) (*NodeDetails, error) {
+	nodes := m.servers.Filter(func(d NodeDetails) bool {
+		return d.Name == name && d.Cluster == m.cluster
+	})
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("server %s is not available", name)
+	}
+	return &nodes[0], nil
+}
+
+// lookup returns the metadata of a log the user can access. Otherwise the failure is
+// written and false is returned.
+func (m *logManager) lookup(w *common.ResponseWriter, user datamodel.User, name string) (datamodel.Log, bool) {
+	logs, err := m.system.Logs()
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return datamodel.Log{}, false
+	}
+
+	meta, err := logs.Get(name)
+	if err == datamodel.ErrLogDoesNotExist {
+		w.Fail(common.LogDoesNotExist, "%s", name)
+		return meta, false
+	} else if err != nil {
+		w.Fail(common.InternalServerError, "could not access log data")
+		return meta, false
+	}
+
+	if !canAccess(user, meta.Namespace()) {
+		w.Fail(common.Unauthorized, "cannot access log '%s'", name)
+		return meta, false
+	} else if !meta.Assigned() {
+		w.Fail(common.LogNotAvailable, "log %s has not been placed on servers", name)
+		return meta, false
+	}
+	return meta, true
+}
+
+// canAccess determines if the user is the admin or has access to the namespace.
+func canAccess(user datamodel.User, namespace string) bool {
+	if user.IsAdmin() {
+		return true
+	}
+	for _, ns := range user.Namespaces() {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert appends the tuples of an insert to a log and waits for the replicas given by the
+// log's ack level. The tuples of logs clustered by a key are routed to partitions by the
+// hash of their key, and a status is written for each partition. Records are appended by
+// the leader of the partition, so other servers forward the tuples unless forward is false.
+func (m *logManager) Insert(w *common.ResponseWriter, user datamodel.User, insert *protocol.Insert, forward bool) {
+	meta, ok := m.lookup(w, user, insert.Log)
+	if !ok {
+		return
+	}
+
+	routed, err := route(meta, insert)
+	if err != nil {
+		w.Fail(common.KeyRequired, "%s", err.Error())
+		return
+	}
+	for p, tuples := range routed {
+		if tuples != nil {
+			m.insertPartition(w, user, meta, p, tuples, forward)
+		}
+	}
+}
+
+// route splits the tuples of an insert by partition. Unpartitioned logs do not need keys.
+func route(meta datamodel.Log, insert *protocol.Insert) ([]*protocol.Insert, error) {
+	routed := make([]*protocol.Insert, len(meta.Partitions))
+	if len(meta.Partitions) == 1 || len(insert.Tuples) == 0 {
+		routed[0] = insert
+		return routed, nil
+	} else if len(insert.Keys) != len(insert.Tuples) {
+		return nil, fmt.Errorf("log %s is clustered by %s, which is required for every tuple", meta.Name, meta.Key)
+	}
+
+	for i, tuple := range insert.Tuples {
+		p := meta.Partition(insert.Keys[i])
+		if routed[p] == nil {
+			routed[p] = &protocol.Insert{Log: insert.Log}
+		}
+		routed[p].Tuples = append(routed[p].Tuples, tuple)
+		routed[p].Keys = append(routed[p].Keys, insert.Keys[i])
+	}
+	return routed, nil
+}
+
+// insertPartition appends tuples to a partition of a log, or forwards them to the leader
+// of the partition.
+func (m *logManager) insertPartition(w *common.ResponseWriter, user datamodel.User, meta datamodel.Log, partition int, insert *protocol.Insert, forward bool) {
+	name := meta.Name
+	if len(meta.Partitions) > 1 {
+		name = meta.PartitionName(partition)
+	}
+
+	if meta.Partitions[partition].Leader != m.name {
+		m.forward(w, meta.Partitions[partition], name, user, insert, forward)
+		return
+	}
+
+	r := m.leading(meta.Name, partition)
+	if r == nil {
+		w.Fail(common.LogNotAvailable, "%s is not ready on %s", name, m.name)
+		return
+	}
+
+	offset, err := r.log.Append(insert.Tuples)
+	if err != nil {
+		w.Fail(common.InternalServerError, "could not append to %s", name)
+		return
+	}
+	r.appended(m.lagTime)
+
+	err = r.wait(offset+uint64(len(insert.Tuples)), meta.Acks, m.ackTimeout)
+	if err == errNotEnoughReplicas {
+		w.Fail(common.NotEnoughReplicas, "%d tuples inserted into %s at offset %d but %s", len(insert.Tuples), name, offset, err.Error())
+		return
+	} else if err != nil {
+		w.Fail(common.LogNotAvailable, "%s", err.Error())
+		return
+	}
+	w.Success(common.OK, "%d tuples inserted into %s at offset %d", len(insert.Tuples), name, offset)
+}
+
+// forward sends an insert to the leader of a partition and relays the response.
+func (m *logManager) forward(w *common.ResponseWriter, placement datamodel.Partition, name string, user datamodel.User, insert *protocol.Insert, forward bool) {
+	if !forward {
+		w.Fail(common.LogNotAvailable, "%s is not the leader of %s", m.name, name)
+		return
+	}
+
+	leader, err := m.server(placement.Leader)
+	if err != nil {
+		w.Fail(common.LogNotAvailable, "%s", err.Error())
+		return
+	}
+	if err := sendTo(w, m.creds, leader, user, "", insert); err != nil {
+		w.Fail(common.LogNotAvailable, "%s", err.Error())
+	}
+}
+
+// Subscribe streams the records of one or all partitions of a log which have been copied
+// to the in-sync replicas. Partitions are served by their leader, so the records of other
+// partitions are relayed from their leaders unless forward is false. The records of several
+// partitions are merged as they arrive. The subscription ends when the client closes the
+// channel, or once the committed records have been sent if it is bounded.
+func (m *logManager) Subscribe(enc *protocol.Encoder, dec *protocol.Decoder, requestID uint32, user datamodel.User, subscribe *protocol.Subscribe, forward bool) error {
+	w := common.ResponseWriter{Colors: common.NoColorCodes, Handler: &resultWriter{enc: enc, requestID: requestID}}
+	meta, ok := m.lookup(&w, user, subscribe.Log)
+	if !ok {
+		return enc.EncodeMessage(requestID, &protocol.End{})
+	}
+
+	partitions, err := m.subscribed(meta, subscribe.Partition, forward)
+	if err != nil {
+		w.Fail(err.Code, "%s", err.Message)
+		return enc.EncodeMessage(requestID, &protocol.End{})
+	}
+	if err := enc.EncodeMessage(requestID, &protocol.Status{Code: common.OK, Message: "subscribed to " + meta.Name}); err != nil {
+		return err
+	}
+
+	// Each partition is streamed until the subscription ends
+	closed := waitClosed(dec)
+	var encodeErr error
+	err = m.merge(meta, partitions, user, subscribe.From, !subscribe.Bounded, func(event protocol.Event) bool {
+		encodeErr = enc.EncodeMessage(requestID, &event)
+		return encodeErr == nil
+	}, closed)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	select {
+	case <-closed:
+		return nil
+	default:
+	}
+	if err != nil {
+		w.Fail(err.Code, "%s", err.Message)
+	} else if !subscribe.Bounded {
+		return nil
+	}
+	return enc.EncodeMessage(requestID, &protocol.End{})
+}
+
+// merge passes the records of the partitions of a log starting at from to emit as they
+// arrive. Partitions led by other servers are relayed from their leaders. Unless follow is
+// true, each partition ends with the records which were committed when it started, and
+// merge returns once every partition has ended. Otherwise merge returns when emit returns
+// false or done is closed.
+func (m *logManager) merge(meta datamodel.Log, partitions []int, user datamodel.User, from uint64, follow bool, emit func(protocol.Event) bool, done <-chan struct{}) *protocol.Error {
+	stop := make(chan struct{})
+	defer close(stop)
+	events := make(chan protocol.Event)
+	ended := make(chan *protocol.Error, len(partitions))
+	for _, p := range partitions {
+		go func(p int) {
+			if r := m.leading(meta.Name, p); r != nil {
+				ended <- m.stream(r, from, follow, events, stop)
+			} else {
+				ended <- m.relay(meta, p, user, from, follow, events, stop)
+			}
+		}(p)
+	}
+
+	for running := len(partitions); running > 0; {
+		select {
+		case event := <-events:
+			if !emit(event) {
+				return nil
+			}
+		case err := <-ended:
+			if err != nil {
+				return err
+			}
+			running--
+		case <-done:
+			return nil
+		case <-m.t.Dying():
+			return nil
+		}
+	}
+	return nil
+}
+
+// logReader reads logs for the statements of a session until closed is closed.
+type logReader struct {
+	logs    *logManager
+	forward bool
+	closed  <-chan struct{}
+}
+
+// newLogReader creates a reader for the statements of a session. Partitions led by other
+// servers are relayed unless forward is false. Logs cannot be read if logs is nil.
+func newLogReader(logs *logManager, forward bool, closed <-chan struct{}) executor.LogReader {
+	if logs == nil {
+		return nil
+	}
+	return &logReader{logs, forward, closed}
+}
+
+// Read passes the records of one or all partitions of a log to emit.
+func (l *logReader) Read(w *common.ResponseWriter, user datamodel.User, name string, partition int, from uint64, follow bool, emit func(executor.Record) bool) bool {
+	meta, ok := l.logs.lookup(w, user, name)
+	if !ok {
+		return false
+	}
+
+	subscribed := uint32(protocol.AllPartitions)
+	if partition != skl.AllPartitions {
+		subscribed = uint32(partition)
+	}
+	partitions, err := l.logs.subscribed(meta, subscribed, l.forward)
+	if err == nil {
+		err = l.logs.merge(meta, partitions, user, from, follow, func(event protocol.Event) bool {
+			return emit(executor.Record{Partition: int(event.Partition), Offset: event.Offset, Data: event.Data})
+		}, l.closed)
+	}
+	if err != nil {
+		w.Fail(err.Code, "%s", err.Message)
+		return false
+	}
+	return true
+}
+
+// subscribed returns the partitions of a subscription. Partitions led by other servers can
+// only be subscribed to if forward is true.
+func (m *logManager) subscribed(meta datamodel.Log, partition uint32, forward bool) ([]int, *protocol.Error) {
+	var partitions []int
+	if partition == protocol.AllPartitions {
+		for p := range meta.Partitions {
+			partitions = append(partitions, p)
+		}
+	} else if int(partition) < len(meta.Partitions) {
+		partitions = append(partitions, int(partition))
+	} else {
+		return nil, &protocol.Error{Code: common.PartitionDoesNotExist, Message: fmt.Sprintf("log %s has %d partitions", meta.Name, len(meta.Partitions))}
+	}
+
+	for _, p := range partitions {
+		if leader := meta.Partitions[p].Leader; leader != m.name && !forward {
+			return nil, &protocol.Error{Code: common.LogNotAvailable, Message: fmt.Sprintf("%s is not the leader of %s", m.name, meta.PartitionName(p))}
+		} else if leader == m.name && m.leading(meta.Name, p) == nil {
+			return nil, &protocol.Error{Code: common.LogNotAvailable, Message: fmt.Sprintf("%s is not ready on %s", meta.PartitionName(p), m.name)}
+		}
+	}
+	return partitions, nil
+}
+
+// stream sends the records of a partition led by this server up to its high watermark
+// until done is closed. Unless follow is true, stream returns once the records below the
+// high watermark at the start have been sent.
+func (m *logManager) stream(r *replica, from uint64, follow bool, events chan<- protocol.Event, done <-chan struct{}) *protocol.Error {
+	offset := from
+	until, _ := r.highWatermark()
+	for {
+		hw, progress := r.highWatermark()
+		if !follow {
+			if offset >= until {
+				return nil
+			}
+			hw = minOffset(hw, until)
+		}
+		if offset < hw {
+			records, err := r.log.Read(offset, int(minOffset(hw-offset, replicaFetchSize)))
+			if err != nil {
+				return &protocol.Error{Code: common.InternalServerError, Message: "could not read " + r.name}
+			}
+			for _, record := range records {
+				select {
+				case events <- protocol.Event{Partition: uint32(r.partition), Offset: offset, Data: record}:
+				case <-done:
+					return nil
+				}
+				offset++
+			}
+			continue
+		}
+
+		select {
+		case <-progress:
+		case <-done:
+			return nil
+		case <-r.stop:
+			return &protocol.Error{Code: common.LogNotAvailable, Message: fmt.Sprintf("%s is no longer the leader of %s", m.name, r.name)}
+		case <-m.t.Dying():
+			return nil
+		}
+	}
+}
+
+// relay subscribes to a partition on its leader and sends the records until done is
+// closed or the leader ends the subscription. Unless follow is true, the subscription is
+// bounded and relay returns once the leader has sent the committed records.
+func (m *logManager) relay(meta datamodel.Log, partition int, user datamodel.User, from uint64, follow bool, events chan<- protocol.Event, done <-chan struct{}) *protocol.Error {
+	unavailable := func(err error) *protocol.Error {
+		return &protocol.Error{Code: common.LogNotAvailable, Message: err.Error()}
+	}
+
+	leader, err := m.server(meta.Partitions[partition].Leader)
+	if err != nil {
+		return unavailable(err)
+	}
+	conn, err := dialServer(m.creds, leader)
+	if err != nil {
+		return unavailable(err)
+	}
+	defer conn.Close()
+
+	channel, err := openForwardChannel(conn, user.Username(), "")
+	if err != nil {
+		return unavailable(err)
+	}
+	defer channel.Close()
+
+	// Stop relaying when the subscription ends
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-done:
+			channel.Close()
+		case <-stopped:
+		}
+	}()
+
+	enc := protocol.NewEncoder(channel, protocol.DefaultMaxFrameSize)
+	dec := protocol.NewDecoder(channel, protocol.DefaultMaxFrameSize)
+	if err := enc.EncodeMessage(0, &protocol.Subscribe{Log: meta.Name, Partition: uint32(partition), From: from, Bounded: !follow}); err != nil {
+		return unavailable(err)
+	}
+
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			return unavailable(fmt.Errorf("subscription to %s ended: %s", leader.Name, err.Error()))
+		}
+
+		switch f.Type {
+		case protocol.EventFrame:
+			var event protocol.Event
+			if err := event.UnmarshalBinary(f.Payload); err != nil {
+				return unavailable(err)
+			}
+			select {
+			case events <- event:
+			case <-done:
+				return nil
+			}
+		case protocol.ErrorFrame:
+			var e protocol.Error
+			if err := e.UnmarshalBinary(f.Payload); err != nil {
+				return unavailable(err)
+			}
+			return &e
+		case protocol.EndFrame:
+			if !follow {
+				return nil
+			}
+			return unavailable(fmt.Errorf("subscription to %s ended", leader.Name))
+		}
+	}
+}
+
+// waitClosed returns a channel which is closed once the decoder fails because the peer
+// closed the channel. Frames received in the meantime are ignored.
+func waitClosed(dec *protocol.Decoder) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := dec.Decode(); err != nil {
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+// minOffset returns the smaller of two offsets.
+func minOffset(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// replica is the copy of a partition stored by this server. The leader of the partition
+// tracks the progress of the other replicas.
+type replica struct {
+	meta      datamodel.Log
+	partition int
+	placement datamodel.Partition
+	name      string
+	log       *storage.Log
+	stop      chan struct{}
+
+	// lock protects the progress of the followers. progress is closed when it changes.
+	lock      sync.Mutex
+	followers map[string]*follower
+	hw        uint64
+	inSync    []string
+	progress  chan struct{}
+
+	// reported are the in-sync replicas last stored in the cluster metadata
+	reported []string
+}
+
+// follower is the progress of a replica on the leader. A follower is in sync if it has
+// fetched every record within the lag time.
+type follower struct {
+	end      uint64
+	caughtUp time.Time
+}
+
+// newReplica creates a replica of a partition. The followers which were in sync under the
+// previous leader are considered in sync until they fall behind for the lag time.
+func newReplica(meta datamodel.Log, partition int, log *storage.Log) *replica {
+	r := &replica{
+		meta:      meta,
+		partition: partition,
+		placement: meta.Partitions[partition],
+		name:      meta.PartitionName(partition),
+		log:       log,
+		stop:      make(chan struct{}),
+		followers: make(map[string]*follower),
+		progress:  make(chan struct{}),
+		reported:  meta.Partitions[partition].InSync,
+	}
+
+	now := time.Now()
+	for _, server := range r.placement.Servers {
+		if server == r.placement.Leader {
+			continue
+		} else if r.placement.CanLead(server) {
+			r.followers[server] = &follower{caughtUp: now}
+		} else {
+			r.followers[server] = &follower{}
+		}
+	}
+	return r
+}
+
+// placedLike determines if the replica has the same leader and servers as the partition.
+func (r *replica) placedLike(p datamodel.Partition) bool {
+	if r.placement.Leader != p.Leader || len(r.placement.Servers) != len(p.Servers) {
+		return false
+	}
+	for i, server := range p.Servers {
+		if r.placement.Servers[i] != server {
+			return false
+		}
+	}
+	return true
+}
+
+// reassign changes the servers of a replica whose leader stays the same. Followers which
+// were added are not in sync until they have caught up with the leader.
+func (r *replica) reassign(servers []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	placed := make(map[string]bool)
+	for _, server := range servers {
+		placed[server] = true
+		if _, ok := r.followers[server]; !ok && server != r.placement.Leader {
+			r.followers[server] = &follower{}
+		}
+	}
+	for server := range r.followers {
+		if !placed[server] {
+			delete(r.followers, server)
+		}
+	}
+	r.placement.Servers = servers
+}
+
+// close stops the replica.
+func (r *replica) close() {
+	close(r.stop)
+}
+
+// fetched records that a follower has copied the records before offset.
+func (r *replica) fetched(server string, offset uint64, lagTime time.Duration) error {
+	end := r.log.End()
+	if offset > end {
+		return fmt.Errorf("offset %d is past the end of %s", offset, r.name)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f, ok := r.followers[server]
+	if !ok {
+		return fmt.Errorf("%s is not a replica of %s", server, r.name)
+	}
+
+	f.end = offset
+	if offset == end {
+		f.caughtUp = time.Now()
+	}
+	r.update(lagTime, true)
+	return nil
+}
+
+// appended updates the high watermark after the leader appended records.
+func (r *replica) appended(lagTime time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.update(lagTime, false)
+}
+
+// monitor removes the followers which fall behind from the in-sync replicas until the
+// replica is stopped or dying is closed. Changes of the in-sync replicas are reported
+// unless report is nil, and retried until they are stored.
+func (r *replica) monitor(lagTime time.Duration, dying <-chan struct{}, report inSyncReporter) {
+	ticker := time.NewTicker(lagTime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.lock.Lock()
+			r.update(lagTime, false)
+			inSync := r.inSync
+			r.lock.Unlock()
+
+			if report != nil && !sameServers(inSync, r.reported) {
+				err := report(inSyncReport{Log: r.meta.Name, Partition: uint32(r.partition), Epoch: r.placement.Epoch, InSync: inSync})
+				if err == nil {
+					r.reported = inSync
+				}
+			}
+		case <-r.stop:
+			return
+		case <-dying:
+			return
+		}
+	}
+}
+
+// update advances the high watermark to the end of the in-sync replicas and wakes up the
+// waiting inserts and subscriptions. The lock must be held.
+func (r *replica) update(lagTime time.Duration, changed bool) {
+	hw := r.log.End()
+	inSync := []string{r.placement.Leader}
+	for _, server := range r.inSyncFollowers(lagTime) {
+		if f, ok := r.followers[server]; ok && f.end < hw {
+			hw = f.end
+		}
+		inSync = append(inSync, server)
+	}
+	sort.Strings(inSync)
+
+	if hw > r.hw {
+		r.hw = hw
+		changed = true
+	}
+	if !sameServers(inSync, r.inSync) {
+		r.inSync = inSync
+		changed = true
+	}
+	if changed {
+		close(r.progress)
+		r.progress = make(chan struct{})
+	}
+}
+
+// inSyncFollowers returns the followers which have caught up with the leader within the
+// lag time. The lock must be held.
+func (r *replica) inSyncFollowers(lagTime time.Duration) (servers []string) {
+	now := time.Now()
+	for server, f := range r.followers {
+		if now.Sub(f.caughtUp) <= lagTime {
+			servers = append(servers, server)
+		}
+	}
+	return
+}
+
+// highWatermark returns the offset up to which records have been copied to the in-sync
+// replicas, and a channel which is closed when the progress of the replicas changes.
+func (r *replica) highWatermark() (uint64, <-chan struct{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.hw, r.progress
+}
+
+// acknowledged determines if enough replicas have copied the records before end. Inserts
+// into logs which acknowledge with every in-sync replica also need a majority of the
+// replicas to be in sync, so the records survive the loss of the leader. The lock must
+// be held.
+func (r *replica) acknowledged(end uint64, acks datamodel.AckLevel) bool {
+	majority := len(r.placement.Servers)/2 + 1
+	switch acks {
+	case datamodel.AckLeader:
+		return true
+	case datamodel.AckAll:
+		return r.hw >= end && len(r.inSync) >= majority
+	}
+
+	// The leader and a majority of the replicas
+	count := 1
+	for _, f := range r.followers {
+		if f.end >= end {
+			count++
+		}
+	}
+	return count >= majority
+}
+
+// sameServers determines if two sorted lists name the same servers.
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// wait waits until enough replicas have copied the records before end.
+func (r *replica) wait(end uint64, acks datamodel.AckLevel, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.lock.Lock()
+		ok, progress := r.acknowledged(end, acks), r.progress
+		r.lock.Unlock()
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-progress:
+		case <-timer.C:
+			return errNotEnoughReplicas
+		case <-r.stop:
+			return errReplicaStopped
+		}
+	}
+}
@@ -0,0 +1,759 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/kappa/client"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/storage"
+	"github.com/blacklabeldata/namedtuple"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// testCluster runs servers which replicate logs on local ports. The servers share the
+// system metadata, which is replicated by Raft in a real cluster.
+type testCluster struct {
+	t       *testing.T
+	dir     string
+	system  datamodel.System
+	servers NodeList
+	ca      ssh.Signer
+	creds   map[string]*serverCredentials
+	nodes   map[string]*testNode
+}
+
+// testNode is a running server of a test cluster
+type testNode struct {
+	details  NodeDetails
+	store    *storage.Store
+	logs     *logManager
+	listener net.Listener
+	tb       *tomb.Tomb
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+// newTestCluster starts the named servers. The admin account and the acme namespace are
+// created.
+func newTestCluster(t *testing.T, names ...string) (*testCluster, func()) {
+	dir, err := ioutil.TempDir("", "kappa-logs")
+	requireNil(t, err)
+
+	system, err := datamodel.NewSystem(path.Join(dir, "meta.db"))
+	requireNil(t, err)
+	users, err := system.Users()
+	requireNil(t, err)
+	_, err = users.Create("admin")
+	requireNil(t, err)
+	namespaces, err := system.Namespaces()
+	requireNil(t, err)
+	_, err = namespaces.Create("acme")
+	requireNil(t, err)
+
+	c := &testCluster{
+		t:       t,
+		dir:     dir,
+		system:  system,
+		servers: NewNodeList(),
+		ca:      newTestSigner(t),
+		creds:   make(map[string]*serverCredentials),
+		nodes:   make(map[string]*testNode),
+	}
+	for _, name := range names {
+		c.start(name)
+	}
+	return c, func() {
+		for name := range c.nodes {
+			c.stop(name)
+		}
+		system.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// start starts a server, which keeps its host certificate and stored logs across restarts.
+func (c *testCluster) start(name string) *testNode {
+	creds, ok := c.creds[name]
+	if !ok {
+		creds = newTestCredentials(c.t, c.ca, name)
+		c.creds[name] = creds
+	}
+
+	requireNil(c.t, ensurePath(path.Join(c.dir, name), true))
+	store, err := storage.Open(path.Join(c.dir, name, "logs.db"))
+	requireNil(c.t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requireNil(c.t, err)
+
+	n := &testNode{
+		details: NodeDetails{
+			Name:    name,
+			Cluster: "kappa",
+			Addr:    *listener.Addr().(*net.TCPAddr),
+		},
+		store:    store,
+		listener: listener,
+		tb:       &tomb.Tomb{},
+	}
+	c.servers.AddNode(n.details)
+
+	// Replicate quickly
+	n.logs = newLogManager(log.NullLog, name, "kappa", c.system, store, c.servers, creds)
+	n.logs.lagTime = 300 * time.Millisecond
+	n.logs.ackTimeout = time.Second
+	n.logs.fetchWait = 50 * time.Millisecond
+	n.logs.retry = 50 * time.Millisecond
+
+	// The in-sync replicas are reported to the server itself, which stores them in the
+	// shared metadata
+	n.logs.report = func(report inSyncReport) error {
+		return sendInSync(creds, &n.details, report)
+	}
+
+	// Clients log in as any user. Statements are executed locally.
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: ServerPublicKeyCallback(creds.authorities, func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"username": conn.User()}}, nil
+		}),
+	}
+	serverConfig.AddHostKey(creds.signer)
+	handlers := map[string]interface {
+		Handle(tomb.Tomb, *ssh.ServerConn, ssh.Channel, <-chan *ssh.Request) error
+	}{
+		"kappa-client":    NewProtocolHandler(log.NullLog, c.system, &leaderForwarder{isLeader: func() bool { return true }}, n.logs, nil, nil),
+		"kappa-forward":   NewForwardHandler(log.NullLog, c.system, n.logs),
+		"kappa-replicate": NewReplicateHandler(log.NullLog, n.logs),
+		"kappa-in-sync":   NewInSyncHandler(log.NullLog, c.system),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n.lock.Lock()
+			n.conns = append(n.conns, conn)
+			n.lock.Unlock()
+
+			go func() {
+				sshConn, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+
+				for ch := range channels {
+					handler, ok := handlers[ch.ChannelType()]
+					if !ok {
+						ch.Reject(ssh.UnknownChannelType, "unknown channel type")
+						continue
+					}
+
+					channel, reqs, err := ch.Accept()
+					if err != nil {
+						return
+					}
+					go handler.Handle(*n.tb, sshConn, channel, reqs)
+				}
+			}()
+		}
+	}()
+
+	n.logs.Start()
+	c.nodes[name] = n
+	return n
+}
+
+// stop stops a server and closes its connections.
+func (c *testCluster) stop(name string) {
+	n := c.nodes[name]
+	delete(c.nodes, name)
+	c.servers.RemoveNode(n.details)
+
+	n.listener.Close()
+	n.lock.Lock()
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.lock.Unlock()
+	n.logs.Stop()
+	n.store.Close()
+}
+
+// createLog creates a log with one partition and places it on the given servers. The
+// first server leads the log.
+func (c *testCluster) createLog(name string, acks datamodel.AckLevel, servers ...string) {
+	c.createPartitionedLog(datamodel.Log{Name: name, Replicas: len(servers), Acks: acks}, datamodel.Partition{Servers: servers, Leader: servers[0]})
+}
+
+// createPartitionedLog creates a log and places its partitions.
+func (c *testCluster) createPartitionedLog(l datamodel.Log, partitions ...datamodel.Partition) {
+	logs, err := c.system.Logs()
+	requireNil(c.t, err)
+	l.Partitions = make([]datamodel.Partition, len(partitions))
+	requireNil(c.t, logs.Create(l))
+	c.assign(l.Name, partitions...)
+}
+
+// assign places the partitions of a log and notifies the running servers.
+func (c *testCluster) assign(name string, partitions ...datamodel.Partition) {
+	logs, err := c.system.Logs()
+	requireNil(c.t, err)
+	requireNil(c.t, logs.Assign(name, partitions))
+
+	for _, n := range c.nodes {
+		n.logs.Notify()
+	}
+}
+
+// client connects a client to a server as the admin.
+func (c *testCluster) client(name string) *client.Client {
+	addr := c.nodes[name].details.Addr.String()
+	config := &ssh.ClientConfig{
+		User:            "admin",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newTestSigner(c.t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	requireNil(c.t, err)
+
+	kc, err := client.NewClient(conn, client.Options{Redial: func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, config)
+	}})
+	requireNil(c.t, err)
+	return kc
+}
+
+// records returns the records of a partition stored by a server. Unpartitioned logs are
+// stored as their first partition.
+func (c *testCluster) records(server, name string) [][]byte {
+	if !strings.Contains(name, "/") {
+		name += "/0"
+	}
+	l, err := c.nodes[server].store.Log(name)
+	requireNil(c.t, err)
+	records, err := l.Read(0, 100)
+	requireNil(c.t, err)
+	return records
+}
+
+// waitForRecords waits until a server has stored the given number of records.
+func (c *testCluster) waitForRecords(server, name string, count int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(c.records(server, name)) == count {
+			return
+		}
+	}
+	c.t.Fatalf("%s did not store %d records of %s", server, count, name)
+}
+
+// waitFor waits until the condition holds.
+func (c *testCluster) waitFor(condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	c.t.Fatal("condition did not hold in time")
+}
+
+// newTestEvent creates a tuple with the given name
+func newTestEvent(t *testing.T, name string) namedtuple.Tuple {
+	eventType := namedtuple.New("acme", "event")
+	eventType.AddVersion(namedtuple.Field{Name: "name", Required: true, Type: namedtuple.StringField})
+	builder := eventType.Builder(make([]byte, 64))
+	builder.PutString("name", name)
+	tuple, err := builder.Build()
+	requireNil(t, err)
+	return tuple
+}
+
+func TestReplicateLog(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2", "node-3")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckAll, "node-1", "node-2", "node-3")
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx := context.Background()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "signup"), newTestEvent(t, "login")))
+
+	// Every replica has the records once the insert is acknowledged
+	leader := c.records("node-1", "acme.events")
+	assert.Len(t, leader, 2)
+	assert.Equal(t, leader, c.records("node-2", "acme.events"))
+	assert.Equal(t, leader, c.records("node-3", "acme.events"))
+}
+
+func TestInsertOnFollower(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2", "node-3")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckQuorum, "node-1", "node-2")
+
+	// Inserts are forwarded to the leader of the log
+	kc := c.client("node-3")
+	defer kc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "signup")))
+	assert.Len(t, c.records("node-1", "acme.events"), 1)
+	assert.Empty(t, c.records("node-3", "acme.events"))
+
+	// Subscriptions are relayed from the leader
+	events, err := kc.Subscribe(ctx, "acme.events", 0)
+	requireNil(t, err)
+	select {
+	case event := <-events:
+		requireNil(t, event.Err)
+		assert.Equal(t, uint64(0), event.Offset)
+		assert.Equal(t, c.records("node-1", "acme.events")[0], event.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	// Logs which do not exist cannot be used
+	err = kc.Insert(ctx, "acme.missing", newTestEvent(t, "signup"))
+	assert.True(t, errors.Is(err, client.ErrLogDoesNotExist))
+}
+
+func TestSubscribeTwice(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckLeader, "node-1")
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "signup")))
+
+	// Each subscription uses a connection of its own
+	for i := 0; i < 2; i++ {
+		events, err := kc.Subscribe(ctx, "acme.events", 0)
+		requireNil(t, err)
+		select {
+		case event := <-events:
+			requireNil(t, event.Err)
+			assert.Equal(t, uint64(0), event.Offset)
+		case <-ctx.Done():
+			t.Fatal("no event received")
+		}
+	}
+
+	// Statements are still sent on the client's channel
+	_, err := kc.Exec(ctx, "SHOW NAMESPACES")
+	assert.Nil(t, err)
+}
+
+func TestReplicateForgedServer(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckLeader, "node-1", "node-2")
+	leader := c.nodes["node-1"].details
+
+	// replicate opens a replicate channel to the leader as the named server
+	replicate := func(creds *serverCredentials, server string) error {
+		conn, err := dialServer(creds, &leader)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		channel, requests, err := conn.OpenChannel(replicateChannel, nil)
+		if err != nil {
+			return err
+		}
+		go ssh.DiscardRequests(requests)
+		defer channel.Close()
+
+		ok, err := channel.SendRequest(replicaRequest, true, ssh.Marshal(&replicaSession{server}))
+		if err == nil && !ok {
+			err = errors.New("replica rejected")
+		}
+		return err
+	}
+	assert.Nil(t, replicate(c.creds["node-2"], "node-2"))
+
+	// A node which advertises itself as a server through gossip cannot log in with a plain
+	// host key or a host certificate of another CA
+	c.servers.AddNode(NodeDetails{Name: "node-3", Cluster: "kappa", Addr: leader.Addr})
+	plain := &serverCredentials{signer: newTestSigner(t), authorities: c.creds["node-2"].authorities}
+	assert.NotNil(t, replicate(plain, "node-3"))
+	forged := newTestCredentials(t, newTestSigner(t), "node-2")
+	forged.authorities = plain.authorities
+	assert.NotNil(t, replicate(forged, "node-2"))
+
+	// A server cannot replicate as another server
+	assert.NotNil(t, replicate(newTestCredentials(t, c.ca, "node-3"), "node-2"))
+}
+
+func TestInsertAckLevels(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2", "node-3")
+	defer cleanup()
+	c.createLog("acme.leader", datamodel.AckLeader, "node-1", "node-2", "node-3")
+	c.createLog("acme.quorum", datamodel.AckQuorum, "node-1", "node-2", "node-3")
+	c.createLog("acme.all", datamodel.AckAll, "node-1", "node-2", "node-3")
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx := context.Background()
+
+	// A quorum is available while one follower is down
+	c.stop("node-3")
+	assert.Nil(t, kc.Insert(ctx, "acme.quorum", newTestEvent(t, "signup")))
+
+	// Without followers, only the leader acknowledges inserts
+	c.stop("node-2")
+	assert.Nil(t, kc.Insert(ctx, "acme.leader", newTestEvent(t, "signup")))
+	err := kc.Insert(ctx, "acme.quorum", newTestEvent(t, "login"))
+	assert.True(t, errors.Is(err, client.ErrNotEnoughReplicas))
+
+	// The leader alone is not a majority of in-sync replicas
+	err = kc.Insert(ctx, "acme.all", newTestEvent(t, "signup"))
+	assert.True(t, errors.Is(err, client.ErrNotEnoughReplicas))
+
+	// Records which were not acknowledged are kept by the leader
+	assert.Len(t, c.records("node-1", "acme.quorum"), 2)
+}
+
+func TestReportInSync(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2", "node-3")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckAll, "node-1", "node-2", "node-3")
+	inSync := func() []string {
+		logs, err := c.system.Logs()
+		requireNil(t, err)
+		l, err := logs.Get("acme.events")
+		requireNil(t, err)
+		return l.Partitions[0].InSync
+	}
+
+	// The leader stores the replicas which keep up with it
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx := context.Background()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "signup")))
+	c.waitFor(func() bool { return assert.ObjectsAreEqual([]string{"node-1", "node-2", "node-3"}, inSync()) })
+
+	// A follower which falls behind is removed and can no longer lead
+	c.stop("node-3")
+	c.waitFor(func() bool { return assert.ObjectsAreEqual([]string{"node-1", "node-2"}, inSync()) })
+	assert.Nil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "login")))
+
+	// Only the leader reports the in-sync replicas
+	err := sendInSync(c.creds["node-2"], &c.nodes["node-1"].details, inSyncReport{Log: "acme.events", Epoch: 1, InSync: []string{"node-2"}})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"node-1", "node-2"}, inSync())
+}
+
+func TestFollowerCatchUp(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckLeader, "node-1", "node-2")
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx := context.Background()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "signup")))
+	c.waitForRecords("node-2", "acme.events", 1)
+
+	// The follower misses records while it is down
+	c.stop("node-2")
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "login"), newTestEvent(t, "logout")))
+
+	// After a restart, it continues from its last offset
+	c.start("node-2")
+	c.waitForRecords("node-2", "acme.events", 3)
+	assert.Equal(t, c.records("node-1", "acme.events"), c.records("node-2", "acme.events"))
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckLeader, "node-1", "node-2")
+
+	kc := c.client("node-1")
+	ctx := context.Background()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "signup"), newTestEvent(t, "login")))
+	c.waitForRecords("node-2", "acme.events", 2)
+
+	// The leader appends records which never reach the follower
+	c.stop("node-2")
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "view"), newTestEvent(t, "click")))
+	kc.Close()
+	c.stop("node-1")
+
+	// The follower takes over and appends other records at the same offsets
+	c.assign("acme.events", datamodel.Partition{Servers: []string{"node-1", "node-2"}, Leader: "node-2"})
+	c.start("node-2")
+	kc = c.client("node-2")
+	defer kc.Close()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "logout")))
+
+	// The old leader drops its diverged records and copies the new leader's
+	c.start("node-1")
+	c.waitForRecords("node-1", "acme.events", 3)
+	leader := c.records("node-2", "acme.events")
+	assert.Equal(t, leader, c.records("node-1", "acme.events"))
+	var logout bytes.Buffer
+	requireNil(t, namedtuple.NewEncoder(&logout).Encode(newTestEvent(t, "logout")))
+	assert.Equal(t, logout.Bytes(), leader[2])
+}
+
+func TestPlacePartitions(t *testing.T) {
+	servers := []string{"node-1", "node-2", "node-3"}
+	logs := []datamodel.Log{
+		{Name: "acme.views", Replicas: 2, Partitions: []datamodel.Partition{{Servers: []string{"node-1", "node-2"}, Leader: "node-1"}}},
+		{Name: "acme.clicks", Replicas: 1, Partitions: []datamodel.Partition{{Servers: []string{"node-1"}, Leader: "node-1"}}},
+	}
+
+	// The servers with the fewest replicas are chosen
+	partitions, err := placePartitions(datamodel.Log{Name: "acme.events", Replicas: 2, Partitions: make([]datamodel.Partition, 1)}, servers, logs)
+	assert.Nil(t, err)
+	assert.Equal(t, []datamodel.Partition{{Servers: []string{"node-3", "node-2"}, Leader: "node-3", InSync: []string{"node-3", "node-2"}}}, partitions)
+
+	// Partitions are spread over the servers
+	partitions, err = placePartitions(datamodel.Log{Name: "acme.events", Replicas: 1, Partitions: make([]datamodel.Partition, 3)}, servers, logs)
+	assert.Nil(t, err)
+	assert.Equal(t, []datamodel.Partition{
+		{Servers: []string{"node-3"}, Leader: "node-3", InSync: []string{"node-3"}},
+		{Servers: []string{"node-2"}, Leader: "node-2", InSync: []string{"node-2"}},
+		{Servers: []string{"node-3"}, Leader: "node-3", InSync: []string{"node-3"}},
+	}, partitions)
+
+	// There must be a server for each replica
+	_, err = placePartitions(datamodel.Log{Name: "acme.events", Replicas: 4, Partitions: make([]datamodel.Partition, 1)}, servers, logs)
+	assert.NotNil(t, err)
+}
+
+func TestPartitionedLog(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2", "node-3")
+	defer cleanup()
+	c.createPartitionedLog(datamodel.Log{Name: "acme.events", Replicas: 1, Acks: datamodel.AckLeader, Key: "name"},
+		datamodel.Partition{Servers: []string{"node-1"}, Leader: "node-1"},
+		datamodel.Partition{Servers: []string{"node-2"}, Leader: "node-2"},
+		datamodel.Partition{Servers: []string{"node-3"}, Leader: "node-3"},
+	)
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Tuples are routed to the leader of their partition
+	names := []string{"alice", "bob", "carol", "dave", "alice", "erin", "alice"}
+	for _, name := range names {
+		requireNil(t, kc.InsertClustered(ctx, "acme.events", "name", newTestEvent(t, name)))
+	}
+
+	// Records with the same key are stored in the same partition with their own offsets
+	alice := newTestEvent(t, "alice")
+	var buf bytes.Buffer
+	requireNil(t, namedtuple.NewEncoder(&buf).Encode(alice))
+	total, stored := 0, make(map[int]int)
+	for p, server := range []string{"node-1", "node-2", "node-3"} {
+		records := c.records(server, fmt.Sprintf("acme.events/%d", p))
+		total += len(records)
+		for _, record := range records {
+			if bytes.Equal(record, buf.Bytes()) {
+				stored[p]++
+			}
+		}
+	}
+	assert.Equal(t, len(names), total)
+	assert.Len(t, stored, 1)
+
+	// Subscriptions merge every partition
+	events, err := kc.Subscribe(ctx, "acme.events", 0)
+	requireNil(t, err)
+	received := make(map[int]uint64)
+	for i := 0; i < len(names); i++ {
+		select {
+		case event := <-events:
+			requireNil(t, event.Err)
+			assert.Equal(t, received[event.Partition], event.Offset)
+			received[event.Partition]++
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	// Or target one partition
+	events, err = kc.SubscribePartition(ctx, "acme.events", 1, 0)
+	requireNil(t, err)
+	for i := uint64(0); i < received[1]; i++ {
+		select {
+		case event := <-events:
+			requireNil(t, event.Err)
+			assert.Equal(t, 1, event.Partition)
+			assert.Equal(t, i, event.Offset)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	// Keys are required and partitions must exist
+	err = kc.Insert(ctx, "acme.events", newTestEvent(t, "alice"))
+	assert.True(t, errors.Is(err, client.ErrKeyRequired))
+	_, err = kc.SubscribePartition(ctx, "acme.events", 3, 0)
+	assert.True(t, errors.Is(err, client.ErrPartitionDoesNotExist))
+}
+
+// queryRecords runs a statement reading a log and returns the decoded rows. The rows are
+// read until the result set ends.
+func queryRecords(t *testing.T, rows *client.Rows) (records []client.Event) {
+	for rows.Next() {
+		assert.Equal(t, []string{"partition", "offset", "record"}, rows.Columns())
+		var partition, offset, record string
+		requireNil(t, rows.Scan(&partition, &offset, &record))
+
+		var event client.Event
+		var err error
+		event.Partition, err = strconv.Atoi(partition)
+		requireNil(t, err)
+		event.Offset, err = strconv.ParseUint(offset, 10, 64)
+		requireNil(t, err)
+		event.Data, err = base64.StdEncoding.DecodeString(record)
+		requireNil(t, err)
+		records = append(records, event)
+	}
+	return
+}
+
+func TestSelectLog(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2", "node-3")
+	defer cleanup()
+	c.createPartitionedLog(datamodel.Log{Name: "acme.events", Replicas: 1, Acks: datamodel.AckLeader, Key: "name"},
+		datamodel.Partition{Servers: []string{"node-1"}, Leader: "node-1"},
+		datamodel.Partition{Servers: []string{"node-2"}, Leader: "node-2"},
+		datamodel.Partition{Servers: []string{"node-3"}, Leader: "node-3"},
+	)
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	names := []string{"alice", "bob", "carol", "dave", "alice", "erin", "alice"}
+	for _, name := range names {
+		requireNil(t, kc.InsertClustered(ctx, "acme.events", "name", newTestEvent(t, name)))
+	}
+	stored := make(map[int][][]byte)
+	for p, server := range []string{"node-1", "node-2", "node-3"} {
+		stored[p] = c.records(server, fmt.Sprintf("acme.events/%d", p))
+	}
+
+	// The records of every partition are merged, relaying those led by other servers
+	rows, err := kc.Query(ctx, "SELECT * FROM acme.events")
+	requireNil(t, err)
+	records := queryRecords(t, rows)
+	requireNil(t, rows.Err())
+	assert.Len(t, records, len(names))
+	next := make(map[int]uint64)
+	for _, record := range records {
+		assert.Equal(t, next[record.Partition], record.Offset)
+		assert.Equal(t, stored[record.Partition][record.Offset], record.Data)
+		next[record.Partition]++
+	}
+
+	// A single partition is read from an offset. Unqualified names are in the session namespace.
+	rows, err = kc.Query(ctx, "USE acme; SELECT * FROM events PARTITION 1 OFFSET 1")
+	requireNil(t, err)
+	records = queryRecords(t, rows)
+	requireNil(t, rows.Err())
+	for i, record := range records {
+		assert.Equal(t, 1, record.Partition)
+		assert.Equal(t, uint64(i+1), record.Offset)
+	}
+	if len(stored[1]) > 0 {
+		assert.Len(t, records, len(stored[1])-1)
+	}
+
+	// Reading stops at the limit
+	rows, err = kc.Query(ctx, "SELECT * FROM acme.events LIMIT 2")
+	requireNil(t, err)
+	assert.Len(t, queryRecords(t, rows), 2)
+	requireNil(t, rows.Err())
+
+	// Logs and partitions must exist
+	_, err = kc.Exec(ctx, "SELECT * FROM acme.missing")
+	assert.True(t, errors.Is(err, client.ErrLogDoesNotExist))
+	_, err = kc.Exec(ctx, "SELECT * FROM acme.events PARTITION 3")
+	assert.True(t, errors.Is(err, client.ErrPartitionDoesNotExist))
+}
+
+func TestSubscribeLog(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2")
+	defer cleanup()
+	c.createPartitionedLog(datamodel.Log{Name: "acme.events", Replicas: 1, Acks: datamodel.AckLeader, Key: "name"},
+		datamodel.Partition{Servers: []string{"node-1"}, Leader: "node-1"},
+		datamodel.Partition{Servers: []string{"node-2"}, Leader: "node-2"},
+	)
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	requireNil(t, kc.InsertClustered(ctx, "acme.events", "name", newTestEvent(t, "alice")))
+
+	// Subscriptions to every partition wait for new records until the limit is reached
+	subscriber := c.client("node-1")
+	defer subscriber.Close()
+	rows, err := subscriber.Query(ctx, "SUBSCRIBE * FROM acme.events LIMIT 3")
+	requireNil(t, err)
+	requireNil(t, kc.InsertClustered(ctx, "acme.events", "name", newTestEvent(t, "bob"), newTestEvent(t, "carol")))
+	records := queryRecords(t, rows)
+	requireNil(t, rows.Err())
+	assert.Len(t, records, 3)
+
+	// Subscriptions to a single partition only receive its records
+	p := records[0].Partition
+	rows, err = subscriber.Query(ctx, fmt.Sprintf("SUBSCRIBE * FROM acme.events PARTITION %d LIMIT 2", p))
+	requireNil(t, err)
+	requireNil(t, kc.InsertClustered(ctx, "acme.events", "name", newTestEvent(t, "alice"), newTestEvent(t, "bob"), newTestEvent(t, "carol")))
+	records = queryRecords(t, rows)
+	requireNil(t, rows.Err())
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, p, records[0].Partition)
+		assert.Equal(t, p, records[1].Partition)
+		assert.Equal(t, uint64(0), records[0].Offset)
+		assert.Equal(t, uint64(1), records[1].Offset)
+	}
+}
+
+func TestMoveFollower(t *testing.T) {
+	c, cleanup := newTestCluster(t, "node-1", "node-2", "node-3")
+	defer cleanup()
+	c.createLog("acme.events", datamodel.AckAll, "node-1", "node-2")
+
+	kc := c.client("node-1")
+	defer kc.Close()
+	ctx := context.Background()
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "signup"), newTestEvent(t, "login")))
+
+	// The follower moves while the leader keeps its replica
+	c.assign("acme.events", datamodel.Partition{Servers: []string{"node-1", "node-3"}, Leader: "node-1"})
+
+	// The new follower copies the partition from the leader
+	c.waitForRecords("node-3", "acme.events", 2)
+	requireNil(t, kc.Insert(ctx, "acme.events", newTestEvent(t, "logout")))
+	assert.Equal(t, c.records("node-1", "acme.events"), c.records("node-3", "acme.events"))
+}
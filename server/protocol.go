@@ -0,0 +1,218 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/executor"
+	"github.com/blacklabeldata/kappa/protocol"
+	"github.com/blacklabeldata/kappa/skl"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// serverCapabilities are the optional protocol features supported by the server.
+const serverCapabilities = protocol.CapabilityMultiStatement
+
+// ProtocolHandler services "kappa-client" channels which speak the binary protocol.
+type ProtocolHandler struct {
+	logger    log.Logger
+	system    datamodel.System
+	forwarder executor.Forwarder
+	logs      *logManager
+	cluster   executor.Cluster
+	sessions  *sessionList
+}
+
+// NewProtocolHandler creates a handler for kappa-client channels. Writes are sent to the
+// leader by the forwarder unless it is nil, in which case inserts and subscriptions are
+// not forwarded to the leader of the log either. Logs do not exist if logs is nil. The
+// sessions are tracked in sessions unless it is nil.
+func NewProtocolHandler(logger log.Logger, system datamodel.System, forwarder executor.Forwarder, logs *logManager, cluster executor.Cluster, sessions *sessionList) *ProtocolHandler {
+	return &ProtocolHandler{logger, system, forwarder, logs, cluster, sessions}
+}
+
+// Handle performs the protocol handshake and then executes queries until the client closes the channel.
+func (p *ProtocolHandler) Handle(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+	defer channel.Close()
+
+	// Requests end once the client closes the channel
+	closed := make(chan struct{})
+	go func() {
+		ssh.DiscardRequests(requests)
+		close(closed)
+	}()
+
+	enc := protocol.NewEncoder(channel, protocol.DefaultMaxFrameSize)
+	dec := protocol.NewDecoder(channel, protocol.DefaultMaxFrameSize)
+
+	// Get session user
+	user, err := connectionUser(p.system, sshConn)
+	if err != nil {
+		enc.EncodeMessage(0, &protocol.Error{Code: common.InternalServerError, Message: err.Error()})
+		return err
+	}
+
+	// Close the channel if the server is shutting down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-parentTomb.Dying():
+			channel.Close()
+		case <-done:
+		}
+	}()
+
+	// Negotiate protocol version
+	hello, err := protocol.ServerHandshake(enc, dec, serverCapabilities, protocol.DefaultMaxFrameSize)
+	if err != nil {
+		p.logger.Debug("Protocol handshake failed", "err", err.Error())
+		return err
+	}
+
+	// Track the session while it is open
+	defer p.sessions.add(executor.SessionInfo{User: user.Username(), Kind: "client", Remote: sshConn.RemoteAddr().String(), Started: time.Now()})()
+
+	// Create executor
+	session := executor.NewSession("", user)
+	exec := executor.NewExecutor(session, common.NewHeadlessTerminal(defaultPrompt), p.system, p.forwarder, p.cluster, newLogReader(p.logs, p.forwarder != nil, closed))
+	return p.serve(enc, dec, exec, user, hello.Capabilities)
+}
+
+// serve executes requests until the channel is closed.
+func (p *ProtocolHandler) serve(enc *protocol.Encoder, dec *protocol.Decoder, exec *executor.Executor, user datamodel.User, capabilities protocol.Capability) error {
+	for {
+		f, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+
+			// The stream cannot be resynchronized, so report the error and close the channel
+			enc.EncodeMessage(0, &protocol.Error{Code: common.ProtocolError, Message: err.Error()})
+			p.logger.Debug("Error reading frame", "err", err.Error())
+			return err
+		}
+
+		switch f.Type {
+		case protocol.QueryFrame:
+			var query protocol.Query
+			if err := query.UnmarshalBinary(f.Payload); err != nil {
+				err = p.fail(enc, f.RequestID, common.ProtocolError, "invalid Query frame")
+			} else {
+				err = p.query(enc, exec, f.RequestID, query.Statement, capabilities)
+			}
+			if err != nil {
+				return err
+			}
+
+		case protocol.InsertFrame:
+			var insert protocol.Insert
+			if err := insert.UnmarshalBinary(f.Payload); err != nil {
+				err = p.fail(enc, f.RequestID, common.ProtocolError, "invalid Insert frame")
+			} else {
+				err = p.insert(enc, f.RequestID, user, &insert)
+			}
+			if err != nil {
+				return err
+			}
+
+		case protocol.SubscribeFrame:
+			var subscribe protocol.Subscribe
+			if err := subscribe.UnmarshalBinary(f.Payload); err != nil {
+				err = p.fail(enc, f.RequestID, common.ProtocolError, "invalid Subscribe frame")
+			} else if p.logs == nil {
+				err = p.fail(enc, f.RequestID, common.LogDoesNotExist, subscribe.Log)
+			} else {
+
+				// The subscription uses the channel until it ends
+				return p.logs.Subscribe(enc, dec, f.RequestID, user, &subscribe, p.forwarder != nil)
+			}
+			if err != nil {
+				return err
+			}
+
+		default:
+			if err := p.fail(enc, f.RequestID, common.ProtocolError, "unexpected "+f.Type.String()+" frame"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// query executes the statements of a Query frame and ends the response.
+func (p *ProtocolHandler) query(enc *protocol.Encoder, exec *executor.Executor, requestID uint32, statement string, capabilities protocol.Capability) error {
+
+	// Parse statements
+	var stmts []skl.Statement
+	if capabilities.Has(protocol.CapabilityMultiStatement) {
+		var err error
+		if stmts, err = skl.ParseStatements(statement); err != nil {
+			return p.fail(enc, requestID, common.InvalidStatementType, err.Error())
+		}
+	} else {
+		stmt, err := skl.ParseStatement(statement)
+		if err != nil {
+			return p.fail(enc, requestID, common.InvalidStatementType, err.Error())
+		}
+		stmts = []skl.Statement{stmt}
+	}
+
+	// Execute statements
+	results := &resultWriter{enc: enc, requestID: requestID}
+	for _, stmt := range stmts {
+		w := common.ResponseWriter{Colors: common.NoColorCodes, Handler: results}
+		exec.Execute(&w, stmt)
+	}
+	return enc.EncodeMessage(requestID, &protocol.End{})
+}
+
+// insert appends the tuples of an Insert frame to a log and ends the response.
+func (p *ProtocolHandler) insert(enc *protocol.Encoder, requestID uint32, user datamodel.User, insert *protocol.Insert) error {
+	w := common.ResponseWriter{Colors: common.NoColorCodes, Handler: &resultWriter{enc: enc, requestID: requestID}}
+	if p.logs == nil {
+		w.Fail(common.LogDoesNotExist, "%s", insert.Log)
+	} else {
+		p.logs.Insert(&w, user, insert, p.forwarder != nil)
+	}
+	return enc.EncodeMessage(requestID, &protocol.End{})
+}
+
+// fail sends an Error frame followed by an End frame.
+func (p *ProtocolHandler) fail(enc *protocol.Encoder, requestID uint32, code common.StatusCode, message string) error {
+	if err := enc.EncodeMessage(requestID, &protocol.Error{Code: code, Message: message}); err != nil {
+		return err
+	}
+	return enc.EncodeMessage(requestID, &protocol.End{})
+}
+
+// resultWriter sends the results of a statement as protocol frames.
+type resultWriter struct {
+	enc       *protocol.Encoder
+	requestID uint32
+	columns   []string
+}
+
+func (r *resultWriter) Status(code common.StatusCode, message string) error {
+	return r.enc.EncodeMessage(r.requestID, &protocol.Status{Code: code, Message: message})
+}
+
+func (r *resultWriter) Error(code common.StatusCode, message string) error {
+	return r.enc.EncodeMessage(r.requestID, &protocol.Error{Code: code, Message: message})
+}
+
+func (r *resultWriter) Columns(names ...string) error {
+	r.columns = names
+	return r.enc.EncodeMessage(r.requestID, &protocol.ColumnHeader{Columns: names})
+}
+
+func (r *resultWriter) Row(values ...string) error {
+	err := r.enc.EncodeMessage(r.requestID, &protocol.Row{Columns: r.columns, Values: values})
+	if err == protocol.ErrFrameTooLarge {
+		return r.Error(common.InternalServerError, "row exceeds the maximum frame size")
+	}
+	return err
+}
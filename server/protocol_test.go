@@ -0,0 +1,113 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/protocol"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestProtocol opens a kappa-client channel and performs the handshake.
+func newTestProtocol(t *testing.T, client *ssh.Client) (*protocol.Encoder, *protocol.Decoder, ssh.Channel) {
+	channel, requests, err := client.OpenChannel("kappa-client", nil)
+	requireNil(t, err)
+	go ssh.DiscardRequests(requests)
+
+	enc := protocol.NewEncoder(channel, protocol.DefaultMaxFrameSize)
+	dec := protocol.NewDecoder(channel, protocol.DefaultMaxFrameSize)
+	hello, err := protocol.ClientHandshake(enc, dec, protocol.CapabilityMultiStatement, protocol.DefaultMaxFrameSize)
+	requireNil(t, err)
+	assert.Equal(t, protocol.Version, hello.Version)
+	assert.True(t, hello.Capabilities.Has(protocol.CapabilityMultiStatement))
+	return enc, dec, channel
+}
+
+// readResponse reads the frames for a request up to and including the End frame.
+func readResponse(t *testing.T, dec *protocol.Decoder, requestID uint32) []protocol.Frame {
+	var frames []protocol.Frame
+	for {
+		f, err := dec.Decode()
+		requireNil(t, err)
+		assert.Equal(t, requestID, f.RequestID)
+
+		frames = append(frames, f)
+		if f.Type == protocol.EndFrame {
+			return frames
+		}
+	}
+}
+
+func TestProtocolQuery(t *testing.T) {
+	client, cleanup := newTestSession(t, "admin")
+	defer cleanup()
+
+	enc, dec, channel := newTestProtocol(t, client)
+	defer channel.Close()
+
+	requireNil(t, enc.EncodeMessage(1, &protocol.Query{Statement: "CREATE NAMESPACE acme; SHOW NAMESPACES"}))
+	frames := readResponse(t, dec, 1)
+
+	var types []protocol.FrameType
+	for _, f := range frames {
+		types = append(types, f.Type)
+	}
+	assert.Equal(t, []protocol.FrameType{
+		protocol.StatusFrame,
+		protocol.ColumnHeaderFrame,
+		protocol.RowFrame,
+		protocol.StatusFrame,
+		protocol.EndFrame,
+	}, types)
+
+	var status protocol.Status
+	assert.Nil(t, status.UnmarshalBinary(frames[0].Payload))
+	assert.Equal(t, protocol.Status{Code: common.OK, Message: "namespace created"}, status)
+
+	var header protocol.ColumnHeader
+	assert.Nil(t, header.UnmarshalBinary(frames[1].Payload))
+	assert.Equal(t, []string{"namespace"}, header.Columns)
+
+	row := protocol.Row{Columns: header.Columns}
+	assert.Nil(t, row.UnmarshalBinary(frames[2].Payload))
+	assert.Equal(t, []string{"acme"}, row.Values)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	client, cleanup := newTestSession(t, "admin")
+	defer cleanup()
+
+	enc, dec, channel := newTestProtocol(t, client)
+	defer channel.Close()
+
+	// Parse errors
+	requireNil(t, enc.EncodeMessage(1, &protocol.Query{Statement: "UPDATE nothing"}))
+	frames := readResponse(t, dec, 1)
+	if assert.Len(t, frames, 2) {
+		var e protocol.Error
+		assert.Nil(t, e.UnmarshalBinary(frames[0].Payload))
+		assert.Equal(t, common.InvalidStatementType, e.Code)
+	}
+
+	// Unexpected frames
+	requireNil(t, enc.EncodeMessage(2, &protocol.End{}))
+	frames = readResponse(t, dec, 2)
+	if assert.Len(t, frames, 2) {
+		var e protocol.Error
+		assert.Nil(t, e.UnmarshalBinary(frames[0].Payload))
+		assert.Equal(t, common.ProtocolError, e.Code)
+	}
+
+	// The channel is closed after an oversized frame
+	length := []byte{0xff, 0xff, 0xff, 0x7f, byte(protocol.QueryFrame), 3, 0, 0, 0}
+	_, err := channel.Write(length)
+	requireNil(t, err)
+	f, err := dec.Decode()
+	requireNil(t, err)
+	var e protocol.Error
+	assert.Nil(t, e.UnmarshalBinary(f.Payload))
+	assert.Equal(t, protocol.ErrFrameTooLarge.Error(), e.Message)
+	_, err = dec.Decode()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+const (
+	// raftState is the directory holding the Raft log and snapshots
+	raftState = "raft"
+
+	// raftLogCacheSize is the number of recent log entries kept in memory
+	raftLogCacheSize = 512
+
+	// raftSnapshotsRetained is the number of snapshots kept on disk
+	raftSnapshotsRetained = 2
+
+	// raftPoolSize is the number of connections kept to each peer
+	raftPoolSize = 3
+
+	// raftTimeout limits network operations between peers
+	raftTimeout = 10 * time.Second
+
+	// raftApplyTimeout limits the time spent waiting for a command to be applied
+	raftApplyTimeout = 30 * time.Second
+)
+
+// errLocalMetadata is returned when joining a cluster would discard local metadata
+var errLocalMetadata = errors.New("the local metadata would be discarded by joining a cluster")
+
+// setupRaft creates the Raft server which replicates the system metadata. A server with
+// Raft state clears the local store, since Raft rebuilds it from the latest snapshot and
+// the log. A bootstrap server starts a new cluster with itself as the only peer, as does a
+// server which has no other servers to join. Other servers receive the metadata of the
+// cluster they join, and refuse to start if they hold metadata which was never replicated.
+func (s *Server) setupRaft() (err error) {
+
+	// Raft is advertised on the gossip address
+	bindAddr := net.JoinHostPort(s.config.RaftBindAddr, strconv.Itoa(s.config.RaftBindPort))
+	advertise := &net.TCPAddr{IP: s.serf.LocalMember().Addr, Port: s.config.RaftBindPort}
+	trans, err := raft.NewTCPTransport(bindAddr, advertise, raftPoolSize, raftTimeout, s.config.LogOutput)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			trans.Close()
+		}
+	}()
+
+	// Create the log store and snapshot store
+	path := filepath.Join(s.config.DataPath, raftState)
+	if err = ensurePath(path, true); err != nil {
+		return
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(path, "raft.db"))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			store.Close()
+		}
+	}()
+	logs, err := raft.NewLogCache(raftLogCacheSize, store)
+	if err != nil {
+		return
+	}
+	snapshots, err := raft.NewFileSnapshotStore(path, raftSnapshotsRetained, s.config.LogOutput)
+	if err != nil {
+		return
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(s.config.NodeName)
+	conf.NotifyCh = s.leaderCh
+	conf.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Output: s.config.LogOutput})
+
+	// Start a new cluster unless this server has already joined one
+	hasState, err := raft.HasExistingState(logs, store, snapshots)
+	if err != nil {
+		return
+	}
+	bootstrap := s.config.Bootstrap
+	if !hasState && !bootstrap && s.config.BootstrapExpect == 0 && len(s.config.ExistingNodes) == 0 {
+		s.logger.Warn("No servers to join, bootstrapping a single-server cluster")
+		bootstrap = true
+	}
+
+	fsm := &kappaFSM{s.logger, s.store, s.logsChanged, s.cache}
+	switch {
+	case hasState:
+		// The store is rebuilt from the snapshots and the log
+		err = s.store.Clear()
+	case bootstrap:
+		err = s.bootstrapRaft(conf, fsm, logs, store, snapshots, trans)
+	default:
+		err = s.discardMetadata()
+	}
+	if err != nil {
+		return
+	}
+
+	if s.raft, err = raft.NewRaft(conf, fsm, logs, store, snapshots, trans); err != nil {
+		return
+	}
+	s.raftStore, s.raftSnapshots, s.raftTransport = store, snapshots, trans
+	return nil
+}
+
+// discardMetadata clears the store of a server which joins a cluster, so it receives the
+// cluster's metadata. Users and namespaces which were never replicated, such as those of a
+// server which ran before Raft was introduced, are only discarded if DiscardMetadata is set.
+func (s *Server) discardMetadata() error {
+	empty, err := s.store.Empty()
+	if err != nil || empty {
+		return err
+	} else if !s.config.DiscardMetadata {
+		s.logger.Error("Joining a cluster would discard the local metadata, bootstrap from this server or set DiscardMetadata", "path", s.config.DataPath)
+		return errLocalMetadata
+	}
+
+	s.logger.Warn("Discarding local metadata to join a cluster", "path", s.config.DataPath)
+	return s.store.Clear()
+}
+
+// bootstrapRaft starts a new cluster with this server as the only peer. The metadata in the
+// local store, such as the users and namespaces of a server which ran without Raft, becomes
+// the first snapshot of the cluster, so the servers which join receive it.
+func (s *Server) bootstrapRaft(conf *raft.Config, fsm raft.FSM, logs raft.LogStore, stable raft.StableStore, snapshots raft.SnapshotStore, trans raft.Transport) error {
+	s.logger.Info("Bootstrapping Raft cluster", "node", s.config.NodeName, "addr", trans.LocalAddr())
+	configuration := raft.Configuration{Servers: []raft.Server{{ID: conf.LocalID, Address: trans.LocalAddr()}}}
+	if err := raft.BootstrapCluster(conf, logs, stable, snapshots, trans, configuration); err != nil {
+		return err
+	}
+
+	// Recovering the new cluster snapshots the store and compacts the log
+	return raft.RecoverCluster(conf, fsm, logs, stable, snapshots, trans, configuration)
+}
+
+// maybeBootstrap bootstraps the cluster once the number of servers given by BootstrapExpect
+// is known. Each server bootstraps the same configuration, so the first election can start
+// on any of them. A server which already has Raft state has joined a cluster and does not
+// bootstrap.
+func (s *Server) maybeBootstrap() {
+	s.bootstrapLock.Lock()
+	defer s.bootstrapLock.Unlock()
+	if s.config.BootstrapExpect == 0 || s.raft == nil {
+		return
+	}
+
+	hasState, err := raft.HasExistingState(s.raftStore, s.raftStore, s.raftSnapshots)
+	if err != nil {
+		s.logger.Warn("Failed to read the Raft state", "err", err.Error())
+		return
+	} else if hasState {
+		s.logger.Info("Raft state found, bootstrap expect disabled")
+		s.config.BootstrapExpect = 0
+		return
+	}
+
+	servers, err := bootstrapServers(s.serf.Members(), s.config.ClusterName, s.config.BootstrapExpect)
+	if err != nil {
+		s.logger.Warn("Cannot bootstrap the cluster", "err", err.Error())
+		return
+	} else if servers == nil {
+		return
+	}
+
+	s.logger.Info("Bootstrapping Raft cluster", "servers", len(servers))
+	if err := s.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		s.logger.Warn("Failed to bootstrap the Raft cluster", "err", err.Error())
+	}
+
+	// Bootstrapping complete, don't enter this again
+	s.config.BootstrapExpect = 0
+}
+
+// apply replicates a change to the system metadata. It returns the result once the change
+// has been applied by this server, which must be the leader.
+func (s *Server) apply(cmd datamodel.Command) (string, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	future := s.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		return "", err
+	}
+	s.metadataChanged(cmd, future.Index())
+
+	switch resp := future.Response().(type) {
+	case error:
+		return "", resp
+	case string:
+		return resp, nil
+	}
+	return "", nil
+}
+
+// addRaftPeer adds a server to the Raft peers, or updates its address if it changed.
+func (s *Server) addRaftPeer(n *NodeDetails) error {
+	addr := raft.ServerAddress(net.JoinHostPort(n.Addr.IP.String(), strconv.Itoa(n.RaftPort)))
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.ID == raft.ServerID(n.Name) && server.Address == addr {
+			return nil
+		}
+	}
+
+	s.logger.Info("Adding Raft peer", "node", n.Name, "addr", addr)
+	return s.raft.AddVoter(raft.ServerID(n.Name), addr, 0, 0).Error()
+}
+
+// removeRaftPeer removes a server which left the cluster from the Raft peers.
+func (s *Server) removeRaftPeer(n *NodeDetails) error {
+	if n.Name == s.config.NodeName {
+		return nil
+	}
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.ID == raft.ServerID(n.Name) {
+			s.logger.Info("Removing Raft peer", "node", n.Name, "addr", server.Address)
+			return s.raft.RemoveServer(server.ID, 0, 0).Error()
+		}
+	}
+	return nil
+}
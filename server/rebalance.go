@@ -0,0 +1,240 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// rebalanceDelay is how long a failed or leaving server may be away before its replicas
+	// are moved to other servers. Leadership moves to another replica immediately.
+	rebalanceDelay = 30 * time.Second
+
+	// rebalanceInterval is the time between rebalancing rounds
+	rebalanceInterval = 10 * time.Second
+
+	// rebalanceMoves is the number of replicas which may be moved in each interval
+	rebalanceMoves = 2
+)
+
+// rebalancer keeps the placement of the partitions in line with the servers of the
+// cluster. Moving a replica copies the partition to another server, so moves are spread
+// over time.
+type rebalancer struct {
+	delay  time.Duration
+	moves  int
+	budget int
+
+	// failed holds the time at which a server was seen failing or leaving
+	failed map[string]time.Time
+}
+
+// newRebalancer creates a rebalancer which moves the replicas of failed and leaving servers
+// after delay and moves up to moves replicas per interval.
+func newRebalancer(delay time.Duration, moves int) *rebalancer {
+	return &rebalancer{delay: delay, moves: moves, budget: moves, failed: make(map[string]time.Time)}
+}
+
+// observe records a membership change of a server. Servers leave when they are stopped,
+// so leaving is treated like failing.
+func (r *rebalancer) observe(name string, status serf.MemberStatus) {
+	if !away(status) {
+		delete(r.failed, name)
+	} else if _, ok := r.failed[name]; !ok {
+		r.failed[name] = time.Now()
+	}
+}
+
+// away determines if a member with the given status may come back.
+func away(status serf.MemberStatus) bool {
+	switch status {
+	case serf.StatusFailed, serf.StatusLeaving, serf.StatusLeft:
+		return true
+	}
+	return false
+}
+
+// refill allows another interval's worth of moves.
+func (r *rebalancer) refill() {
+	r.budget = r.moves
+}
+
+// classify splits the servers of the cluster into the alive servers and the failed or
+// leaving ones which may still come back. Other servers are gone and their replicas are
+// moved. Membership events may be dropped, so the status of every member is observed
+// again and a server first seen away here gets the full delay.
+func (r *rebalancer) classify(members []serf.Member, cluster string) (alive []string, down map[string]bool) {
+	down = make(map[string]bool)
+	for _, m := range members {
+		details, err := GetKappaServer(m)
+		if err != nil || details.Cluster != cluster {
+			continue
+		}
+
+		r.observe(details.Name, m.Status)
+		if m.Status == serf.StatusAlive {
+			alive = append(alive, details.Name)
+		} else if since, ok := r.failed[details.Name]; ok && time.Since(since) < r.delay {
+			down[details.Name] = true
+		}
+	}
+	sort.Strings(alive)
+	return
+}
+
+// rebalance returns the logs whose placement changed and uses up the moves it made.
+func (r *rebalancer) rebalance(logs []datamodel.Log, alive []string, down map[string]bool) []datamodel.Log {
+	changed, moves := rebalance(logs, alive, down, r.budget)
+	r.budget -= moves
+	return changed
+}
+
+// rebalance computes a placement which moves as few replicas as possible. Servers which
+// are neither alive nor down are gone.
+//
+// Partitions led by a server which is not alive are led by another alive replica which is
+// in sync, and stay without a leader if there is none. The replicas of gone followers are
+// then moved to the least loaded alive servers, and finally
+// followers are moved from the most to the least loaded alive servers until their number
+// of replicas differs by at most one. At most moves replicas are moved. The logs whose
+// placement changed are returned with the number of moves.
+func rebalance(logs []datamodel.Log, alive []string, down map[string]bool, moves int) ([]datamodel.Log, int) {
+	isAlive := make(map[string]bool)
+	for _, server := range alive {
+		isAlive[server] = true
+	}
+
+	// Copy the placement and count the replicas of the alive servers
+	load := byLoad{servers: append([]string{}, alive...), replicas: make(map[string]int)}
+	placed := make([]datamodel.Log, 0, len(logs))
+	for _, l := range logs {
+		if !l.Assigned() {
+			continue
+		}
+		partitions := make([]datamodel.Partition, len(l.Partitions))
+		for p, placement := range l.Partitions {
+			partitions[p] = datamodel.Partition{
+				Servers: append([]string{}, placement.Servers...),
+				Leader:  placement.Leader,
+				Epoch:   placement.Epoch,
+				InSync:  placement.InSync,
+			}
+			for _, server := range placement.Servers {
+				load.replicas[server]++
+			}
+		}
+		l.Partitions = partitions
+		placed = append(placed, l)
+	}
+	sort.Sort(byLogName(placed))
+
+	used := 0
+
+	// Leadership moves to another replica without copying data. Replicas which are not in
+	// sync may miss acknowledged records.
+	for i, l := range placed {
+		for p, placement := range l.Partitions {
+			if isAlive[placement.Leader] {
+				continue
+			}
+			for _, server := range placement.Servers {
+				if isAlive[server] && placement.CanLead(server) {
+					placed[i].Partitions[p].Leader = server
+					break
+				}
+			}
+		}
+	}
+
+	// Replace the followers of gone servers. A new replica has no records, so a gone
+	// leader is kept until an in-sync replica returns.
+	for _, l := range placed {
+		for _, placement := range l.Partitions {
+			for r, server := range placement.Servers {
+				if isAlive[server] || down[server] || server == placement.Leader || used == moves {
+					continue
+				}
+
+				sort.Sort(load)
+				for _, candidate := range load.servers {
+					if !placement.HasReplica(candidate) {
+						placement.Servers[r] = candidate
+						load.replicas[candidate]++
+						used++
+						break
+					}
+				}
+			}
+		}
+	}
+
+	// Spread the followers evenly over the alive servers
+	for used < moves && len(load.servers) > 1 {
+		sort.Sort(load)
+		least, most := load.servers[0], load.servers[len(load.servers)-1]
+		if load.replicas[most]-load.replicas[least] <= 1 || !moveFollower(placed, most, least) {
+			break
+		}
+		load.replicas[most]--
+		load.replicas[least]++
+		used++
+	}
+
+	var changed []datamodel.Log
+	for _, l := range placed {
+		if !samePlacement(l, logs) {
+			changed = append(changed, l)
+		}
+	}
+	return changed, used
+}
+
+// moveFollower moves the first follower replica on one server to another server which
+// does not hold a replica of the partition.
+func moveFollower(logs []datamodel.Log, from, to string) bool {
+	for _, l := range logs {
+		for _, placement := range l.Partitions {
+			if placement.Leader == from || placement.HasReplica(to) {
+				continue
+			}
+			for r, server := range placement.Servers {
+				if server == from {
+					placement.Servers[r] = to
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// samePlacement determines if a log is placed as it is in the list of logs.
+func samePlacement(l datamodel.Log, logs []datamodel.Log) bool {
+	for _, other := range logs {
+		if other.Name != l.Name {
+			continue
+		}
+		for p, placement := range other.Partitions {
+			if placement.Leader != l.Partitions[p].Leader || len(placement.Servers) != len(l.Partitions[p].Servers) {
+				return false
+			}
+			for r, server := range placement.Servers {
+				if l.Partitions[p].Servers[r] != server {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// byLogName sorts logs by name
+type byLogName []datamodel.Log
+
+func (b byLogName) Len() int           { return len(b) }
+func (b byLogName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byLogName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebalanceLeaders(t *testing.T) {
+	logs := []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1"},
+			{Servers: []string{"node-2", "node-3"}, Leader: "node-2"},
+		}},
+	}
+
+	// Leadership moves to an alive replica while the failed server may come back
+	changed, moves := rebalance(logs, []string{"node-2", "node-3"}, map[string]bool{"node-1": true}, 2)
+	assert.Equal(t, 0, moves)
+	assert.Equal(t, []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-2"},
+			{Servers: []string{"node-2", "node-3"}, Leader: "node-2"},
+		}},
+	}, changed)
+
+	// The logs are not modified
+	assert.Equal(t, "node-1", logs[0].Partitions[0].Leader)
+
+	// Nothing changes while the servers are alive
+	changed, moves = rebalance(logs, []string{"node-1", "node-2", "node-3"}, nil, 2)
+	assert.Equal(t, 0, moves)
+	assert.Empty(t, changed)
+}
+
+func TestRebalanceInSyncLeaders(t *testing.T) {
+	logs := []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-2", "node-3"}, Leader: "node-1", InSync: []string{"node-1", "node-3"}},
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1", InSync: []string{"node-1"}},
+		}},
+	}
+
+	// Only an in-sync replica takes over, and partitions without one keep their leader
+	changed, moves := rebalance(logs, []string{"node-2", "node-3"}, map[string]bool{"node-1": true}, 2)
+	assert.Equal(t, 0, moves)
+	assert.Equal(t, []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-2", "node-3"}, Leader: "node-3", InSync: []string{"node-1", "node-3"}},
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1", InSync: []string{"node-1"}},
+		}},
+	}, changed)
+
+	// The replicas of a gone leader are not moved to servers without its records
+	changed, moves = rebalance(logs[:1], []string{"node-2", "node-3", "node-4"}, nil, 2)
+	assert.Equal(t, 1, moves)
+	assert.Equal(t, []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-4", "node-2", "node-3"}, Leader: "node-3", InSync: []string{"node-1", "node-3"}},
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1", InSync: []string{"node-1"}},
+		}},
+	}, changed)
+}
+
+func TestRebalanceGoneServer(t *testing.T) {
+	logs := []datamodel.Log{
+		{Name: "acme.clicks", Partitions: []datamodel.Partition{{Servers: []string{"node-1", "node-2"}, Leader: "node-1"}}},
+		{Name: "acme.views", Partitions: []datamodel.Partition{{Servers: []string{"node-3", "node-1"}, Leader: "node-3"}}},
+		{Name: "acme.pending", Partitions: make([]datamodel.Partition, 1)},
+	}
+
+	// The replicas of a gone server move to the least loaded servers
+	changed, moves := rebalance(logs, []string{"node-2", "node-3", "node-4"}, nil, 2)
+	assert.Equal(t, 2, moves)
+	assert.Equal(t, []datamodel.Log{
+		{Name: "acme.clicks", Partitions: []datamodel.Partition{{Servers: []string{"node-4", "node-2"}, Leader: "node-2"}}},
+		{Name: "acme.views", Partitions: []datamodel.Partition{{Servers: []string{"node-3", "node-2"}, Leader: "node-3"}}},
+	}, changed)
+
+	// Moves beyond the budget are left for later
+	changed, moves = rebalance(logs, []string{"node-2", "node-3", "node-4"}, nil, 1)
+	assert.Equal(t, 1, moves)
+	assert.Equal(t, []datamodel.Log{
+		{Name: "acme.clicks", Partitions: []datamodel.Partition{{Servers: []string{"node-4", "node-2"}, Leader: "node-2"}}},
+	}, changed)
+}
+
+func TestRebalanceJoin(t *testing.T) {
+	logs := []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1"},
+			{Servers: []string{"node-2", "node-1"}, Leader: "node-2"},
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1"},
+		}},
+	}
+
+	// Followers move to a server which joined the cluster
+	changed, moves := rebalance(logs, []string{"node-1", "node-2", "node-3"}, nil, 5)
+	assert.Equal(t, 2, moves)
+	assert.Equal(t, []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-3"}, Leader: "node-1"},
+			{Servers: []string{"node-2", "node-3"}, Leader: "node-2"},
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1"},
+		}},
+	}, changed)
+}
+
+func TestRebalancer(t *testing.T) {
+	members := []serf.Member{expectMember("node-1", 3), expectMember("node-2", 3), expectMember("node-3", 3)}
+	members[1].Status = serf.StatusFailed
+	members[2].Status = serf.StatusLeft
+
+	// Failed and leaving servers are down until the delay has passed
+	rb := newRebalancer(time.Hour, 2)
+	rb.observe("node-2", serf.StatusFailed)
+	rb.observe("node-3", serf.StatusLeft)
+	alive, down := rb.classify(members, "kappa")
+	assert.Equal(t, []string{"node-1"}, alive)
+	assert.Equal(t, map[string]bool{"node-2": true, "node-3": true}, down)
+
+	rb.failed["node-2"] = time.Now().Add(-2 * time.Hour)
+	rb.failed["node-3"] = time.Now().Add(-2 * time.Hour)
+	alive, down = rb.classify(members, "kappa")
+	assert.Equal(t, []string{"node-1"}, alive)
+	assert.Empty(t, down)
+
+	// Recovered servers are forgotten
+	rb.observe("node-2", serf.StatusAlive)
+	rb.observe("node-3", serf.StatusAlive)
+	assert.Empty(t, rb.failed)
+}
+
+func TestRebalancerLeaveRejoin(t *testing.T) {
+	members := []serf.Member{expectMember("node-1", 3), expectMember("node-2", 3), expectMember("node-3", 3)}
+	logs := []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1"},
+			{Servers: []string{"node-2", "node-3"}, Leader: "node-2"},
+		}},
+	}
+
+	// A stopped server leaves the cluster. It keeps its replicas during the delay, but
+	// leadership moves at once.
+	rb := newRebalancer(time.Hour, 2)
+	for _, status := range []serf.MemberStatus{serf.StatusLeaving, serf.StatusLeft} {
+		members[0].Status = status
+		rb.observe("node-1", status)
+		alive, down := rb.classify(members, "kappa")
+		assert.Equal(t, []string{"node-2", "node-3"}, alive)
+		assert.Equal(t, map[string]bool{"node-1": true}, down)
+
+		changed := rb.rebalance(logs, alive, down)
+		assert.Equal(t, []datamodel.Log{
+			{Name: "acme.events", Partitions: []datamodel.Partition{
+				{Servers: []string{"node-1", "node-2"}, Leader: "node-2"},
+				{Servers: []string{"node-2", "node-3"}, Leader: "node-2"},
+			}},
+		}, changed)
+	}
+	logs[0].Partitions[0].Leader = "node-2"
+
+	// After rejoining, the server still holds its replicas
+	members[0].Status = serf.StatusAlive
+	rb.observe("node-1", serf.StatusAlive)
+	alive, down := rb.classify(members, "kappa")
+	assert.Equal(t, []string{"node-1", "node-2", "node-3"}, alive)
+	assert.Empty(t, down)
+	assert.Empty(t, rb.rebalance(logs, alive, down))
+
+	// A server which stays away is gone once the delay has passed
+	members[0].Status = serf.StatusLeft
+	rb.observe("node-1", serf.StatusLeft)
+	rb.failed["node-1"] = time.Now().Add(-2 * time.Hour)
+	alive, down = rb.classify(members, "kappa")
+	assert.Equal(t, []string{"node-2", "node-3"}, alive)
+	assert.Empty(t, down)
+}
+
+func TestRebalancerUnobserved(t *testing.T) {
+	members := []serf.Member{expectMember("node-1", 3), expectMember("node-2", 3), expectMember("node-3", 3)}
+	logs := []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-2"}, Leader: "node-1"},
+		}},
+	}
+
+	// A server whose failure was never observed is down from the first round it is seen
+	rb := newRebalancer(time.Hour, 2)
+	members[1].Status = serf.StatusFailed
+	alive, down := rb.classify(members, "kappa")
+	assert.Equal(t, []string{"node-1", "node-3"}, alive)
+	assert.Equal(t, map[string]bool{"node-2": true}, down)
+	_, failed := rb.failed["node-2"]
+	assert.True(t, failed)
+
+	// and its replicas are moved once the delay has passed
+	rb.failed["node-2"] = time.Now().Add(-2 * time.Hour)
+	alive, down = rb.classify(members, "kappa")
+	assert.Empty(t, down)
+	assert.Equal(t, []datamodel.Log{
+		{Name: "acme.events", Partitions: []datamodel.Partition{
+			{Servers: []string{"node-1", "node-3"}, Leader: "node-1"},
+		}},
+	}, rb.rebalance(logs, alive, down))
+
+	// A recovery which was never observed is noticed as well
+	members[1].Status = serf.StatusAlive
+	alive, down = rb.classify(members, "kappa")
+	assert.Equal(t, []string{"node-1", "node-2", "node-3"}, alive)
+	assert.Empty(t, down)
+	assert.Empty(t, rb.failed)
+}
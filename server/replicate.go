@@ -0,0 +1,329 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/protocol"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+const (
+	// replicateChannel is the channel type opened by replicas to fetch records from the
+	// leader of a log
+	replicateChannel = "kappa-replicate"
+
+	// replicaRequest names the server which opened a replicate channel
+	replicaRequest = "kappa-replica"
+)
+
+// replicaSession is the payload of a replicaRequest.
+type replicaSession struct {
+	Server string
+}
+
+// ReplicateHandler services "kappa-replicate" channels opened by the replicas of the
+// partitions led by this server. After a "kappa-replica" request names the server of the replica,
+// each Fetch frame is answered with an Event frame for every record starting at the
+// requested offset, followed by an End frame. Replicas holding records of an older epoch
+// which the leader does not have are sent a Truncate frame instead of the records.
+type ReplicateHandler struct {
+	logger log.Logger
+	logs   *logManager
+}
+
+// NewReplicateHandler creates a handler for kappa-replicate channels.
+func NewReplicateHandler(logger log.Logger, logs *logManager) *ReplicateHandler {
+	return &ReplicateHandler{logger, logs}
+}
+
+// Handle answers fetches until the replica closes the channel.
+func (h *ReplicateHandler) Handle(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+	defer channel.Close()
+
+	// Only servers can replicate logs
+	if sshConn.Permissions == nil || sshConn.Permissions.Extensions["server"] == "" {
+		return errors.New("replicate channel opened by a client")
+	}
+
+	// Wait for the name of the server, which must be named by its host certificate
+	var session replicaSession
+	select {
+	case req, ok := <-requests:
+		if !ok {
+			return nil
+		}
+
+		err := errors.New("expected a " + replicaRequest + " request")
+		if req.Type == replicaRequest {
+			if err = ssh.Unmarshal(req.Payload, &session); err == nil {
+				err = h.verify(session.Server, sshConn.Permissions.Extensions["server"])
+			}
+		}
+		req.Reply(err == nil, nil)
+		if err != nil {
+			return err
+		}
+	case <-parentTomb.Dying():
+		return nil
+	}
+	go ssh.DiscardRequests(requests)
+	server := session.Server
+
+	// Close the channel if the server is shutting down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-parentTomb.Dying():
+			channel.Close()
+		case <-done:
+		}
+	}()
+
+	enc := protocol.NewEncoder(channel, protocol.DefaultMaxFrameSize)
+	dec := protocol.NewDecoder(channel, protocol.DefaultMaxFrameSize)
+	for {
+		f, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			h.logger.Debug("Error reading frame", "err", err.Error())
+			return err
+		}
+
+		var fetch protocol.Fetch
+		if f.Type != protocol.FetchFrame {
+			err = h.fail(enc, f.RequestID, common.ProtocolError, "unexpected "+f.Type.String()+" frame")
+		} else if fetch.UnmarshalBinary(f.Payload) != nil {
+			err = h.fail(enc, f.RequestID, common.ProtocolError, "invalid Fetch frame")
+		} else {
+			err = h.fetch(enc, f.RequestID, server, &fetch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// verify ensures the named server logged in with its own host certificate.
+func (h *ReplicateHandler) verify(server, authenticated string) error {
+	if server != authenticated {
+		return fmt.Errorf("host certificate of %s does not belong to %s", authenticated, server)
+	}
+	_, err := h.logs.server(server)
+	return err
+}
+
+// fetch sends the records of a partition starting at the requested offset. If there are none,
+// the fetch waits for new records for up to the fetch wait time.
+func (h *ReplicateHandler) fetch(enc *protocol.Encoder, requestID uint32, server string, fetch *protocol.Fetch) error {
+	m := h.logs
+	r := m.leading(fetch.Log, int(fetch.Partition))
+	if r == nil {
+		return h.fail(enc, requestID, common.LogNotAvailable, fmt.Sprintf("%s is not the leader of partition %d of log %s", m.name, fetch.Partition, fetch.Log))
+	}
+
+	// Records appended by an older leader after the end of its epoch here have diverged
+	if fetch.Epoch > r.placement.Epoch {
+		return h.fail(enc, requestID, common.LogNotAvailable, fmt.Sprintf("%s has records of epoch %d of %s, which is newer than %d", server, fetch.Epoch, r.name, r.placement.Epoch))
+	} else if end := r.log.EpochEnd(fetch.Epoch); fetch.From > end {
+		h.logger.Info("Truncating diverged replica", "partition", r.name, "server", server, "from", fetch.From, "offset", end)
+		if err := enc.EncodeMessage(requestID, &protocol.Truncate{Partition: fetch.Partition, Offset: end}); err != nil {
+			return err
+		}
+		return enc.EncodeMessage(requestID, &protocol.End{})
+	}
+
+	// The replica has copied the records before the offset
+	if err := r.fetched(server, fetch.From, m.lagTime); err != nil {
+		return h.fail(enc, requestID, common.LogNotAvailable, err.Error())
+	}
+
+	changed := r.log.Changed()
+	records, err := r.log.Read(fetch.From, replicaFetchSize)
+	if err == nil && len(records) == 0 {
+		select {
+		case <-changed:
+		case <-time.After(m.fetchWait):
+		case <-r.stop:
+		case <-m.t.Dying():
+		}
+		records, err = r.log.Read(fetch.From, replicaFetchSize)
+	}
+	if err != nil {
+		return h.fail(enc, requestID, common.InternalServerError, "could not read "+r.name)
+	}
+
+	for i, record := range records {
+		if err := enc.EncodeMessage(requestID, &protocol.Event{Partition: fetch.Partition, Offset: fetch.From + uint64(i), Data: record}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeMessage(requestID, &protocol.End{})
+}
+
+// fail sends an Error frame followed by an End frame.
+func (h *ReplicateHandler) fail(enc *protocol.Encoder, requestID uint32, code common.StatusCode, message string) error {
+	if err := enc.EncodeMessage(requestID, &protocol.Error{Code: code, Message: message}); err != nil {
+		return err
+	}
+	return enc.EncodeMessage(requestID, &protocol.End{})
+}
+
+// follow copies the records of a partition from its leader until the replica is stopped. After
+// a restart, the replica continues from the end of its local copy once the records which
+// diverged from the leader's have been truncated.
+func (m *logManager) follow(r *replica) {
+	for {
+		err := m.fetchFrom(r)
+		select {
+		case <-r.stop:
+			return
+		case <-m.t.Dying():
+			return
+		default:
+		}
+
+		m.logger.Warn("Failed to fetch records", "partition", r.name, "leader", r.placement.Leader, "err", err.Error())
+		select {
+		case <-time.After(m.retry):
+		case <-r.stop:
+			return
+		case <-m.t.Dying():
+			return
+		}
+	}
+}
+
+// fetchFrom connects to the leader of a partition and appends the fetched records to the replica
+// until the connection fails.
+func (m *logManager) fetchFrom(r *replica) error {
+	leader, err := m.server(r.placement.Leader)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialServer(m.creds, leader)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channel, requests, err := conn.OpenChannel(replicateChannel, nil)
+	if err != nil {
+		return err
+	}
+	go ssh.DiscardRequests(requests)
+	defer channel.Close()
+
+	ok, err := channel.SendRequest(replicaRequest, true, ssh.Marshal(&replicaSession{m.name}))
+	if err == nil && !ok {
+		err = errors.New("leader rejected the replica")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Close the channel when the replica is stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.stop:
+		case <-m.t.Dying():
+		case <-done:
+			return
+		}
+		channel.Close()
+	}()
+
+	enc := protocol.NewEncoder(channel, protocol.DefaultMaxFrameSize)
+	dec := protocol.NewDecoder(channel, protocol.DefaultMaxFrameSize)
+	for {
+		from := r.log.End()
+		fetch := protocol.Fetch{Log: r.meta.Name, Partition: uint32(r.partition), From: from, Epoch: r.log.LastEpoch()}
+		if err := enc.EncodeMessage(0, &fetch); err != nil {
+			return err
+		}
+
+		records, err := readRecords(dec, from)
+		if d, ok := err.(*diverged); ok {
+			m.logger.Info("Truncating diverged records", "partition", r.name, "from", from, "offset", d.offset)
+			if err := r.log.Truncate(d.offset); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Copied records are counted in the leader's epoch. Records it appended in older
+		// epochs may be counted too, which only makes later truncations start earlier.
+		if len(records) > 0 {
+			if err := r.log.StartEpoch(r.placement.Epoch); err != nil {
+				return err
+			}
+		}
+		if err := r.log.AppendAt(from, records); err != nil {
+			return err
+		}
+	}
+}
+
+// diverged is returned by readRecords when the leader asks the replica to truncate its log.
+type diverged struct {
+	offset uint64
+}
+
+func (d *diverged) Error() string {
+	return fmt.Sprintf("records diverged from the leader at offset %d", d.offset)
+}
+
+// readRecords reads the records sent in response to a fetch.
+func readRecords(dec *protocol.Decoder, from uint64) (records [][]byte, err error) {
+	var truncate *diverged
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			return nil, err
+		}
+
+		switch f.Type {
+		case protocol.TruncateFrame:
+			var t protocol.Truncate
+			if err := t.UnmarshalBinary(f.Payload); err != nil {
+				return nil, err
+			} else if t.Offset >= from {
+				return nil, fmt.Errorf("cannot truncate at offset %d, the log ends at %d", t.Offset, from)
+			}
+			truncate = &diverged{t.Offset}
+		case protocol.EventFrame:
+			var event protocol.Event
+			if err := event.UnmarshalBinary(f.Payload); err != nil {
+				return nil, err
+			} else if event.Offset != from+uint64(len(records)) {
+				return nil, fmt.Errorf("expected offset %d, got %d", from+uint64(len(records)), event.Offset)
+			}
+			records = append(records, event.Data)
+		case protocol.ErrorFrame:
+			var e protocol.Error
+			if err := e.UnmarshalBinary(f.Payload); err != nil {
+				return nil, err
+			}
+			return nil, &e
+		case protocol.EndFrame:
+			if truncate != nil {
+				return nil, truncate
+			}
+			return records, nil
+		default:
+			return nil, errors.New("unexpected " + f.Type.String() + " frame")
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package server
 
 import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
 	log "github.com/mgutz/logxi/v1"
 
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 )
 
@@ -41,11 +47,36 @@ func (s *SerfUserEventHandler) HandleUserEvent(event serf.UserEvent) {
 	s.UserEventCh <- event
 }
 
+// SerfQueryHandler answers the Serf queries sent to this server. Answer returns the
+// response to a query, or false if the query is not for this server.
+type SerfQueryHandler struct {
+	Logger log.Logger
+	Answer func(name string) ([]byte, bool, error)
+}
+
+// HandleQueryEvent is called when a query is received from any node, including this one.
+func (s *SerfQueryHandler) HandleQueryEvent(query serf.Query) {
+	answer, ok, err := s.Answer(query.Name)
+	if !ok {
+		s.Logger.Debug("Ignoring query", "name", query.Name)
+		return
+	} else if err != nil {
+		s.Logger.Warn("Failed to answer query", "name", query.Name, "err", err.Error())
+		return
+	}
+
+	if err := query.Respond(answer); err != nil {
+		s.Logger.Warn("Failed to respond to query", "name", query.Name, "err", err.Error())
+	}
+}
+
 // SerfNodeJoinHandler processes cluster Join events.
+// Bootstrap is called after the servers are added. It may be nil.
 type SerfNodeJoinHandler struct {
 	// ClusterManager ClusterManager
-	Cluster NodeList
-	Logger  log.Logger
+	Cluster   NodeList
+	Logger    log.Logger
+	Bootstrap func()
 }
 
 // HandleMemberEvent is used to handle join events on the serf cluster.
@@ -61,16 +92,20 @@ func (s *SerfNodeJoinHandler) HandleMemberEvent(me serf.MemberEvent) {
 		// Add to the local list as well
 		s.Cluster.AddNode(*details)
 
-		// // If we still expecting to bootstrap, may need to handle this
-		// if s.config.BootstrapExpect != 0 {
-		// 	s.maybeBootstrap()
-		// }
+	}
+
+	// If we are still expecting to bootstrap, the new servers may complete the cluster
+	if s.Bootstrap != nil {
+		s.Bootstrap()
 	}
 }
 
+// SerfNodeUpdateHandler processes cluster update events. Bootstrap is called after the
+// servers are updated. It may be nil.
 type SerfNodeUpdateHandler struct {
-	Cluster NodeList
-	Logger  log.Logger
+	Cluster   NodeList
+	Logger    log.Logger
+	Bootstrap func()
 }
 
 // nodeJoin is used to handle join events on the both serf clusters
@@ -86,67 +121,53 @@ func (s *SerfNodeUpdateHandler) HandleMemberEvent(me serf.MemberEvent) {
 		// Add to the local list as well
 		s.Cluster.AddNode(*details)
 
-		// // If we still expecting to bootstrap, may need to handle this
-		// if s.config.BootstrapExpect != 0 {
-		// 	s.maybeBootstrap()
-		// }
+	}
+
+	// If we are still expecting to bootstrap, the new servers may complete the cluster
+	if s.Bootstrap != nil {
+		s.Bootstrap()
 	}
 }
 
-// // maybeBootsrap is used to handle bootstrapping when a new consul server joins
-// func (s *SerfNodeJoinHandler) maybeBootstrap() {
-// 	// // TODO: Requires Raft!
-// 	// index, err := s.raftStore.LastIndex()
-// 	// if err != nil {
-// 	// 	s.logger.Error("kappa: failed to read last raft index: %v", err)
-// 	// 	return
-// 	// }
-// 	// // Bootstrap can only be done if there are no committed logs,
-// 	// // remove our expectations of bootstrapping
-// 	// if index != 0 {
-// 	// 	s.config.BootstrapExpect = 0
-// 	// 	return
-// 	// }
-
-// 	// Scan for all the known servers
-// 	members := s.serf.Members()
-// 	addrs := make([]string, 0)
-// 	for _, member := range members {
-// 		details, err := GetKappaServer(member)
-// 		if err != nil {
-// 			continue
-// 		}
-// 		if details.Cluster != s.config.ClusterName {
-// 			s.Logger.Warn("kappa: Member %v has a conflicting datacenter, ignoring", member)
-// 			continue
-// 		}
-// 		if details.Expect != 0 && details.Expect != s.config.BootstrapExpect {
-// 			s.Logger.Warn("kappa: Member %v has a conflicting expect value. All nodes should expect the same number.", member)
-// 			return
-// 		}
-// 		if details.Bootstrap {
-// 			s.Logger.Warn("kappa: Member %v has bootstrap mode. Expect disabled.", member)
-// 			return
-// 		}
-// 		addr := &net.TCPAddr{IP: member.Addr, Port: details.SSHPort}
-// 		addrs = append(addrs, addr.String())
-// 	}
-
-// 	// Skip if we haven't met the minimum expect count
-// 	if len(addrs) < s.config.BootstrapExpect {
-// 		return
-// 	}
-
-// 	// Update the peer set
-// 	// TODO: Requires Raft!
-// 	// s.logger.Info("kappa: Attempting bootstrap with nodes: %v", addrs)
-// 	// if err := s.raft.SetPeers(addrs).Error(); err != nil {
-// 	// 	s.logger.Error("kappa: failed to bootstrap peers: %v", err)
-// 	// }
-
-// 	// Bootstrapping complete, don't enter this again
-// 	s.config.BootstrapExpect = 0
-// }
+// bootstrapServers returns the Raft peers of a new cluster formed by the alive servers of
+// the cluster once the expected number of them is known. It returns nil if more servers
+// are expected, and an error if a server expects a different number or was started in
+// bootstrap mode.
+func bootstrapServers(members []serf.Member, cluster string, expect int) ([]raft.Server, error) {
+	servers := make([]raft.Server, 0, expect)
+	for _, m := range members {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+		details, err := GetKappaServer(m)
+		if err != nil || details.Cluster != cluster || details.RaftPort == 0 {
+			continue
+		}
+		if details.Expect != 0 && details.Expect != expect {
+			return nil, fmt.Errorf("member %s expects %d servers, all servers should expect the same number", m.Name, details.Expect)
+		}
+		if details.Bootstrap {
+			return nil, fmt.Errorf("member %s is in bootstrap mode", m.Name)
+		}
+
+		addr := net.JoinHostPort(m.Addr.String(), strconv.Itoa(details.RaftPort))
+		servers = append(servers, raft.Server{ID: raft.ServerID(m.Name), Address: raft.ServerAddress(addr)})
+	}
+
+	// Skip if we haven't met the minimum expect count
+	if len(servers) < expect {
+		return nil, nil
+	}
+	sort.Sort(byServerID(servers))
+	return servers, nil
+}
+
+// byServerID sorts Raft servers by ID so all servers bootstrap the same configuration.
+type byServerID []raft.Server
+
+func (s byServerID) Len() int           { return len(s) }
+func (s byServerID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s byServerID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
 // SerfNodeLeaveHandler processes cluster leave events.
 type SerfNodeLeaveHandler struct {
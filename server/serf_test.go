@@ -1,8 +1,11 @@
 package server
 
 import (
+	"fmt"
+	"net"
 	"testing"
 
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 	log "github.com/mgutz/logxi/v1"
 	"github.com/stretchr/testify/assert"
@@ -90,8 +93,8 @@ func TestNodeJoin_InvalidNode(t *testing.T) {
 
 	// Create Member Event
 	evt := serf.MemberEvent{
-		serf.EventMemberJoin,
-		[]serf.Member{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
 			serf.Member{
 				Name:   "node-1",
 				Status: serf.StatusNone,
@@ -117,8 +120,8 @@ func TestNodeJoin_ValidNode(t *testing.T) {
 
 	// Create Member Event
 	evt := serf.MemberEvent{
-		serf.EventMemberJoin,
-		[]serf.Member{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
 			serf.Member{
 				Name: "node-1",
 				Tags: map[string]string{
@@ -137,6 +140,31 @@ func TestNodeJoin_ValidNode(t *testing.T) {
 	assert.Equal(t, 1, nodelist.Size(), "Cluster should not be empty")
 }
 
+func TestNodeJoin_Bootstrap(t *testing.T) {
+	nodelist := NewNodeList()
+	logger := log.NullLogger{}
+
+	// Create join handler
+	var calls int
+	handler := &SerfNodeJoinHandler{
+		Cluster:   nodelist,
+		Logger:    &logger,
+		Bootstrap: func() { calls++ },
+	}
+
+	// Process event
+	other := expectMember("node-2", 3)
+	other.Addr = net.ParseIP("127.0.0.2")
+	handler.HandleMemberEvent(serf.MemberEvent{
+		Type:    serf.EventMemberJoin,
+		Members: []serf.Member{expectMember("node-1", 3), other},
+	})
+
+	// Verify bootstrap is attempted once the nodes are added
+	assert.Equal(t, 2, nodelist.Size(), "Cluster should have two nodes")
+	assert.Equal(t, 1, calls, "Bootstrap should be called once per event")
+}
+
 func TestNodeUpdate_InvalidNode(t *testing.T) {
 	nodelist := NewNodeList()
 	logger := log.NullLogger{}
@@ -149,8 +177,8 @@ func TestNodeUpdate_InvalidNode(t *testing.T) {
 
 	// Create Member Event
 	evt := serf.MemberEvent{
-		serf.EventMemberUpdate,
-		[]serf.Member{
+		Type: serf.EventMemberUpdate,
+		Members: []serf.Member{
 			serf.Member{
 				Name:   "node-1",
 				Status: serf.StatusNone,
@@ -176,8 +204,8 @@ func TestNodeUpdate_ValidNode(t *testing.T) {
 
 	// Create Member Event
 	evt := serf.MemberEvent{
-		serf.EventMemberUpdate,
-		[]serf.Member{
+		Type: serf.EventMemberUpdate,
+		Members: []serf.Member{
 			serf.Member{
 				Name: "node-1",
 				Tags: map[string]string{
@@ -208,8 +236,8 @@ func TestNodeLeave_InvalidNode(t *testing.T) {
 
 	// Create Member Event
 	evt := serf.MemberEvent{
-		serf.EventMemberLeave,
-		[]serf.Member{
+		Type: serf.EventMemberLeave,
+		Members: []serf.Member{
 			serf.Member{
 				Name:   "node-1",
 				Status: serf.StatusNone,
@@ -235,8 +263,8 @@ func TestNodeLeave_ValidNode(t *testing.T) {
 
 	// Create Member Event
 	evt := serf.MemberEvent{
-		serf.EventMemberLeave,
-		[]serf.Member{
+		Type: serf.EventMemberLeave,
+		Members: []serf.Member{
 			serf.Member{
 				Name: "node-1",
 				Tags: map[string]string{
@@ -259,3 +287,69 @@ func TestNodeLeave_ValidNode(t *testing.T) {
 	// Verify node was added
 	assert.Equal(t, 0, nodelist.Size(), "Cluster should be empty")
 }
+
+// expectMember returns an alive server which expects the given number of servers
+func expectMember(name string, expect int) serf.Member {
+	return serf.Member{
+		Name: name,
+		Addr: net.ParseIP("127.0.0.1"),
+		Tags: map[string]string{
+			"role":    "kappa-server",
+			"cluster": "kappa",
+			"port":    "9000",
+			"raft":    fmt.Sprintf("%d", 7000+len(name)),
+			"expect":  fmt.Sprintf("%d", expect),
+		},
+		Status: serf.StatusAlive,
+	}
+}
+
+func TestBootstrapServers(t *testing.T) {
+	members := []serf.Member{expectMember("node-3", 3), expectMember("node-1", 3)}
+
+	// Wait until the expected servers are known
+	servers, err := bootstrapServers(members, "kappa", 3)
+	assert.Nil(t, err)
+	assert.Nil(t, servers, "Bootstrap should wait for more servers")
+
+	// Other clusters, clients and failed servers are not counted
+	other := expectMember("node-4", 3)
+	other.Tags["cluster"] = "other"
+	client := expectMember("node-5", 3)
+	client.Tags["role"] = "kappa-client"
+	failed := expectMember("node-6", 3)
+	failed.Status = serf.StatusFailed
+	members = append(members, other, client, failed)
+	servers, err = bootstrapServers(members, "kappa", 3)
+	assert.Nil(t, err)
+	assert.Nil(t, servers, "Bootstrap should wait for more servers")
+
+	// The servers are sorted so every node bootstraps the same configuration
+	members = append(members, expectMember("node-22", 3))
+	servers, err = bootstrapServers(members, "kappa", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []raft.Server{
+		{ID: "node-1", Address: "127.0.0.1:7006"},
+		{ID: "node-22", Address: "127.0.0.1:7007"},
+		{ID: "node-3", Address: "127.0.0.1:7006"},
+	}, servers)
+}
+
+func TestBootstrapServers_ConflictingExpect(t *testing.T) {
+	members := []serf.Member{expectMember("node-1", 3), expectMember("node-2", 2), expectMember("node-3", 3)}
+
+	servers, err := bootstrapServers(members, "kappa", 3)
+	assert.NotNil(t, err, "Servers should expect the same number")
+	assert.Nil(t, servers)
+}
+
+func TestBootstrapServers_BootstrapMode(t *testing.T) {
+	bootstrap := expectMember("node-2", 0)
+	delete(bootstrap.Tags, "expect")
+	bootstrap.Tags["bootstrap"] = "1"
+	members := []serf.Member{expectMember("node-1", 3), bootstrap, expectMember("node-3", 3)}
+
+	servers, err := bootstrapServers(members, "kappa", 3)
+	assert.NotNil(t, err, "Bootstrap mode should disable expect")
+	assert.Nil(t, servers)
+}
@@ -1,19 +1,23 @@
 package server
 
 import (
-	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/blacklabeldata/kappa/auth"
 	"github.com/blacklabeldata/kappa/datamodel"
 	"github.com/blacklabeldata/kappa/pkg/uuid"
+	"github.com/blacklabeldata/kappa/storage"
 	"github.com/blacklabeldata/serfer"
 	"github.com/blacklabeldata/sshh"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"github.com/hashicorp/serf/serf"
 	log "github.com/mgutz/logxi/v1"
 	"golang.org/x/crypto/ssh"
@@ -30,6 +34,24 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 	}
 	logger := log.NewLogger(c.LogOutput, "kappa")
 
+	// A bootstrap server starts the cluster on its own
+	if c.Bootstrap && c.BootstrapExpect != 0 {
+		err = logger.Error("Bootstrap and BootstrapExpect cannot both be set")
+		return
+	} else if c.BootstrapExpect < 0 {
+		err = logger.Error("BootstrapExpect cannot be negative", "expect", c.BootstrapExpect)
+		return
+	}
+
+	// Ignore empty addresses, such as the one split from an empty list
+	var existing []string
+	for _, addr := range c.ExistingNodes {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			existing = append(existing, addr)
+		}
+	}
+	c.ExistingNodes = existing
+
 	// Create data directory
 	if err = os.MkdirAll(c.DataPath, 0755); err != nil {
 		logger.Warn("Could not create data directory", "err", err)
@@ -46,21 +68,94 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 
 	file := path.Join(cwd, c.DataPath, "meta.db")
 	logger.Info("Connecting to database", "file", file)
-	system, err := datamodel.NewSystem(file)
+	store, err := datamodel.NewBoltSystemStore(file)
 	if err != nil {
 		logger.Error("Could not connect to database", "error", err.Error())
 		return
 	}
 
+	// Open the replicas of the logs
+	logFile := path.Join(cwd, c.DataPath, "logs.db")
+	logger.Info("Opening log storage", "file", logFile)
+	logStore, err := storage.Open(logFile)
+	if err != nil {
+		logger.Error("Could not open log storage", "error", err.Error())
+		return
+	}
+
+	// Create database server
+	s := &Server{
+		config:      c,
+		logger:      logger,
+		store:       store,
+		logStore:    logStore,
+		localKappas: NewNodeList(),
+		sessions:    newSessionList(),
+		started:     time.Now(),
+		leaderCh:    make(chan bool, 1),
+		logsCh:      make(chan struct{}, 1),
+		shutdownCh:  make(chan struct{}),
+	}
+
+	// Changes to the system metadata are replicated through Raft. The users and
+	// namespaces are cached until they change.
+	s.cache = newMetadataCache(datamodel.NewReplicatedSystem(store, s.apply))
+	s.system = s.cache
+
 	// Get SSH Key file
 	sshKeyFile := c.SSHPrivateKeyFile
 	logger.Info("Reading private key", "file", sshKeyFile)
 
-	privateKey, err := auth.ReadPrivateKey(logger, sshKeyFile)
+	privateKey, err := auth.ReadEncryptedPrivateKey(logger, sshKeyFile, c.SSHPrivateKeyPassphrase)
 	if err != nil {
 		return
 	}
 
+	// Present the host certificate so clients and other servers can verify the server
+	// with the CA
+	if c.SSHHostCertificateFile == "" {
+		logger.Warn("No host certificate, other servers cannot forward writes or replicate logs to this server")
+	} else {
+		logger.Info("Reading host certificate", "file", c.SSHHostCertificateFile)
+
+		var hostCert *ssh.Certificate
+		hostCert, err = auth.ReadHostCertificate(c.SSHHostCertificateFile)
+		if err != nil {
+			logger.Error("host certificate could not be read", "filename", c.SSHHostCertificateFile, "error", err.Error())
+			return
+		}
+
+		privateKey, err = ssh.NewCertSigner(hostCert, privateKey)
+		if err != nil {
+			logger.Error("host certificate does not match private key", "filename", c.SSHHostCertificateFile, "error", err.Error())
+			return
+		}
+		if c.NodeName != "" && hostCert.KeyId != c.NodeName {
+			logger.Warn("Host certificate does not name this server, other servers will reject it", "filename", c.SSHHostCertificateFile, "name", hostCert.KeyId, "node", c.NodeName)
+		}
+	}
+
+	// Servers only trust the host certificates signed by the CA
+	authorities, err := auth.ReadCertificateAuthorities(c.CACertificateFile)
+	if err != nil {
+		logger.Error("root certificate could not be read", "filename", c.CACertificateFile, "error", err.Error())
+		return
+	}
+	creds := &serverCredentials{signer: privateKey, authorities: authorities}
+
+	// Servers authenticate with the host certificate when forwarding writes to the leader
+	s.forwarder = &leaderForwarder{
+		logger:   logger,
+		creds:    creds,
+		isLeader: s.IsLeader,
+		leader:   s.leaderDetails,
+	}
+
+	// Replicas of the logs are copied between servers in the same way, and the leaders of
+	// partitions report the in-sync replicas to the cluster leader
+	s.logs = newLogManager(log.NewLogger(c.LogOutput, "logs"), c.NodeName, c.ClusterName, s.system, logStore, s.localKappas, creds)
+	s.logs.report = s.reportInSync
+
 	// Get admin certificate
 	adminCertFile := c.AdminCertificateFile
 	logger.Info("Reading admin public key", "file", adminCertFile)
@@ -72,46 +167,30 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 		return
 	}
 
-	// Add admin cert to key ring
-	userStore, err := system.Users()
-	if err != nil {
-		logger.Error("could not get user store", "error", err.Error())
-		return
-	}
-
-	// Create admin account
-	admin, err := userStore.Create("admin")
+	// Read CA certificates
+	roots, intermediates, err := auth.LoadCertPool(c.CACertificateFile)
 	if err != nil {
-		logger.Error("error creating admin account", "error", err.Error())
+		logger.Error("root certificate could not be read", "filename", c.CACertificateFile, "error", err.Error())
 		return
 	}
 
-	// Add admin certificate
-	keyRing := admin.KeyRing()
-	fingerprint, err := keyRing.AddPublicKey(cert)
+	// Verify the admin certificate chains up to the CA
+	adminChain, err := auth.ReadCertificateChain(adminCertFile)
 	if err != nil {
-		logger.Error("admin certificate could not be added", "error", err.Error())
+		logger.Error("admin certificate could not be parsed", "filename", adminCertFile, "error", err.Error())
 		return
 	}
-	logger.Info("Added admin certificate", "fingerprint", fingerprint)
-
-	// Read root cert
-	rootPem, err := ioutil.ReadFile(c.CACertificateFile)
-	if err != nil {
-		logger.Error("root certificate could not be read", "filename", c.CACertificateFile)
+	if err = auth.VerifyCertificate(adminChain, roots, intermediates); err != nil {
+		logger.Error("admin certificate was not issued by the CA", "filename", adminCertFile, "error", err.Error())
 		return
 	}
 
-	// Create certificate pool
-	roots := x509.NewCertPool()
-	if ok := roots.AppendCertsFromPEM(rootPem); !ok {
-		logger.Error("failed to parse root certificate")
-		return
-	}
+	// The admin account is created by the leader once it is elected
+	s.adminCert = cert
 
 	// Setup SSH Server
 	sshLogger := log.NewLogger(c.LogOutput, "ssh")
-	pubKeyCallback, err := PublicKeyCallback(system)
+	pubKeyCallback, err := PublicKeyCallback(s.system)
 	if err != nil {
 		logger.Error("failed to create PublicKeyCallback", err)
 		return
@@ -123,7 +202,7 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 		Logger:            sshLogger,
 		Bind:              c.SSHBindAddress,
 		PrivateKey:        privateKey,
-		PublicKeyCallback: pubKeyCallback,
+		PublicKeyCallback: ServerPublicKeyCallback(authorities, pubKeyCallback),
 		AuthLogCallback: func(meta ssh.ConnMetadata, method string, err error) {
 			if err == nil {
 				sshLogger.Info("login success", "user", meta.User())
@@ -132,7 +211,12 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 			}
 		},
 		Handlers: map[string]sshh.SSHHandler{
-			"kappa-client": &EchoHandler{},
+			"kappa-client":    NewProtocolHandler(sshLogger, s.system, s.forwarder, s.logs, s, s.sessions),
+			"kappa-forward":   NewForwardHandler(sshLogger, s.system, s.logs),
+			"kappa-replicate": NewReplicateHandler(sshLogger, s.logs),
+			"kappa-in-sync":   NewInSyncHandler(sshLogger, s.system),
+			"kappa-admin":     NewAdminHandler(sshLogger, s.system, s, serverKeyring{s}, s.requestShutdown),
+			"session":         NewSessionHandler(sshLogger, s.system, s.forwarder, s, s.logs, s.sessions),
 		},
 	}
 
@@ -144,22 +228,22 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 	}
 
 	// Setup Serf handlers
-	mgr := NewNodeList()
+	mgr := s.localKappas
 	reconcilerCh := make(chan serf.Member, 32)
 	serfEventCh := make(chan serf.Event, 256)
 	userEventCh := make(chan serf.UserEvent, 256)
 	serfer := serfer.NewSerfer(serfEventCh, serfer.SerfEventHandler{
 		Logger:            log.NewLogger(c.LogOutput, "serf"),
-		ServicePrefix:     "kappa",
+		ServicePrefix:     KappaEventService,
 		ReconcileOnJoin:   true,
 		ReconcileOnLeave:  true,
 		ReconcileOnFail:   true,
 		ReconcileOnUpdate: true,
 		ReconcileOnReap:   true,
 		NodeJoined: &SerfNodeJoinHandler{
-			mgr, log.NewLogger(c.LogOutput, "serf:node-join")},
+			mgr, log.NewLogger(c.LogOutput, "serf:node-join"), s.maybeBootstrap},
 		NodeUpdated: &SerfNodeUpdateHandler{
-			mgr, log.NewLogger(c.LogOutput, "serf:node-update")},
+			mgr, log.NewLogger(c.LogOutput, "serf:node-update"), s.maybeBootstrap},
 		NodeLeft: &SerfNodeLeaveHandler{
 			mgr, log.NewLogger(c.LogOutput, "serf:node-left")},
 		NodeFailed: &SerfNodeLeaveHandler{
@@ -168,27 +252,19 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 			mgr, log.NewLogger(c.LogOutput, "serf:node-reap")},
 		UserEvent: &SerfUserEventHandler{
 			log.NewLogger(c.LogOutput, "serf:user-events"), userEventCh},
-		UnknownEventHandler: &SerfUserEventHandler{
-			log.NewLogger(c.LogOutput, "serf:unknown-event"), userEventCh},
+		QueryHandler: &SerfQueryHandler{
+			log.NewLogger(c.LogOutput, "serf:query"), s.answerQuery},
 		Reconciler: &SerfReconciler{reconcilerCh},
-		IsLeader: func() bool {
+		IsLeader:   s.IsLeader,
 
-			// TODO: Replace with Raft IsLeader check
-			return true
-		},
+		// The leader is elected by Raft rather than with Serf events
+		IsLeaderEvent: func(string) bool { return false },
 	})
 
-	// Create database server
-	s := &Server{
-		config:       c,
-		logger:       logger,
-		sshServer:    &sshServer,
-		serfer:       serfer,
-		localKappas:  make(map[string]*NodeDetails),
-		serfEventCh:  serfEventCh,
-		kappaEventCh: userEventCh,
-		reconcileCh:  reconcilerCh,
-	}
+	s.sshServer = &sshServer
+	s.serfer = serfer
+	s.serfEventCh = serfEventCh
+	s.reconcileCh = reconcilerCh
 
 	// Create serf server
 	s.serf, err = s.setupSerf()
@@ -197,6 +273,16 @@ func NewServer(c *DatabaseConfig) (server *Server, err error) {
 		return
 	}
 
+	// Kappa events are broadcast as Serf user events
+	s.events = NewEventBus(log.NewLogger(c.LogOutput, "events"), s.serf.UserEvent, userEventCh)
+	s.handleMetadataEvents()
+
+	// Create Raft server
+	if err = s.setupRaft(); err != nil {
+		err = logger.Error("Failed to start raft", "err", err)
+		return
+	}
+
 	return s, nil
 }
 
@@ -205,27 +291,74 @@ type Server struct {
 	logger    log.Logger
 	sshServer *sshh.SSHServer
 
+	// store is the local copy of the system metadata. Changes are made
+	// through system, which replicates them with Raft.
+	store     *datamodel.BoltSystemStore
+	system    datamodel.System
+	cache     *metadataCache
+	adminCert []byte
+
+	forwarder *leaderForwarder
+
+	// logStore holds the replicas of the logs placed on this server
+	logStore *storage.Store
+	logs     *logManager
+	logsCh   chan struct{}
+
+	raft          *raft.Raft
+	raftStore     *raftboltdb.BoltStore
+	raftSnapshots raft.SnapshotStore
+	raftTransport *raft.NetworkTransport
+	leaderCh      chan bool
+
+	// sessions are the client sessions of this server
+	sessions *sessionList
+	started  time.Time
+
+	// shutdownCh is closed once the admin made this server leave the cluster
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+
+	// bootstrapLock ensures the cluster is bootstrapped once with BootstrapExpect
+	bootstrapLock sync.Mutex
+
 	serfer serfer.Serfer
 
 	// localKappas is used to track the known kappas
 	// in the cluster. Used to do leader forwarding.
-	localKappas map[string]*NodeDetails
-	localLock   sync.RWMutex
-
-	serf         *serf.Serf
-	serfEventCh  chan serf.Event
-	kappaEventCh chan serf.UserEvent
-	reconcileCh  chan serf.Member
-	t            tomb.Tomb
+	localKappas NodeList
+
+	serf        *serf.Serf
+	serfEventCh chan serf.Event
+	events      *EventBus
+	reconcileCh chan serf.Member
+	t           tomb.Tomb
 }
 
 func (s *Server) Start() error {
 	s.sshServer.Start()
 
+	// Warn about expiring certificates
+	s.t.Go(s.watchCertificates)
+
+	// Run the leader loop while this server is the leader
+	s.t.Go(s.monitorLeadership)
+
+	// Replicate the logs placed on this server
+	s.logs.Start()
+
+	// Deliver kappa events to their handlers
+	s.t.Go(func() error {
+		return s.events.Run(s.t.Dying())
+	})
+
 	// Start serf handler
 	s.serfer.Start()
 
 	// Join serf cluster
+	if len(s.config.ExistingNodes) == 0 {
+		return nil
+	}
 	s.logger.Info("Joining cluster", "nodes", s.config.ExistingNodes)
 
 	n, err := s.serf.Join(s.config.ExistingNodes, true)
@@ -254,9 +387,29 @@ func (s *Server) Stop() {
 		s.logger.Warn("error: stopping Serfer handlers", err.Error())
 	}
 
-	// Kill Serf handler
-	// s.t.Kill(nil)
-	// s.t.Wait()
+	// Stop background tasks
+	s.t.Kill(nil)
+	s.logs.Stop()
+
+	// Shutdown raft
+	s.logger.Info("Shutting down Raft server...")
+	if err := s.raft.Shutdown().Error(); err != nil {
+		s.logger.Warn("error: shutting down Raft", "err", err.Error())
+	}
+	s.t.Wait()
+	s.raftTransport.Close()
+	s.raftStore.Close()
+	s.store.Close()
+	s.logStore.Close()
+}
+
+// logsChanged is called after the logs are changed through Raft.
+func (s *Server) logsChanged() {
+	select {
+	case s.logsCh <- struct{}{}:
+	default:
+	}
+	s.logs.Notify()
 }
 
 func (s *Server) setupSerf() (*serf.Serf, error) {
@@ -287,6 +440,7 @@ func (s *Server) setupSerf() (*serf.Serf, error) {
 	conf.Tags["cluster"] = s.config.ClusterName
 	conf.Tags["build"] = s.config.Build
 	conf.Tags["port"] = fmt.Sprintf("%d", port)
+	conf.Tags["raft"] = fmt.Sprintf("%d", s.config.RaftBindPort)
 	if s.config.Bootstrap {
 		conf.Tags["bootstrap"] = "1"
 	}
@@ -297,6 +451,8 @@ func (s *Server) setupSerf() (*serf.Serf, error) {
 	conf.MemberlistConfig.LogOutput = s.config.LogOutput
 	conf.LogOutput = s.config.LogOutput
 	conf.EventCh = s.serfEventCh
+	conf.UserCoalescePeriod = eventCoalescePeriod
+	conf.UserQuiescentPeriod = eventQuiescentPeriod
 	conf.SnapshotPath = filepath.Join(s.config.DataPath, serfSnapshot)
 	conf.ProtocolVersion = conf.ProtocolVersion
 	conf.RejoinAfterLeave = true
@@ -306,6 +462,9 @@ func (s *Server) setupSerf() (*serf.Serf, error) {
 	if err := ensurePath(conf.SnapshotPath, false); err != nil {
 		return nil, err
 	}
+	if err := s.setupKeyring(conf); err != nil {
+		return nil, err
+	}
 	return serf.Create(conf)
 }
 
@@ -326,6 +485,21 @@ func (s *Server) Members() []serf.Member {
 	return s.serf.Members()
 }
 
+// Leave is used to gracefully leave the cluster. The server should be stopped afterwards.
+func (s *Server) Leave() error {
+	return s.serf.Leave()
+}
+
+// ShutdownCh is closed once the server left the cluster at the admin's request.
+func (s *Server) ShutdownCh() <-chan struct{} {
+	return s.shutdownCh
+}
+
+// requestShutdown closes the shutdown channel.
+func (s *Server) requestShutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdownCh) })
+}
+
 // RemoveFailedNode is used to remove a failed node from the cluster
 func (s *Server) RemoveFailedNode(node string) error {
 	if err := s.serf.RemoveFailedNode(node); err != nil {
@@ -336,8 +510,7 @@ func (s *Server) RemoveFailedNode(node string) error {
 
 // IsLeader checks if this server is the cluster leader
 func (s *Server) IsLeader() bool {
-	return true
-	// return s.raft.State() == raft.Leader
+	return s.raft != nil && s.raft.State() == raft.Leader
 }
 
 // KeyManager returns the Serf keyring manager
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/kappa/client"
+	"github.com/blacklabeldata/kappa/common"
+	"github.com/blacklabeldata/kappa/datamodel"
+	"github.com/blacklabeldata/kappa/executor"
+	"github.com/blacklabeldata/kappa/skl"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// defaultPrompt is shown until a namespace is selected with a USE statement.
+const defaultPrompt = "kappa> "
+
+// ptyRequest is the payload of a "pty-req" request (RFC 4254 section 6.2).
+type ptyRequest struct {
+	Term          string
+	Width, Height uint32
+	PixelWidth    uint32
+	PixelHeight   uint32
+	Modes         string
+}
+
+// windowChangeRequest is the payload of a "window-change" request (RFC 4254 section 6.7).
+type windowChangeRequest struct {
+	Width, Height uint32
+	PixelWidth    uint32
+	PixelHeight   uint32
+}
+
+// execRequest is the payload of an "exec" request (RFC 4254 section 6.5).
+type execRequest struct {
+	Command string
+}
+
+// exitStatusRequest is the payload of an "exit-status" request (RFC 4254 section 6.10).
+type exitStatusRequest struct {
+	Status uint32
+}
+
+// SessionHandler services "session" channels opened by standard SSH clients. It runs either
+// an interactive shell or the statements given in an exec request.
+type SessionHandler struct {
+	logger    log.Logger
+	system    datamodel.System
+	forwarder executor.Forwarder
+	cluster   executor.Cluster
+	logs      *logManager
+	sessions  *sessionList
+}
+
+// NewSessionHandler creates a handler for SSH session channels. Writes are sent to the
+// leader by the forwarder unless it is nil. Logs do not exist if logs is nil. The sessions
+// are tracked in sessions unless it is nil.
+func NewSessionHandler(logger log.Logger, system datamodel.System, forwarder executor.Forwarder, cluster executor.Cluster, logs *logManager, sessions *sessionList) *SessionHandler {
+	return &SessionHandler{logger, system, forwarder, cluster, logs, sessions}
+}
+
+// Handle processes the requests on a session channel until the shell exits or the client disconnects.
+func (s *SessionHandler) Handle(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+	defer channel.Close()
+
+	// Get session user
+	user, err := connectionUser(s.system, sshConn)
+	if err != nil {
+		channel.Write([]byte(err.Error() + "\r\n"))
+		return err
+	}
+
+	// Close the channel if the server is shutting down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-parentTomb.Dying():
+			channel.Close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	var mutex sync.Mutex
+	var term *terminal.Terminal
+	var width, height uint32
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			var pty ptyRequest
+			if err := ssh.Unmarshal(req.Payload, &pty); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			mutex.Lock()
+			width, height = pty.Width, pty.Height
+			mutex.Unlock()
+			req.Reply(true, nil)
+
+		case "window-change":
+			var win windowChangeRequest
+			if err := ssh.Unmarshal(req.Payload, &win); err != nil {
+				continue
+			}
+
+			mutex.Lock()
+			width, height = win.Width, win.Height
+			if term != nil {
+				term.SetSize(int(width), int(height))
+			}
+			mutex.Unlock()
+
+		case "shell":
+			started := false
+			once.Do(func() {
+				mutex.Lock()
+				term = terminal.NewTerminal(channel, defaultPrompt)
+				if width > 0 && height > 0 {
+					term.SetSize(int(width), int(height))
+				}
+				mutex.Unlock()
+
+				started = true
+				remove := s.sessions.add(executor.SessionInfo{User: user.Username(), Kind: "shell", Remote: sshConn.RemoteAddr().String(), Started: time.Now()})
+				go func() {
+					defer remove()
+					s.shell(term, user, done)
+					channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatusRequest{0}))
+					channel.Close()
+				}()
+			})
+			req.Reply(started, nil)
+
+		case "exec":
+			var cmd execRequest
+			if err := ssh.Unmarshal(req.Payload, &cmd); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			started := false
+			once.Do(func() {
+				started = true
+				remove := s.sessions.add(executor.SessionInfo{User: user.Username(), Kind: "exec", Remote: sshConn.RemoteAddr().String(), Started: time.Now()})
+				go func() {
+					defer remove()
+					status := s.exec(channel, user, cmd.Command, done)
+					channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatusRequest{status}))
+					channel.Close()
+				}()
+			})
+			req.Reply(started, nil)
+
+		default:
+			s.logger.Debug("Unsupported session request", "type", req.Type)
+			req.Reply(false, nil)
+		}
+	}
+	return nil
+}
+
+// connectionUser looks up the authenticated user of an SSH connection.
+func connectionUser(system datamodel.System, sshConn *ssh.ServerConn) (datamodel.User, error) {
+	if sshConn.Permissions == nil {
+		return nil, errors.New("session user could not be determined")
+	}
+
+	users, err := system.Users()
+	if err != nil {
+		return nil, err
+	}
+	return users.Get(sshConn.Permissions.Extensions["username"])
+}
+
+// shell runs a read-eval-print loop on the terminal until the user exits. Logs are read
+// until closed is closed.
+func (s *SessionHandler) shell(term *terminal.Terminal, user datamodel.User, closed <-chan struct{}) {
+	colors := common.DefaultColorCodes
+
+	// Write ascii text
+	term.Write([]byte("\r\n"))
+	for _, line := range common.ASCII {
+		term.Write([]byte(line))
+		term.Write([]byte("\r\n"))
+	}
+
+	// Write login message
+	term.Write([]byte("\r\n\n"))
+	client.GetMessage(term, colors)
+	term.Write([]byte("\n"))
+
+	// Create executor
+	session := executor.NewSession("", user)
+	exec := executor.NewExecutor(session, common.NewTerminal(term, defaultPrompt), s.system, s.forwarder, s.cluster, newLogReader(s.logs, s.forwarder != nil, closed))
+	w := common.ResponseWriter{Colors: colors, Writer: term}
+
+	for {
+		input, err := term.ReadLine()
+		if err != nil {
+			break
+		}
+
+		// Process line
+		line := strings.TrimSpace(input)
+		if len(line) == 0 {
+			continue
+		} else if line == "exit" || line == "quit" {
+			break
+		} else if strings.HasPrefix(line, "//") || strings.HasPrefix(line, "--") {
+			continue
+		}
+
+		// Parse statement
+		stmt, err := skl.ParseStatement(line)
+		if err != nil {
+			term.Write(colors.LightRed)
+			term.Write([]byte(" " + err.Error() + "\r\n"))
+			term.Write(colors.Reset)
+			continue
+		}
+
+		// Execute statement
+		exec.Execute(&w, stmt)
+	}
+
+	term.Write(colors.LightGreen)
+	term.Write([]byte("\r\n Yo homes, smell you later!\r\n"))
+	term.Write(colors.Reset)
+}
+
+// exec runs semicolon delimited statements without a terminal. Results are written without
+// colors and the exit status is non-zero if any statement failed. Logs are read until
+// closed is closed.
+func (s *SessionHandler) exec(channel ssh.Channel, user datamodel.User, command string, closed <-chan struct{}) uint32 {
+	out := common.NewlineWriter(channel)
+
+	// Parse statements
+	stmts, err := skl.ParseStatements(command)
+	if err != nil {
+		fmt.Fprintln(common.NewlineWriter(channel.Stderr()), err.Error())
+		return 1
+	}
+
+	// Create executor
+	session := executor.NewSession("", user)
+	exec := executor.NewExecutor(session, common.NewHeadlessTerminal(defaultPrompt), s.system, s.forwarder, s.cluster, newLogReader(s.logs, s.forwarder != nil, closed))
+
+	// Execute statements
+	var status uint32
+	for _, stmt := range stmts {
+		w := common.ResponseWriter{Colors: common.NoColorCodes, Writer: out}
+		exec.Execute(&w, stmt)
+		if w.Failed() {
+			status = 1
+		}
+	}
+	return status
+}
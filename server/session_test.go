@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/blacklabeldata/kappa/datamodel"
+	log "github.com/mgutz/logxi/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	tomb "gopkg.in/tomb.v2"
+)
+
+// requireNil stops the test if there was an error.
+func requireNil(t *testing.T, err error) {
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+}
+
+// testHandler services the SSH channels of a type.
+type testHandler interface {
+	Handle(tomb.Tomb, *ssh.ServerConn, ssh.Channel, <-chan *ssh.Request) error
+}
+
+// newTestSession starts the session and protocol handlers on a local port and returns an
+// SSH client connected to the other end as the given user.
+func newTestSession(t *testing.T, username string) (*ssh.Client, func()) {
+	return newTestServer(t, username, nil)
+}
+
+// newTestServer starts the session and protocol handlers as well as those returned by
+// extra, unless it is nil, and returns an SSH client connected as the given user.
+func newTestServer(t *testing.T, username string, extra func(datamodel.System) map[string]testHandler) (*ssh.Client, func()) {
+	dir, err := ioutil.TempDir("", "kappa-session")
+	requireNil(t, err)
+
+	// Create system with user
+	system, err := datamodel.NewSystem(path.Join(dir, "meta.db"))
+	requireNil(t, err)
+	users, err := system.Users()
+	requireNil(t, err)
+	_, err = users.Create(username)
+	requireNil(t, err)
+
+	// Create keys
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	requireNil(t, err)
+	hostSigner, err := ssh.NewSignerFromSigner(hostKey)
+	requireNil(t, err)
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	requireNil(t, err)
+	userSigner, err := ssh.NewSignerFromSigner(userKey)
+	requireNil(t, err)
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"username": conn.User()}}, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	// Start server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requireNil(t, err)
+	handlers := map[string]testHandler{
+		"session":      NewSessionHandler(log.NullLog, system, nil, nil, nil, nil),
+		"kappa-client": NewProtocolHandler(log.NullLog, system, nil, nil, nil, nil),
+	}
+	if extra != nil {
+		for name, h := range extra(system) {
+			handlers[name] = h
+		}
+	}
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+
+		sshConn, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+
+		var tb tomb.Tomb
+		for ch := range channels {
+			handler, ok := handlers[ch.ChannelType()]
+			if !ok {
+				ch.Reject(ssh.UnknownChannelType, "unknown channel type")
+				continue
+			}
+
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				return
+			}
+			go handler.Handle(tb, sshConn, channel, reqs)
+		}
+	}()
+
+	// Connect client
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	requireNil(t, err)
+
+	return client, func() {
+		client.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSessionShell(t *testing.T) {
+	client, cleanup := newTestSession(t, "admin")
+	defer cleanup()
+
+	session, err := client.NewSession()
+	requireNil(t, err)
+	defer session.Close()
+
+	// Request a terminal and shell
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	session.Stdin = bytes.NewBufferString("CREATE NAMESPACE acme\rUSE acme\rSHOW NAMESPACES\rexit\r")
+	requireNil(t, session.RequestPty("xterm", 40, 120, ssh.TerminalModes{}))
+	requireNil(t, session.Shell())
+
+	// Wait for the shell to exit
+	assert.Nil(t, session.Wait())
+
+	output := stdout.String()
+	assert.Contains(t, output, "kappa> CREATE NAMESPACE acme")
+	assert.Contains(t, output, "namespace created")
+	assert.Contains(t, output, "kappa: acme> SHOW NAMESPACES")
+	assert.Contains(t, output, " acme")
+}
+
+func TestSessionShellParseError(t *testing.T) {
+	client, cleanup := newTestSession(t, "admin")
+	defer cleanup()
+
+	session, err := client.NewSession()
+	requireNil(t, err)
+	defer session.Close()
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	session.Stdin = bytes.NewBufferString("UPDATE nothing\rexit\r")
+	requireNil(t, session.RequestPty("xterm", 40, 120, ssh.TerminalModes{}))
+	requireNil(t, session.Shell())
+	assert.Nil(t, session.Wait())
+
+	assert.Contains(t, stdout.String(), "found UPDATE, expected USE, CREATE, SHOW, DROP, SELECT, SUBSCRIBE")
+}
+
+func TestSessionExec(t *testing.T) {
+	client, cleanup := newTestSession(t, "admin")
+	defer cleanup()
+
+	session, err := client.NewSession()
+	requireNil(t, err)
+	defer session.Close()
+
+	output, err := session.Output("CREATE NAMESPACE acme; USE acme; SHOW NAMESPACES")
+	assert.Nil(t, err)
+	assert.Contains(t, string(output), "namespace created\n")
+	assert.Contains(t, string(output), " acme")
+	assert.NotContains(t, string(output), "\x1b")
+	assert.NotContains(t, string(output), "\r\n")
+}
+
+func TestSessionExecFailure(t *testing.T) {
+	client, cleanup := newTestSession(t, "admin")
+	defer cleanup()
+
+	session, err := client.NewSession()
+	requireNil(t, err)
+	defer session.Close()
+
+	// Dropping a missing namespace fails
+	err = session.Run("DROP NAMESPACE missing; SHOW NAMESPACES")
+	if assert.IsType(t, &ssh.ExitError{}, err) {
+		assert.Equal(t, 1, err.(*ssh.ExitError).ExitStatus())
+	}
+}
+
+func TestSessionExecParseError(t *testing.T) {
+	client, cleanup := newTestSession(t, "admin")
+	defer cleanup()
+
+	session, err := client.NewSession()
+	requireNil(t, err)
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err = session.Run("SHOW NAMESPACES; UPDATE nothing")
+	if assert.IsType(t, &ssh.ExitError{}, err) {
+		assert.Equal(t, 1, err.(*ssh.ExitError).ExitStatus())
+	}
+	assert.Contains(t, stderr.String(), "found UPDATE")
+}
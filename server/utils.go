@@ -15,8 +15,11 @@ import (
 
 const (
 
+	// KappaEventService is the Serf service name of kappa events
+	KappaEventService = "kappa-event"
+
 	// KappaEventPrefix is pre-pended to a kappa event to distinguish it
-	KappaEventPrefix = "kappa-event:"
+	KappaEventPrefix = KappaEventService + ":"
 )
 
 // GetKappaEventName computes the name of a kappa event
@@ -75,10 +78,29 @@ func GetKappaServer(m serf.Member) (n *NodeDetails, err error) {
 		return
 	}
 
+	// Get node Raft port
+	// Servers which do not advertise a Raft port are not added to the Raft peers
+	var raftPort int
+	if port, ok := m.Tags["raft"]; ok {
+		if raftPort, err = strconv.Atoi(port); err != nil {
+			err = fmt.Errorf("error: member raft port cannot be converted to int: '%s'", port)
+			return
+		}
+	}
+
 	// Get node bootstrap
 	// All nodes which have this tag are bootstrapped
 	_, bootstrap := m.Tags["bootstrap"]
 
+	// Get the number of servers expected to bootstrap the cluster
+	var expect int
+	if e, ok := m.Tags["expect"]; ok {
+		if expect, err = strconv.Atoi(e); err != nil {
+			err = fmt.Errorf("error: member expect cannot be converted to int: '%s'", e)
+			return
+		}
+	}
+
 	// Get SSH addr
 	addr := net.TCPAddr{IP: m.Addr, Port: p}
 
@@ -87,8 +109,10 @@ func GetKappaServer(m serf.Member) (n *NodeDetails, err error) {
 		Role:      role,
 		Cluster:   cluster,
 		SSHPort:   p,
+		RaftPort:  raftPort,
 		Bootstrap: bootstrap,
 		Addr:      addr,
+		Expect:    expect,
 	}
 	return
 }
@@ -101,6 +125,7 @@ type NodeDetails struct {
 	DataCenter string
 	Service    string
 	SSHPort    int
+	RaftPort   int
 	Bootstrap  bool
 	Addr       net.TCPAddr
 	Expect     int
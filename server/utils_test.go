@@ -165,6 +165,74 @@ func TestGetKappaServer_Bootstrap(t *testing.T) {
 	assert.Equal(t, net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}, node.Addr, "Addr should be 127.0.0.1")
 }
 
+func TestGetKappaServer_RaftPort(t *testing.T) {
+	m := serf.Member{
+		Name: "node",
+		Addr: net.ParseIP("127.0.0.1"),
+		Tags: map[string]string{
+			"role":    "kappa-server",
+			"cluster": "kappa",
+			"port":    "9000",
+			"raft":    "7947",
+		},
+	}
+
+	node, err := GetKappaServer(m)
+	assert.NotNil(t, node, "node should not be nil")
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, 7947, node.RaftPort, "RaftPort should be 7947")
+}
+
+func TestGetKappaServer_Expect(t *testing.T) {
+	m := serf.Member{
+		Name: "node",
+		Addr: net.ParseIP("127.0.0.1"),
+		Tags: map[string]string{
+			"role":    "kappa-server",
+			"cluster": "kappa",
+			"port":    "9000",
+			"expect":  "3",
+		},
+	}
+
+	node, err := GetKappaServer(m)
+	assert.NotNil(t, node, "node should not be nil")
+	assert.Nil(t, err, "err should be nil")
+	assert.Equal(t, 3, node.Expect, "Expect should be 3")
+}
+
+func TestGetKappaServer_InvalidExpectTag(t *testing.T) {
+	m := serf.Member{
+		Addr: net.ParseIP("127.0.0.1"),
+		Tags: map[string]string{
+			"role":    "kappa-server",
+			"cluster": "kappa",
+			"port":    "9000",
+			"expect":  "abc",
+		},
+	}
+
+	node, err := GetKappaServer(m)
+	assert.Nil(t, node, "node should be nil")
+	assert.NotNil(t, err, "err should not be nil")
+}
+
+func TestGetKappaServer_InvalidRaftPortTag(t *testing.T) {
+	m := serf.Member{
+		Addr: net.ParseIP("127.0.0.1"),
+		Tags: map[string]string{
+			"role":    "kappa-server",
+			"cluster": "kappa",
+			"port":    "9000",
+			"raft":    "abc",
+		},
+	}
+
+	node, err := GetKappaServer(m)
+	assert.Nil(t, node, "node should be nil")
+	assert.NotNil(t, err, "err should not be nil")
+}
+
 func TestNodeDetails_String(t *testing.T) {
 	n := NodeDetails{
 		Name:    "node-1",
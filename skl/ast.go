@@ -2,6 +2,8 @@ package skl
 
 import (
 	"bytes"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -13,8 +15,19 @@ const (
 	CreateNamespaceType NodeType = iota
 	DropNamespaceType   NodeType = iota
 	ShowNamespaceType   NodeType = iota
+	CreateLogType       NodeType = iota
+	ShowLogsType        NodeType = iota
+	ShowPartitionsType  NodeType = iota
+	ShowNodesType       NodeType = iota
+	ShowHealthType      NodeType = iota
+	ShowSessionsType    NodeType = iota
+	SelectType          NodeType = iota
+	SubscribeType       NodeType = iota
 )
 
+// AllPartitions is the partition of statements which read every partition of a log
+const AllPartitions = -1
+
 // Node is an interface for AST nodes
 type Node interface {
 	NodeType() NodeType
@@ -134,3 +147,251 @@ func (s ShowNamespacesStatement) NodeType() NodeType { return ShowNamespaceType
 
 // RequiredPermissions returns the required permissions in order to use this command
 func (s ShowNamespacesStatement) RequiredPermissions() string { return "show.namespaces" }
+
+// CreateLogStatement represents the CREATE LOG statement
+type CreateLogStatement struct {
+	name       string
+	key        string
+	partitions int
+	options    map[string]string
+}
+
+// Name returns the name of the log. Names without a period belong to the namespace of the session.
+func (s CreateLogStatement) Name() string {
+	return s.name
+}
+
+// Key returns the field given with CLUSTERED BY, or an empty string.
+func (s CreateLogStatement) Key() string {
+	return s.key
+}
+
+// Partitions returns the number of partitions given with INTO n PARTITIONS. Logs without
+// a CLUSTERED BY clause have one partition.
+func (s CreateLogStatement) Partitions() int {
+	if s.partitions == 0 {
+		return 1
+	}
+	return s.partitions
+}
+
+// Options returns the options given with WITH OPTIONS. Option names are lower case.
+func (s CreateLogStatement) Options() map[string]string {
+	return s.options
+}
+
+// String returns a string representation
+func (s CreateLogStatement) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("CREATE LOG ")
+	buf.WriteString(s.name)
+
+	if s.key != "" {
+		buf.WriteString(" CLUSTERED BY (")
+		buf.WriteString(s.key)
+		buf.WriteString(") INTO ")
+		buf.WriteString(strconv.Itoa(s.partitions))
+		buf.WriteString(" PARTITIONS")
+	}
+
+	if len(s.options) > 0 {
+		names := make([]string, 0, len(s.options))
+		for name := range s.options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		buf.WriteString(" WITH OPTIONS (")
+		for i, name := range names {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(name)
+			buf.WriteString(" = ")
+			buf.WriteString(s.options[name])
+		}
+		buf.WriteString(")")
+	}
+	return buf.String()
+}
+
+// NodeType returns an NodeType id
+func (s CreateLogStatement) NodeType() NodeType { return CreateLogType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s CreateLogStatement) RequiredPermissions() string { return "create.log" }
+
+// ShowLogsStatement represents the SHOW LOGS statement
+type ShowLogsStatement struct {
+}
+
+// String returns a string representation
+func (s ShowLogsStatement) String() string {
+	return "SHOW LOGS"
+}
+
+// NodeType returns an NodeType id
+func (s ShowLogsStatement) NodeType() NodeType { return ShowLogsType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s ShowLogsStatement) RequiredPermissions() string { return "show.logs" }
+
+// ShowPartitionsStatement represents the SHOW PARTITIONS statement
+type ShowPartitionsStatement struct {
+	log string
+}
+
+// Log returns the name of the log whose partitions are listed, if any
+func (s ShowPartitionsStatement) Log() string {
+	return s.log
+}
+
+// String returns a string representation
+func (s ShowPartitionsStatement) String() string {
+	if s.log == "" {
+		return "SHOW PARTITIONS"
+	}
+	return "SHOW PARTITIONS " + s.log
+}
+
+// NodeType returns an NodeType id
+func (s ShowPartitionsStatement) NodeType() NodeType { return ShowPartitionsType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s ShowPartitionsStatement) RequiredPermissions() string { return "show.logs" }
+
+// ShowNodesStatement represents the SHOW NODES statement
+type ShowNodesStatement struct {
+}
+
+// String returns a string representation
+func (s ShowNodesStatement) String() string {
+	return "SHOW NODES"
+}
+
+// NodeType returns an NodeType id
+func (s ShowNodesStatement) NodeType() NodeType { return ShowNodesType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s ShowNodesStatement) RequiredPermissions() string { return "show.cluster" }
+
+// ShowHealthStatement represents the SHOW CLUSTER HEALTH statement
+type ShowHealthStatement struct {
+}
+
+// String returns a string representation
+func (s ShowHealthStatement) String() string {
+	return "SHOW CLUSTER HEALTH"
+}
+
+// NodeType returns an NodeType id
+func (s ShowHealthStatement) NodeType() NodeType { return ShowHealthType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s ShowHealthStatement) RequiredPermissions() string { return "show.cluster" }
+
+// ShowSessionsStatement represents the SHOW SESSIONS statement
+type ShowSessionsStatement struct {
+	cluster bool
+}
+
+// OnCluster returns whether the sessions of every server are listed
+func (s ShowSessionsStatement) OnCluster() bool {
+	return s.cluster
+}
+
+// String returns a string representation
+func (s ShowSessionsStatement) String() string {
+	if s.cluster {
+		return "SHOW SESSIONS ON CLUSTER"
+	}
+	return "SHOW SESSIONS"
+}
+
+// NodeType returns an NodeType id
+func (s ShowSessionsStatement) NodeType() NodeType { return ShowSessionsType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s ShowSessionsStatement) RequiredPermissions() string { return "show.cluster" }
+
+// logRead holds the clauses of the statements which read the records of a log
+type logRead struct {
+	log       string
+	partition int
+	offset    uint64
+	limit     int
+}
+
+// Log returns the name of the log. Names without a period belong to the namespace of the session.
+func (r logRead) Log() string {
+	return r.log
+}
+
+// Partition returns the partition given with PARTITION, or AllPartitions.
+func (r logRead) Partition() int {
+	return r.partition
+}
+
+// Offset returns the offset given with OFFSET. Each partition is read from this offset.
+func (r logRead) Offset() uint64 {
+	return r.offset
+}
+
+// Limit returns the number of records given with LIMIT, or 0 if the records are not limited.
+func (r logRead) Limit() int {
+	return r.limit
+}
+
+// String returns the string representation of the clauses following the keyword
+func (r logRead) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(" * FROM ")
+	buf.WriteString(r.log)
+	if r.partition != AllPartitions {
+		buf.WriteString(" PARTITION ")
+		buf.WriteString(strconv.Itoa(r.partition))
+	}
+	if r.offset > 0 {
+		buf.WriteString(" OFFSET ")
+		buf.WriteString(strconv.FormatUint(r.offset, 10))
+	}
+	if r.limit > 0 {
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.Itoa(r.limit))
+	}
+	return buf.String()
+}
+
+// SelectStatement represents the SELECT statement, which reads the records of a log
+// which have been copied to its in-sync replicas.
+type SelectStatement struct {
+	logRead
+}
+
+// String returns a string representation
+func (s SelectStatement) String() string {
+	return "SELECT" + s.logRead.String()
+}
+
+// NodeType returns an NodeType id
+func (s SelectStatement) NodeType() NodeType { return SelectType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s SelectStatement) RequiredPermissions() string { return "read.log" }
+
+// SubscribeStatement represents the SUBSCRIBE statement, which reads the records of a log
+// like SELECT and then waits for new records.
+type SubscribeStatement struct {
+	logRead
+}
+
+// String returns a string representation
+func (s SubscribeStatement) String() string {
+	return "SUBSCRIBE" + s.logRead.String()
+}
+
+// NodeType returns an NodeType id
+func (s SubscribeStatement) NodeType() NodeType { return SubscribeType }
+
+// RequiredPermissions returns the required permissions in order to use this command
+func (s SubscribeStatement) RequiredPermissions() string { return "read.log" }
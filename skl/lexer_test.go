@@ -48,6 +48,7 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `ON`, tok: ON},
 		{s: `OPTIONAL`, tok: OPTIONAL},
 		{s: `OPTIONS`, tok: OPTIONS},
+		{s: `PARTITION`, tok: PARTITION},
 		{s: `PASSWORD`, tok: PASSWORD},
 		{s: `PERMISSION`, tok: PERMISSION},
 		{s: `REMOVE`, tok: REMOVE},
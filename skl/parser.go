@@ -3,6 +3,7 @@ package skl
 import (
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 
@@ -15,6 +16,9 @@ const (
 
 	// DateTimeFormat represents the format for date time literals.
 	DateTimeFormat = "2006-01-02 15:04:05.999999"
+
+	// MaxPartitions is the largest number of partitions of a log.
+	MaxPartitions = 1024
 )
 
 // Parser represents an InfluxQL parser.
@@ -46,8 +50,52 @@ func (p *Parser) ParseStatement() (Statement, error) {
 		return p.parseDropStatement()
 	case SHOW:
 		return p.parseShowStatement()
+	case SELECT:
+		read, err := p.parseLogRead()
+		if err != nil {
+			return nil, err
+		}
+		return &SelectStatement{read}, nil
+	case SUBSCRIBE:
+		read, err := p.parseLogRead()
+		if err != nil {
+			return nil, err
+		}
+		return &SubscribeStatement{read}, nil
 	default:
-		return nil, newParseError(tokstr(tok, lit), []string{"USE", "CREATE", "SHOW", "DROP"}, pos)
+		return nil, newParseError(tokstr(tok, lit), []string{"USE", "CREATE", "SHOW", "DROP", "SELECT", "SUBSCRIBE"}, pos)
+	}
+}
+
+// ParseStatements parses a string of semicolon delimited statements.
+func ParseStatements(s string) ([]Statement, error) {
+	return NewParser(strings.NewReader(s)).ParseStatements()
+}
+
+// ParseStatements parses semicolon delimited statements until the end of the input.
+// An error in any statement is returned without the statements which were parsed.
+func (p *Parser) ParseStatements() ([]Statement, error) {
+	var statements []Statement
+	separated := true
+	for {
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		switch {
+		case tok == lexer.EOF:
+			return statements, nil
+		case tok == lexer.SEMICOLON:
+			separated = true
+			continue
+		case !separated:
+			return nil, newParseError(tokstr(tok, lit), []string{";"}, pos)
+		}
+		p.unscan()
+
+		stmt, err := p.ParseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, stmt)
+		separated = false
 	}
 }
 
@@ -75,8 +123,10 @@ func (p *Parser) parseCreateStatement() (Statement, error) {
 	switch tok {
 	case NAMESPACE:
 		return p.parseCreateNamespaceStatement()
+	case LOG:
+		return p.parseCreateLogStatement()
 	default:
-		return nil, newParseError(tokstr(tok, lit), []string{"NAMESPACE"}, pos)
+		return nil, newParseError(tokstr(tok, lit), []string{"NAMESPACE", "LOG"}, pos)
 	}
 }
 
@@ -95,6 +145,109 @@ func (p *Parser) parseCreateNamespaceStatement() (*CreateNamespaceStatement, err
 	return stmt, nil
 }
 
+// parseCreateLogStatement parses a string and returns a CreateLogStatement.
+// This function assumes the "CREATE LOG" tokens have already been consumed.
+func (p *Parser) parseCreateLogStatement() (*CreateLogStatement, error) {
+	stmt := &CreateLogStatement{}
+
+	// Parse the name of the log, which may be qualified by its namespace
+	lit, err := p.parseNamespace()
+	if err != nil {
+		return nil, err
+	}
+	stmt.name = lit
+
+	// Parse the optional CLUSTERED BY clause
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == CLUSTERED {
+		if stmt.key, stmt.partitions, err = p.parseClusteredBy(); err != nil {
+			return nil, err
+		}
+	} else {
+		p.unscan()
+	}
+
+	// Parse the optional WITH OPTIONS clause
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok != WITH {
+		p.unscan()
+		return stmt, nil
+	}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != OPTIONS {
+		return nil, newParseError(tokstr(tok, lit), []string{"OPTIONS"}, pos)
+	}
+	if stmt.options, err = p.parseOptions(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseClusteredBy parses "BY (field) INTO n PARTITIONS".
+// This function assumes the "CLUSTERED" token has already been consumed.
+func (p *Parser) parseClusteredBy() (key string, partitions int, err error) {
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != BY {
+		return "", 0, newParseError(tokstr(tok, lit), []string{"BY"}, pos)
+	}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != lexer.LPAREN {
+		return "", 0, newParseError(tokstr(tok, lit), []string{"("}, pos)
+	}
+	if key, err = p.parseIdent(); err != nil {
+		return "", 0, err
+	}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != lexer.RPAREN {
+		return "", 0, newParseError(tokstr(tok, lit), []string{")"}, pos)
+	}
+
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != INTO {
+		return "", 0, newParseError(tokstr(tok, lit), []string{"INTO"}, pos)
+	}
+	if partitions, err = p.parseInt(1, MaxPartitions); err != nil {
+		return "", 0, err
+	}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != PARTITIONS {
+		return "", 0, newParseError(tokstr(tok, lit), []string{"PARTITIONS"}, pos)
+	}
+	return key, partitions, nil
+}
+
+// parseOptions parses a parenthesized list of "name = value" pairs. Values are
+// identifiers or numbers.
+func (p *Parser) parseOptions() (map[string]string, error) {
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != lexer.LPAREN {
+		return nil, newParseError(tokstr(tok, lit), []string{"("}, pos)
+	}
+
+	options := make(map[string]string)
+	for {
+		// Parse option name
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if tok != lexer.IDENT {
+			return nil, newParseError(tokstr(tok, lit), []string{"option"}, pos)
+		}
+		name := strings.ToLower(lit)
+		if _, ok := options[name]; ok {
+			return nil, &ParseError{Message: fmt.Sprintf("duplicate option %s", name), Pos: pos}
+		}
+
+		if tok, pos, lit := p.scanIgnoreWhitespace(); tok != lexer.EQ {
+			return nil, newParseError(tokstr(tok, lit), []string{"="}, pos)
+		}
+
+		// Parse option value
+		tok, pos, lit = p.scanIgnoreWhitespace()
+		if tok != lexer.IDENT && tok != lexer.NUMBER {
+			return nil, newParseError(tokstr(tok, lit), []string{"value"}, pos)
+		}
+		options[name] = lit
+
+		// Options are separated by commas
+		tok, pos, lit = p.scanIgnoreWhitespace()
+		if tok == lexer.RPAREN {
+			return options, nil
+		} else if tok != lexer.COMMA {
+			return nil, newParseError(tokstr(tok, lit), []string{",", ")"}, pos)
+		}
+	}
+}
+
 // parseDropStatement parses a string and returns a Statement AST object.
 // This function assumes the "DROP" token has already been consumed.
 func (p *Parser) parseDropStatement() (Statement, error) {
@@ -132,9 +285,106 @@ func (p *Parser) parseShowStatement() (Statement, error) {
 	switch tok {
 	case NAMESPACES:
 		return &ShowNamespacesStatement{}, nil
+	case LOGS:
+		return &ShowLogsStatement{}, nil
+	case PARTITIONS:
+		return p.parseShowPartitionsStatement()
+	case NODES:
+		return &ShowNodesStatement{}, nil
+	case CLUSTER:
+		if tok, pos, lit := p.scanIgnoreWhitespace(); tok != HEALTH {
+			return nil, newParseError(tokstr(tok, lit), []string{"HEALTH"}, pos)
+		}
+		return &ShowHealthStatement{}, nil
+	case SESSIONS:
+		return p.parseShowSessionsStatement()
 	default:
-		return nil, newParseError(tokstr(tok, lit), []string{"NAMESPACES"}, pos)
+		return nil, newParseError(tokstr(tok, lit), []string{"NAMESPACES", "LOGS", "PARTITIONS", "NODES", "CLUSTER", "SESSIONS"}, pos)
+	}
+}
+
+// parseShowSessionsStatement parses a string and returns a ShowSessionsStatement.
+// This function assumes the "SHOW SESSIONS" tokens have already been consumed.
+func (p *Parser) parseShowSessionsStatement() (*ShowSessionsStatement, error) {
+	stmt := &ShowSessionsStatement{}
+
+	// Parse the optional ON CLUSTER clause
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok != ON {
+		p.unscan()
+		return stmt, nil
+	}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != CLUSTER {
+		return nil, newParseError(tokstr(tok, lit), []string{"CLUSTER"}, pos)
+	}
+	stmt.cluster = true
+	return stmt, nil
+}
+
+// parseShowPartitionsStatement parses a string and returns a ShowPartitionsStatement.
+// This function assumes the "SHOW PARTITIONS" tokens have already been consumed.
+func (p *Parser) parseShowPartitionsStatement() (*ShowPartitionsStatement, error) {
+	stmt := &ShowPartitionsStatement{}
+
+	// Parse the optional name of the log
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok != lexer.IDENT {
+		p.unscan()
+		return stmt, nil
+	}
+	p.unscan()
+
+	lit, err := p.parseNamespace()
+	if err != nil {
+		return nil, err
+	}
+	stmt.log = lit
+	return stmt, nil
+}
+
+// parseLogRead parses "* FROM log [PARTITION n] [OFFSET n] [LIMIT n]".
+// This function assumes the "SELECT" or "SUBSCRIBE" token has already been consumed.
+func (p *Parser) parseLogRead() (logRead, error) {
+	read := logRead{partition: AllPartitions}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != lexer.MUL {
+		return read, newParseError(tokstr(tok, lit), []string{"*"}, pos)
+	}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok != FROM {
+		return read, newParseError(tokstr(tok, lit), []string{"FROM"}, pos)
+	}
+
+	// Parse the name of the log, which may be qualified by its namespace
+	lit, err := p.parseNamespace()
+	if err != nil {
+		return read, err
+	}
+	read.log = lit
+
+	// Parse the optional PARTITION clause
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == PARTITION {
+		if read.partition, err = p.parseInt(0, MaxPartitions-1); err != nil {
+			return read, err
+		}
+	} else {
+		p.unscan()
+	}
+
+	// Parse the optional OFFSET clause
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == OFFSET {
+		if read.offset, err = p.parseUInt64(); err != nil {
+			return read, err
+		}
+	} else {
+		p.unscan()
+	}
+
+	// Parse the optional LIMIT clause
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == LIMIT {
+		if read.limit, err = p.parseInt(1, math.MaxInt32); err != nil {
+			return read, err
+		}
+	} else {
+		p.unscan()
 	}
+	return read, nil
 }
 
 // parseNamespace returns a namespace title or an error
@@ -53,7 +53,7 @@ func (suite *ParserTestSuite) TestInvalidStatement() {
 	var tests = []TestCase{
 
 		// Errors
-		{s: `a bad statement.`, err: `found a, expected USE, CREATE, SHOW, DROP at line 1, char 1`},
+		{s: `a bad statement.`, err: `found a, expected USE, CREATE, SHOW, DROP, SELECT, SUBSCRIBE at line 1, char 1`},
 	}
 
 	suite.validate(tests)
@@ -86,7 +86,7 @@ func (suite *ParserTestSuite) TestCreateNamespace() {
 		},
 
 		// Errors
-		{s: `CREATE `, err: `found EOF, expected NAMESPACE at line 1, char 9`},
+		{s: `CREATE `, err: `found EOF, expected NAMESPACE, LOG at line 1, char 9`},
 		{s: `CREATE NAMESPACE `, err: `found EOF, expected namespace at line 1, char 19`},
 		{s: `CREATE NAMESPACE acme.example.`, err: `found EOF, expected identifier at line 1, char 31`},
 		{s: `CREATE NAMESPACE acme.example. `, err: `found WS, expected identifier at line 1, char 31`},
@@ -124,13 +124,240 @@ func (suite *ParserTestSuite) TestShowNamespaces() {
 		},
 
 		// Errors
-		{s: `SHOW `, err: `found EOF, expected NAMESPACES at line 1, char 7`},
-		{s: `SHOW NAMESPACE`, err: `found NAMESPACE, expected NAMESPACES at line 1, char 6`},
+		{s: `SHOW `, err: `found EOF, expected NAMESPACES, LOGS, PARTITIONS, NODES, CLUSTER, SESSIONS at line 1, char 7`},
+		{s: `SHOW NAMESPACE`, err: `found NAMESPACE, expected NAMESPACES, LOGS, PARTITIONS, NODES, CLUSTER, SESSIONS at line 1, char 6`},
 	}
 
 	suite.validate(tests)
 }
 
+// Ensure the parser can parse strings into CREATE LOG statements
+func (suite *ParserTestSuite) TestCreateLog() {
+	var tests = []TestCase{
+		{
+			s:    `CREATE LOG events`,
+			stmt: &CreateLogStatement{name: "events"},
+		},
+		{
+			s:    `CREATE LOG acme.events`,
+			stmt: &CreateLogStatement{name: "acme.events"},
+		},
+		{
+			s:    `CREATE LOG events WITH OPTIONS (replicas = 3, ACKS = all)`,
+			stmt: &CreateLogStatement{name: "events", options: map[string]string{"replicas": "3", "acks": "all"}},
+		},
+		{
+			s:    `CREATE LOG events WITH OPTIONS(replicas=1)`,
+			stmt: &CreateLogStatement{name: "events", options: map[string]string{"replicas": "1"}},
+		},
+		{
+			s:    `CREATE LOG acme.events CLUSTERED BY (customer) INTO 8 PARTITIONS`,
+			stmt: &CreateLogStatement{name: "acme.events", key: "customer", partitions: 8},
+		},
+		{
+			s:    `CREATE LOG events CLUSTERED BY(customer)INTO 2 PARTITIONS WITH OPTIONS (replicas = 2)`,
+			stmt: &CreateLogStatement{name: "events", key: "customer", partitions: 2, options: map[string]string{"replicas": "2"}},
+		},
+
+		// Errors
+		{s: `CREATE LOG `, err: `found EOF, expected namespace at line 1, char 13`},
+		{s: `CREATE LOG events WITH`, err: `found EOF, expected OPTIONS at line 1, char 24`},
+		{s: `CREATE LOG events WITH OPTIONS replicas = 3`, err: `found replicas, expected ( at line 1, char 32`},
+		{s: `CREATE LOG events WITH OPTIONS ()`, err: `found ), expected option at line 1, char 33`},
+		{s: `CREATE LOG events WITH OPTIONS (replicas 3)`, err: `found 3, expected = at line 1, char 42`},
+		{s: `CREATE LOG events WITH OPTIONS (replicas = )`, err: `found ), expected value at line 1, char 44`},
+		{s: `CREATE LOG events WITH OPTIONS (replicas = 3`, err: `found EOF, expected ,, ) at line 1, char 45`},
+		{s: `CREATE LOG events WITH OPTIONS (acks = all, acks = leader)`, err: `duplicate option acks at line 1, char 45`},
+		{s: `CREATE LOG events CLUSTERED (user)`, err: `found (, expected BY at line 1, char 29`},
+		{s: `CREATE LOG events CLUSTERED BY customer`, err: `found customer, expected ( at line 1, char 32`},
+		{s: `CREATE LOG events CLUSTERED BY (customer INTO`, err: `found INTO, expected ) at line 1, char 42`},
+		{s: `CREATE LOG events CLUSTERED BY (customer)`, err: `found EOF, expected INTO at line 1, char 42`},
+		{s: `CREATE LOG events CLUSTERED BY (customer) INTO 0 PARTITIONS`, err: `invalid value 0: must be 1 <= n <= 1024 at line 1, char 48`},
+		{s: `CREATE LOG events CLUSTERED BY (customer) INTO 4`, err: `found EOF, expected PARTITIONS at line 1, char 49`},
+	}
+
+	suite.validate(tests)
+}
+
+// Ensure CREATE LOG statements are parsed from their string representation
+func (suite *ParserTestSuite) TestCreateLogString() {
+	for _, s := range []string{
+		`CREATE LOG events`,
+		`CREATE LOG acme.events WITH OPTIONS (acks = all, replicas = 3)`,
+		`CREATE LOG acme.events CLUSTERED BY (customer) INTO 4 PARTITIONS WITH OPTIONS (replicas = 2)`,
+	} {
+		stmt, err := ParseStatement(s)
+		suite.Nil(err)
+		suite.Equal(s, stmt.String())
+	}
+}
+
+// Ensure the parser can parse strings into SHOW LOGS statements
+func (suite *ParserTestSuite) TestShowLogs() {
+	var tests = []TestCase{
+		{
+			s:    `SHOW LOGS`,
+			stmt: &ShowLogsStatement{},
+		},
+	}
+
+	suite.validate(tests)
+}
+
+// Ensure the parser can parse strings into SHOW PARTITIONS statements
+func (suite *ParserTestSuite) TestShowPartitions() {
+	var tests = []TestCase{
+		{
+			s:    `SHOW PARTITIONS`,
+			stmt: &ShowPartitionsStatement{},
+		},
+		{
+			s:    `SHOW PARTITIONS events`,
+			stmt: &ShowPartitionsStatement{log: "events"},
+		},
+		{
+			s:    `SHOW PARTITIONS acme.events`,
+			stmt: &ShowPartitionsStatement{log: "acme.events"},
+		},
+		{
+			s:   `SHOW PARTITIONS acme.`,
+			err: `found EOF, expected identifier at line 1, char 22`,
+		},
+	}
+
+	suite.validate(tests)
+}
+
+// Ensure the parser can parse strings into cluster statements
+func (suite *ParserTestSuite) TestShowCluster() {
+	var tests = []TestCase{
+		{s: `SHOW NODES`, stmt: &ShowNodesStatement{}},
+		{s: `SHOW CLUSTER HEALTH`, stmt: &ShowHealthStatement{}},
+		{s: `SHOW SESSIONS`, stmt: &ShowSessionsStatement{}},
+		{s: `SHOW SESSIONS ON CLUSTER`, stmt: &ShowSessionsStatement{cluster: true}},
+
+		// Errors
+		{s: `SHOW CLUSTER`, err: `found EOF, expected HEALTH at line 1, char 14`},
+		{s: `SHOW SESSIONS ON`, err: `found EOF, expected CLUSTER at line 1, char 18`},
+	}
+
+	suite.validate(tests)
+}
+
+// Ensure the parser can parse strings into SELECT statements
+func (suite *ParserTestSuite) TestSelect() {
+	var tests = []TestCase{
+		{
+			s:    `SELECT * FROM events`,
+			stmt: &SelectStatement{logRead{log: "events", partition: AllPartitions}},
+		},
+		{
+			s:    `SELECT * FROM acme.events PARTITION 3`,
+			stmt: &SelectStatement{logRead{log: "acme.events", partition: 3}},
+		},
+		{
+			s:    `SELECT * FROM acme.events PARTITION 0 OFFSET 42 LIMIT 10`,
+			stmt: &SelectStatement{logRead{log: "acme.events", partition: 0, offset: 42, limit: 10}},
+		},
+		{
+			s:    `SELECT * FROM acme.events LIMIT 10`,
+			stmt: &SelectStatement{logRead{log: "acme.events", partition: AllPartitions, limit: 10}},
+		},
+
+		// Errors
+		{s: `SELECT events`, err: `found events, expected * at line 1, char 8`},
+		{s: `SELECT * events`, err: `found events, expected FROM at line 1, char 10`},
+		{s: `SELECT * FROM `, err: `found EOF, expected namespace at line 1, char 16`},
+		{s: `SELECT * FROM events PARTITION`, err: `found EOF, expected number at line 1, char 32`},
+		{s: `SELECT * FROM events PARTITION 1024`, err: `invalid value 1024: must be 0 <= n <= 1023 at line 1, char 32`},
+		{s: `SELECT * FROM events OFFSET first`, err: `found first, expected number at line 1, char 29`},
+		{s: `SELECT * FROM events LIMIT 0`, err: `invalid value 0: must be 1 <= n <= 2147483647 at line 1, char 28`},
+	}
+
+	suite.validate(tests)
+}
+
+// Ensure the parser can parse strings into SUBSCRIBE statements
+func (suite *ParserTestSuite) TestSubscribe() {
+	var tests = []TestCase{
+		{
+			s:    `SUBSCRIBE * FROM acme.events`,
+			stmt: &SubscribeStatement{logRead{log: "acme.events", partition: AllPartitions}},
+		},
+		{
+			s:    `SUBSCRIBE * FROM events PARTITION 1 OFFSET 5`,
+			stmt: &SubscribeStatement{logRead{log: "events", partition: 1, offset: 5}},
+		},
+		{
+			s:    `SUBSCRIBE * FROM events OFFSET 5 LIMIT 1`,
+			stmt: &SubscribeStatement{logRead{log: "events", partition: AllPartitions, offset: 5, limit: 1}},
+		},
+
+		// Errors
+		{s: `SUBSCRIBE TO events`, err: `found TO, expected * at line 1, char 11`},
+		{s: `SUBSCRIBE * FROM events PARTITION -1`, err: `invalid value -1: must be 0 <= n <= 1023 at line 1, char 35`},
+	}
+
+	suite.validate(tests)
+}
+
+// Ensure SELECT and SUBSCRIBE statements are parsed from their string representation
+func (suite *ParserTestSuite) TestLogReadString() {
+	for _, s := range []string{
+		`SELECT * FROM events`,
+		`SELECT * FROM acme.events PARTITION 2 OFFSET 10 LIMIT 5`,
+		`SUBSCRIBE * FROM acme.events`,
+		`SUBSCRIBE * FROM acme.events PARTITION 0 LIMIT 1`,
+	} {
+		stmt, err := ParseStatement(s)
+		suite.Nil(err)
+		suite.Equal(s, stmt.String())
+	}
+}
+
+// Ensure the parser can parse strings of semicolon delimited statements
+func (suite *ParserTestSuite) TestParseStatements() {
+	var tests = []struct {
+		s     string
+		stmts []Statement
+		err   string
+	}{
+		{s: ``},
+		{s: ` ; ;`},
+		{
+			s:     `SHOW NAMESPACES`,
+			stmts: []Statement{&ShowNamespacesStatement{}},
+		},
+		{
+			s:     `CREATE NAMESPACE acme; USE acme;SHOW NAMESPACES;`,
+			stmts: []Statement{&CreateNamespaceStatement{name: "acme"}, &UseStatement{name: "acme"}, &ShowNamespacesStatement{}},
+		},
+		{
+			s:     `CREATE LOG events; CREATE LOG clicks WITH OPTIONS (replicas = 2); SHOW LOGS`,
+			stmts: []Statement{&CreateLogStatement{name: "events"}, &CreateLogStatement{name: "clicks", options: map[string]string{"replicas": "2"}}, &ShowLogsStatement{}},
+		},
+		{
+			s:     `USE acme; SELECT * FROM events PARTITION 1; SUBSCRIBE * FROM events`,
+			stmts: []Statement{&UseStatement{name: "acme"}, &SelectStatement{logRead{log: "events", partition: 1}}, &SubscribeStatement{logRead{log: "events", partition: AllPartitions}}},
+		},
+
+		// Errors
+		{s: `USE acme SHOW NAMESPACES`, err: `found SHOW, expected ; at line 1, char 10`},
+		{s: `USE acme; SHOW`, err: `found EOF, expected NAMESPACES, LOGS, PARTITIONS, NODES, CLUSTER, SESSIONS at line 1, char 16`},
+		{s: `SELECT * FROM events LIMIT 10 PARTITION 1`, err: `found PARTITION, expected ; at line 1, char 31`},
+		{s: `USE acme;; bad`, err: `found bad, expected USE, CREATE, SHOW, DROP, SELECT, SUBSCRIBE at line 1, char 12`},
+	}
+
+	for i, tt := range tests {
+		stmts, err := ParseStatements(tt.s)
+		if !reflect.DeepEqual(tt.err, errstring(err)) {
+			suite.T().Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s\n\n", i, tt.s, tt.err, err)
+		} else if tt.err == "" && !reflect.DeepEqual(tt.stmts, stmts) {
+			suite.T().Errorf("%d. %q\n\nstmts mismatch:\n\nexp=%#v\n\ngot=%#v\n\n", i, tt.s, tt.stmts, stmts)
+		}
+	}
+}
+
 // errstring converts an error to its string representation.
 func errstring(err error) string {
 	if err != nil {
@@ -30,22 +30,28 @@ const (
 	startKeywords
 	ADD
 	BY
+	CLUSTER
 	CLUSTERED
 	CREATE
 	DESCRIBE
 	DROP
 	FOR
 	FROM
+	HEALTH
 	INSERT
+	INTO
 	LIMIT
 	LOG
 	LOGS
 	NAMESPACE
 	NAMESPACES
+	NODES
 	OFFSET
 	ON
 	OPTIONAL
 	OPTIONS
+	PARTITION
+	PARTITIONS
 	PASSWORD
 	PERMISSION
 	PERMISSIONS
@@ -54,6 +60,7 @@ const (
 	ROLE
 	ROLES
 	SELECT
+	SESSIONS
 	SET
 	SHOW
 	SUBSCRIBE
@@ -91,22 +98,28 @@ var testKeywords = map[lexer.Token]string{
 
 	ADD:         "ADD",
 	BY:          "BY",
+	CLUSTER:     "CLUSTER",
 	CLUSTERED:   "CLUSTERED",
 	CREATE:      "CREATE",
 	DESCRIBE:    "DESCRIBE",
 	DROP:        "DROP",
 	FOR:         "FOR",
 	FROM:        "FROM",
+	HEALTH:      "HEALTH",
 	INSERT:      "INSERT",
+	INTO:        "INTO",
 	LIMIT:       "LIMIT",
 	LOG:         "LOG",
 	LOGS:        "LOGS",
 	NAMESPACE:   "NAMESPACE",
 	NAMESPACES:  "NAMESPACES",
+	NODES:       "NODES",
 	OFFSET:      "OFFSET",
 	ON:          "ON",
 	OPTIONAL:    "OPTIONAL",
 	OPTIONS:     "OPTIONS",
+	PARTITION:   "PARTITION",
+	PARTITIONS:  "PARTITIONS",
 	PASSWORD:    "PASSWORD",
 	PERMISSION:  "PERMISSION",
 	PERMISSIONS: "PERMISSIONS",
@@ -115,6 +128,7 @@ var testKeywords = map[lexer.Token]string{
 	ROLE:        "ROLE",
 	ROLES:       "ROLES",
 	SELECT:      "SELECT",
+	SESSIONS:    "SESSIONS",
 	SET:         "SET",
 	SHOW:        "SHOW",
 	SUBSCRIBE:   "SUBSCRIBE",
@@ -0,0 +1,315 @@
+// Package storage keeps the records of the logs replicated to a server on its local disk.
+//
+// Every log is a bucket in a single bolt database. Records are keyed by their offset,
+// which starts at zero and increases by one for each record. The leader epochs in which
+// the records of a log were appended are kept in a separate bucket.
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrInvalidOffset is returned when records are read or written past the end of a log.
+	ErrInvalidOffset = errors.New("storage: invalid offset")
+
+	// ErrClosed is returned when a log is used after the store was closed.
+	ErrClosed = errors.New("storage: store is closed")
+)
+
+// epochsBucket holds a bucket of epochs for each log. Its name cannot be a log name.
+var epochsBucket = []byte("\x00epochs")
+
+// Store holds the logs of a server.
+type Store struct {
+	db     *bolt.DB
+	lock   sync.Mutex
+	logs   map[string]*Log
+	closed bool
+}
+
+// Open opens the store in the given file, creating it if it does not exist.
+func Open(filename string) (*Store, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db, logs: make(map[string]*Log)}, nil
+}
+
+// Log returns the named log, creating it if it does not exist.
+func (s *Store) Log(name string) (*Log, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	} else if l, ok := s.logs[name]; ok {
+		return l, nil
+	}
+
+	l := &Log{name: []byte(name), db: s.db, changed: make(chan struct{})}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(l.name)
+		if err != nil {
+			return err
+		}
+
+		// The next offset follows the last record
+		if k, _ := bkt.Cursor().Last(); k != nil {
+			l.end = binary.BigEndian.Uint64(k) + 1
+		}
+
+		epochs, err := l.epochBucket(tx)
+		if err != nil {
+			return err
+		}
+		return epochs.ForEach(func(k, v []byte) error {
+			l.epochs = append(l.epochs, Epoch{binary.BigEndian.Uint64(k), binary.BigEndian.Uint64(v)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logs[name] = l
+	return l, nil
+}
+
+// Close closes the database. Readers waiting for changes are woken up.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	for _, l := range s.logs {
+		l.lock.Lock()
+		l.closed = true
+		close(l.changed)
+		l.lock.Unlock()
+	}
+	return s.db.Close()
+}
+
+// Epoch is a leader epoch of a log and the offset of the first record appended in it.
+type Epoch struct {
+	Epoch uint64
+	Start uint64
+}
+
+// Log is an append-only sequence of records.
+type Log struct {
+	name []byte
+	db   *bolt.DB
+
+	// lock serializes writes and protects end, epochs and changed
+	lock    sync.RWMutex
+	end     uint64
+	epochs  []Epoch
+	changed chan struct{}
+	closed  bool
+}
+
+// epochBucket returns the bucket of the epochs of the log, creating it if the
+// transaction is writable.
+func (l *Log) epochBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	root, err := tx.CreateBucketIfNotExists(epochsBucket)
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists(l.name)
+}
+
+// Append writes records at the end of the log and returns the offset of the first one.
+func (l *Log) Append(records [][]byte) (uint64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.append(l.end, records)
+}
+
+// AppendAt writes records which must start at the end of the log. Replicas use it to
+// copy records to the same offsets.
+func (l *Log) AppendAt(offset uint64, records [][]byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if offset != l.end {
+		return ErrInvalidOffset
+	}
+	_, err := l.append(offset, records)
+	return err
+}
+
+// append writes records starting at offset. The lock must be held.
+func (l *Log) append(offset uint64, records [][]byte) (uint64, error) {
+	if l.closed {
+		return 0, ErrClosed
+	} else if len(records) == 0 {
+		return offset, nil
+	}
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(l.name)
+		for i, record := range records {
+			if err := bkt.Put(encodeOffset(offset+uint64(i)), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	l.end = offset + uint64(len(records))
+	l.notify()
+	return offset, nil
+}
+
+// Read returns up to max records starting at offset.
+func (l *Log) Read(offset uint64, max int) (records [][]byte, err error) {
+	if offset > l.End() {
+		return nil, ErrInvalidOffset
+	}
+
+	err = l.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(l.name)
+		if bkt == nil {
+			return ErrClosed
+		}
+
+		cur := bkt.Cursor()
+		for k, v := cur.Seek(encodeOffset(offset)); k != nil && len(records) < max; k, v = cur.Next() {
+			records = append(records, append([]byte{}, v...))
+		}
+		return nil
+	})
+	return
+}
+
+// Truncate removes the records at and after offset.
+func (l *Log) Truncate(offset uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrClosed
+	} else if offset >= l.end {
+		return nil
+	}
+
+	// Epochs without records left are dropped too
+	kept := len(l.epochs)
+	for kept > 0 && l.epochs[kept-1].Start >= offset {
+		kept--
+	}
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(l.name)
+		for o := offset; o < l.end; o++ {
+			if err := bkt.Delete(encodeOffset(o)); err != nil {
+				return err
+			}
+		}
+
+		epochs, err := l.epochBucket(tx)
+		if err != nil {
+			return err
+		}
+		for _, e := range l.epochs[kept:] {
+			if err := epochs.Delete(encodeOffset(e.Epoch)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.end = offset
+	l.epochs = l.epochs[:kept]
+	l.notify()
+	return nil
+}
+
+// StartEpoch records that the records appended from the end of the log on belong to
+// the given leader epoch. Epochs which are not newer than the last one are ignored.
+func (l *Log) StartEpoch(epoch uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return ErrClosed
+	} else if n := len(l.epochs); n > 0 && epoch <= l.epochs[n-1].Epoch {
+		return nil
+	}
+
+	e := Epoch{epoch, l.end}
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		epochs, err := l.epochBucket(tx)
+		if err != nil {
+			return err
+		}
+		return epochs.Put(encodeOffset(e.Epoch), encodeOffset(e.Start))
+	})
+	if err != nil {
+		return err
+	}
+	l.epochs = append(l.epochs, e)
+	return nil
+}
+
+// LastEpoch returns the newest epoch of the log, or zero if none was started.
+func (l *Log) LastEpoch() uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if n := len(l.epochs); n > 0 {
+		return l.epochs[n-1].Epoch
+	}
+	return 0
+}
+
+// EpochEnd returns the end of the records appended in the given epoch or before it,
+// which is the start of the next newer epoch or the end of the log.
+func (l *Log) EpochEnd(epoch uint64) uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for _, e := range l.epochs {
+		if e.Epoch > epoch {
+			return e.Start
+		}
+	}
+	return l.end
+}
+
+// End returns the offset of the next record.
+func (l *Log) End() uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.end
+}
+
+// Changed returns a channel which is closed when the log changes or the store is closed.
+func (l *Log) Changed() <-chan struct{} {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.changed
+}
+
+// notify wakes up the readers waiting for changes. The lock must be held.
+func (l *Log) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// encodeOffset returns the key of a record. Keys are big endian so they sort by offset.
+func encodeOffset(offset uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, offset)
+	return key
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStore opens a store in a temporary directory
+func newTestStore(t *testing.T) (*Store, string, func()) {
+	dir, err := ioutil.TempDir("", "kappa-storage")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	filename := path.Join(dir, "logs.db")
+	store, err := Open(filename)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return store, filename, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func records(values ...string) (r [][]byte) {
+	for _, v := range values {
+		r = append(r, []byte(v))
+	}
+	return
+}
+
+func TestAppendRead(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	l, err := store.Log("acme.events")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), l.End())
+
+	offset, err := l.Append(records("a", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), offset)
+	offset, err = l.Append(records("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), offset)
+	assert.Equal(t, uint64(3), l.End())
+
+	// Read from an offset
+	r, err := l.Read(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, records("b", "c"), r)
+
+	// Read a limited number of records
+	r, err = l.Read(0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, records("a", "b"), r)
+
+	// Nothing to read at the end
+	r, err = l.Read(3, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, r)
+
+	// Reading past the end fails
+	_, err = l.Read(4, 10)
+	assert.Equal(t, ErrInvalidOffset, err)
+}
+
+func TestAppendAt(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	l, err := store.Log("acme.events")
+	assert.Nil(t, err)
+	assert.Nil(t, l.AppendAt(0, records("a", "b")))
+	assert.Equal(t, ErrInvalidOffset, l.AppendAt(1, records("c")))
+	assert.Nil(t, l.AppendAt(2, records("c")))
+	assert.Equal(t, uint64(3), l.End())
+}
+
+func TestTruncate(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	l, err := store.Log("acme.events")
+	assert.Nil(t, err)
+	_, err = l.Append(records("a", "b", "c"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, l.Truncate(1))
+	assert.Equal(t, uint64(1), l.End())
+	r, err := l.Read(0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, records("a"), r)
+
+	// Offsets are reused after truncating
+	offset, err := l.Append(records("d"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), offset)
+}
+
+func TestEpochs(t *testing.T) {
+	store, filename, cleanup := newTestStore(t)
+	defer cleanup()
+
+	l, err := store.Log("acme.events")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), l.LastEpoch())
+	assert.Equal(t, uint64(0), l.EpochEnd(0))
+
+	assert.Nil(t, l.StartEpoch(1))
+	_, err = l.Append(records("a", "b"))
+	assert.Nil(t, err)
+	assert.Nil(t, l.StartEpoch(3))
+	_, err = l.Append(records("c", "d"))
+	assert.Nil(t, err)
+
+	// Older epochs are ignored
+	assert.Nil(t, l.StartEpoch(2))
+	assert.Equal(t, uint64(3), l.LastEpoch())
+	assert.Equal(t, uint64(2), l.EpochEnd(1))
+	assert.Equal(t, uint64(2), l.EpochEnd(2))
+	assert.Equal(t, uint64(4), l.EpochEnd(3))
+
+	// Truncating drops the epochs without records
+	assert.Nil(t, l.Truncate(2))
+	assert.Equal(t, uint64(1), l.LastEpoch())
+	assert.Equal(t, uint64(2), l.EpochEnd(1))
+
+	// Epochs are kept on disk
+	assert.Nil(t, l.StartEpoch(4))
+	store.Close()
+	store, err = Open(filename)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer store.Close()
+	l, err = store.Log("acme.events")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), l.LastEpoch())
+	assert.Equal(t, uint64(2), l.EpochEnd(1))
+}
+
+func TestChanged(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	l, err := store.Log("acme.events")
+	assert.Nil(t, err)
+
+	changed := l.Changed()
+	select {
+	case <-changed:
+		t.Fatal("log has not changed")
+	default:
+	}
+
+	_, err = l.Append(records("a"))
+	assert.Nil(t, err)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("append should close the channel")
+	}
+
+	// Closing the store wakes up readers
+	changed = l.Changed()
+	store.Close()
+	select {
+	case <-changed:
+	default:
+		t.Fatal("close should close the channel")
+	}
+	_, err = l.Append(records("b"))
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestReopen(t *testing.T) {
+	store, filename, cleanup := newTestStore(t)
+	defer cleanup()
+
+	l, err := store.Log("acme.events")
+	assert.Nil(t, err)
+	_, err = l.Append(records("a", "b"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+
+	// The end of the log is restored
+	store, err = Open(filename)
+	assert.Nil(t, err)
+	defer store.Close()
+	l, err = store.Log("acme.events")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), l.End())
+}